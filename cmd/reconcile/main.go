@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"quantlo/internal/config"
+	"quantlo/internal/model"
+	"quantlo/internal/repository"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+func main() {
+	cfg, err := config.New()
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+
+	policy := flag.String("policy", "none", "repair policy: none, trust_redis or trust_postgres")
+	asJSON := flag.Bool("json", false, "print the drift report as JSON")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	db, err := pgxpool.New(ctx, cfg.DSN())
+	if err != nil {
+		log.Fatalf("Postgres error: %v", err)
+	}
+	defer db.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr()})
+	defer rdb.Close()
+
+	// Reconciliation never publishes events, so no bus is needed.
+	repo := repository.NewLedgerRepo(rdb, db, nil)
+
+	report, err := repo.Reconcile(ctx, model.RepairPolicy(*policy))
+	if err != nil {
+		log.Fatalf("Reconcile error: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		for _, d := range report.Accounts {
+			fmt.Printf("%s/%s: redis=%d postgres=%d holds=%d pending=%d stale=%d (%d) drift=%d missing=%t repaired=%t\n",
+				d.AccountID, d.ResourceType, d.RedisBalance, d.PostgresBalance, d.PendingHolds,
+				d.PendingEvents, d.StaleEvents, d.StaleAmount, d.Drift, d.MissingInPostgres, d.Repaired)
+		}
+		fmt.Printf("Scanned %d balances, %d drifted, %d repaired (policy %s)\n",
+			report.Scanned, len(report.Accounts), report.Repaired, report.Policy)
+	}
+
+	// Unrepaired drift exits non-zero so the binary can gate a cron job or an alert.
+	if report.Repaired < len(report.Accounts) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,112 @@
+// Package apperr defines the ledger's domain errors. Every error a caller can act on
+// carries a stable Code; the transports map codes to HTTP statuses, gRPC status codes
+// and NATS reply headers, so the same failure reads the same way on every API.
+package apperr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// StatusClientClosedRequest is reported for a request cancelled by its caller. It is not
+// a standard HTTP status; nginx introduced it for the same case.
+const StatusClientClosedRequest = 499
+
+// Code is a stable, machine-readable error code. Codes are part of the public API:
+// they may be added but never renamed.
+type Code string
+
+const (
+	CodeAccountNotFound   Code = "ACCOUNT_NOT_FOUND"
+	CodeAccountExists     Code = "ACCOUNT_EXISTS"
+	CodeAccountDeleted    Code = "ACCOUNT_DELETED"
+	CodeInsufficientFunds Code = "INSUFFICIENT_FUNDS"
+	CodeDuplicateRequest  Code = "DUPLICATE_REQUEST"
+	// CodeIdempotencyConflict is for an idempotency key reused with a different request.
+	CodeIdempotencyConflict Code = "IDEMPOTENCY_CONFLICT"
+	CodeValidationFailed    Code = "VALIDATION_FAILED"
+	// CodeNotFound is for anything other than an account: holds, transactions, dead letters.
+	CodeNotFound Code = "NOT_FOUND"
+	// CodeConflict is for a request that clashes with the current state of the ledger.
+	CodeConflict Code = "CONFLICT"
+	// CodeInternal is reported for every error without a code of its own.
+	CodeInternal Code = "INTERNAL"
+)
+
+// Error is a domain error. Sentinels are *Error values, so they can be matched with
+// errors.Is and wrapped with fmt.Errorf("...: %w", err) like any other error.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// New returns a domain error with the given code.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Validation returns a VALIDATION_FAILED error, for requests that can never succeed as sent.
+func Validation(message string) *Error {
+	return New(CodeValidationFailed, message)
+}
+
+// CodeOf returns the code of the first domain error in err's chain, or CodeInternal.
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+// HTTPStatus maps err to an HTTP status. A cancelled request gets 499 and one that ran
+// out of time 504; any other error gets the status of its code. NATS replies carry the
+// same number as their error code.
+func HTTPStatus(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return StatusClientClosedRequest
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	switch CodeOf(err) {
+	case CodeAccountNotFound, CodeNotFound:
+		return http.StatusNotFound
+	case CodeAccountDeleted:
+		return http.StatusGone
+	case CodeAccountExists, CodeDuplicateRequest, CodeConflict:
+		return http.StatusConflict
+	case CodeInsufficientFunds, CodeIdempotencyConflict:
+		return http.StatusUnprocessableEntity
+	case CodeValidationFailed:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Body is the machine-readable error body written by the HTTP API and NATS replies.
+type Body struct {
+	Code  Code   `json:"code"`
+	Error string `json:"error"`
+}
+
+// BodyOf builds the error body for err.
+func BodyOf(err error) Body {
+	return Body{Code: CodeOf(err), Error: Message(err)}
+}
+
+// Message is the message clients are shown for err. Errors without a code of their own
+// may carry driver or SQL text, so they all read "internal error"; the transports log them.
+func Message(err error) string {
+	if CodeOf(err) == CodeInternal {
+		return "internal error"
+	}
+	return err.Error()
+}
@@ -0,0 +1,64 @@
+package apperr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCodeOf(t *testing.T) {
+	notFound := New(CodeAccountNotFound, "account not found")
+
+	tests := []struct {
+		err  error
+		want Code
+	}{
+		{notFound, CodeAccountNotFound},
+		{fmt.Errorf("spend: %w", notFound), CodeAccountNotFound},
+		{Validation("amount must be positive"), CodeValidationFailed},
+		{errors.New("connection refused"), CodeInternal},
+	}
+	for _, tt := range tests {
+		if got := CodeOf(tt.err); got != tt.want {
+			t.Errorf("%v: expected %s, got %s", tt.err, tt.want, got)
+		}
+	}
+
+	if !errors.Is(fmt.Errorf("spend: %w", notFound), notFound) {
+		t.Error("expected a wrapped sentinel to match with errors.Is")
+	}
+}
+
+func TestBodyOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Body
+	}{
+		{fmt.Errorf("spend: %w", New(CodeInsufficientFunds, "insufficient funds")), Body{CodeInsufficientFunds, "spend: insufficient funds"}},
+		{fmt.Errorf("db insert journal entry: %w", errors.New(`relation "journal_legs" does not exist`)), Body{CodeInternal, "internal error"}},
+	}
+	for _, tt := range tests {
+		if got := BodyOf(tt.err); got != tt.want {
+			t.Errorf("%v: expected %+v, got %+v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{New(CodeInsufficientFunds, "insufficient funds"), 422},
+		{fmt.Errorf("spend: %w", New(CodeAccountNotFound, "account not found")), 404},
+		{errors.New("connection refused"), 500},
+		{fmt.Errorf("spend: %w", context.Canceled), StatusClientClosedRequest},
+		{fmt.Errorf("spend: %w", context.DeadlineExceeded), 504},
+	}
+	for _, tt := range tests {
+		if got := HTTPStatus(tt.err); got != tt.want {
+			t.Errorf("%v: expected %d, got %d", tt.err, tt.want, got)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -25,6 +27,52 @@ type Config struct {
 	ApiEnabled     string
 	BusBufferSize  int
 	WorkerProvider string
+	// HoldSweepInterval is how often expired holds are released, in seconds.
+	HoldSweepInterval int
+	// GrantSweepInterval is how often expired credit grants are removed, in seconds.
+	GrantSweepInterval int
+	// RefillSweepInterval is how often due quota refills are applied, in seconds.
+	RefillSweepInterval int
+	// SnapshotInterval is how often the latest day's balance snapshots are taken or brought up to date, in seconds.
+	SnapshotInterval int
+	// ReconcileInterval is how often Redis is reconciled with PostgreSQL, in seconds; 0 disables it.
+	ReconcileInterval int
+	// ReconcilePolicy is the repair policy of the periodic reconciliation: none, trust_redis or trust_postgres.
+	ReconcilePolicy string
+	// OutboxAckTimeout is how long a relayed event may go unconfirmed before it is relayed again, in seconds.
+	OutboxAckTimeout int
+	// JetStreamMaxDeliver is how many times the jetstream worker gets an event before giving up on it.
+	JetStreamMaxDeliver int
+	// SyncMaxAttempts is how many times the worker tries to sync an event before parking it as a dead letter.
+	SyncMaxAttempts int
+	// SyncBackoff is the delay before the first retry of a failed sync, in milliseconds; it doubles on each retry.
+	SyncBackoff int
+	// WorkerBatchSize is how many events the nats worker writes to PostgreSQL at once; 0 or 1 syncs them one by one.
+	WorkerBatchSize int
+	// WorkerBatchWait is how long the nats worker waits to fill a batch, in milliseconds.
+	WorkerBatchWait int
+	// GRPCBusPublishTimeout is how long the grpc bus waits for room in a full buffer before rejecting an event, in milliseconds.
+	GRPCBusPublishTimeout int
+	// GRPCBusBatchSize is how many events the grpc bus streams in one call.
+	GRPCBusBatchSize int
+	// GRPCBusMaxAttempts is how many times the grpc bus sends an event before spilling it.
+	GRPCBusMaxAttempts int
+	// GRPCBusRetryBackoff is the delay before the grpc bus resends an event, in milliseconds; it doubles on each retry.
+	GRPCBusRetryBackoff int
+	// GRPCBusFlushTimeout is how long the grpc bus keeps delivering queued events on shutdown, in seconds.
+	GRPCBusFlushTimeout int
+	// GRPCBusSpillPath is an optional file for events the grpc bus could not deliver; they are resent on the next start.
+	GRPCBusSpillPath string
+	// WebhookMaxAttempts is how many times a webhook delivery is sent before it is given up.
+	WebhookMaxAttempts int
+	// WebhookBackoff is the delay before the first retry of a webhook delivery, in seconds; it doubles on each retry.
+	WebhookBackoff int
+	// WebhookTimeout bounds one webhook request, in seconds.
+	WebhookTimeout int
+	// KafkaBrokers is the comma-separated list of Kafka brokers for the kafka bus and worker.
+	KafkaBrokers string
+	// KafkaGroup is the consumer group the kafka workers join.
+	KafkaGroup string
 }
 
 // New loads and validates configuration from environment variables.
@@ -51,39 +99,142 @@ func New() (*Config, error) {
 		ApiEnabled:     os.Getenv("QANTLO_API_ENABLED"),
 		BusBufferSize:  getEnvInt("QANTLO_BUS_BUFFER_SIZE", 1024),
 		WorkerProvider: os.Getenv("QANTLO_WORKER_PROVIDER"),
-	}
 
-	// Required: database
-	if cfg.DBUser == "" || cfg.DBHost == "" || cfg.DBName == "" || cfg.SSLMode == "" {
-		return nil, fmt.Errorf("missing required env for database: QANTLO_POSTGRES_USER/HOST/DB/SSLMODE")
-	}
+		HoldSweepInterval:   getEnvInt("QANTLO_HOLD_SWEEP_INTERVAL", 30),
+		GrantSweepInterval:  getEnvInt("QANTLO_GRANT_SWEEP_INTERVAL", 60),
+		RefillSweepInterval: getEnvInt("QANTLO_REFILL_SWEEP_INTERVAL", 30),
+		SnapshotInterval:    getEnvInt("QANTLO_SNAPSHOT_INTERVAL", 3600),
+		ReconcileInterval:   getEnvInt("QANTLO_RECONCILE_INTERVAL", 300),
+		ReconcilePolicy:     os.Getenv("QANTLO_RECONCILE_POLICY"),
+		OutboxAckTimeout:    getEnvInt("QANTLO_OUTBOX_ACK_TIMEOUT", 30),
+
+		JetStreamMaxDeliver: getEnvInt("QANTLO_JETSTREAM_MAX_DELIVER", 5),
+		SyncMaxAttempts:     getEnvInt("QANTLO_SYNC_MAX_ATTEMPTS", 5),
+		SyncBackoff:         getEnvInt("QANTLO_SYNC_BACKOFF_MS", 100),
+		WorkerBatchSize:     getEnvInt("QANTLO_WORKER_BATCH_SIZE", 0),
+		WorkerBatchWait:     getEnvInt("QANTLO_WORKER_BATCH_WAIT_MS", 50),
+
+		GRPCBusPublishTimeout: getEnvInt("QANTLO_GRPC_BUS_PUBLISH_TIMEOUT_MS", 1000),
+		GRPCBusBatchSize:      getEnvInt("QANTLO_GRPC_BUS_BATCH_SIZE", 100),
+		GRPCBusMaxAttempts:    getEnvInt("QANTLO_GRPC_BUS_MAX_ATTEMPTS", 5),
+		GRPCBusRetryBackoff:   getEnvInt("QANTLO_GRPC_BUS_RETRY_BACKOFF_MS", 100),
+		GRPCBusFlushTimeout:   getEnvInt("QANTLO_GRPC_BUS_FLUSH_TIMEOUT", 10),
+		GRPCBusSpillPath:      os.Getenv("QANTLO_GRPC_BUS_SPILL_PATH"),
+
+		WebhookMaxAttempts: getEnvInt("QANTLO_WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookBackoff:     getEnvInt("QANTLO_WEBHOOK_BACKOFF", 30),
+		WebhookTimeout:     getEnvInt("QANTLO_WEBHOOK_TIMEOUT", 10),
 
-	// Required: redis
-	if cfg.RedisHost == "" || cfg.RedisPort == "" {
-		return nil, fmt.Errorf("missing required env for redis: QANTLO_REDIS_HOST/PORT")
+		KafkaBrokers: os.Getenv("QANTLO_KAFKA_BROKERS"),
+		KafkaGroup:   os.Getenv("QANTLO_KAFKA_GROUP"),
 	}
 
 	// Required: bus provider
 	if cfg.BusProvider == "" {
-		return nil, fmt.Errorf("missing required env: QANTLO_BUS_PROVIDER (nats|grpc)")
+		return nil, fmt.Errorf("missing required env: QANTLO_BUS_PROVIDER (nats|jetstream|grpc|kafka|memory)")
 	}
-	if cfg.BusProvider != "nats" && cfg.BusProvider != "grpc" {
-		return nil, fmt.Errorf("invalid bus provider %q, must be 'nats' or 'grpc'", cfg.BusProvider)
+	if cfg.BusProvider != "nats" && cfg.BusProvider != "jetstream" && cfg.BusProvider != "grpc" && cfg.BusProvider != "kafka" && cfg.BusProvider != "memory" {
+		return nil, fmt.Errorf("invalid bus provider %q, must be 'nats', 'jetstream', 'grpc', 'kafka' or 'memory'", cfg.BusProvider)
+	}
+
+	// The memory provider keeps the whole ledger in process and needs no database or cache.
+	if cfg.BusProvider != "memory" {
+		// Required: database
+		if cfg.DBUser == "" || cfg.DBHost == "" || cfg.DBName == "" || cfg.SSLMode == "" {
+			return nil, fmt.Errorf("missing required env for database: QANTLO_POSTGRES_USER/HOST/DB/SSLMODE")
+		}
+
+		// Required: redis
+		if cfg.RedisHost == "" || cfg.RedisPort == "" {
+			return nil, fmt.Errorf("missing required env for redis: QANTLO_REDIS_HOST/PORT")
+		}
 	}
 
 	// Required: worker provider (default to bus provider if empty)
 	if cfg.WorkerProvider == "" {
 		cfg.WorkerProvider = cfg.BusProvider
 	}
-	if cfg.WorkerProvider != "nats" && cfg.WorkerProvider != "grpc" {
-		return nil, fmt.Errorf("invalid worker provider %q, must be 'nats' or 'grpc'", cfg.WorkerProvider)
+	if cfg.WorkerProvider != "nats" && cfg.WorkerProvider != "jetstream" && cfg.WorkerProvider != "grpc" && cfg.WorkerProvider != "kafka" && cfg.WorkerProvider != "memory" {
+		return nil, fmt.Errorf("invalid worker provider %q, must be 'nats', 'jetstream', 'grpc', 'kafka' or 'memory'", cfg.WorkerProvider)
+	}
+	if (cfg.WorkerProvider == "kafka") != (cfg.BusProvider == "kafka") {
+		return nil, fmt.Errorf("the 'kafka' provider must be used for both bus and worker, got bus %q and worker %q", cfg.BusProvider, cfg.WorkerProvider)
+	}
+	if (cfg.WorkerProvider == "memory") != (cfg.BusProvider == "memory") {
+		return nil, fmt.Errorf("the 'memory' provider must be used for both bus and worker, got bus %q and worker %q", cfg.BusProvider, cfg.WorkerProvider)
+	}
+	if (cfg.WorkerProvider == "grpc") != (cfg.BusProvider == "grpc") {
+		return nil, fmt.Errorf("the 'grpc' provider must be used for both bus and worker, got bus %q and worker %q", cfg.BusProvider, cfg.WorkerProvider)
 	}
 	if cfg.BusProvider == "grpc" && (cfg.GRPCHost == "" || cfg.GRPCPort == "") {
 		return nil, fmt.Errorf("missing required env for grpc bus: QANTLO_GRPC_HOST/PORT")
 	}
-	if cfg.BusProvider == "nats" && (cfg.NatsHost == "" || cfg.NatsPort == "") {
+	if cfg.GRPCBusPublishTimeout <= 0 || cfg.GRPCBusBatchSize <= 0 || cfg.GRPCBusMaxAttempts <= 0 || cfg.GRPCBusRetryBackoff <= 0 || cfg.GRPCBusFlushTimeout <= 0 {
+		return nil, fmt.Errorf("invalid grpc bus settings: QANTLO_GRPC_BUS_PUBLISH_TIMEOUT_MS/BATCH_SIZE/MAX_ATTEMPTS/RETRY_BACKOFF_MS/FLUSH_TIMEOUT must be positive")
+	}
+	if (cfg.BusProvider == "nats" || cfg.BusProvider == "jetstream") && (cfg.NatsHost == "" || cfg.NatsPort == "") {
 		return nil, fmt.Errorf("missing required env for nats bus: QANTLO_NATS_HOST/PORT")
 	}
+	if cfg.BusProvider == "kafka" && len(cfg.KafkaBrokerList()) == 0 {
+		return nil, fmt.Errorf("missing required env for kafka bus: QANTLO_KAFKA_BROKERS")
+	}
+	if cfg.KafkaGroup == "" {
+		cfg.KafkaGroup = "quantlo-worker"
+	}
+	if cfg.JetStreamMaxDeliver <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_JETSTREAM_MAX_DELIVER %d, must be positive", cfg.JetStreamMaxDeliver)
+	}
+
+	if cfg.HoldSweepInterval <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_HOLD_SWEEP_INTERVAL %d, must be positive", cfg.HoldSweepInterval)
+	}
+	if cfg.GrantSweepInterval <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_GRANT_SWEEP_INTERVAL %d, must be positive", cfg.GrantSweepInterval)
+	}
+	if cfg.RefillSweepInterval <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_REFILL_SWEEP_INTERVAL %d, must be positive", cfg.RefillSweepInterval)
+	}
+	if cfg.SnapshotInterval <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_SNAPSHOT_INTERVAL %d, must be positive", cfg.SnapshotInterval)
+	}
+
+	if cfg.SyncMaxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_SYNC_MAX_ATTEMPTS %d, must be positive", cfg.SyncMaxAttempts)
+	}
+	if cfg.SyncBackoff < 0 {
+		return nil, fmt.Errorf("invalid QANTLO_SYNC_BACKOFF_MS %d, must not be negative", cfg.SyncBackoff)
+	}
+	if cfg.WorkerBatchSize < 0 {
+		return nil, fmt.Errorf("invalid QANTLO_WORKER_BATCH_SIZE %d, must not be negative", cfg.WorkerBatchSize)
+	}
+	// Only the nats worker batches; the others ack or commit every event on its own.
+	if cfg.WorkerBatchSize > 1 && cfg.WorkerProvider != "nats" {
+		return nil, fmt.Errorf("QANTLO_WORKER_BATCH_SIZE is only supported by the 'nats' worker, got worker %q", cfg.WorkerProvider)
+	}
+	if cfg.WorkerBatchSize > 1 && cfg.WorkerBatchWait <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_WORKER_BATCH_WAIT_MS %d, must be positive", cfg.WorkerBatchWait)
+	}
+	if cfg.OutboxAckTimeout <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_OUTBOX_ACK_TIMEOUT %d, must be positive", cfg.OutboxAckTimeout)
+	}
+	if cfg.WebhookMaxAttempts <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_WEBHOOK_MAX_ATTEMPTS %d, must be positive", cfg.WebhookMaxAttempts)
+	}
+	if cfg.WebhookBackoff <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_WEBHOOK_BACKOFF %d, must be positive", cfg.WebhookBackoff)
+	}
+	if cfg.WebhookTimeout <= 0 {
+		return nil, fmt.Errorf("invalid QANTLO_WEBHOOK_TIMEOUT %d, must be positive", cfg.WebhookTimeout)
+	}
+	if cfg.ReconcileInterval < 0 {
+		return nil, fmt.Errorf("invalid QANTLO_RECONCILE_INTERVAL %d, must not be negative", cfg.ReconcileInterval)
+	}
+	if cfg.ReconcilePolicy == "" {
+		cfg.ReconcilePolicy = "none"
+	}
+	if cfg.ReconcilePolicy != "none" && cfg.ReconcilePolicy != "trust_redis" && cfg.ReconcilePolicy != "trust_postgres" {
+		return nil, fmt.Errorf("invalid reconcile policy %q, must be 'none', 'trust_redis' or 'trust_postgres'", cfg.ReconcilePolicy)
+	}
 
 	// Optional: HTTP API — ApiAddr() will return an error if not enabled.
 	// Optional: GRPC server — GRPCAddr() will return an error if not configured.
@@ -108,6 +259,82 @@ func (c *Config) GRPCAddr() string {
 	return fmt.Sprintf("%s:%s", c.GRPCHost, c.GRPCPort)
 }
 
+// KafkaBrokerList returns the configured Kafka brokers.
+func (c *Config) KafkaBrokerList() []string {
+	var brokers []string
+	for _, b := range strings.Split(c.KafkaBrokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	return brokers
+}
+
+// HoldSweepPeriod returns how often the hold expirer looks for expired holds.
+func (c *Config) HoldSweepPeriod() time.Duration {
+	return time.Duration(c.HoldSweepInterval) * time.Second
+}
+
+// GrantSweepPeriod returns how often the grant expirer looks for expired credit lots.
+func (c *Config) GrantSweepPeriod() time.Duration {
+	return time.Duration(c.GrantSweepInterval) * time.Second
+}
+
+// RefillSweepPeriod returns how often the quota scheduler looks for due refills.
+func (c *Config) RefillSweepPeriod() time.Duration {
+	return time.Duration(c.RefillSweepInterval) * time.Second
+}
+
+// SnapshotPeriod returns how often the snapshot job snapshots the latest day.
+func (c *Config) SnapshotPeriod() time.Duration {
+	return time.Duration(c.SnapshotInterval) * time.Second
+}
+
+// SyncBackoffPeriod returns the delay before the first retry of a failed sync.
+func (c *Config) SyncBackoffPeriod() time.Duration {
+	return time.Duration(c.SyncBackoff) * time.Millisecond
+}
+
+// WorkerBatchPeriod returns how long the nats worker waits to fill a batch.
+func (c *Config) WorkerBatchPeriod() time.Duration {
+	return time.Duration(c.WorkerBatchWait) * time.Millisecond
+}
+
+// GRPCBusPublishPeriod returns how long the grpc bus waits for room in a full buffer.
+func (c *Config) GRPCBusPublishPeriod() time.Duration {
+	return time.Duration(c.GRPCBusPublishTimeout) * time.Millisecond
+}
+
+// GRPCBusRetryPeriod returns the delay before the grpc bus first resends an event.
+func (c *Config) GRPCBusRetryPeriod() time.Duration {
+	return time.Duration(c.GRPCBusRetryBackoff) * time.Millisecond
+}
+
+// GRPCBusFlushPeriod returns how long the grpc bus keeps delivering queued events on shutdown.
+func (c *Config) GRPCBusFlushPeriod() time.Duration {
+	return time.Duration(c.GRPCBusFlushTimeout) * time.Second
+}
+
+// OutboxAckPeriod returns how long the outbox relay waits for the worker to confirm an event.
+func (c *Config) OutboxAckPeriod() time.Duration {
+	return time.Duration(c.OutboxAckTimeout) * time.Second
+}
+
+// WebhookBackoffPeriod returns the delay before the first retry of a webhook delivery.
+func (c *Config) WebhookBackoffPeriod() time.Duration {
+	return time.Duration(c.WebhookBackoff) * time.Second
+}
+
+// WebhookTimeoutPeriod returns how long one webhook request may take.
+func (c *Config) WebhookTimeoutPeriod() time.Duration {
+	return time.Duration(c.WebhookTimeout) * time.Second
+}
+
+// ReconcilePeriod returns how often the reconciler runs; zero means it is disabled.
+func (c *Config) ReconcilePeriod() time.Duration {
+	return time.Duration(c.ReconcileInterval) * time.Second
+}
+
 // ApiAddr returns the HTTP listen address if the API is enabled.
 // Returns an error if QANTLO_API_ENABLED != "true" — callers should skip starting the HTTP server.
 func (c *Config) ApiAddr() (string, error) {
@@ -120,12 +347,19 @@ func (c *Config) ApiAddr() (string, error) {
 	return "", fmt.Errorf("HTTP API is disabled (QANTLO_API_ENABLED != true)")
 }
 
-// BusAddr returns the connection address for the configured bus provider.
+// BusAddr returns the connection address for the configured bus provider: the Kafka
+// brokers as configured for kafka, and nothing for the in-process memory bus.
 func (c *Config) BusAddr() string {
-	if c.BusProvider == "nats" {
+	switch c.BusProvider {
+	case "grpc":
+		return c.GRPCAddr()
+	case "kafka":
+		return c.KafkaBrokers
+	case "memory":
+		return ""
+	default:
 		return c.NatsAddr()
 	}
-	return c.GRPCAddr()
 }
 
 func getEnvInt(key string, defaultVal int) int {
@@ -0,0 +1,171 @@
+// Package cron parses standard five-field cron expressions ("minute hour day-of-month
+// month day-of-week") and finds the times they fire at. Fields take "*", values, ranges
+// ("1-5"), steps ("*/15", "0-30/10") and comma-separated lists of them; day-of-week runs
+// from 0 (Sunday) to 6, with 7 as Sunday too. The @hourly, @daily, @weekly, @monthly and
+// @yearly shorthands are accepted as well.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLookahead bounds the search for the next activation, so that an expression that
+// never fires (such as "0 0 30 2 *") does not loop forever.
+const maxLookahead = 5 * 366 * 24 * time.Hour
+
+var shorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// Schedule is a parsed cron expression. Each field is a bit set of the values it allows.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// A day matches either day field when both are restricted, as in Vixie cron.
+	domAny, dowAny bool
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse parses a cron expression. It fails for an expression that never fires.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if full, ok := shorthands[expr]; ok {
+		expr = full
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron: %q must have 5 fields", expr)
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := parseField(parts[i], f)
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	s := &Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		// Sunday is both 0 and 7.
+		dow:    (sets[4] | sets[4]>>7) & 0x7f,
+		domAny: parts[2] == "*",
+		dowAny: parts[4] == "*",
+	}
+	if s.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron: %q never fires", expr)
+	}
+	return s, nil
+}
+
+func parseField(spec string, f field) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(spec, ",") {
+		rng, stepSpec, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepSpec)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("cron: invalid step %q in %s", stepSpec, f.name)
+			}
+			step = n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			from, to, _ := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from, f); err != nil {
+				return 0, err
+			}
+			if hi, err = value(to, f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("cron: invalid range %q in %s", rng, f.name)
+			}
+		default:
+			var err error
+			if lo, err = value(rng, f); err != nil {
+				return 0, err
+			}
+			// "5/15" runs from 5 to the end of the field.
+			if !hasStep {
+				hi = lo
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func value(s string, f field) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("cron: invalid %s %q, must be %d-%d", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<v) != 0
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := has(s.dom, t.Day()), has(s.dow, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t the schedule fires at, in t's location, or the
+// zero time if it does not fire within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	limit := t.Add(maxLookahead)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		switch {
+		case !has(s.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !has(s.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !has(s.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,44 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_Next(t *testing.T) {
+	from := time.Date(2026, 1, 31, 10, 17, 30, 0, time.UTC) // a Saturday
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2026, 1, 31, 13, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"30 6 * * 1-5", time.Date(2026, 2, 2, 6, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either one matches.
+		{"0 0 15 * 0", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestParse_RejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "0 0 30 2 *", "@often"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
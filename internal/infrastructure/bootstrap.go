@@ -2,13 +2,20 @@ package infrastructure
 
 import (
 	"context"
+	"net/http"
 	"quantlo/internal/config"
+	"quantlo/internal/model"
 	"quantlo/internal/repository"
 	"quantlo/internal/service"
 	transportGRPC "quantlo/internal/transport/grpc"
 	transportHTTP "quantlo/internal/transport/http"
+	transportKafka "quantlo/internal/transport/kafka"
+	transportMemory "quantlo/internal/transport/memory"
 	transportNATS "quantlo/internal/transport/nats"
 	"quantlo/internal/worker"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 // Bootstrap initialises all dependencies from config and wires up the application.
@@ -19,6 +26,11 @@ func Bootstrap(ctx context.Context) (*App, func(), error) {
 		return nil, nil, err
 	}
 
+	if cfg.BusProvider == "memory" {
+		app, cleanup := bootstrapMemory(cfg)
+		return app, cleanup, nil
+	}
+
 	db, err := connectPostgres(cfg.DSN())
 	if err != nil {
 		return nil, nil, err
@@ -42,33 +54,71 @@ func Bootstrap(ctx context.Context) (*App, func(), error) {
 
 	// 1. Bus setup
 	switch cfg.BusProvider {
-	case "nats":
+	case "nats", "jetstream":
 		nc, err := connectNats(cfg.NatsAddr())
 		if err != nil {
 			return nil, runCleanup(cleanupFns), err
 		}
-		bus = transportNATS.NewBus(nc)
 		cleanupFns = append(cleanupFns, nc.Close)
 
+		// The stream is needed as soon as either side of the bus uses JetStream.
+		var stream jetstream.Stream
+		var js jetstream.JetStream
+		if cfg.BusProvider == "jetstream" || cfg.WorkerProvider == "jetstream" {
+			if js, err = jetstream.New(nc); err != nil {
+				return nil, runCleanup(cleanupFns), err
+			}
+			if stream, err = transportNATS.EnsureStream(ctx, js); err != nil {
+				return nil, runCleanup(cleanupFns), err
+			}
+		}
+
+		if cfg.BusProvider == "jetstream" {
+			bus = transportNATS.NewJetStreamBus(nc, js)
+		} else {
+			bus = transportNATS.NewBus(nc)
+		}
+
 		// NATS needs handlers to process commands/syncs
 		repo := repository.NewLedgerRepo(rdb, db, bus)
 		var svc service.LedgerService = repo
+		syncer := service.NewEventSyncer(svc, cfg.SyncMaxAttempts, cfg.SyncBackoffPeriod())
+		servers = append(servers, repository.NewOutboxRelay(rdb, bus, cfg.OutboxAckPeriod()))
 
 		// If worker is NATS, add the worker
-		if cfg.WorkerProvider == "nats" {
-			servers = append(servers, worker.NewTransactionWorker(svc, nc))
+		switch cfg.WorkerProvider {
+		case "nats":
+			servers = append(servers, worker.NewTransactionWorker(syncer, nc, cfg.WorkerBatchSize, cfg.WorkerBatchPeriod()))
+		case "jetstream":
+			servers = append(servers, worker.NewJetStreamWorker(svc, stream, cfg.JetStreamMaxDeliver, cfg.SyncBackoffPeriod()))
 		}
 		// NATS can also handle commands
 		servers = append(servers, transportNATS.NewHandler(svc, nc))
+		servers = append(servers, worker.NewHoldExpirer(svc, cfg.HoldSweepPeriod()))
+		servers = append(servers, worker.NewGrantExpirer(svc, cfg.GrantSweepPeriod()))
+		servers = append(servers, worker.NewQuotaScheduler(svc, cfg.RefillSweepPeriod()))
+		servers = append(servers, worker.NewSnapshotJob(svc, cfg.SnapshotPeriod()))
+		servers = append(servers, newWebhookDispatcher(cfg, svc))
+		if period := cfg.ReconcilePeriod(); period > 0 {
+			servers = append(servers, worker.NewReconciler(svc, period, model.RepairPolicy(cfg.ReconcilePolicy)))
+		}
 
 		// Other transports
-		servers = append(servers, transportGRPC.NewServer(":50051", svc))
+		servers = append(servers, transportGRPC.NewServer(":50051", svc, syncer))
 		if addr, apiErr := cfg.ApiAddr(); apiErr == nil {
 			servers = append(servers, transportHTTP.NewServer(addr, svc))
 		}
 
 	case "grpc":
-		grpcBus, cleanup, err := transportGRPC.NewGrpcBusFromAddr(cfg.GRPCAddr(), cfg.BusBufferSize)
+		grpcBus, cleanup, err := transportGRPC.NewGrpcBusFromAddr(cfg.GRPCAddr(), transportGRPC.BusOptions{
+			BufferSize:     cfg.BusBufferSize,
+			PublishTimeout: cfg.GRPCBusPublishPeriod(),
+			BatchSize:      cfg.GRPCBusBatchSize,
+			MaxAttempts:    cfg.GRPCBusMaxAttempts,
+			RetryBackoff:   cfg.GRPCBusRetryPeriod(),
+			FlushTimeout:   cfg.GRPCBusFlushPeriod(),
+			SpillPath:      cfg.GRPCBusSpillPath,
+		})
 		if err != nil {
 			return nil, runCleanup(cleanupFns), err
 		}
@@ -77,9 +127,47 @@ func Bootstrap(ctx context.Context) (*App, func(), error) {
 
 		repo := repository.NewLedgerRepo(rdb, db, bus)
 		var svc service.LedgerService = repo
+		syncer := service.NewEventSyncer(svc, cfg.SyncMaxAttempts, cfg.SyncBackoffPeriod())
+		servers = append(servers, repository.NewOutboxRelay(rdb, bus, cfg.OutboxAckPeriod()))
 
 		// gRPC server acts as worker if WorkerProvider is "grpc" (handled in Server.Publish)
-		servers = append(servers, transportGRPC.NewServer(":50051", svc))
+		servers = append(servers, transportGRPC.NewServer(":50051", svc, syncer))
+		servers = append(servers, worker.NewHoldExpirer(svc, cfg.HoldSweepPeriod()))
+		servers = append(servers, worker.NewGrantExpirer(svc, cfg.GrantSweepPeriod()))
+		servers = append(servers, worker.NewQuotaScheduler(svc, cfg.RefillSweepPeriod()))
+		servers = append(servers, worker.NewSnapshotJob(svc, cfg.SnapshotPeriod()))
+		servers = append(servers, newWebhookDispatcher(cfg, svc))
+		if period := cfg.ReconcilePeriod(); period > 0 {
+			servers = append(servers, worker.NewReconciler(svc, period, model.RepairPolicy(cfg.ReconcilePolicy)))
+		}
+
+		if addr, apiErr := cfg.ApiAddr(); apiErr == nil {
+			servers = append(servers, transportHTTP.NewServer(addr, svc))
+		}
+
+	case "kafka":
+		writer := transportKafka.NewWriter(cfg.KafkaBrokerList())
+		cleanupFns = append(cleanupFns, func() { _ = writer.Close() })
+		bus = transportKafka.NewBus(writer)
+
+		repo := repository.NewLedgerRepo(rdb, db, bus)
+		var svc service.LedgerService = repo
+		syncer := service.NewEventSyncer(svc, cfg.SyncMaxAttempts, cfg.SyncBackoffPeriod())
+		servers = append(servers, repository.NewOutboxRelay(rdb, bus, cfg.OutboxAckPeriod()))
+
+		if cfg.WorkerProvider == "kafka" {
+			reader := transportKafka.NewReader(cfg.KafkaBrokerList(), cfg.KafkaGroup)
+			servers = append(servers, worker.NewKafkaWorker(syncer, reader))
+		}
+		servers = append(servers, transportGRPC.NewServer(":50051", svc, syncer))
+		servers = append(servers, worker.NewHoldExpirer(svc, cfg.HoldSweepPeriod()))
+		servers = append(servers, worker.NewGrantExpirer(svc, cfg.GrantSweepPeriod()))
+		servers = append(servers, worker.NewQuotaScheduler(svc, cfg.RefillSweepPeriod()))
+		servers = append(servers, worker.NewSnapshotJob(svc, cfg.SnapshotPeriod()))
+		servers = append(servers, newWebhookDispatcher(cfg, svc))
+		if period := cfg.ReconcilePeriod(); period > 0 {
+			servers = append(servers, worker.NewReconciler(svc, period, model.RepairPolicy(cfg.ReconcilePolicy)))
+		}
 
 		if addr, apiErr := cfg.ApiAddr(); apiErr == nil {
 			servers = append(servers, transportHTTP.NewServer(addr, svc))
@@ -89,6 +177,12 @@ func Bootstrap(ctx context.Context) (*App, func(), error) {
 	return NewApp(servers), runCleanup(cleanupFns), nil
 }
 
+// newWebhookDispatcher delivers the balance events to the registered webhooks.
+func newWebhookDispatcher(cfg *config.Config, svc service.LedgerService) *worker.WebhookDispatcher {
+	client := &http.Client{Timeout: cfg.WebhookTimeoutPeriod()}
+	return worker.NewWebhookDispatcher(svc, client, time.Second, cfg.WebhookMaxAttempts, cfg.WebhookBackoffPeriod())
+}
+
 // runCleanup returns a single function that calls all cleanup functions in reverse order.
 func runCleanup(fns []func()) func() {
 	return func() {
@@ -97,3 +191,25 @@ func runCleanup(fns []func()) func() {
 		}
 	}
 }
+
+// bootstrapMemory wires the service around the in-memory ledger and bus, as a single
+// process with no database, cache or broker. All state is lost when it stops.
+func bootstrapMemory(cfg *config.Config) (*App, func()) {
+	bus := transportMemory.NewBus(cfg.BusBufferSize)
+	var svc service.LedgerService = repository.NewMemoryLedger(bus)
+	syncer := service.NewEventSyncer(svc, cfg.SyncMaxAttempts, cfg.SyncBackoffPeriod())
+
+	var servers []Server
+	servers = append(servers, transportGRPC.NewServer(":50051", svc, syncer))
+	servers = append(servers, worker.NewHoldExpirer(svc, cfg.HoldSweepPeriod()))
+	servers = append(servers, worker.NewGrantExpirer(svc, cfg.GrantSweepPeriod()))
+	servers = append(servers, worker.NewQuotaScheduler(svc, cfg.RefillSweepPeriod()))
+	servers = append(servers, worker.NewSnapshotJob(svc, cfg.SnapshotPeriod()))
+	servers = append(servers, newWebhookDispatcher(cfg, svc))
+
+	if addr, apiErr := cfg.ApiAddr(); apiErr == nil {
+		servers = append(servers, transportHTTP.NewServer(addr, svc))
+	}
+
+	return NewApp(servers), bus.Close
+}
@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+const (
+	DeadLetterParked = "parked"
+	// DeadLetterReplaying marks a dead letter claimed for a replay that has not reached the bus yet.
+	DeadLetterReplaying = "replaying"
+	DeadLetterReplayed  = "replayed"
+	DeadLetterDiscarded = "discarded"
+)
+
+// DeadLetter is an event the worker gave up on, kept with the error that stopped it.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	EventKey  string    `json:"event_key,omitempty"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
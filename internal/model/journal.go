@@ -0,0 +1,64 @@
+package model
+
+import "time"
+
+type EntryType string
+
+const (
+	EntrySpend          EntryType = "spend"
+	EntryRecharge       EntryType = "recharge"
+	EntryOpeningBalance EntryType = "opening_balance"
+	EntryAdjustment     EntryType = "adjustment"
+	EntryRefund         EntryType = "refund"
+	EntryTransfer       EntryType = "transfer"
+	EntryRefill         EntryType = "refill"
+)
+
+// System counter-accounts. Every journal entry moves value between customer
+// accounts and these, so the legs of an entry always sum to zero.
+const (
+	SystemRevenue   = "system:revenue"   // receives spends, gives back refunds
+	SystemFunding   = "system:funding"   // source of recharges, grants and opening balances
+	SystemExpired   = "system:expired"   // receives expired credit grants
+	SystemClosed    = "system:closed"    // receives the balance of deleted accounts
+	SystemReconcile = "system:reconcile" // absorbs corrections made by the reconciler
+)
+
+// JournalEntry is one balanced double-entry posting.
+type JournalEntry struct {
+	ID             string            `json:"id"`
+	Type           EntryType         `json:"entry_type"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Reference      string            `json:"reference,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Legs           []JournalLeg      `json:"legs"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// JournalLeg changes one account's balance. Positive amounts are credits, negative are debits.
+type JournalLeg struct {
+	AccountID    string `json:"account_id"`
+	ResourceType string `json:"resource_type"`
+	Amount       int64  `json:"amount"`
+}
+
+// JournalReport is the result of checking the journal invariants.
+type JournalReport struct {
+	OK                bool              `json:"ok"`
+	CheckedAt         time.Time         `json:"checked_at"`
+	UnbalancedEntries []UnbalancedEntry `json:"unbalanced_entries"`
+	BalanceMismatches []BalanceMismatch `json:"balance_mismatches"`
+}
+
+type UnbalancedEntry struct {
+	EntryID string `json:"entry_id"`
+	Sum     int64  `json:"sum"`
+}
+
+// BalanceMismatch is an account whose stored balance differs from the sum of its journal legs.
+type BalanceMismatch struct {
+	AccountID      string `json:"account_id"`
+	ResourceType   string `json:"resource_type"`
+	Balance        int64  `json:"balance"`
+	JournalBalance int64  `json:"journal_balance"`
+}
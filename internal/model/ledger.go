@@ -13,17 +13,216 @@ type RechargeRequest struct {
 	AccountID    string `json:"account_id"`
 	ResourceType string `json:"resource_type"`
 	Amount       int64  `json:"amount"`
+	// IdempotencyKey is optional; a recharge retried with the same key is applied once.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 type SpendResult struct {
 	NewBalance int64  `json:"new_balance"`
 	Status     string `json:"status"`
+	// CreditLimit is how far below zero the balance may go; OverdraftUsed is how much of it is in use.
+	CreditLimit   int64 `json:"credit_limit"`
+	OverdraftUsed int64 `json:"overdraft_used"`
+	// Amount and ProcessedAt describe the spend as it was first processed. Replayed is set when
+	// the result is that of an earlier request with the same idempotency key, returned again.
+	Amount      int64     `json:"amount"`
+	ProcessedAt time.Time `json:"processed_at"`
+	Replayed    bool      `json:"replayed,omitempty"`
 }
 
-type SpendEvent struct {
+// Balance event types, as pushed to balance watchers.
+const (
+	BalanceSpend            = "spend"
+	BalanceRecharge         = "recharge"
+	BalanceAccountCreated   = "account_created"
+	BalanceAccountDeleted   = "account_deleted"
+	BalanceThresholdCrossed = "threshold_crossed"
+	BalanceRefill           = "refill"
+	BalanceTransferOut      = "transfer_out"
+	BalanceTransferIn       = "transfer_in"
+	BalanceRefund           = "refund"
+	BalanceGrant            = "grant"
+	BalanceGrantExpired     = "grant_expired"
+	BalanceHold             = "hold"
+	BalanceCapture          = "capture"
+	BalanceVoid             = "void"
+	BalanceHoldExpired      = "hold_expired"
+)
+
+// BalanceEvent is a change to an account's balance, as pushed to balance watchers. Amount is
+// the change (the initial amount of a new account, what was left in a deleted one, the
+// level of a crossed threshold, the amount held, captured or released by a hold, what
+// expired of a grant) and Balance the spendable balance after it. Offset is the event's position in the feed:
+// watching from an offset resumes with the event after it.
+type BalanceEvent struct {
+	Offset         string    `json:"offset"`
+	Type           string    `json:"type"`
 	AccountID      string    `json:"account_id"`
 	ResourceType   string    `json:"resource_type"`
 	Amount         int64     `json:"amount"`
-	IdempotencyKey string    `json:"idempotency_key"`
-	CreatedAt      time.Time `json:"created_at"`
-}
\ No newline at end of file
+	Balance        int64     `json:"balance"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	At             time.Time `json:"at"`
+}
+
+type SpendEvent struct {
+	AccountID      string     `json:"account_id"`
+	ResourceType   string     `json:"resource_type"`
+	Amount         int64      `json:"amount"`
+	IdempotencyKey string     `json:"idempotency_key"`
+	Lots           []LotUsage `json:"lots,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	// OutboxID is the outbox entry the event was relayed from; the worker confirms it once persisted.
+	OutboxID string `json:"outbox_id,omitempty"`
+}
+
+// LotUsage is how much of a single credit grant a spend, transfer or hold consumed.
+type LotUsage struct {
+	GrantID string `json:"grant_id"`
+	Amount  int64  `json:"amount"`
+}
+
+// AuthorizeRequest places a hold on an account. The held amount is taken out of
+// the spendable balance until it is captured, voided or expires.
+type AuthorizeRequest struct {
+	AccountID      string `json:"account_id"`
+	ResourceType   string `json:"resource_type"`
+	Amount         int64  `json:"amount"`
+	IdempotencyKey string `json:"idempotency_key"`
+	TTLSeconds     int64  `json:"ttl_seconds,omitempty"`
+}
+
+// CaptureRequest settles a hold. Amount may be lower than the held amount,
+// in which case the remainder is released back to the balance.
+type CaptureRequest struct {
+	HoldID string `json:"hold_id"`
+	Amount int64  `json:"amount"`
+}
+
+type HoldResult struct {
+	HoldID     string    `json:"hold_id"`
+	Amount     int64     `json:"amount"`
+	NewBalance int64     `json:"new_balance"`
+	Status     string    `json:"status"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+}
+
+type TransferRequest struct {
+	FromAccountID  string `json:"from_account_id"`
+	ToAccountID    string `json:"to_account_id"`
+	ResourceType   string `json:"resource_type"`
+	Amount         int64  `json:"amount"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+type TransferResult struct {
+	FromBalance int64  `json:"from_balance"`
+	ToBalance   int64  `json:"to_balance"`
+	Status      string `json:"status"`
+}
+
+type TransferEvent struct {
+	FromAccountID  string     `json:"from_account_id"`
+	ToAccountID    string     `json:"to_account_id"`
+	ResourceType   string     `json:"resource_type"`
+	Amount         int64      `json:"amount"`
+	IdempotencyKey string     `json:"idempotency_key"`
+	Lots           []LotUsage `json:"lots,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	// OutboxID is the outbox entry the event was relayed from; the worker confirms it once persisted.
+	OutboxID string `json:"outbox_id,omitempty"`
+}
+
+// GrantRequest adds a lot of credits to an account. Lots with a higher Priority are
+// consumed first; among equal priorities the one expiring soonest goes first.
+type GrantRequest struct {
+	AccountID    string     `json:"account_id"`
+	ResourceType string     `json:"resource_type"`
+	Amount       int64      `json:"amount"`
+	Priority     int        `json:"priority"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	// IdempotencyKey makes a retried grant return the grant already made.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+type CreditGrant struct {
+	ID           string     `json:"id"`
+	AccountID    string     `json:"account_id"`
+	ResourceType string     `json:"resource_type"`
+	Amount       int64      `json:"amount"`
+	Remaining    int64      `json:"remaining"`
+	Priority     int        `json:"priority"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// BalanceBreakdown splits a balance into its credit lots and the part not tied to any lot.
+type BalanceBreakdown struct {
+	Balance     int64         `json:"balance"`
+	Unallocated int64         `json:"unallocated"`
+	Lots        []CreditGrant `json:"lots"`
+}
+
+type CreditExpiredEvent struct {
+	GrantID      string    `json:"grant_id"`
+	AccountID    string    `json:"account_id"`
+	ResourceType string    `json:"resource_type"`
+	Amount       int64     `json:"amount"`
+	ExpiredAt    time.Time `json:"expired_at"`
+}
+
+type RefundRequest struct {
+	// IdempotencyKey is the key of the spend to refund.
+	IdempotencyKey string `json:"idempotency_key"`
+	Amount         int64  `json:"amount"`
+	// RefundIdempotencyKey identifies the refund itself, so a retry does not refund twice.
+	RefundIdempotencyKey string `json:"refund_idempotency_key,omitempty"`
+}
+
+type RefundResult struct {
+	RefundID       string `json:"refund_id"`
+	OriginalKey    string `json:"original_idempotency_key"`
+	Amount         int64  `json:"amount"`
+	RefundedTotal  int64  `json:"refunded_total"`
+	OriginalAmount int64  `json:"original_amount"`
+	NewBalance     int64  `json:"new_balance"`
+	Status         string `json:"status"`
+}
+
+// TransactionFilter selects an account's transactions. Nil/empty fields are not filtered on.
+type TransactionFilter struct {
+	AccountID    string
+	ResourceType string
+	From         *time.Time
+	To           *time.Time
+	MinAmount    *int64
+	MaxAmount    *int64
+	Metadata     map[string]string
+	Cursor       string
+	Limit        int
+}
+
+type Transaction struct {
+	ID             string            `json:"id"`
+	AccountID      string            `json:"account_id"`
+	ResourceType   string            `json:"resource_type"`
+	Amount         int64             `json:"amount"`
+	IdempotencyKey string            `json:"idempotency_key"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	ReversalOf     string            `json:"reversal_of,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+type TransactionPage struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+}
+
+// BatchStats describes one batch of spend events written to PostgreSQL; the nats worker logs it.
+type BatchStats struct {
+	Events     int           `json:"events"`
+	Inserted   int           `json:"inserted"`
+	Duplicates int           `json:"duplicates"`
+	Accounts   int           `json:"accounts"`
+	Duration   time.Duration `json:"duration"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import "time"
+
+// Quota refill modes: what a refill does to the balance.
+const (
+	// QuotaRefillTo resets the balance to Amount; what was left of the last period is forfeited.
+	QuotaRefillTo = "refill_to"
+	// QuotaAdd adds Amount to the balance.
+	QuotaAdd = "add"
+	// QuotaRollover adds Amount, but never takes the balance above Cap.
+	QuotaRollover = "rollover"
+)
+
+// QuotaPolicyRequest attaches a periodic refill to an account. It runs on a five-field
+// Cron expression (in UTC) or every IntervalSeconds, counted from when it was created.
+type QuotaPolicyRequest struct {
+	AccountID       string `json:"account_id"`
+	ResourceType    string `json:"resource_type"`
+	Mode            string `json:"mode"`
+	Amount          int64  `json:"amount"`
+	Cap             int64  `json:"cap,omitempty"`
+	Cron            string `json:"cron,omitempty"`
+	IntervalSeconds int64  `json:"interval_seconds,omitempty"`
+}
+
+// QuotaPolicy is a periodic refill. NextRefillAt is the start of the next period to
+// apply and LastPeriod the key of the last one applied.
+type QuotaPolicy struct {
+	ID              string    `json:"id"`
+	AccountID       string    `json:"account_id"`
+	ResourceType    string    `json:"resource_type"`
+	Mode            string    `json:"mode"`
+	Amount          int64     `json:"amount"`
+	Cap             int64     `json:"cap,omitempty"`
+	Cron            string    `json:"cron,omitempty"`
+	IntervalSeconds int64     `json:"interval_seconds,omitempty"`
+	NextRefillAt    time.Time `json:"next_refill_at"`
+	LastPeriod      string    `json:"last_period,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
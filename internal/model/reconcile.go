@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// RepairPolicy decides which store wins when the reconciler finds drift.
+type RepairPolicy string
+
+const (
+	RepairNone          RepairPolicy = "none"           // report only
+	RepairTrustRedis    RepairPolicy = "trust_redis"    // PostgreSQL is corrected to match Redis
+	RepairTrustPostgres RepairPolicy = "trust_postgres" // Redis is corrected to match PostgreSQL
+)
+
+// DriftReport is the result of comparing every cached balance with PostgreSQL.
+type DriftReport struct {
+	OK        bool           `json:"ok"`
+	Policy    RepairPolicy   `json:"policy"`
+	CheckedAt time.Time      `json:"checked_at"`
+	Scanned   int            `json:"scanned"`
+	Repaired  int            `json:"repaired"`
+	Accounts  []AccountDrift `json:"accounts"`
+}
+
+// AccountDrift describes one cached balance that does not match PostgreSQL.
+// Drift is RedisBalance minus what Redis should hold: the PostgreSQL balance
+// less pending holds and spend events not yet synced.
+type AccountDrift struct {
+	AccountID         string `json:"account_id"`
+	ResourceType      string `json:"resource_type"`
+	RedisBalance      int64  `json:"redis_balance"`
+	PostgresBalance   int64  `json:"postgres_balance"`
+	PendingHolds      int64  `json:"pending_holds"`
+	PendingEvents     int64  `json:"pending_events"`
+	StaleEvents       int    `json:"stale_events"`
+	StaleAmount       int64  `json:"stale_amount"`
+	Drift             int64  `json:"drift"`
+	MissingInPostgres bool   `json:"missing_in_postgres,omitempty"`
+	Repaired          bool   `json:"repaired"`
+}
@@ -0,0 +1,47 @@
+package model
+
+import "time"
+
+// Threshold kinds: a fixed balance, or a percentage of the account's last recharge.
+const (
+	ThresholdAbsolute = "absolute"
+	ThresholdPercent  = "percent"
+)
+
+// ThresholdRequest adds a low-balance alert to an account. Value is the balance of an
+// absolute threshold, or the percentage (1 to 100) of the last recharge of a percent one.
+type ThresholdRequest struct {
+	AccountID    string `json:"account_id"`
+	ResourceType string `json:"resource_type"`
+	Kind         string `json:"kind"`
+	Value        int64  `json:"value"`
+}
+
+// BalanceThreshold is a low-balance alert. It fires once when a spend takes the balance
+// from above its level to or below it, and is armed again by the next recharge.
+type BalanceThreshold struct {
+	ID           string    `json:"id"`
+	AccountID    string    `json:"account_id"`
+	ResourceType string    `json:"resource_type"`
+	Kind         string    `json:"kind"`
+	Value        int64     `json:"value"`
+	Armed        bool      `json:"armed"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ThresholdCrossedEvent is published on balance.threshold_crossed when a spend crosses a
+// threshold. Level is the balance the threshold stood for: its Value when absolute, its
+// Value percent of LastRecharge otherwise.
+type ThresholdCrossedEvent struct {
+	ThresholdID     string    `json:"threshold_id"`
+	AccountID       string    `json:"account_id"`
+	ResourceType    string    `json:"resource_type"`
+	Kind            string    `json:"kind"`
+	Value           int64     `json:"value"`
+	Level           int64     `json:"level"`
+	LastRecharge    int64     `json:"last_recharge,omitempty"`
+	PreviousBalance int64     `json:"previous_balance"`
+	Balance         int64     `json:"balance"`
+	IdempotencyKey  string    `json:"idempotency_key"`
+	CrossedAt       time.Time `json:"crossed_at"`
+}
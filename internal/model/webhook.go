@@ -0,0 +1,62 @@
+package model
+
+import "time"
+
+// Webhook event types are the balance event types; a webhook subscribes to some of them.
+var WebhookEventTypes = []string{BalanceSpend, BalanceRecharge, BalanceAccountCreated, BalanceAccountDeleted, BalanceThresholdCrossed, BalanceRefill,
+	BalanceTransferOut, BalanceTransferIn, BalanceRefund, BalanceGrant, BalanceGrantExpired,
+	BalanceHold, BalanceCapture, BalanceVoid, BalanceHoldExpired}
+
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// WebhookRequest registers an HTTPS endpoint for balance events. AccountIDs narrows it to
+// some accounts; without them it gets the events of every account. Secret signs the
+// deliveries and is generated when left empty.
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	AccountIDs []string `json:"account_ids,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+// Webhook is a registered endpoint. Its Secret is only returned when it is created.
+type Webhook struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	AccountIDs []string  `json:"account_ids,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event to be delivered to one webhook, with the outcome of its
+// latest attempt. URL and Secret are those of the webhook, for the dispatcher.
+type WebhookDelivery struct {
+	ID             string       `json:"id"`
+	WebhookID      string       `json:"webhook_id"`
+	Event          BalanceEvent `json:"event"`
+	Status         string       `json:"status"`
+	Attempts       int          `json:"attempts"`
+	LastStatusCode int          `json:"last_status_code,omitempty"`
+	LastError      string       `json:"last_error,omitempty"`
+	NextAttemptAt  *time.Time   `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time   `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt is the outcome of sending a delivery. A failed attempt is retried at
+// RetryAt; a zero RetryAt gives the delivery up.
+type WebhookAttempt struct {
+	DeliveryID string
+	Delivered  bool
+	StatusCode int
+	Error      string
+	RetryAt    time.Time
+}
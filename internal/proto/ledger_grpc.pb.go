@@ -19,8 +19,22 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	LedgerService_Spend_FullMethodName    = "/ledger.LedgerService/Spend"
-	LedgerService_Recharge_FullMethodName = "/ledger.LedgerService/Recharge"
+	LedgerService_Spend_FullMethodName              = "/ledger.LedgerService/Spend"
+	LedgerService_Recharge_FullMethodName           = "/ledger.LedgerService/Recharge"
+	LedgerService_Authorize_FullMethodName          = "/ledger.LedgerService/Authorize"
+	LedgerService_Capture_FullMethodName            = "/ledger.LedgerService/Capture"
+	LedgerService_Void_FullMethodName               = "/ledger.LedgerService/Void"
+	LedgerService_Transfer_FullMethodName           = "/ledger.LedgerService/Transfer"
+	LedgerService_Refund_FullMethodName             = "/ledger.LedgerService/Refund"
+	LedgerService_ListTransactions_FullMethodName   = "/ledger.LedgerService/ListTransactions"
+	LedgerService_GetBalanceAt_FullMethodName       = "/ledger.LedgerService/GetBalanceAt"
+	LedgerService_GetBalance_FullMethodName         = "/ledger.LedgerService/GetBalance"
+	LedgerService_CreateAccount_FullMethodName      = "/ledger.LedgerService/CreateAccount"
+	LedgerService_DeleteAccount_FullMethodName      = "/ledger.LedgerService/DeleteAccount"
+	LedgerService_BatchGetBalance_FullMethodName    = "/ledger.LedgerService/BatchGetBalance"
+	LedgerService_BatchCreateAccount_FullMethodName = "/ledger.LedgerService/BatchCreateAccount"
+	LedgerService_BatchDeleteAccount_FullMethodName = "/ledger.LedgerService/BatchDeleteAccount"
+	LedgerService_WatchBalances_FullMethodName      = "/ledger.LedgerService/WatchBalances"
 )
 
 // LedgerServiceClient is the client API for LedgerService service.
@@ -29,6 +43,20 @@ const (
 type LedgerServiceClient interface {
 	Spend(ctx context.Context, in *SpendRequest, opts ...grpc.CallOption) (*SpendResponse, error)
 	Recharge(ctx context.Context, in *RechargeRequest, opts ...grpc.CallOption) (*RechargeResponse, error)
+	Authorize(ctx context.Context, in *AuthorizeRequest, opts ...grpc.CallOption) (*HoldResponse, error)
+	Capture(ctx context.Context, in *CaptureRequest, opts ...grpc.CallOption) (*HoldResponse, error)
+	Void(ctx context.Context, in *VoidRequest, opts ...grpc.CallOption) (*HoldResponse, error)
+	Transfer(ctx context.Context, in *TransferRequest, opts ...grpc.CallOption) (*TransferResponse, error)
+	Refund(ctx context.Context, in *RefundRequest, opts ...grpc.CallOption) (*RefundResponse, error)
+	ListTransactions(ctx context.Context, in *ListTransactionsRequest, opts ...grpc.CallOption) (*ListTransactionsResponse, error)
+	GetBalanceAt(ctx context.Context, in *GetBalanceAtRequest, opts ...grpc.CallOption) (*BalanceResponse, error)
+	GetBalance(ctx context.Context, in *GetBalanceRequest, opts ...grpc.CallOption) (*GetBalanceResponse, error)
+	CreateAccount(ctx context.Context, in *CreateAccountRequest, opts ...grpc.CallOption) (*CreateAccountResponse, error)
+	DeleteAccount(ctx context.Context, in *DeleteAccountRequest, opts ...grpc.CallOption) (*DeleteAccountResponse, error)
+	BatchGetBalance(ctx context.Context, in *BatchGetBalanceRequest, opts ...grpc.CallOption) (*BatchGetBalanceResponse, error)
+	BatchCreateAccount(ctx context.Context, in *BatchCreateAccountRequest, opts ...grpc.CallOption) (*BatchAccountResponse, error)
+	BatchDeleteAccount(ctx context.Context, in *BatchDeleteAccountRequest, opts ...grpc.CallOption) (*BatchAccountResponse, error)
+	WatchBalances(ctx context.Context, in *WatchBalancesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BalanceEvent], error)
 }
 
 type ledgerServiceClient struct {
@@ -59,12 +87,175 @@ func (c *ledgerServiceClient) Recharge(ctx context.Context, in *RechargeRequest,
 	return out, nil
 }
 
+func (c *ledgerServiceClient) Authorize(ctx context.Context, in *AuthorizeRequest, opts ...grpc.CallOption) (*HoldResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HoldResponse)
+	err := c.cc.Invoke(ctx, LedgerService_Authorize_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) Capture(ctx context.Context, in *CaptureRequest, opts ...grpc.CallOption) (*HoldResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HoldResponse)
+	err := c.cc.Invoke(ctx, LedgerService_Capture_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) Void(ctx context.Context, in *VoidRequest, opts ...grpc.CallOption) (*HoldResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HoldResponse)
+	err := c.cc.Invoke(ctx, LedgerService_Void_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) Transfer(ctx context.Context, in *TransferRequest, opts ...grpc.CallOption) (*TransferResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TransferResponse)
+	err := c.cc.Invoke(ctx, LedgerService_Transfer_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) Refund(ctx context.Context, in *RefundRequest, opts ...grpc.CallOption) (*RefundResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RefundResponse)
+	err := c.cc.Invoke(ctx, LedgerService_Refund_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) ListTransactions(ctx context.Context, in *ListTransactionsRequest, opts ...grpc.CallOption) (*ListTransactionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListTransactionsResponse)
+	err := c.cc.Invoke(ctx, LedgerService_ListTransactions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) GetBalanceAt(ctx context.Context, in *GetBalanceAtRequest, opts ...grpc.CallOption) (*BalanceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BalanceResponse)
+	err := c.cc.Invoke(ctx, LedgerService_GetBalanceAt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) GetBalance(ctx context.Context, in *GetBalanceRequest, opts ...grpc.CallOption) (*GetBalanceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetBalanceResponse)
+	err := c.cc.Invoke(ctx, LedgerService_GetBalance_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) CreateAccount(ctx context.Context, in *CreateAccountRequest, opts ...grpc.CallOption) (*CreateAccountResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CreateAccountResponse)
+	err := c.cc.Invoke(ctx, LedgerService_CreateAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) DeleteAccount(ctx context.Context, in *DeleteAccountRequest, opts ...grpc.CallOption) (*DeleteAccountResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteAccountResponse)
+	err := c.cc.Invoke(ctx, LedgerService_DeleteAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) BatchGetBalance(ctx context.Context, in *BatchGetBalanceRequest, opts ...grpc.CallOption) (*BatchGetBalanceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchGetBalanceResponse)
+	err := c.cc.Invoke(ctx, LedgerService_BatchGetBalance_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) BatchCreateAccount(ctx context.Context, in *BatchCreateAccountRequest, opts ...grpc.CallOption) (*BatchAccountResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchAccountResponse)
+	err := c.cc.Invoke(ctx, LedgerService_BatchCreateAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) BatchDeleteAccount(ctx context.Context, in *BatchDeleteAccountRequest, opts ...grpc.CallOption) (*BatchAccountResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchAccountResponse)
+	err := c.cc.Invoke(ctx, LedgerService_BatchDeleteAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *ledgerServiceClient) WatchBalances(ctx context.Context, in *WatchBalancesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BalanceEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LedgerService_ServiceDesc.Streams[0], LedgerService_WatchBalances_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchBalancesRequest, BalanceEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LedgerService_WatchBalancesClient = grpc.ServerStreamingClient[BalanceEvent]
+
 // LedgerServiceServer is the server API for LedgerService service.
 // All implementations must embed UnimplementedLedgerServiceServer
 // for forward compatibility.
 type LedgerServiceServer interface {
 	Spend(context.Context, *SpendRequest) (*SpendResponse, error)
 	Recharge(context.Context, *RechargeRequest) (*RechargeResponse, error)
+	Authorize(context.Context, *AuthorizeRequest) (*HoldResponse, error)
+	Capture(context.Context, *CaptureRequest) (*HoldResponse, error)
+	Void(context.Context, *VoidRequest) (*HoldResponse, error)
+	Transfer(context.Context, *TransferRequest) (*TransferResponse, error)
+	Refund(context.Context, *RefundRequest) (*RefundResponse, error)
+	ListTransactions(context.Context, *ListTransactionsRequest) (*ListTransactionsResponse, error)
+	GetBalanceAt(context.Context, *GetBalanceAtRequest) (*BalanceResponse, error)
+	GetBalance(context.Context, *GetBalanceRequest) (*GetBalanceResponse, error)
+	CreateAccount(context.Context, *CreateAccountRequest) (*CreateAccountResponse, error)
+	DeleteAccount(context.Context, *DeleteAccountRequest) (*DeleteAccountResponse, error)
+	BatchGetBalance(context.Context, *BatchGetBalanceRequest) (*BatchGetBalanceResponse, error)
+	BatchCreateAccount(context.Context, *BatchCreateAccountRequest) (*BatchAccountResponse, error)
+	BatchDeleteAccount(context.Context, *BatchDeleteAccountRequest) (*BatchAccountResponse, error)
+	WatchBalances(*WatchBalancesRequest, grpc.ServerStreamingServer[BalanceEvent]) error
 	mustEmbedUnimplementedLedgerServiceServer()
 }
 
@@ -81,6 +272,48 @@ func (UnimplementedLedgerServiceServer) Spend(context.Context, *SpendRequest) (*
 func (UnimplementedLedgerServiceServer) Recharge(context.Context, *RechargeRequest) (*RechargeResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Recharge not implemented")
 }
+func (UnimplementedLedgerServiceServer) Authorize(context.Context, *AuthorizeRequest) (*HoldResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Authorize not implemented")
+}
+func (UnimplementedLedgerServiceServer) Capture(context.Context, *CaptureRequest) (*HoldResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capture not implemented")
+}
+func (UnimplementedLedgerServiceServer) Void(context.Context, *VoidRequest) (*HoldResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Void not implemented")
+}
+func (UnimplementedLedgerServiceServer) Transfer(context.Context, *TransferRequest) (*TransferResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Transfer not implemented")
+}
+func (UnimplementedLedgerServiceServer) Refund(context.Context, *RefundRequest) (*RefundResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Refund not implemented")
+}
+func (UnimplementedLedgerServiceServer) ListTransactions(context.Context, *ListTransactionsRequest) (*ListTransactionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTransactions not implemented")
+}
+func (UnimplementedLedgerServiceServer) GetBalanceAt(context.Context, *GetBalanceAtRequest) (*BalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBalanceAt not implemented")
+}
+func (UnimplementedLedgerServiceServer) GetBalance(context.Context, *GetBalanceRequest) (*GetBalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBalance not implemented")
+}
+func (UnimplementedLedgerServiceServer) CreateAccount(context.Context, *CreateAccountRequest) (*CreateAccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAccount not implemented")
+}
+func (UnimplementedLedgerServiceServer) DeleteAccount(context.Context, *DeleteAccountRequest) (*DeleteAccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAccount not implemented")
+}
+func (UnimplementedLedgerServiceServer) BatchGetBalance(context.Context, *BatchGetBalanceRequest) (*BatchGetBalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetBalance not implemented")
+}
+func (UnimplementedLedgerServiceServer) BatchCreateAccount(context.Context, *BatchCreateAccountRequest) (*BatchAccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchCreateAccount not implemented")
+}
+func (UnimplementedLedgerServiceServer) BatchDeleteAccount(context.Context, *BatchDeleteAccountRequest) (*BatchAccountResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchDeleteAccount not implemented")
+}
+func (UnimplementedLedgerServiceServer) WatchBalances(*WatchBalancesRequest, grpc.ServerStreamingServer[BalanceEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchBalances not implemented")
+}
 func (UnimplementedLedgerServiceServer) mustEmbedUnimplementedLedgerServiceServer() {}
 func (UnimplementedLedgerServiceServer) testEmbeddedByValue()                       {}
 
@@ -138,6 +371,251 @@ func _LedgerService_Recharge_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LedgerService_Authorize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthorizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).Authorize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_Authorize_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).Authorize(ctx, req.(*AuthorizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_Capture_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CaptureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).Capture(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_Capture_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).Capture(ctx, req.(*CaptureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_Void_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VoidRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).Void(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_Void_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).Void(ctx, req.(*VoidRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_Transfer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).Transfer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_Transfer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).Transfer(ctx, req.(*TransferRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_Refund_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefundRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).Refund(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_Refund_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).Refund(ctx, req.(*RefundRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_ListTransactions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTransactionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).ListTransactions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_ListTransactions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).ListTransactions(ctx, req.(*ListTransactionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_GetBalanceAt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBalanceAtRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).GetBalanceAt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_GetBalanceAt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).GetBalanceAt(ctx, req.(*GetBalanceAtRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_GetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).GetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_GetBalance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).GetBalance(ctx, req.(*GetBalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_CreateAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).CreateAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_CreateAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).CreateAccount(ctx, req.(*CreateAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_DeleteAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).DeleteAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_DeleteAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).DeleteAccount(ctx, req.(*DeleteAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_BatchGetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetBalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).BatchGetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_BatchGetBalance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).BatchGetBalance(ctx, req.(*BatchGetBalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_BatchCreateAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchCreateAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).BatchCreateAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_BatchCreateAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).BatchCreateAccount(ctx, req.(*BatchCreateAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_BatchDeleteAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDeleteAccountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LedgerServiceServer).BatchDeleteAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LedgerService_BatchDeleteAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LedgerServiceServer).BatchDeleteAccount(ctx, req.(*BatchDeleteAccountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LedgerService_WatchBalances_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchBalancesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LedgerServiceServer).WatchBalances(m, &grpc.GenericServerStream[WatchBalancesRequest, BalanceEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LedgerService_WatchBalancesServer = grpc.ServerStreamingServer[BalanceEvent]
+
 // LedgerService_ServiceDesc is the grpc.ServiceDesc for LedgerService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,13 +631,72 @@ var LedgerService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Recharge",
 			Handler:    _LedgerService_Recharge_Handler,
 		},
+		{
+			MethodName: "Authorize",
+			Handler:    _LedgerService_Authorize_Handler,
+		},
+		{
+			MethodName: "Capture",
+			Handler:    _LedgerService_Capture_Handler,
+		},
+		{
+			MethodName: "Void",
+			Handler:    _LedgerService_Void_Handler,
+		},
+		{
+			MethodName: "Transfer",
+			Handler:    _LedgerService_Transfer_Handler,
+		},
+		{
+			MethodName: "Refund",
+			Handler:    _LedgerService_Refund_Handler,
+		},
+		{
+			MethodName: "ListTransactions",
+			Handler:    _LedgerService_ListTransactions_Handler,
+		},
+		{
+			MethodName: "GetBalanceAt",
+			Handler:    _LedgerService_GetBalanceAt_Handler,
+		},
+		{
+			MethodName: "GetBalance",
+			Handler:    _LedgerService_GetBalance_Handler,
+		},
+		{
+			MethodName: "CreateAccount",
+			Handler:    _LedgerService_CreateAccount_Handler,
+		},
+		{
+			MethodName: "DeleteAccount",
+			Handler:    _LedgerService_DeleteAccount_Handler,
+		},
+		{
+			MethodName: "BatchGetBalance",
+			Handler:    _LedgerService_BatchGetBalance_Handler,
+		},
+		{
+			MethodName: "BatchCreateAccount",
+			Handler:    _LedgerService_BatchCreateAccount_Handler,
+		},
+		{
+			MethodName: "BatchDeleteAccount",
+			Handler:    _LedgerService_BatchDeleteAccount_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchBalances",
+			Handler:       _LedgerService_WatchBalances_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "ledger.proto",
 }
 
 const (
-	EventService_Publish_FullMethodName = "/ledger.EventService/Publish"
+	EventService_Publish_FullMethodName      = "/ledger.EventService/Publish"
+	EventService_PublishBatch_FullMethodName = "/ledger.EventService/PublishBatch"
 )
 
 // EventServiceClient is the client API for EventService service.
@@ -167,6 +704,7 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type EventServiceClient interface {
 	Publish(ctx context.Context, in *EventRequest, opts ...grpc.CallOption) (*EventResponse, error)
+	PublishBatch(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[EventRequest, PublishBatchResponse], error)
 }
 
 type eventServiceClient struct {
@@ -187,11 +725,25 @@ func (c *eventServiceClient) Publish(ctx context.Context, in *EventRequest, opts
 	return out, nil
 }
 
+func (c *eventServiceClient) PublishBatch(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[EventRequest, PublishBatchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &EventService_ServiceDesc.Streams[0], EventService_PublishBatch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[EventRequest, PublishBatchResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EventService_PublishBatchClient = grpc.ClientStreamingClient[EventRequest, PublishBatchResponse]
+
 // EventServiceServer is the server API for EventService service.
 // All implementations must embed UnimplementedEventServiceServer
 // for forward compatibility.
 type EventServiceServer interface {
 	Publish(context.Context, *EventRequest) (*EventResponse, error)
+	PublishBatch(grpc.ClientStreamingServer[EventRequest, PublishBatchResponse]) error
 	mustEmbedUnimplementedEventServiceServer()
 }
 
@@ -205,6 +757,9 @@ type UnimplementedEventServiceServer struct{}
 func (UnimplementedEventServiceServer) Publish(context.Context, *EventRequest) (*EventResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
 }
+func (UnimplementedEventServiceServer) PublishBatch(grpc.ClientStreamingServer[EventRequest, PublishBatchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method PublishBatch not implemented")
+}
 func (UnimplementedEventServiceServer) mustEmbedUnimplementedEventServiceServer() {}
 func (UnimplementedEventServiceServer) testEmbeddedByValue()                      {}
 
@@ -244,6 +799,13 @@ func _EventService_Publish_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _EventService_PublishBatch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EventServiceServer).PublishBatch(&grpc.GenericServerStream[EventRequest, PublishBatchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type EventService_PublishBatchServer = grpc.ClientStreamingServer[EventRequest, PublishBatchResponse]
+
 // EventService_ServiceDesc is the grpc.ServiceDesc for EventService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -256,6 +818,12 @@ var EventService_ServiceDesc = grpc.ServiceDesc{
 			Handler:    _EventService_Publish_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PublishBatch",
+			Handler:       _EventService_PublishBatch_Handler,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "ledger.proto",
 }
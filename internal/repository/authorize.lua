@@ -0,0 +1,70 @@
+-- KEYS[1] = Balance key (e.g., "balance:user123:api_tokens")
+-- KEYS[2] = Idempotency key (e.g., "idem:req-uuid-456")
+-- KEYS[3] = Hold key (e.g., "hold:9f86d081884c7d65")
+-- KEYS[4] = Credit limit key (e.g., "credit_limit:user123:api_tokens"), missing means no overdraft
+-- KEYS[5] = Threshold definitions of the account (e.g., "thresholds:user123:api_tokens")
+-- KEYS[6] = Credit lot order (sorted set of grant IDs, lowest score is consumed first)
+-- KEYS[7] = Credit lot remaining amounts (hash of grant ID -> remaining)
+-- ARGV[1] = Amount to reserve
+-- ARGV[2] = Hold ID
+-- ARGV[3] = Expires at (unix seconds)
+-- ARGV[4] = Account ID
+-- ARGV[5] = Resource type
+
+-- 1. Check idempotency. If this request has already been processed, return status 0
+if redis.call("EXISTS", KEYS[2]) == 1 then
+    return {0, "ALREADY_PROCESSED"}
+end
+
+-- 2. Get the current balance
+local current_balance = redis.call("GET", KEYS[1])
+if not current_balance then
+    return {-1, "BALANCE_NOT_FOUND"}
+end
+
+current_balance = tonumber(current_balance)
+local hold_amount = tonumber(ARGV[1])
+local credit_limit = tonumber(redis.call("GET", KEYS[4]) or "0")
+
+-- 3. Check if there are enough tokens to reserve, allowing the balance to go down to -credit_limit
+if current_balance - hold_amount < -credit_limit then
+    return {-2, "INSUFFICIENT_FUNDS"}
+end
+
+-- 4. Reserve funds, consuming credit lots in order as a spend does. The hold keeps what it
+--    took from each lot, with the lot's score, as "grant,amount,score,...", so whatever is
+--    not captured can go back to the lot
+local new_balance = redis.call("DECRBY", KEYS[1], hold_amount)
+local consumed = {}
+local to_consume = hold_amount
+for _, lot_id in ipairs(redis.call("ZRANGE", KEYS[6], 0, -1)) do
+    if to_consume <= 0 then
+        break
+    end
+    local remaining = tonumber(redis.call("HGET", KEYS[7], lot_id) or "0")
+    local take = math.min(remaining, to_consume)
+    if take > 0 then
+        to_consume = to_consume - take
+        table.insert(consumed, lot_id)
+        table.insert(consumed, take)
+        table.insert(consumed, redis.call("ZSCORE", KEYS[6], lot_id))
+    end
+    if remaining - take <= 0 then
+        redis.call("HDEL", KEYS[7], lot_id)
+        redis.call("ZREM", KEYS[6], lot_id)
+    else
+        redis.call("HINCRBY", KEYS[7], lot_id, -take)
+    end
+end
+redis.call("HSET", KEYS[3],
+    "account_id", ARGV[4],
+    "resource_type", ARGV[5],
+    "amount", hold_amount,
+    "expires_at", ARGV[3],
+    "lots", table.concat(consumed, ","))
+
+-- 5. Store the idempotency key for 24 hours (86400 seconds) to prevent duplicates
+redis.call("SET", KEYS[2], "1", "EX", 86400)
+
+-- Return 1 (success), the new balance and whether the account has thresholds
+return {1, new_balance, redis.call("EXISTS", KEYS[5])}
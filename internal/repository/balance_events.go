@@ -0,0 +1,343 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// balanceEventStream is the feed of balance changes behind WatchBalances. Spends and
+	// transfers are added by their scripts in the same step as their outbox entry; holds
+	// once PostgreSQL has them, and the changes PostgreSQL makes first (recharges, refunds,
+	// grants, expiries, account changes) once it has committed them. Entry IDs are the
+	// offsets watchers resume from.
+	balanceEventStream = "events:balances"
+	// balanceEventRetention is about how many events the feed keeps, which bounds how far
+	// back a watcher can resume.
+	balanceEventRetention = 100000
+	// balanceEventBlock is how long one read of the feed waits for new events.
+	balanceEventBlock = 5 * time.Second
+	// balanceEventPage is how many events one read of the feed returns at most.
+	balanceEventPage = 100
+	// balanceFeedBuffer is how many events a watcher may fall behind the shared reader.
+	balanceFeedBuffer = 1024
+)
+
+var streamOffset = regexp.MustCompile(`^\d+-\d+$`)
+
+// olderOffset reports whether feed offset a comes before b. Offsets are "<ms>-<seq>", so
+// they do not compare as strings; an offset that does not parse counts as the oldest.
+func olderOffset(a, b string) bool {
+	parse := func(offset string) (ms, seq uint64) {
+		msPart, seqPart, _ := strings.Cut(offset, "-")
+		ms, _ = strconv.ParseUint(msPart, 10, 64)
+		seq, _ = strconv.ParseUint(seqPart, 10, 64)
+		return ms, seq
+	}
+	aMs, aSeq := parse(a)
+	bMs, bSeq := parse(b)
+	return aMs < bMs || aMs == bMs && aSeq < bSeq
+}
+
+// publishBalanceEvent adds a balance change to the feed. The change itself is already
+// committed, so a failure is only logged.
+func (r *LedgerRepo) publishBalanceEvent(ctx context.Context, e model.BalanceEvent) {
+	err := r.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: balanceEventStream,
+		MaxLen: balanceEventRetention,
+		Approx: true,
+		Values: []interface{}{
+			"type", e.Type,
+			"account_id", e.AccountID,
+			"resource_type", e.ResourceType,
+			"amount", e.Amount,
+			"balance", e.Balance,
+			"idempotency_key", e.IdempotencyKey,
+			"at", time.Now().UnixMilli(),
+		},
+	}).Err()
+	if err != nil {
+		slog.Error("balance event publish failed", "error", err, "type", e.Type, "account_id", e.AccountID)
+	}
+}
+
+// publishCommittedChange adds a change PostgreSQL has committed to the feed, with the
+// balance read back, which warms the cache up again after the change dropped it.
+func (r *LedgerRepo) publishCommittedChange(ctx context.Context, e model.BalanceEvent) {
+	balance, err := r.GetBalance(ctx, e.AccountID, e.ResourceType)
+	if err != nil {
+		slog.Error("balance event: failed to read the new balance", "error", err, "type", e.Type, "account_id", e.AccountID)
+		return
+	}
+	e.Balance = balance
+	r.publishBalanceEvent(ctx, e)
+}
+
+// WatchBalances follows the feed through the shared reader of this LedgerRepo. A watcher
+// resuming from an offset first reads what it missed with XRANGE, which does not block, then
+// goes on with what the shared reader gets; it subscribes first, so nothing added in
+// between is missed, and skips what it already had.
+func (r *LedgerRepo) WatchBalances(ctx context.Context, accountIDs []string, offset string) (<-chan model.BalanceEvent, error) {
+	watched, err := watchedAccounts(accountIDs)
+	if err != nil {
+		return nil, err
+	}
+	if offset != "" && !streamOffset.MatchString(offset) {
+		return nil, apperr.Validation("invalid offset")
+	}
+
+	live, err := r.feed.subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if offset == "" {
+		// Start after the newest event, so that nothing added from now on is missed.
+		if offset, err = newestOffset(ctx, r.rdb); err != nil {
+			r.feed.unsubscribe(live)
+			return nil, err
+		}
+	}
+
+	events := make(chan model.BalanceEvent, 64)
+	go func() {
+		defer close(events)
+		defer r.feed.unsubscribe(live)
+
+		send := func(msg redis.XMessage) bool {
+			if !olderOffset(offset, msg.ID) {
+				return true
+			}
+			offset = msg.ID
+			e, err := balanceEvent(msg)
+			if err != nil {
+				slog.Error("balance watch: skipping malformed event", "offset", msg.ID, "error", err)
+				return true
+			}
+			if !watched.has(e.AccountID) {
+				return true
+			}
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// Catch up to the events added before the subscription.
+		for {
+			missed, err := r.rdb.XRangeN(ctx, balanceEventStream, "("+offset, "+", balanceEventPage).Result()
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("balance watch: failed to read the feed", "error", err)
+				}
+				return
+			}
+			for _, msg := range missed {
+				if !send(msg) {
+					return
+				}
+			}
+			if len(missed) < balanceEventPage {
+				break
+			}
+		}
+
+		for {
+			select {
+			case msg, ok := <-live:
+				if !ok {
+					// The shared reader failed or this watcher fell behind it.
+					return
+				}
+				if !send(msg) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// newestOffset returns the offset of the newest event of the feed, "0-0" when it is empty.
+func newestOffset(ctx context.Context, rdb *redis.Client) (string, error) {
+	newest, err := rdb.XRevRangeN(ctx, balanceEventStream, "+", "-", 1).Result()
+	if err != nil || len(newest) == 0 {
+		return "0-0", err
+	}
+	return newest[0].ID, nil
+}
+
+// balanceFeed is the one reader of the feed that the watchers of a LedgerRepo share, so
+// that they do not each hold a pool connection in a blocking XREAD. It reads while there
+// are watchers and hands every event to each of them. A watcher that lets balanceFeedBuffer
+// events pile up is dropped, as are all of them when the read fails: their channel is
+// closed and they resume from their last offset.
+type balanceFeed struct {
+	rdb *redis.Client
+
+	mu   sync.Mutex
+	subs map[chan redis.XMessage]bool
+	// stop ends the running read, nil when none runs.
+	stop context.CancelFunc
+}
+
+func newBalanceFeed(rdb *redis.Client) *balanceFeed {
+	return &balanceFeed{rdb: rdb, subs: make(map[chan redis.XMessage]bool)}
+}
+
+// subscribe returns a channel of the events added to the feed from now on, starting the
+// read for the first watcher.
+func (f *balanceFeed) subscribe(ctx context.Context) (chan redis.XMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop == nil {
+		// The read starts from the newest event before the subscription returns, so that
+		// events added right after it are read.
+		last, err := newestOffset(ctx, f.rdb)
+		if err != nil {
+			return nil, err
+		}
+		readCtx, stop := context.WithCancel(context.Background())
+		f.stop = stop
+		go f.read(readCtx, last)
+	}
+	ch := make(chan redis.XMessage, balanceFeedBuffer)
+	f.subs[ch] = true
+	return ch, nil
+}
+
+// unsubscribe removes a watcher, stopping the read after the last one.
+func (f *balanceFeed) unsubscribe(ch chan redis.XMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subs[ch] {
+		delete(f.subs, ch)
+		f.stopIfIdle()
+	}
+}
+
+func (f *balanceFeed) read(ctx context.Context, last string) {
+	for ctx.Err() == nil {
+		streams, err := f.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{balanceEventStream, last},
+			Count:   balanceEventPage,
+			Block:   balanceEventBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+
+		f.mu.Lock()
+		if ctx.Err() != nil {
+			// Stopped meanwhile; the watchers are no longer this read's.
+			f.mu.Unlock()
+			return
+		}
+		if err != nil {
+			slog.Error("balance watch: failed to read the feed", "error", err)
+			for ch := range f.subs {
+				delete(f.subs, ch)
+				close(ch)
+			}
+			f.stopIfIdle()
+			f.mu.Unlock()
+			return
+		}
+		msgs := streams[0].Messages
+		last = msgs[len(msgs)-1].ID
+		for ch := range f.subs {
+			if !offer(ch, msgs) {
+				slog.Warn("balance watch: dropping a watcher that fell behind", "offset", last)
+				delete(f.subs, ch)
+				close(ch)
+			}
+		}
+		f.stopIfIdle()
+		f.mu.Unlock()
+	}
+}
+
+// offer hands events to a watcher without waiting for it, reporting false when its buffer
+// is full.
+func offer(ch chan<- redis.XMessage, msgs []redis.XMessage) bool {
+	for _, msg := range msgs {
+		select {
+		case ch <- msg:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// stopIfIdle stops the read when no watcher is left. The caller must hold f.mu.
+func (f *balanceFeed) stopIfIdle() {
+	if len(f.subs) == 0 && f.stop != nil {
+		f.stop()
+		f.stop = nil
+	}
+}
+
+// balanceEvent reads a feed entry.
+func balanceEvent(msg redis.XMessage) (model.BalanceEvent, error) {
+	field := func(name string) string {
+		v, _ := msg.Values[name].(string)
+		return v
+	}
+	e := model.BalanceEvent{
+		Offset:         msg.ID,
+		Type:           field("type"),
+		AccountID:      field("account_id"),
+		ResourceType:   field("resource_type"),
+		IdempotencyKey: field("idempotency_key"),
+	}
+	var err error
+	if e.Amount, err = strconv.ParseInt(field("amount"), 10, 64); err != nil {
+		return e, fmt.Errorf("amount: %w", err)
+	}
+	if e.Balance, err = strconv.ParseInt(field("balance"), 10, 64); err != nil {
+		return e, fmt.Errorf("balance: %w", err)
+	}
+	at, err := strconv.ParseInt(field("at"), 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("at: %w", err)
+	}
+	e.At = time.UnixMilli(at)
+	return e, nil
+}
+
+// accountSet is the accounts of a watch; an empty set watches every account.
+type accountSet map[string]bool
+
+func (s accountSet) has(accountID string) bool {
+	return len(s) == 0 || s[accountID]
+}
+
+// watchedAccounts checks the accounts of a watch and returns them as a set.
+func watchedAccounts(accountIDs []string) (accountSet, error) {
+	watched := make(accountSet, len(accountIDs))
+	for _, id := range accountIDs {
+		if id == "" {
+			return nil, apperr.Validation("account_id must not be empty")
+		}
+		watched[id] = true
+	}
+	return watched, nil
+}
@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SyncTransactions persists a batch of spend events in one PostgreSQL transaction: a
+// multi-row insert of the transactions, then one balance update per account with the
+// summed amounts of the events that were new. It is the batched SyncTransactionWithBalance.
+func (r *LedgerRepo) SyncTransactions(ctx context.Context, events []model.SpendEvent) (*model.BatchStats, error) {
+	started := time.Now()
+	stats := &model.BatchStats{Events: len(events)}
+
+	// An event delivered twice within a batch is only inserted once.
+	seen := make(map[string]bool, len(events))
+	batch := make([]model.SpendEvent, 0, len(events))
+	for _, e := range events {
+		if !seen[e.IdempotencyKey] {
+			seen[e.IdempotencyKey] = true
+			batch = append(batch, e)
+		}
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	n := len(batch)
+	accounts, resources, keys := make([]string, n), make([]string, n), make([]string, n)
+	amounts, createdAt := make([]int64, n), make([]time.Time, n)
+	for i, e := range batch {
+		accounts[i], resources[i], keys[i] = e.AccountID, e.ResourceType, e.IdempotencyKey
+		amounts[i], createdAt[i] = e.Amount, e.CreatedAt
+	}
+
+	queryInsert := `
+        INSERT INTO transactions (account_id, resource_type, amount, idempotency_key, created_at)
+        SELECT * FROM unnest($1::TEXT[], $2::TEXT[], $3::BIGINT[], $4::TEXT[], $5::TIMESTAMPTZ[])
+        ON CONFLICT (idempotency_key) DO NOTHING
+        RETURNING idempotency_key`
+
+	rows, err := tx.Query(ctx, queryInsert, accounts, resources, amounts, keys, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("db insert transactions: %w", err)
+	}
+	inserted := make(map[string]bool, n)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		inserted[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only the events that were new move balances, journal and lots.
+	fresh := make([]model.SpendEvent, 0, len(inserted))
+	for _, e := range batch {
+		if inserted[e.IdempotencyKey] {
+			fresh = append(fresh, e)
+		}
+	}
+	stats.Inserted = len(fresh)
+	stats.Duplicates = stats.Events - stats.Inserted
+
+	if len(fresh) > 0 {
+		if stats.Accounts, err = applyBalanceDeltas(ctx, tx, fresh); err != nil {
+			return nil, err
+		}
+		if err := writeSpendJournal(ctx, tx, fresh); err != nil {
+			return nil, err
+		}
+		if err := applyLotUsage(ctx, tx, fresh); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	r.confirmSynced(ctx, events)
+	stats.Duration = time.Since(started)
+	return stats, nil
+}
+
+// balanceDelta is the summed amount a batch spends from one account.
+type balanceDelta struct {
+	accountID, resourceType string
+	amount                  int64
+}
+
+// applyBalanceDeltas updates every account once and returns how many accounts it touched.
+// Rows are locked in a fixed order so concurrent batches can not deadlock on each other.
+func applyBalanceDeltas(ctx context.Context, tx pgx.Tx, events []model.SpendEvent) (int, error) {
+	byAccount := make(map[[2]string]int64)
+	for _, e := range events {
+		byAccount[[2]string{e.AccountID, e.ResourceType}] += e.Amount
+	}
+	deltas := make([]balanceDelta, 0, len(byAccount))
+	for k, amount := range byAccount {
+		deltas = append(deltas, balanceDelta{accountID: k[0], resourceType: k[1], amount: amount})
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		if deltas[i].accountID != deltas[j].accountID {
+			return deltas[i].accountID < deltas[j].accountID
+		}
+		return deltas[i].resourceType < deltas[j].resourceType
+	})
+
+	accounts, resources, amounts := make([]string, len(deltas)), make([]string, len(deltas)), make([]int64, len(deltas))
+	for i, d := range deltas {
+		accounts[i], resources[i], amounts[i] = d.accountID, d.resourceType, d.amount
+	}
+
+	queryLock := `
+        SELECT 1 FROM balances b
+        JOIN unnest($1::TEXT[], $2::TEXT[]) AS d(account_id, resource_type)
+          ON b.account_id = d.account_id AND b.resource_type = d.resource_type
+        ORDER BY b.account_id, b.resource_type
+        FOR UPDATE OF b`
+	if _, err := tx.Exec(ctx, queryLock, accounts, resources); err != nil {
+		return 0, fmt.Errorf("db lock balances: %w", err)
+	}
+
+	queryUpdate := `
+        UPDATE balances b
+        SET amount = b.amount - d.amount
+        FROM unnest($1::TEXT[], $2::TEXT[], $3::BIGINT[]) AS d(account_id, resource_type, amount)
+        WHERE b.account_id = d.account_id AND b.resource_type = d.resource_type`
+	if _, err := tx.Exec(ctx, queryUpdate, accounts, resources, amounts); err != nil {
+		return 0, fmt.Errorf("db update balances: %w", err)
+	}
+
+	return len(deltas), nil
+}
+
+// writeSpendJournal records one spend entry per event, each with a leg for the account
+// and one for system:revenue, like writeJournal does for a single spend. Snapshots taken
+// after an event was made are brought up to date with its legs, as writeJournal does.
+func writeSpendJournal(ctx context.Context, tx pgx.Tx, events []model.SpendEvent) error {
+	n := len(events)
+	keys, accounts, resources := make([]string, n), make([]string, n), make([]string, n)
+	amounts, createdAt := make([]int64, n), make([]time.Time, n)
+	for i, e := range events {
+		keys[i], accounts[i], resources[i] = "spend:"+e.IdempotencyKey, e.AccountID, e.ResourceType
+		amounts[i], createdAt[i] = e.Amount, e.CreatedAt
+	}
+
+	query := `
+        WITH spends AS (
+            SELECT * FROM unnest($1::TEXT[], $2::TEXT[], $3::TEXT[], $4::BIGINT[], $5::TIMESTAMPTZ[])
+                AS s(idempotency_key, account_id, resource_type, amount, created_at)
+        ), entries AS (
+            INSERT INTO journal_entries (entry_type, idempotency_key, created_at)
+            SELECT 'spend', idempotency_key, created_at FROM spends
+            RETURNING id, idempotency_key
+        )
+        INSERT INTO journal_legs (entry_id, account_id, resource_type, amount, created_at)
+        SELECT e.id, s.account_id, s.resource_type, -s.amount, s.created_at
+        FROM entries e JOIN spends s USING (idempotency_key)
+        UNION ALL
+        SELECT e.id, $6, s.resource_type, s.amount, s.created_at
+        FROM entries e JOIN spends s USING (idempotency_key)`
+
+	if _, err := tx.Exec(ctx, query, keys, accounts, resources, amounts, createdAt, model.SystemRevenue); err != nil {
+		return fmt.Errorf("db insert journal entries: %w", err)
+	}
+
+	// The legs are summed per snapshot first: an UPDATE ... FROM applies only one of
+	// several rows joining the same snapshot.
+	querySnapshots := `
+        WITH legs AS (
+            SELECT account_id, resource_type, -amount AS amount, created_at
+            FROM unnest($1::TEXT[], $2::TEXT[], $3::BIGINT[], $4::TIMESTAMPTZ[])
+                AS s(account_id, resource_type, amount, created_at)
+            UNION ALL
+            SELECT $5::TEXT, resource_type, amount, created_at
+            FROM unnest($2::TEXT[], $3::BIGINT[], $4::TIMESTAMPTZ[])
+                AS s(resource_type, amount, created_at)
+        ), deltas AS (
+            SELECT b.account_id, b.resource_type, b.snapshot_at, SUM(l.amount) AS amount
+            FROM balance_snapshots b
+            JOIN legs l ON b.account_id = l.account_id AND b.resource_type = l.resource_type
+                AND b.snapshot_at > l.created_at
+            GROUP BY b.account_id, b.resource_type, b.snapshot_at
+        )
+        UPDATE balance_snapshots b SET amount = b.amount + d.amount
+        FROM deltas d
+        WHERE b.account_id = d.account_id AND b.resource_type = d.resource_type
+          AND b.snapshot_at = d.snapshot_at`
+
+	if _, err := tx.Exec(ctx, querySnapshots, accounts, resources, amounts, createdAt, model.SystemRevenue); err != nil {
+		return fmt.Errorf("db update snapshots: %w", err)
+	}
+	return nil
+}
+
+// applyLotUsage takes what the events consumed from each credit grant off its remaining amount.
+func applyLotUsage(ctx context.Context, tx pgx.Tx, events []model.SpendEvent) error {
+	byGrant := make(map[string]int64)
+	for _, e := range events {
+		for _, lot := range e.Lots {
+			byGrant[lot.GrantID] += lot.Amount
+		}
+	}
+	if len(byGrant) == 0 {
+		return nil
+	}
+
+	grants := make([]string, 0, len(byGrant))
+	for id := range byGrant {
+		grants = append(grants, id)
+	}
+	sort.Strings(grants)
+	amounts := make([]int64, len(grants))
+	for i, id := range grants {
+		amounts[i] = byGrant[id]
+	}
+
+	// A lot may have been expired by the sweeper before this event arrived, so never go below zero.
+	query := `
+        UPDATE credit_grants g
+        SET remaining = GREATEST(g.remaining - d.amount, 0), updated_at = NOW()
+        FROM unnest($1::TEXT[], $2::BIGINT[]) AS d(id, amount)
+        WHERE g.id = d.id::UUID`
+	if _, err := tx.Exec(ctx, query, grants, amounts); err != nil {
+		return fmt.Errorf("db update credit grants: %w", err)
+	}
+	return nil
+}
+
+// confirmSynced removes synced events from the pending set and the outbox in one round trip.
+func (r *LedgerRepo) confirmSynced(ctx context.Context, events []model.SpendEvent) {
+	pipe := r.rdb.Pipeline()
+	for _, e := range events {
+		pipe.ZRem(ctx, pendingKey(e.AccountID, e.ResourceType), pendingMember(e.IdempotencyKey, e.Amount))
+		if e.OutboxID != "" {
+			pipe.XAck(ctx, outboxStream, outboxGroup, e.OutboxID)
+			pipe.XDel(ctx, outboxStream, e.OutboxID)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("failed to confirm synced batch", "events", len(events), "error", err)
+	}
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"quantlo/internal/apperr"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func creditLimitKey(accountID, resourceType string) string {
+	return fmt.Sprintf("credit_limit:%s:%s", accountID, resourceType)
+}
+
+// SetCreditLimit sets how far below zero an account's balance may go.
+// Lowering the limit never changes the balance; it only blocks further spends.
+func (r *LedgerRepo) SetCreditLimit(ctx context.Context, accountID, resourceType string, limit int64) error {
+	if limit < 0 {
+		return apperr.Validation("credit limit must not be negative")
+	}
+
+	query := `
+        UPDATE balances
+        SET credit_limit = $1, updated_at = NOW()
+        WHERE account_id = $2 AND resource_type = $3 AND deleted_at IS NULL`
+
+	res, err := r.db.Exec(ctx, query, limit, accountID, resourceType)
+	if err != nil {
+		return fmt.Errorf("db set credit limit: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFoundInDB
+	}
+
+	return r.rdb.Set(ctx, creditLimitKey(accountID, resourceType), limit, 0).Err()
+}
+
+func (r *LedgerRepo) GetCreditLimit(ctx context.Context, accountID, resourceType string) (int64, error) {
+	var limit int64
+	query := `SELECT credit_limit FROM balances WHERE account_id = $1 AND resource_type = $2 AND deleted_at IS NULL`
+
+	if err := r.db.QueryRow(ctx, query, accountID, resourceType).Scan(&limit); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNotFoundInDB
+		}
+		return 0, err
+	}
+	return limit, nil
+}
@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrDeadLetterNotFound = apperr.New(apperr.CodeNotFound, "dead letter not found or no longer parked")
+
+// deadLetterReplayLease is how long a dead letter stays claimed by a replay. One still
+// marked replaying after it, left by a replay that crashed before publishing, can be
+// replayed again.
+const deadLetterReplayLease = time.Minute
+
+// ParkDeadLetter stores an event the worker gave up on. The event's outbox entry is
+// confirmed, since the dead-letter table now holds it and the relay must stop resending it.
+func (r *LedgerRepo) ParkDeadLetter(ctx context.Context, dl model.DeadLetter) error {
+	// Malformed payloads are parked too; they just have no key to deduplicate on.
+	var event struct {
+		IdempotencyKey string `json:"idempotency_key"`
+		OutboxID       string `json:"outbox_id"`
+	}
+	_ = json.Unmarshal([]byte(dl.Payload), &event)
+
+	var eventKey *string
+	if event.IdempotencyKey != "" {
+		eventKey = &event.IdempotencyKey
+	}
+
+	query := `
+        INSERT INTO dead_letters (topic, event_key, payload, error, attempts, status, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, 'parked', NOW(), NOW())
+        ON CONFLICT (topic, event_key) WHERE status = 'parked'
+        DO UPDATE SET error = EXCLUDED.error, attempts = dead_letters.attempts + EXCLUDED.attempts, updated_at = NOW()`
+
+	if _, err := r.db.Exec(ctx, query, dl.Topic, eventKey, dl.Payload, dl.Error, dl.Attempts); err != nil {
+		return fmt.Errorf("db park dead letter: %w", err)
+	}
+
+	r.confirmOutbox(ctx, event.OutboxID)
+	return nil
+}
+
+// ListDeadLetters returns dead letters with the given status (parked by default), newest first.
+func (r *LedgerRepo) ListDeadLetters(ctx context.Context, status string, limit int) ([]model.DeadLetter, error) {
+	if status == "" {
+		status = model.DeadLetterParked
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	query := `
+        SELECT id, topic, COALESCE(event_key, ''), payload, error, attempts, status, created_at, updated_at
+        FROM dead_letters
+        WHERE status = $1
+        ORDER BY created_at DESC
+        LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []model.DeadLetter{}
+	for rows.Next() {
+		var dl model.DeadLetter
+		if err := rows.Scan(&dl.ID, &dl.Topic, &dl.EventKey, &dl.Payload, &dl.Error, &dl.Attempts, &dl.Status, &dl.CreatedAt, &dl.UpdatedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, dl)
+	}
+	return letters, rows.Err()
+}
+
+func (r *LedgerRepo) GetDeadLetter(ctx context.Context, id string) (*model.DeadLetter, error) {
+	query := `
+        SELECT id, topic, COALESCE(event_key, ''), payload, error, attempts, status, created_at, updated_at
+        FROM dead_letters
+        WHERE id = $1`
+
+	var dl model.DeadLetter
+	err := r.db.QueryRow(ctx, query, id).
+		Scan(&dl.ID, &dl.Topic, &dl.EventKey, &dl.Payload, &dl.Error, &dl.Attempts, &dl.Status, &dl.CreatedAt, &dl.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrDeadLetterNotFound
+		}
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// ReplayDeadLetter publishes a parked event to the bus again, for after the cause was fixed.
+// If it fails again the worker parks it as a new dead letter.
+func (r *LedgerRepo) ReplayDeadLetter(ctx context.Context, id string) error {
+	// The row is claimed in a transaction of its own, so that no lock is held while
+	// publishing and concurrent replays of the same row publish it only once.
+	var topic, payload string
+	queryClaim := `
+        UPDATE dead_letters SET status = 'replaying', updated_at = NOW()
+        WHERE id = $1 AND (status = 'parked' OR (status = 'replaying' AND updated_at < $2))
+        RETURNING topic, payload`
+	if err := r.db.QueryRow(ctx, queryClaim, id, time.Now().Add(-deadLetterReplayLease)).Scan(&topic, &payload); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrDeadLetterNotFound
+		}
+		return err
+	}
+
+	if err := r.bus.Publish(topic, []byte(payload)); err != nil {
+		queryRelease := `UPDATE dead_letters SET status = 'parked', updated_at = NOW() WHERE id = $1 AND status = 'replaying'`
+		if _, relErr := r.db.Exec(ctx, queryRelease, id); relErr != nil {
+			slog.Error("failed to park dead letter again", "id", id, "error", relErr)
+		}
+		return fmt.Errorf("replay dead letter: %w", err)
+	}
+
+	// The event is on the bus; a row left replaying is only replayed again after the lease.
+	queryDone := `UPDATE dead_letters SET status = 'replayed', updated_at = NOW() WHERE id = $1 AND status = 'replaying'`
+	if _, err := r.db.Exec(ctx, queryDone, id); err != nil {
+		slog.Error("failed to mark dead letter replayed", "id", id, "error", err)
+	}
+	return nil
+}
+
+// DiscardDeadLetter gives up on a parked event for good. The row is kept for the record.
+func (r *LedgerRepo) DiscardDeadLetter(ctx context.Context, id string) error {
+	query := `UPDATE dead_letters SET status = 'discarded', updated_at = NOW() WHERE id = $1 AND status = 'parked'`
+
+	res, err := r.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
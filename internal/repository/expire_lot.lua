@@ -0,0 +1,23 @@
+-- KEYS[1] = Balance key (e.g., "balance:user123:api_tokens")
+-- KEYS[2] = Credit lot order (sorted set of grant IDs)
+-- KEYS[3] = Credit lot remaining amounts (hash of grant ID -> remaining)
+-- ARGV[1] = Grant ID
+-- ARGV[2] = Remaining amount according to PostgreSQL, used when the lot is not cached
+
+-- 1. Prefer the cached remaining amount: it already reflects spends not yet synced.
+--    The lot is taken out of the order so no spend draws from it any more; the balance
+--    itself is left alone until PostgreSQL has expired the lot
+local remaining = tonumber(redis.call("HGET", KEYS[3], ARGV[1]) or ARGV[2])
+redis.call("HDEL", KEYS[3], ARGV[1])
+local score = redis.call("ZSCORE", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+
+-- 2. Balance not cached; PostgreSQL alone decides how much expires
+local balance = redis.call("GET", KEYS[1])
+if not balance then
+    return {2, remaining}
+end
+
+-- Return 1 (cached), the remaining amount, the cached balance and, when the lot was
+-- cached, its score so it can be put back if PostgreSQL fails
+return {1, remaining, tonumber(balance), score}
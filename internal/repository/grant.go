@@ -0,0 +1,442 @@
+package repository
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed expire_lot.lua
+var expireLotLuaScript string
+
+//go:embed grant_lot.lua
+var grantLotLuaScript string
+
+// noExpiryScore orders lots without an expiry after every lot that has one.
+const noExpiryScore = 9_999_999_999
+
+// maxLotPriority bounds lot priorities so that lotScore stays an integer a float64 holds
+// exactly (below 2^53), which is what Redis keeps sorted set scores as.
+const maxLotPriority = 100_000
+
+// lotsCachedField is a placeholder field of the lot remaining hash. It keeps the hash in
+// Redis once every lot is used up, so an empty hash still means the lots are cached.
+const lotsCachedField = "cached"
+
+// lotKeys returns the sorted set that orders an account's credit lots and
+// the hash that holds their remaining amounts.
+func lotKeys(accountID, resourceType string) (string, string) {
+	return fmt.Sprintf("lots:%s:%s", accountID, resourceType),
+		fmt.Sprintf("lots_remaining:%s:%s", accountID, resourceType)
+}
+
+// lotScore orders lots by priority (highest first), then by expiry (soonest first).
+func lotScore(priority int, expiresAt *time.Time) float64 {
+	expiry := int64(noExpiryScore)
+	if expiresAt != nil {
+		expiry = expiresAt.Unix()
+	}
+	return float64(-int64(priority)*(noExpiryScore+1) + expiry)
+}
+
+// validateGrant checks a new grant.
+func validateGrant(req model.GrantRequest) error {
+	if req.Amount <= 0 {
+		return apperr.Validation("grant amount must be positive")
+	}
+	if req.Priority < -maxLotPriority || req.Priority > maxLotPriority {
+		return apperr.Validation(fmt.Sprintf("grant priority must be between %d and %d", -maxLotPriority, maxLotPriority))
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return apperr.Validation("grant must expire in the future")
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Unix() >= noExpiryScore {
+		return apperr.Validation("grant expires too far in the future")
+	}
+	return nil
+}
+
+// GrantCredits adds an expiring or prioritised lot of credits to an account.
+func (r *LedgerRepo) GrantCredits(ctx context.Context, req model.GrantRequest) (*model.CreditGrant, error) {
+	if err := validateGrant(req); err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	done, err := claimIdempotencyKey(ctx, tx, req.IdempotencyKey, opGrantCredits, grantFingerprint(req))
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		return r.grantByKey(ctx, tx, req.IdempotencyKey)
+	}
+
+	queryBalance := `
+        UPDATE balances
+        SET amount = amount + $1, updated_at = NOW()
+        WHERE account_id = $2 AND resource_type = $3 AND deleted_at IS NULL`
+
+	res, err := tx.Exec(ctx, queryBalance, req.Amount, req.AccountID, req.ResourceType)
+	if err != nil {
+		return nil, fmt.Errorf("db grant credits: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return nil, ErrNotFoundInDB
+	}
+
+	grant := &model.CreditGrant{
+		AccountID:    req.AccountID,
+		ResourceType: req.ResourceType,
+		Amount:       req.Amount,
+		Remaining:    req.Amount,
+		Priority:     req.Priority,
+		ExpiresAt:    req.ExpiresAt,
+	}
+
+	queryInsert := `
+        INSERT INTO credit_grants (account_id, resource_type, amount, remaining, priority, expires_at, idempotency_key, created_at, updated_at)
+        VALUES ($1, $2, $3, $3, $4, $5, NULLIF($6, ''), NOW(), NOW())
+        RETURNING id, created_at`
+
+	err = tx.QueryRow(ctx, queryInsert,
+		req.AccountID, req.ResourceType, req.Amount, req.Priority, req.ExpiresAt, req.IdempotencyKey,
+	).Scan(&grant.ID, &grant.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("db insert grant: %w", err)
+	}
+
+	err = writeJournal(ctx, tx, model.JournalEntry{
+		Type:           model.EntryRecharge,
+		IdempotencyKey: "grant:" + grant.ID,
+		Reference:      grant.ID,
+		Metadata:       map[string]string{"source": "credit_grant"},
+		Legs:           legs(req.AccountID, model.SystemFunding, req.ResourceType, req.Amount),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	// Register the lot and drop the cached balance so it is reloaded with the grant included.
+	lotOrderKey, lotRemainingKey := lotKeys(req.AccountID, req.ResourceType)
+	err = r.rdb.Eval(ctx, grantLotLuaScript,
+		[]string{fmt.Sprintf("balance:%s:%s", req.AccountID, req.ResourceType), lotOrderKey, lotRemainingKey},
+		grant.ID, grant.Amount, lotScore(grant.Priority, grant.ExpiresAt),
+	).Err()
+	if err != nil {
+		return nil, err
+	}
+	r.publishCommittedChange(ctx, model.BalanceEvent{
+		Type:           model.BalanceGrant,
+		AccountID:      req.AccountID,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
+	})
+
+	return grant, nil
+}
+
+// grantFingerprint identifies a grant request; the expiry is compared to the second.
+func grantFingerprint(req model.GrantRequest) string {
+	var expiry int64
+	if req.ExpiresAt != nil {
+		expiry = req.ExpiresAt.Unix()
+	}
+	return fingerprint(opGrantCredits, req.AccountID, req.ResourceType, req.Amount, req.Priority, expiry)
+}
+
+// grantByKey returns the grant made earlier with an idempotency key, as it was made.
+func (r *LedgerRepo) grantByKey(ctx context.Context, tx pgx.Tx, key string) (*model.CreditGrant, error) {
+	grant := &model.CreditGrant{}
+	query := `
+        SELECT id, account_id, resource_type, amount, amount, priority, expires_at, created_at
+        FROM credit_grants WHERE idempotency_key = $1`
+	err := tx.QueryRow(ctx, query, key).Scan(&grant.ID, &grant.AccountID, &grant.ResourceType, &grant.Amount,
+		&grant.Remaining, &grant.Priority, &grant.ExpiresAt, &grant.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("db read grant %s: %w", key, err)
+	}
+	return grant, tx.Commit(ctx)
+}
+
+// GetBalanceBreakdown returns the balance together with the active credit lots
+// it is made of. Remaining amounts come from Redis when the lots are cached.
+func (r *LedgerRepo) GetBalanceBreakdown(ctx context.Context, accountID, resourceType string) (*model.BalanceBreakdown, error) {
+	balance, err := r.GetBalance(ctx, accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+        SELECT id, amount, remaining, priority, expires_at, created_at
+        FROM credit_grants
+        WHERE account_id = $1 AND resource_type = $2 AND status = 'active'`
+
+	rows, err := r.db.Query(ctx, query, accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	_, lotRemainingKey := lotKeys(accountID, resourceType)
+	cached, err := r.rdb.HGetAll(ctx, lotRemainingKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	_, lotsCached := cached[lotsCachedField]
+
+	breakdown := &model.BalanceBreakdown{Balance: balance, Lots: []model.CreditGrant{}}
+	var allocated int64
+	for rows.Next() {
+		lot := model.CreditGrant{AccountID: accountID, ResourceType: resourceType}
+		if err := rows.Scan(&lot.ID, &lot.Amount, &lot.Remaining, &lot.Priority, &lot.ExpiresAt, &lot.CreatedAt); err != nil {
+			return nil, err
+		}
+		if lotsCached {
+			// Lots missing from the cache were fully consumed.
+			lot.Remaining, _ = strconv.ParseInt(cached[lot.ID], 10, 64)
+		}
+		if lot.Remaining == 0 {
+			continue
+		}
+		allocated += lot.Remaining
+		breakdown.Lots = append(breakdown.Lots, lot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortLots(breakdown.Lots)
+	breakdown.Unallocated = balance - allocated
+	return breakdown, nil
+}
+
+// ExpireGrants removes every active lot that expired before the given time from the
+// balance and emits a credits.expired event for each. It returns the number of lots expired.
+func (r *LedgerRepo) ExpireGrants(ctx context.Context, before time.Time) (int, error) {
+	query := `
+        SELECT id, account_id, resource_type, remaining
+        FROM credit_grants
+        WHERE status = 'active' AND expires_at <= $1
+        ORDER BY expires_at
+        LIMIT 500`
+
+	rows, err := r.db.Query(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	var due []model.CreditExpiredEvent
+	for rows.Next() {
+		var e model.CreditExpiredEvent
+		if err := rows.Scan(&e.GrantID, &e.AccountID, &e.ResourceType, &e.Amount); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, e := range due {
+		amount, ok, err := r.expireLot(ctx, e)
+		if err != nil {
+			return expired, err
+		}
+		if !ok {
+			continue
+		}
+
+		e.Amount = amount
+		e.ExpiredAt = time.Now()
+		r.publishExpiredEvent(e)
+		r.publishCommittedChange(ctx, model.BalanceEvent{
+			Type:         model.BalanceGrantExpired,
+			AccountID:    e.AccountID,
+			ResourceType: e.ResourceType,
+			Amount:       amount,
+		})
+		expired++
+	}
+
+	return expired, nil
+}
+
+// expireLot expires a lot in PostgreSQL first. The lot is taken out of the cached order
+// beforehand so no spend draws from it meanwhile, and put back if PostgreSQL fails; the
+// cached balance is only dropped once the expiry is committed, as after a recharge.
+func (r *LedgerRepo) expireLot(ctx context.Context, e model.CreditExpiredEvent) (int64, bool, error) {
+	balanceKey := fmt.Sprintf("balance:%s:%s", e.AccountID, e.ResourceType)
+	lotOrderKey, lotRemainingKey := lotKeys(e.AccountID, e.ResourceType)
+
+	result, err := r.rdb.Eval(ctx, expireLotLuaScript,
+		[]string{balanceKey, lotOrderKey, lotRemainingKey}, e.GrantID, e.Amount,
+	).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	resArray := result.([]interface{})
+	remaining := resArray[1].(int64)
+	var cachedBalance *int64
+	if resArray[0].(int64) == 1 {
+		balance := resArray[2].(int64)
+		cachedBalance = &balance
+	}
+
+	expired, ok, err := r.expireLotInDB(ctx, e, remaining, cachedBalance)
+	if err != nil {
+		if cachedBalance != nil && resArray[3] != nil {
+			score, _ := strconv.ParseFloat(resArray[3].(string), 64)
+			pipe := r.rdb.TxPipeline()
+			pipe.HSet(ctx, lotRemainingKey, e.GrantID, remaining)
+			pipe.ZAdd(ctx, lotOrderKey, redis.Z{Score: score, Member: e.GrantID})
+			if _, rerr := pipe.Exec(ctx); rerr != nil {
+				slog.Error("expire grant: failed to restore the cached lot", "error", rerr, "grant_id", e.GrantID)
+			}
+		}
+		return 0, false, err
+	}
+	if !ok {
+		return 0, false, nil
+	}
+
+	if err := r.rdb.Del(ctx, balanceKey).Err(); err != nil {
+		return expired, true, err
+	}
+	return expired, true, nil
+}
+
+// expireLotInDB marks the lot expired and takes what is left of it off the balance. It
+// reports false when the lot was no longer active.
+func (r *LedgerRepo) expireLotInDB(ctx context.Context, e model.CreditExpiredEvent, remaining int64, cachedBalance *int64) (int64, bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	queryGrant := `UPDATE credit_grants SET status = 'expired', remaining = 0, updated_at = NOW() WHERE id = $1 AND status = 'active'`
+	res, err := tx.Exec(ctx, queryGrant, e.GrantID)
+	if err != nil {
+		return 0, false, fmt.Errorf("db expire grant: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		// Another sweep expired it first.
+		return 0, false, nil
+	}
+
+	// Never expire more than is left on the balance (a refill_to takes credits away without
+	// drawing from lots). The cached balance already accounts for holds and spends not
+	// synced yet; otherwise PostgreSQL is the only reference.
+	var expired int64
+	if cachedBalance != nil {
+		expired = min(remaining, max(*cachedBalance, 0))
+	} else if err := tx.QueryRow(ctx,
+		`SELECT LEAST($1, GREATEST(amount, 0)) FROM balances WHERE account_id = $2 AND resource_type = $3 FOR UPDATE`,
+		remaining, e.AccountID, e.ResourceType,
+	).Scan(&expired); err != nil {
+		return 0, false, fmt.Errorf("db expire grant balance: %w", err)
+	}
+	queryBalance := `UPDATE balances SET amount = amount - $1, updated_at = NOW() WHERE account_id = $2 AND resource_type = $3`
+	if _, err := tx.Exec(ctx, queryBalance, expired, e.AccountID, e.ResourceType); err != nil {
+		return 0, false, fmt.Errorf("db expire grant balance: %w", err)
+	}
+
+	if expired > 0 {
+		err = writeJournal(ctx, tx, model.JournalEntry{
+			Type:           model.EntryAdjustment,
+			IdempotencyKey: "expire:" + e.GrantID,
+			Reference:      e.GrantID,
+			Metadata:       map[string]string{"reason": "credit_grant_expired"},
+			Legs:           legs(e.AccountID, model.SystemExpired, e.ResourceType, -expired),
+		})
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, false, err
+	}
+	return expired, true, nil
+}
+
+// warmUpLots loads active credit lots into Redis unless they are already cached;
+// the cached remaining amounts are ahead of PostgreSQL and must not be overwritten.
+func (r *LedgerRepo) warmUpLots(ctx context.Context, accountID, resourceType string) error {
+	lotOrderKey, lotRemainingKey := lotKeys(accountID, resourceType)
+
+	exists, err := r.rdb.Exists(ctx, lotRemainingKey).Result()
+	if err != nil || exists == 1 {
+		return err
+	}
+
+	query := `
+        SELECT id, remaining, priority, expires_at
+        FROM credit_grants
+        WHERE account_id = $1 AND resource_type = $2 AND status = 'active' AND remaining > 0`
+
+	rows, err := r.db.Query(ctx, query, accountID, resourceType)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pipe := r.rdb.TxPipeline()
+	pipe.HSet(ctx, lotRemainingKey, lotsCachedField, 1)
+	for rows.Next() {
+		var id string
+		var remaining int64
+		var priority int
+		var expiresAt *time.Time
+		if err := rows.Scan(&id, &remaining, &priority, &expiresAt); err != nil {
+			return err
+		}
+		pipe.HSet(ctx, lotRemainingKey, id, remaining)
+		pipe.ZAdd(ctx, lotOrderKey, redis.Z{Score: lotScore(priority, expiresAt), Member: id})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *LedgerRepo) publishExpiredEvent(e model.CreditExpiredEvent) {
+	data, _ := json.Marshal(e)
+
+	if err := r.bus.Publish("credits.expired", data); err != nil {
+		slog.Error("event publish failed", "error", err, "topic", "credits.expired")
+	}
+}
+
+func sortLots(lots []model.CreditGrant) {
+	sort.Slice(lots, func(i, j int) bool {
+		return lotScore(lots[i].Priority, lots[i].ExpiresAt) < lotScore(lots[j].Priority, lots[j].ExpiresAt)
+	})
+}
@@ -0,0 +1,20 @@
+-- KEYS[1] = Balance key (e.g., "balance:user123:api_tokens")
+-- KEYS[2] = Credit lot order (sorted set of grant IDs)
+-- KEYS[3] = Credit lot remaining amounts (hash of grant ID -> remaining)
+-- ARGV[1] = Grant ID
+-- ARGV[2] = Amount of the grant
+-- ARGV[3] = Score of the lot in the order
+
+-- 1. Only add the lot to lots that are cached; otherwise the older lots would never be
+--    loaded, so the lot keys are dropped and rebuilt from PostgreSQL with the rest
+if redis.call("EXISTS", KEYS[3]) == 1 then
+    redis.call("HSET", KEYS[3], ARGV[1], ARGV[2])
+    redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+else
+    redis.call("DEL", KEYS[2], KEYS[3])
+end
+
+-- 2. Drop the cached balance so it is reloaded with the grant included
+redis.call("DEL", KEYS[1])
+
+return 1
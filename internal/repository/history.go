@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+var ErrInvalidCursor = apperr.New(apperr.CodeValidationFailed, "invalid pagination cursor")
+
+// ListTransactions returns an account's transactions, newest first, one page at a time.
+// Pages are keyed on (created_at, id) so rows inserted meanwhile never shift a page.
+func (r *LedgerRepo) ListTransactions(ctx context.Context, f model.TransactionFilter) (*model.TransactionPage, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	conds := []string{"account_id = $1"}
+	args := []any{f.AccountID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.ResourceType != "" {
+		conds = append(conds, "resource_type = "+arg(f.ResourceType))
+	}
+	if f.From != nil {
+		conds = append(conds, "created_at >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		conds = append(conds, "created_at < "+arg(*f.To))
+	}
+	if f.MinAmount != nil {
+		conds = append(conds, "amount >= "+arg(*f.MinAmount))
+	}
+	if f.MaxAmount != nil {
+		conds = append(conds, "amount <= "+arg(*f.MaxAmount))
+	}
+	if len(f.Metadata) > 0 {
+		metadata, _ := json.Marshal(f.Metadata)
+		conds = append(conds, "metadata @> "+arg(string(metadata)))
+	}
+	if f.Cursor != "" {
+		createdAt, id, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, fmt.Sprintf("(created_at, id) < (%s, %s)", arg(createdAt), arg(id)))
+	}
+
+	// One extra row tells whether there is a next page.
+	query := fmt.Sprintf(`
+        SELECT id, account_id, resource_type, amount, idempotency_key, metadata, reversal_of, created_at
+        FROM transactions
+        WHERE %s
+        ORDER BY created_at DESC, id DESC
+        LIMIT %s`, strings.Join(conds, " AND "), arg(limit+1))
+
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &model.TransactionPage{Transactions: []model.Transaction{}}
+	for rows.Next() {
+		var t model.Transaction
+		var metadata []byte
+		var reversalOf *string
+		if err := rows.Scan(&t.ID, &t.AccountID, &t.ResourceType, &t.Amount, &t.IdempotencyKey, &metadata, &reversalOf, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Metadata = decodeMetadata(metadata)
+		if reversalOf != nil {
+			t.ReversalOf = *reversalOf
+		}
+		page.Transactions = append(page.Transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Transactions) > limit {
+		page.Transactions = page.Transactions[:limit]
+		last := page.Transactions[limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	return page, nil
+}
+
+func encodeCursor(createdAt time.Time, id string) string {
+	raw := createdAt.UTC().Format(time.RFC3339Nano) + "|" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || !isTransactionID(id) {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return createdAt, id, nil
+}
+
+// isTransactionID reports whether id is a UUID, in its canonical form or as the 32 hex
+// digits MemoryLedger uses, so a tampered cursor never reaches PostgreSQL.
+func isTransactionID(id string) bool {
+	if len(id) == 36 {
+		for _, i := range []int{8, 13, 18, 23} {
+			if id[i] != '-' {
+				return false
+			}
+		}
+		id = strings.ReplaceAll(id, "-", "")
+	}
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
+
+// decodeMetadata flattens the JSONB metadata column into string values.
+func decodeMetadata(raw []byte) map[string]string {
+	var values map[string]any
+	if len(raw) == 0 || json.Unmarshal(raw, &values) != nil || len(values) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		if s, ok := v.(string); ok {
+			out[k] = s
+			continue
+		}
+		b, _ := json.Marshal(v)
+		out[k] = string(b)
+	}
+	return out
+}
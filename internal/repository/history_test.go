@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	createdAt := time.Date(2026, 3, 14, 15, 9, 26, 535897000, time.UTC)
+	id := "3f2b8e0c-6c1e-4b7a-9d7e-2f1a0b9c8d7e"
+
+	gotAt, gotID, err := decodeCursor(encodeCursor(createdAt, id))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !gotAt.Equal(createdAt) || gotID != id {
+		t.Errorf("expected (%v, %s), got (%v, %s)", createdAt, id, gotAt, gotID)
+	}
+}
+
+func TestCursor_MemoryLedgerID(t *testing.T) {
+	id := "3f2b8e0c6c1e4b7a9d7e2f1a0b9c8d7e"
+	if _, gotID, err := decodeCursor(encodeCursor(time.Now(), id)); err != nil || gotID != id {
+		t.Errorf("expected id %s, got %s (%v)", id, gotID, err)
+	}
+}
+
+func TestCursor_Invalid(t *testing.T) {
+	tampered := []string{
+		encodeCursor(time.Now(), "1; DROP TABLE transactions"),
+		encodeCursor(time.Now(), "3f2b8e0cx6c1e-4b7a-9d7e-2f1a0b9c8d7e"),
+		encodeCursor(time.Now(), "3f2b8e0c6c1e4b7a9d7e2f1a0b9c8d7z"),
+	}
+	for _, cursor := range append([]string{"not base64!", "bm8tc2VwYXJhdG9y", "YmFkLXRpbWV8aWQ"}, tampered...) {
+		if _, _, err := decodeCursor(cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("cursor %q: expected ErrInvalidCursor, got %v", cursor, err)
+		}
+	}
+}
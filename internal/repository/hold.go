@@ -0,0 +1,396 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed authorize.lua
+var authorizeLuaScript string
+
+//go:embed release.lua
+var releaseLuaScript string
+
+//go:embed revert_authorize.lua
+var revertAuthorizeLuaScript string
+
+// DefaultHoldTTL is used when an AuthorizeRequest does not set TTLSeconds.
+const DefaultHoldTTL = 15 * time.Minute
+
+var (
+	ErrHoldNotFound       = apperr.New(apperr.CodeNotFound, "hold not found or already settled")
+	ErrCaptureExceedsHold = apperr.New(apperr.CodeValidationFailed, "capture amount exceeds held amount")
+)
+
+// Authorize reserves funds on an account. The reserved amount is removed from the
+// spendable balance in Redis, taken from the credit lots like a spend, and recorded as
+// a pending hold in PostgreSQL.
+func (r *LedgerRepo) Authorize(ctx context.Context, req model.AuthorizeRequest) (*model.HoldResult, error) {
+	if req.Amount <= 0 {
+		return nil, apperr.Validation("hold amount must be positive")
+	}
+	if req.IdempotencyKey == "" {
+		return nil, apperr.Validation("idempotency key is required")
+	}
+
+	ttl := DefaultHoldTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	holdID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second).UTC()
+
+	newBalance, hasThresholds, err := r.executeAuthorize(ctx, req, holdID, expiresAt)
+	if errors.Is(err, ErrCacheMiss) {
+		slog.Info("cold start, warming up cache", "account_id", req.AccountID)
+
+		if err := r.warmUpCache(ctx, req.AccountID, req.ResourceType); err != nil {
+			return nil, err
+		}
+		newBalance, hasThresholds, err = r.executeAuthorize(ctx, req, holdID, expiresAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+        INSERT INTO holds (id, account_id, resource_type, amount, idempotency_key, expires_at, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())`
+
+	if _, err := r.db.Exec(ctx, query, holdID, req.AccountID, req.ResourceType, req.Amount, req.IdempotencyKey, expiresAt); err != nil {
+		// Give the reservation back so Redis does not keep funds locked by a hold PostgreSQL
+		// never saw, and free the idempotency key so a retry is not ALREADY_PROCESSED.
+		if revErr := r.revertAuthorize(ctx, req, holdID); revErr != nil {
+			slog.Error("failed to roll back hold", "hold_id", holdID, "error", revErr)
+		}
+		return nil, fmt.Errorf("db insert hold: %w", err)
+	}
+	change := model.BalanceEvent{
+		Type:           model.BalanceHold,
+		AccountID:      req.AccountID,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		Balance:        newBalance,
+		IdempotencyKey: req.IdempotencyKey,
+	}
+	r.publishBalanceEvent(ctx, change)
+	if hasThresholds {
+		r.checkThresholds(ctx, change)
+	}
+
+	return &model.HoldResult{
+		HoldID:     holdID,
+		Amount:     req.Amount,
+		NewBalance: newBalance,
+		Status:     "AUTHORIZED",
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// Capture settles a pending hold for req.Amount and releases whatever was not captured.
+// The captured amount is synced to PostgreSQL as a regular spend event queued by releaseHold.
+func (r *LedgerRepo) Capture(ctx context.Context, req model.CaptureRequest) (*model.HoldResult, error) {
+	if req.Amount < 0 {
+		return nil, apperr.Validation("capture amount must not be negative")
+	}
+
+	hold, newBalance, err := r.releaseHold(ctx, req.HoldID, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.settleHold(ctx, req.HoldID, "captured", req.Amount); err != nil {
+		return nil, err
+	}
+	if !hold.BalanceCached {
+		if newBalance, err = r.settledBalance(ctx, hold); err != nil {
+			return nil, err
+		}
+	}
+	r.publishBalanceEvent(ctx, model.BalanceEvent{
+		Type:           model.BalanceCapture,
+		AccountID:      hold.AccountID,
+		ResourceType:   hold.ResourceType,
+		Amount:         req.Amount,
+		Balance:        newBalance,
+		IdempotencyKey: "hold:" + req.HoldID,
+	})
+
+	return &model.HoldResult{
+		HoldID:     req.HoldID,
+		Amount:     req.Amount,
+		NewBalance: newBalance,
+		Status:     "CAPTURED",
+	}, nil
+}
+
+// Void releases a pending hold in full.
+func (r *LedgerRepo) Void(ctx context.Context, holdID string) (*model.HoldResult, error) {
+	hold, newBalance, err := r.releaseHold(ctx, holdID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.settleHold(ctx, holdID, "voided", 0); err != nil {
+		return nil, err
+	}
+	if !hold.BalanceCached {
+		if newBalance, err = r.settledBalance(ctx, hold); err != nil {
+			return nil, err
+		}
+	}
+	r.publishBalanceEvent(ctx, model.BalanceEvent{
+		Type:         model.BalanceVoid,
+		AccountID:    hold.AccountID,
+		ResourceType: hold.ResourceType,
+		Amount:       hold.Amount,
+		Balance:      newBalance,
+	})
+
+	return &model.HoldResult{
+		HoldID:     holdID,
+		NewBalance: newBalance,
+		Status:     "VOIDED",
+	}, nil
+}
+
+// ExpireHolds releases every pending hold that expired before the given time.
+// PostgreSQL decides which holds are due, so holds Redis lost still expire.
+// It returns the number of holds released.
+func (r *LedgerRepo) ExpireHolds(ctx context.Context, before time.Time) (int, error) {
+	query := `
+        SELECT id, account_id, resource_type, amount
+        FROM holds
+        WHERE status = 'pending' AND expires_at <= $1
+        ORDER BY expires_at
+        LIMIT 500`
+
+	rows, err := r.db.Query(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	due, err := pgx.CollectRows(rows, pgx.RowToStructByPos[dueHold])
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, h := range due {
+		hold, newBalance, err := r.releaseHold(ctx, h.ID, 0)
+		if errors.Is(err, ErrHoldNotFound) {
+			lost, err := r.holdLost(ctx, h)
+			if err != nil {
+				return expired, err
+			}
+			if !lost {
+				// Settled concurrently; Capture or Void updates PostgreSQL.
+				continue
+			}
+		} else if err != nil {
+			return expired, err
+		}
+		if err := r.settleHold(ctx, h.ID, "expired", 0); err != nil {
+			return expired, err
+		}
+		if hold == nil || !hold.BalanceCached {
+			hold = &pendingHold{AccountID: h.AccountID, ResourceType: h.ResourceType}
+			if newBalance, err = r.settledBalance(ctx, hold); err != nil {
+				return expired, err
+			}
+		}
+		r.publishBalanceEvent(ctx, model.BalanceEvent{
+			Type:         model.BalanceHoldExpired,
+			AccountID:    h.AccountID,
+			ResourceType: h.ResourceType,
+			Amount:       h.Amount,
+			Balance:      newBalance,
+		})
+		expired++
+	}
+
+	return expired, nil
+}
+
+type dueHold struct {
+	ID           string
+	AccountID    string
+	ResourceType string
+	Amount       int64
+}
+
+// holdLost reports whether Redis lost a pending hold, rather than settled it. The cached
+// balance of its account was warmed up with the hold reserved, so it is dropped and
+// rebuilt once the hold is settled.
+func (r *LedgerRepo) holdLost(ctx context.Context, h dueHold) (bool, error) {
+	settled, err := r.rdb.HExists(ctx, fmt.Sprintf("hold:%s", h.ID), "settled").Result()
+	if err != nil || settled {
+		return false, err
+	}
+	slog.Warn("pending hold missing from Redis, expiring it from PostgreSQL", "hold_id", h.ID, "account_id", h.AccountID)
+	return true, r.rdb.Del(ctx, fmt.Sprintf("balance:%s:%s", h.AccountID, h.ResourceType)).Err()
+}
+
+type pendingHold struct {
+	AccountID    string
+	ResourceType string
+	Amount       int64
+	// BalanceCached is false when the account's balance was not in Redis, so the new
+	// balance releaseHold returns is unknown.
+	BalanceCached bool
+}
+
+// executeAuthorize runs authorize.lua and returns the new balance and whether the account has thresholds.
+func (r *LedgerRepo) executeAuthorize(ctx context.Context, req model.AuthorizeRequest, holdID string, expiresAt time.Time) (int64, bool, error) {
+	balanceKey := fmt.Sprintf("balance:%s:%s", req.AccountID, req.ResourceType)
+	idemKey := fmt.Sprintf("idem:%s", req.IdempotencyKey)
+	holdKey := fmt.Sprintf("hold:%s", holdID)
+	limitKey := creditLimitKey(req.AccountID, req.ResourceType)
+	defsKey, _, _ := thresholdKeys(req.AccountID, req.ResourceType)
+	lotOrderKey, lotRemainingKey := lotKeys(req.AccountID, req.ResourceType)
+
+	result, err := r.rdb.Eval(ctx, authorizeLuaScript,
+		[]string{balanceKey, idemKey, holdKey, limitKey, defsKey, lotOrderKey, lotRemainingKey},
+		req.Amount, holdID, expiresAt.Unix(), req.AccountID, req.ResourceType,
+	).Result()
+	if err != nil {
+		return 0, false, err
+	}
+
+	resArray := result.([]interface{})
+	status := resArray[0].(int64)
+
+	switch status {
+	case 1:
+		return resArray[1].(int64), resArray[2].(int64) == 1, nil
+	case 0:
+		return 0, false, ErrAlreadyProcessed
+	case -1:
+		return 0, false, ErrCacheMiss
+	case -2:
+		return 0, false, ErrInsufficient
+	default:
+		return 0, false, fmt.Errorf("unknown lua status: %d", status)
+	}
+}
+
+// revertAuthorize undoes an authorization in Redis: the reservation goes back to the
+// balance and its lots, and the hold and its idempotency key are removed.
+func (r *LedgerRepo) revertAuthorize(ctx context.Context, req model.AuthorizeRequest, holdID string) error {
+	lotOrderKey, lotRemainingKey := lotKeys(req.AccountID, req.ResourceType)
+	return r.rdb.Eval(ctx, revertAuthorizeLuaScript, []string{
+		fmt.Sprintf("hold:%s", holdID),
+		fmt.Sprintf("balance:%s:%s", req.AccountID, req.ResourceType),
+		fmt.Sprintf("idem:%s", req.IdempotencyKey),
+		lotOrderKey, lotRemainingKey,
+	}).Err()
+}
+
+// releaseHold removes a pending hold from Redis, keeping captureAmount and
+// returning the rest to the balance and to the credit lots it was taken from. A
+// captured amount is queued in the outbox as a spend event. It returns the hold
+// and the new balance.
+func (r *LedgerRepo) releaseHold(ctx context.Context, holdID string, captureAmount int64) (*pendingHold, int64, error) {
+	holdKey := fmt.Sprintf("hold:%s", holdID)
+
+	fields, err := r.rdb.HMGet(ctx, holdKey, "account_id", "resource_type").Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	accountID, _ := fields[0].(string)
+	resourceType, _ := fields[1].(string)
+	if accountID == "" || resourceType == "" {
+		return nil, 0, ErrHoldNotFound
+	}
+
+	// The captured amount settles as a spend keyed by the hold.
+	spendKey := "hold:" + holdID
+	var payload []byte
+	if captureAmount > 0 {
+		payload, err = json.Marshal(model.SpendEvent{
+			AccountID:      accountID,
+			ResourceType:   resourceType,
+			Amount:         captureAmount,
+			IdempotencyKey: spendKey,
+			CreatedAt:      time.Now(),
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	balanceKey := fmt.Sprintf("balance:%s:%s", accountID, resourceType)
+	lotOrderKey, lotRemainingKey := lotKeys(accountID, resourceType)
+	result, err := r.rdb.Eval(ctx, releaseLuaScript,
+		[]string{holdKey, balanceKey, outboxStream, pendingKey(accountID, resourceType), lotOrderKey, lotRemainingKey},
+		captureAmount, payload, pendingMember(spendKey, captureAmount), time.Now().Unix(), noExpiryScore+1,
+	).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resArray := result.([]interface{})
+	status := resArray[0].(int64)
+
+	switch status {
+	case 1, 2:
+		hold := &pendingHold{
+			AccountID:     accountID,
+			ResourceType:  resourceType,
+			Amount:        resArray[2].(int64),
+			BalanceCached: status == 1,
+		}
+		return hold, resArray[1].(int64), nil
+	case -1:
+		return nil, 0, ErrHoldNotFound
+	case -2:
+		return nil, 0, ErrCaptureExceedsHold
+	default:
+		return nil, 0, fmt.Errorf("unknown lua status: %d", status)
+	}
+}
+
+// settledBalance reads the balance of a hold's account once the hold is settled in
+// PostgreSQL, which rebuilds it when it was not cached. A deleted account has none left.
+func (r *LedgerRepo) settledBalance(ctx context.Context, hold *pendingHold) (int64, error) {
+	balance, err := r.GetBalance(ctx, hold.AccountID, hold.ResourceType)
+	if errors.Is(err, ErrAccountDeleted) || errors.Is(err, ErrNotFoundInDB) {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func (r *LedgerRepo) settleHold(ctx context.Context, holdID, status string, capturedAmount int64) error {
+	query := `
+        UPDATE holds
+        SET status = $1, captured_amount = $2, updated_at = NOW()
+        WHERE id = $3 AND status = 'pending'`
+
+	if _, err := r.db.Exec(ctx, query, status, capturedAmount, holdID); err != nil {
+		return fmt.Errorf("db settle hold: %w", err)
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Operations whose idempotency keys are kept in PostgreSQL.
+const (
+	opRecharge      = "recharge"
+	opCreateAccount = "create_account"
+	opDeleteAccount = "delete_account"
+	opRefund        = "refund"
+	opGrantCredits  = "grant_credits"
+)
+
+// fingerprint identifies what a request asks for, so a reused idempotency key can be told
+// apart from a retry: a retry sends the same operation with the same arguments.
+func fingerprint(operation string, args ...interface{}) string {
+	parts := []string{operation}
+	for _, a := range args {
+		parts = append(parts, fmt.Sprint(a))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func spendFingerprint(req model.SpendRequest) string {
+	return fingerprint("spend", req.AccountID, req.ResourceType, req.Amount)
+}
+
+// claimIdempotencyKey records an operation's idempotency key in the transaction that performs
+// it. It reports true when the key was already claimed by the same request, which has then
+// been done before, and ErrIdempotencyConflict when it was claimed by a different one.
+// A request without a key is always performed.
+func claimIdempotencyKey(ctx context.Context, tx pgx.Tx, key, operation, fingerprint string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+
+	// A concurrent claim of the same key waits here until the other transaction ends.
+	query := `
+        INSERT INTO idempotency_keys (key, operation, fingerprint)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (key) DO NOTHING`
+	res, err := tx.Exec(ctx, query, key, operation, fingerprint)
+	if err != nil {
+		return false, fmt.Errorf("db claim idempotency key: %w", err)
+	}
+	if res.RowsAffected() == 1 {
+		return false, nil
+	}
+
+	var storedOp, storedFingerprint string
+	err = tx.QueryRow(ctx, `SELECT operation, fingerprint FROM idempotency_keys WHERE key = $1`, key).Scan(&storedOp, &storedFingerprint)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, fmt.Errorf("db claim idempotency key: %s vanished", key)
+	}
+	if err != nil {
+		return false, fmt.Errorf("db read idempotency key: %w", err)
+	}
+	if storedOp != operation || storedFingerprint != fingerprint {
+		return false, ErrIdempotencyConflict
+	}
+	return true, nil
+}
+
+// replayedSpend rebuilds the outcome spend.lua stored for an idempotency key:
+// new balance, credit limit, amount and when it was processed (unix milliseconds).
+func replayedSpend(fields []interface{}) (*model.SpendResult, error) {
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("replayed spend: expected 4 fields, got %d", len(fields))
+	}
+	values := make([]int64, len(fields))
+	for i, f := range fields {
+		s, ok := f.(string)
+		if !ok {
+			return nil, fmt.Errorf("replayed spend: field %d is %T", i, f)
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("replayed spend: %w", err)
+		}
+		values[i] = n
+	}
+	return &model.SpendResult{
+		NewBalance:    values[0],
+		Status:        "SUCCESS",
+		CreditLimit:   values[1],
+		OverdraftUsed: max(0, -values[0]),
+		Amount:        values[2],
+		ProcessedAt:   time.UnixMilli(values[3]),
+		Replayed:      true,
+	}, nil
+}
@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrUnbalancedEntry = errors.New("journal entry legs do not sum to zero")
+
+// writeJournal records a balanced entry inside the caller's transaction.
+// Entries whose legs do not sum to zero are rejected before anything is written.
+func writeJournal(ctx context.Context, tx pgx.Tx, entry model.JournalEntry) error {
+	var sum int64
+	for _, leg := range entry.Legs {
+		sum += leg.Amount
+	}
+	if sum != 0 || len(entry.Legs) < 2 {
+		return fmt.Errorf("%w: %s %s", ErrUnbalancedEntry, entry.Type, entry.IdempotencyKey)
+	}
+
+	metadata, err := json.Marshal(entry.Metadata)
+	if err != nil {
+		return err
+	}
+
+	var reference *string
+	if entry.Reference != "" {
+		reference = &entry.Reference
+	}
+
+	createdAt := entry.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	var entryID string
+	queryEntry := `
+        INSERT INTO journal_entries (entry_type, idempotency_key, reference, metadata, created_at)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id`
+
+	if err := tx.QueryRow(ctx, queryEntry, entry.Type, entry.IdempotencyKey, reference, metadata, createdAt).Scan(&entryID); err != nil {
+		return fmt.Errorf("db insert journal entry: %w", err)
+	}
+
+	queryLeg := `
+        INSERT INTO journal_legs (entry_id, account_id, resource_type, amount, created_at)
+        VALUES ($1, $2, $3, $4, $5)`
+
+	// A leg booked after the snapshots that should include it were taken (a spend synced
+	// late) brings them up to date.
+	querySnapshots := `
+        UPDATE balance_snapshots SET amount = amount + $1
+        WHERE account_id = $2 AND resource_type = $3 AND snapshot_at > $4`
+
+	for _, leg := range entry.Legs {
+		if _, err := tx.Exec(ctx, queryLeg, entryID, leg.AccountID, leg.ResourceType, leg.Amount, createdAt); err != nil {
+			return fmt.Errorf("db insert journal leg: %w", err)
+		}
+		if _, err := tx.Exec(ctx, querySnapshots, leg.Amount, leg.AccountID, leg.ResourceType, createdAt); err != nil {
+			return fmt.Errorf("db update snapshots: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// legs builds the two legs of an entry: amount is credited to the account
+// and debited from the counter-account (negative amounts go the other way).
+func legs(accountID, counterAccountID, resourceType string, amount int64) []model.JournalLeg {
+	return []model.JournalLeg{
+		{AccountID: accountID, ResourceType: resourceType, Amount: amount},
+		{AccountID: counterAccountID, ResourceType: resourceType, Amount: -amount},
+	}
+}
+
+// CheckJournal verifies the journal invariants: the legs of every entry sum to zero,
+// and every customer balance equals the sum of its legs.
+func (r *LedgerRepo) CheckJournal(ctx context.Context) (*model.JournalReport, error) {
+	report := &model.JournalReport{
+		CheckedAt:         time.Now(),
+		UnbalancedEntries: []model.UnbalancedEntry{},
+		BalanceMismatches: []model.BalanceMismatch{},
+	}
+
+	queryEntries := `
+        SELECT entry_id, SUM(amount)::BIGINT
+        FROM journal_legs
+        GROUP BY entry_id
+        HAVING SUM(amount) <> 0`
+
+	rows, err := r.db.Query(ctx, queryEntries)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e model.UnbalancedEntry
+		if err := rows.Scan(&e.EntryID, &e.Sum); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	queryBalances := `
+        SELECT b.account_id, b.resource_type, b.amount, COALESCE(j.total, 0)::BIGINT
+        FROM balances b
+        LEFT JOIN (
+            SELECT account_id, resource_type, SUM(amount) AS total
+            FROM journal_legs
+            GROUP BY account_id, resource_type
+        ) j ON j.account_id = b.account_id AND j.resource_type = b.resource_type
+        WHERE b.amount <> COALESCE(j.total, 0)`
+
+	rows, err = r.db.Query(ctx, queryBalances)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m model.BalanceMismatch
+		if err := rows.Scan(&m.AccountID, &m.ResourceType, &m.Balance, &m.JournalBalance); err != nil {
+			return nil, err
+		}
+		report.BalanceMismatches = append(report.BalanceMismatches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report.OK = len(report.UnbalancedEntries) == 0 && len(report.BalanceMismatches) == 0
+	return report, nil
+}
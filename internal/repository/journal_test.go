@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"quantlo/internal/model"
+)
+
+func TestWriteJournal_RejectsUnbalancedEntry(t *testing.T) {
+	entry := model.JournalEntry{
+		Type:           model.EntrySpend,
+		IdempotencyKey: "spend:req-1",
+		Legs: []model.JournalLeg{
+			{AccountID: "user123", ResourceType: "api_credits", Amount: -10},
+			{AccountID: model.SystemRevenue, ResourceType: "api_credits", Amount: 9},
+		},
+	}
+
+	// The check happens before the transaction is used, so no database is needed.
+	err := writeJournal(context.Background(), nil, entry)
+	if !errors.Is(err, ErrUnbalancedEntry) {
+		t.Fatalf("expected ErrUnbalancedEntry, got %v", err)
+	}
+}
+
+func TestLegs_SumToZero(t *testing.T) {
+	var sum int64
+	for _, leg := range legs("user123", model.SystemFunding, "api_credits", 250) {
+		sum += leg.Amount
+	}
+	if sum != 0 {
+		t.Errorf("expected legs to sum to zero, got %d", sum)
+	}
+}
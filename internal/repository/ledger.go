@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"time"
 
+	"quantlo/internal/apperr"
 	"quantlo/internal/model"
 	"quantlo/internal/service"
 
@@ -24,28 +25,41 @@ var _ service.LedgerService = (*LedgerRepo)(nil)
 var spendLuaScript string
 
 var (
-	ErrAlreadyProcessed = errors.New("request already processed (idempotency)")
-	ErrCacheMiss        = errors.New("balance not found in cache")
-	ErrInsufficient     = errors.New("insufficient funds")
-	ErrNotFoundInDB     = errors.New("account not found in database")
+	ErrAlreadyProcessed = apperr.New(apperr.CodeDuplicateRequest, "request already processed (idempotency)")
+	// ErrIdempotencyConflict is returned when an idempotency key is reused for a different request.
+	ErrIdempotencyConflict = apperr.New(apperr.CodeIdempotencyConflict, "idempotency key already used for a different request")
+	ErrCacheMiss           = errors.New("balance not found in cache")
+	ErrInsufficient        = apperr.New(apperr.CodeInsufficientFunds, "insufficient funds")
+	ErrNotFoundInDB        = apperr.New(apperr.CodeAccountNotFound, "account not found in database")
+	ErrAccountExists       = apperr.New(apperr.CodeAccountExists, "account already exists")
+	ErrAccountDeleted      = apperr.New(apperr.CodeAccountDeleted, "account is deleted")
 )
 
 type LedgerRepo struct {
-	rdb *redis.Client
-	db  *pgxpool.Pool
-	bus MessageBus
+	rdb  *redis.Client
+	db   *pgxpool.Pool
+	bus  MessageBus
+	feed *balanceFeed
 }
 
 func NewLedgerRepo(rdb *redis.Client, db *pgxpool.Pool, bus MessageBus) *LedgerRepo {
 	return &LedgerRepo{
-		rdb: rdb,
-		db:  db,
-		bus: bus,
+		rdb:  rdb,
+		db:   db,
+		bus:  bus,
+		feed: newBalanceFeed(rdb),
 	}
 }
 
 func (r *LedgerRepo) Spend(ctx context.Context, req model.SpendRequest) (*model.SpendResult, error) {
-	result, err := r.executeLua(ctx, req)
+	if req.Amount <= 0 {
+		return nil, apperr.Validation("spend amount must be positive")
+	}
+	if req.IdempotencyKey == "" {
+		return nil, apperr.Validation("idempotency key is required")
+	}
+
+	result, hasThresholds, err := r.executeLua(ctx, req)
 
 	if errors.Is(err, ErrCacheMiss) {
 		slog.Info("cold start, warming up cache", "account_id", req.AccountID)
@@ -54,19 +68,44 @@ func (r *LedgerRepo) Spend(ctx context.Context, req model.SpendRequest) (*model.
 			return nil, err
 		}
 
-		return r.executeLua(ctx, req)
+		result, hasThresholds, err = r.executeLua(ctx, req)
 	}
 
+	if err == nil && hasThresholds {
+		r.checkThresholds(ctx, model.BalanceEvent{AccountID: req.AccountID, ResourceType: req.ResourceType,
+			Amount: req.Amount, Balance: result.NewBalance, IdempotencyKey: req.IdempotencyKey})
+	}
 	return result, err
 }
 
 func (r *LedgerRepo) Recharge(ctx context.Context, req model.RechargeRequest) error {
+	if req.Amount <= 0 {
+		return apperr.Validation("recharge amount must be positive")
+	}
+
+	entryID, err := newID()
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	done, err := claimIdempotencyKey(ctx, tx, req.IdempotencyKey, opRecharge,
+		fingerprint(opRecharge, req.AccountID, req.ResourceType, req.Amount))
+	if err != nil || done {
+		return err
+	}
+
 	query := `
         UPDATE balances 
-        SET amount = amount + $1, updated_at = NOW() 
+        SET amount = amount + $1, last_recharge = $1, updated_at = NOW() 
         WHERE account_id = $2 AND resource_type = $3 AND deleted_at IS NULL`
 
-	res, err := r.db.Exec(ctx, query, req.Amount, req.AccountID, req.ResourceType)
+	res, err := tx.Exec(ctx, query, req.Amount, req.AccountID, req.ResourceType)
 	if err != nil {
 		return fmt.Errorf("db recharge error: %w", err)
 	}
@@ -75,8 +114,38 @@ func (r *LedgerRepo) Recharge(ctx context.Context, req model.RechargeRequest) er
 		return ErrNotFoundInDB
 	}
 
+	// A recharge arms the account's thresholds again; the cache picks them up when it is warmed below.
+	queryArm := `UPDATE balance_thresholds SET armed = TRUE WHERE account_id = $1 AND resource_type = $2 AND NOT armed`
+	if _, err := tx.Exec(ctx, queryArm, req.AccountID, req.ResourceType); err != nil {
+		return fmt.Errorf("db arm thresholds: %w", err)
+	}
+
+	err = writeJournal(ctx, tx, model.JournalEntry{
+		Type:           model.EntryRecharge,
+		IdempotencyKey: "recharge:" + entryID,
+		Legs:           legs(req.AccountID, model.SystemFunding, req.ResourceType, req.Amount),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
 	cacheKey := fmt.Sprintf("balance:%s:%s", req.AccountID, req.ResourceType)
-	return r.rdb.Del(ctx, cacheKey).Err()
+	if err := r.rdb.Del(ctx, cacheKey).Err(); err != nil {
+		return err
+	}
+
+	r.publishCommittedChange(ctx, model.BalanceEvent{
+		Type:           model.BalanceRecharge,
+		AccountID:      req.AccountID,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
+	})
+	return nil
 }
 
 func (r *LedgerRepo) GetBalance(ctx context.Context, accountID, resourceType string) (int64, error) {
@@ -97,45 +166,129 @@ func (r *LedgerRepo) GetBalance(ctx context.Context, accountID, resourceType str
 	return 0, err
 }
 
-func (r *LedgerRepo) CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64) error {
+func (r *LedgerRepo) CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64, idempotencyKey string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	done, err := claimIdempotencyKey(ctx, tx, idempotencyKey, opCreateAccount,
+		fingerprint(opCreateAccount, accountID, resourceType, initialAmount))
+	if err != nil || done {
+		return err
+	}
+
 	query := `
-        INSERT INTO balances (account_id, resource_type, amount, created_at, updated_at)
-        VALUES ($1, $2, $3, NOW(), NOW())
+        INSERT INTO balances (account_id, resource_type, amount, last_recharge, created_at, updated_at)
+        VALUES ($1, $2, $3, GREATEST($3, 0), NOW(), NOW())
         ON CONFLICT (account_id, resource_type) DO NOTHING`
 
-	res, err := r.db.Exec(ctx, query, accountID, resourceType, initialAmount)
+	res, err := tx.Exec(ctx, query, accountID, resourceType, initialAmount)
 	if err != nil {
 		return err
 	}
 	if res.RowsAffected() == 0 {
-		return errors.New("account already exists")
+		return ErrAccountExists
+	}
+
+	if initialAmount != 0 {
+		err = writeJournal(ctx, tx, model.JournalEntry{
+			Type:           model.EntryOpeningBalance,
+			IdempotencyKey: fmt.Sprintf("opening:%s:%s", accountID, resourceType),
+			Legs:           legs(accountID, model.SystemFunding, resourceType, initialAmount),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
 	}
 
 	cacheKey := fmt.Sprintf("balance:%s:%s", accountID, resourceType)
-	return r.rdb.Set(ctx, cacheKey, initialAmount, 0).Err()
+	if err := r.rdb.Set(ctx, cacheKey, initialAmount, 0).Err(); err != nil {
+		return err
+	}
+
+	r.publishBalanceEvent(ctx, model.BalanceEvent{
+		Type:           model.BalanceAccountCreated,
+		AccountID:      accountID,
+		ResourceType:   resourceType,
+		Amount:         initialAmount,
+		Balance:        initialAmount,
+		IdempotencyKey: idempotencyKey,
+	})
+	return nil
 }
 
-func (r *LedgerRepo) DeleteAccount(ctx context.Context, accountID, resourceType string) error {
+func (r *LedgerRepo) DeleteAccount(ctx context.Context, accountID, resourceType, idempotencyKey string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	done, err := claimIdempotencyKey(ctx, tx, idempotencyKey, opDeleteAccount,
+		fingerprint(opDeleteAccount, accountID, resourceType))
+	if err != nil || done {
+		return err
+	}
+
+	// The remaining balance is closed out to the system account so the journal
+	// and the balances table agree that a deleted account holds nothing.
+	var closedAmount int64
 	query := `
-        UPDATE balances 
-        SET deleted_at = NOW(), updated_at = NOW() 
-        WHERE account_id = $1 AND resource_type = $2 AND deleted_at IS NULL`
+        UPDATE balances b
+        SET deleted_at = NOW(), updated_at = NOW(), amount = 0
+        FROM (SELECT amount FROM balances WHERE account_id = $1 AND resource_type = $2 FOR UPDATE) old
+        WHERE b.account_id = $1 AND b.resource_type = $2 AND b.deleted_at IS NULL
+        RETURNING old.amount`
 
-	res, err := r.db.Exec(ctx, query, accountID, resourceType)
+	err = tx.QueryRow(ctx, query, accountID, resourceType).Scan(&closedAmount)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFoundInDB
+		}
 		return fmt.Errorf("db delete account: %w", err)
 	}
-	if res.RowsAffected() == 0 {
-		return ErrNotFoundInDB
+
+	if closedAmount != 0 {
+		err = writeJournal(ctx, tx, model.JournalEntry{
+			Type:           model.EntryAdjustment,
+			IdempotencyKey: fmt.Sprintf("close:%s:%s", accountID, resourceType),
+			Metadata:       map[string]string{"reason": "account_deleted"},
+			Legs:           legs(accountID, model.SystemClosed, resourceType, -closedAmount),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
 	}
 
 	balanceKey := fmt.Sprintf("balance:%s:%s", accountID, resourceType)
 	pipe := r.rdb.Pipeline()
-	pipe.Del(ctx, balanceKey)
+	lotOrderKey, lotRemainingKey := lotKeys(accountID, resourceType)
+	defsKey, armedKey, lastRechargeKey := thresholdKeys(accountID, resourceType)
+	pipe.Del(ctx, balanceKey, creditLimitKey(accountID, resourceType), lotOrderKey, lotRemainingKey, pendingKey(accountID, resourceType),
+		defsKey, armedKey, lastRechargeKey)
 	pipe.Set(ctx, fmt.Sprintf("deleted:%s:%s", accountID, resourceType), "1", 30*time.Second)
-	_, err = pipe.Exec(ctx)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
 
-	return err
+	r.publishBalanceEvent(ctx, model.BalanceEvent{
+		Type:           model.BalanceAccountDeleted,
+		AccountID:      accountID,
+		ResourceType:   resourceType,
+		Amount:         closedAmount,
+		IdempotencyKey: idempotencyKey,
+	})
+	return nil
 }
 
 func (r *LedgerRepo) SyncTransactionWithBalance(ctx context.Context, event model.SpendEvent) error {
@@ -160,6 +313,8 @@ func (r *LedgerRepo) SyncTransactionWithBalance(ctx context.Context, event model
 		return err
 	}
 	if insertedKey == "" {
+		r.untrackPending(ctx, event.AccountID, event.ResourceType, event.IdempotencyKey, event.Amount)
+		r.confirmOutbox(ctx, event.OutboxID)
 		return nil
 	}
 
@@ -168,16 +323,62 @@ func (r *LedgerRepo) SyncTransactionWithBalance(ctx context.Context, event model
 		return err
 	}
 
-	return tx.Commit(ctx)
+	err = writeJournal(ctx, tx, model.JournalEntry{
+		Type:           model.EntrySpend,
+		IdempotencyKey: "spend:" + event.IdempotencyKey,
+		Legs:           legs(event.AccountID, model.SystemRevenue, event.ResourceType, -event.Amount),
+		CreatedAt:      event.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A lot may have been expired by the sweeper before this event arrived, so never go below zero.
+	queryLot := `UPDATE credit_grants SET remaining = GREATEST(remaining - $1, 0), updated_at = NOW() WHERE id = $2`
+	for _, lot := range event.Lots {
+		if _, err = tx.Exec(ctx, queryLot, lot.Amount, lot.GrantID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	r.untrackPending(ctx, event.AccountID, event.ResourceType, event.IdempotencyKey, event.Amount)
+	r.confirmOutbox(ctx, event.OutboxID)
+	return nil
 }
 
-func (r *LedgerRepo) executeLua(ctx context.Context, req model.SpendRequest) (*model.SpendResult, error) {
+// executeLua runs spend.lua and also reports whether the account has thresholds; a
+// replayed spend reports none, as its thresholds were checked the first time.
+func (r *LedgerRepo) executeLua(ctx context.Context, req model.SpendRequest) (*model.SpendResult, bool, error) {
 	balanceKey := fmt.Sprintf("balance:%s:%s", req.AccountID, req.ResourceType)
 	idemKey := fmt.Sprintf("idem:%s", req.IdempotencyKey)
+	limitKey := creditLimitKey(req.AccountID, req.ResourceType)
+	lotOrderKey, lotRemainingKey := lotKeys(req.AccountID, req.ResourceType)
+	defsKey, _, _ := thresholdKeys(req.AccountID, req.ResourceType)
+
+	now := time.Now()
+	payload, err := json.Marshal(model.SpendEvent{
+		AccountID:      req.AccountID,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
+		CreatedAt:      now,
+	})
+	if err != nil {
+		return nil, false, err
+	}
 
-	result, err := r.rdb.Eval(ctx, spendLuaScript, []string{balanceKey, idemKey}, req.Amount).Result()
+	result, err := r.rdb.Eval(ctx, spendLuaScript,
+		[]string{balanceKey, idemKey, limitKey, lotOrderKey, lotRemainingKey, outboxStream, pendingKey(req.AccountID, req.ResourceType),
+			balanceEventStream, defsKey},
+		req.Amount, payload, pendingMember(req.IdempotencyKey, req.Amount), now.Unix(),
+		spendFingerprint(req), now.UnixMilli(),
+		balanceEventRetention, req.AccountID, req.ResourceType, req.IdempotencyKey,
+	).Result()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	resArray := result.([]interface{})
@@ -186,25 +387,52 @@ func (r *LedgerRepo) executeLua(ctx context.Context, req model.SpendRequest) (*m
 	switch status {
 	case 1:
 		newBalance := resArray[1].(int64)
-		r.publishEvent(req)
-		return &model.SpendResult{NewBalance: newBalance, Status: "SUCCESS"}, nil
+		creditLimit := resArray[2].(int64)
+
+		return &model.SpendResult{
+			NewBalance:    newBalance,
+			Status:        "SUCCESS",
+			CreditLimit:   creditLimit,
+			OverdraftUsed: max(0, -newBalance),
+			Amount:        req.Amount,
+			ProcessedAt:   now,
+		}, resArray[3].(int64) == 1, nil
+	case 2:
+		res, err := replayedSpend(resArray[1:])
+		return res, false, err
 	case 0:
-		return nil, ErrAlreadyProcessed
+		return nil, false, ErrAlreadyProcessed
 	case -1:
-		return nil, ErrCacheMiss
+		return nil, false, ErrCacheMiss
 	case -2:
-		return nil, ErrInsufficient
+		return nil, false, ErrInsufficient
+	case -3:
+		return nil, false, ErrIdempotencyConflict
 	default:
-		return nil, fmt.Errorf("unknown lua status: %d", status)
+		return nil, false, fmt.Errorf("unknown lua status: %d", status)
 	}
 }
 
 func (r *LedgerRepo) warmUpCache(ctx context.Context, accountID, resourceType string) error {
-	var currentBalance int64
+	var currentBalance, creditLimit int64
 	var deletedAt *time.Time
 
-	query := `SELECT amount, deleted_at FROM balances WHERE account_id = $1 AND resource_type = $2`
-	err := r.db.QueryRow(ctx, query, accountID, resourceType).Scan(&currentBalance, &deletedAt)
+	// Spends not yet synced are read before PostgreSQL: one synced in between is then
+	// counted twice, which understates the balance rather than overstating it.
+	pending, err := r.pendingTotal(ctx, accountID, resourceType)
+	if err != nil {
+		return err
+	}
+
+	// Funds reserved by pending holds are not spendable, so they are kept out of the cached balance.
+	query := `
+        SELECT b.amount - COALESCE((
+            SELECT SUM(h.amount) FROM holds h
+            WHERE h.account_id = b.account_id AND h.resource_type = b.resource_type AND h.status = 'pending'
+        ), 0), b.credit_limit, b.deleted_at
+        FROM balances b
+        WHERE b.account_id = $1 AND b.resource_type = $2`
+	err = r.db.QueryRow(ctx, query, accountID, resourceType).Scan(&currentBalance, &creditLimit, &deletedAt)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -213,23 +441,22 @@ func (r *LedgerRepo) warmUpCache(ctx context.Context, accountID, resourceType st
 		return err
 	}
 	if deletedAt != nil {
-		return errors.New("account is deleted")
+		return ErrAccountDeleted
 	}
 
-	return r.rdb.Set(ctx, fmt.Sprintf("balance:%s:%s", accountID, resourceType), currentBalance, 0).Err()
-}
-
-func (r *LedgerRepo) publishEvent(req model.SpendRequest) {
-	event := model.SpendEvent{
-		AccountID:      req.AccountID,
-		ResourceType:   req.ResourceType,
-		Amount:         req.Amount,
-		IdempotencyKey: req.IdempotencyKey,
-		CreatedAt:      time.Now(),
+	if err := r.warmUpLots(ctx, accountID, resourceType); err != nil {
+		return err
 	}
-	data, _ := json.Marshal(event)
-
-	if err := r.bus.Publish("transactions.created", data); err != nil {
-		slog.Error("event publish failed", "error", err, "topic", "transactions.created")
+	if err := r.warmUpThresholds(ctx, accountID, resourceType); err != nil {
+		return err
 	}
+	currentBalance -= pending
+
+	// The credit limit is loaded first so a spend never sees the balance without its limit.
+	pipe := r.rdb.TxPipeline()
+	pipe.Set(ctx, creditLimitKey(accountID, resourceType), creditLimit, 0)
+	pipe.Set(ctx, fmt.Sprintf("balance:%s:%s", accountID, resourceType), currentBalance, 0)
+	_, err = pipe.Exec(ctx)
+
+	return err
 }
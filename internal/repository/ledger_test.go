@@ -13,3 +13,17 @@ func TestSpend_InsufficientFunds(t *testing.T) {
 func TestRecharge_NotFound(t *testing.T) {
 	// ...
 }
+
+func TestReplayedSpend(t *testing.T) {
+	res, err := replayedSpend([]interface{}{"-5", "10", "25", "1700000000000"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.Replayed || res.NewBalance != -5 || res.OverdraftUsed != 5 || res.CreditLimit != 10 || res.Amount != 25 || res.ProcessedAt.UnixMilli() != 1700000000000 {
+		t.Errorf("unexpected replayed result: %+v", res)
+	}
+
+	if _, err := replayedSpend([]interface{}{"1", "0", "25", false}); err == nil {
+		t.Error("expected an error for a missing field")
+	}
+}
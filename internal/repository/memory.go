@@ -0,0 +1,1932 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+	"quantlo/internal/service"
+)
+
+// Compile-time assertion: MemoryLedger must implement service.LedgerService.
+var _ service.LedgerService = (*MemoryLedger)(nil)
+
+// idempotencyTTL is how long a processed idempotency key is remembered, as in the Lua scripts.
+const idempotencyTTL = 24 * time.Hour
+
+// memFeedRetention is about how many balance events are kept for watchers to resume from.
+const memFeedRetention = 10000
+
+// MemoryLedger is an in-process implementation of service.LedgerService, for tests and for
+// running Quantlo as a single binary with no dependencies. Where LedgerRepo has Redis in front
+// of PostgreSQL, it has a single store, so every change is persisted as soon as it is made.
+//
+// It follows the rules of the Lua scripts: idempotency keys are remembered for 24 hours, a
+// spend may take the balance down to -credit_limit and no further, credit lots are consumed
+// in order, and a deleted account stays behind as a tombstone that can neither be used nor
+// created again. Events are still published to the bus for anyone subscribed to them.
+type MemoryLedger struct {
+	mu  sync.Mutex
+	bus MessageBus
+
+	accounts     map[memKey]*memAccount
+	idempotency  map[string]time.Time // idempotency key -> when it is forgotten
+	spendReplies map[string]memSpendReply
+	opKeys       map[string]string // idempotency key -> fingerprint, kept for good like idempotency_keys
+	holds        map[string]*memHold
+	grants       map[string]*memGrant
+	transactions []model.Transaction
+	txByKey      map[string]int // idempotency key -> index in transactions
+	journal      []model.JournalEntry
+	snapshots    map[memKey][]memSnapshot
+	deadLetters  []*model.DeadLetter
+
+	// feed holds the latest balance events, oldest first; feedSeq is the sequence number of
+	// the newest one, and feedMs and feedMsSeq the parts of its offset. feedSignal is closed
+	// and replaced whenever an event is added.
+	feed       []model.BalanceEvent
+	feedSeq    uint64
+	feedMs     int64
+	feedMsSeq  int64
+	feedSignal chan struct{}
+
+	webhooks   []*model.Webhook
+	deliveries []*model.WebhookDelivery // in the order they were enqueued
+	// webhookSeq is the sequence number of the last feed event fanned out. The feed starts
+	// with this process, so webhooks get all of it.
+	webhookSeq uint64
+
+	thresholds []*model.BalanceThreshold
+	quotas     []*model.QuotaPolicy
+}
+
+type memKey struct {
+	accountID    string
+	resourceType string
+}
+
+type memAccount struct {
+	// amount is the booked balance, as in the balances table; held is reserved by pending holds.
+	amount      int64
+	held        int64
+	creditLimit int64
+	// lastRecharge is the latest recharge, or the opening balance, that percent thresholds are taken of.
+	lastRecharge int64
+	deleted      bool
+}
+
+// available is the spendable balance, what Redis would hold for the account.
+func (a *memAccount) available() int64 {
+	return a.amount - a.held
+}
+
+type memHold struct {
+	id        string
+	key       memKey
+	amount    int64
+	expiresAt time.Time
+	status    string
+	// lots is what the hold took from each credit lot, in the order it took it.
+	lots []model.LotUsage
+}
+
+type memGrant struct {
+	model.CreditGrant
+	status         string
+	idempotencyKey string
+}
+
+type memSnapshot struct {
+	at     time.Time
+	amount int64
+}
+
+// memSpendReply is the outcome of a spend kept with its idempotency key, as spend.lua stores it.
+type memSpendReply struct {
+	fingerprint string
+	result      model.SpendResult
+}
+
+func NewMemoryLedger(bus MessageBus) *MemoryLedger {
+	return &MemoryLedger{
+		bus:          bus,
+		accounts:     make(map[memKey]*memAccount),
+		idempotency:  make(map[string]time.Time),
+		spendReplies: make(map[string]memSpendReply),
+		opKeys:       make(map[string]string),
+		holds:        make(map[string]*memHold),
+		grants:       make(map[string]*memGrant),
+		txByKey:      make(map[string]int),
+		snapshots:    make(map[memKey][]memSnapshot),
+		feedSignal:   make(chan struct{}),
+	}
+}
+
+func (m *MemoryLedger) Spend(ctx context.Context, req model.SpendRequest) (*model.SpendResult, error) {
+	if req.Amount <= 0 {
+		return nil, apperr.Validation("spend amount must be positive")
+	}
+	if req.IdempotencyKey == "" {
+		return nil, apperr.Validation("idempotency key is required")
+	}
+
+	fingerprint := spendFingerprint(req)
+	m.mu.Lock()
+	if m.processed(req.IdempotencyKey) {
+		reply, ok := m.spendReplies[req.IdempotencyKey]
+		m.mu.Unlock()
+		switch {
+		case !ok:
+			return nil, ErrAlreadyProcessed
+		case reply.fingerprint != fingerprint:
+			return nil, ErrIdempotencyConflict
+		}
+		res := reply.result
+		res.Replayed = true
+		return &res, nil
+	}
+	acc, err := m.cachedAccount(req.AccountID, req.ResourceType)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if acc.available()-req.Amount < -acc.creditLimit {
+		m.mu.Unlock()
+		return nil, ErrInsufficient
+	}
+
+	event := model.SpendEvent{
+		AccountID:      req.AccountID,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
+		Lots:           m.consumeLots(memKey{req.AccountID, req.ResourceType}, req.Amount),
+		CreatedAt:      time.Now(),
+	}
+	err = m.recordSpend(event)
+	res := model.SpendResult{
+		NewBalance:    acc.available(),
+		Status:        "SUCCESS",
+		CreditLimit:   acc.creditLimit,
+		OverdraftUsed: max(0, -acc.available()),
+		Amount:        req.Amount,
+		ProcessedAt:   event.CreatedAt,
+	}
+	var crossed []model.ThresholdCrossedEvent
+	if err == nil {
+		m.remember(req.IdempotencyKey)
+		m.spendReplies[req.IdempotencyKey] = memSpendReply{fingerprint: fingerprint, result: res}
+		m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceSpend, AccountID: req.AccountID, ResourceType: req.ResourceType,
+			Amount: req.Amount, Balance: res.NewBalance, IdempotencyKey: req.IdempotencyKey, At: event.CreatedAt})
+		crossed = m.crossThresholds(model.BalanceEvent{AccountID: req.AccountID, ResourceType: req.ResourceType,
+			Amount: req.Amount, Balance: res.NewBalance, IdempotencyKey: req.IdempotencyKey}, acc)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m.publish("transactions.created", event)
+	for _, e := range crossed {
+		m.publish("balance.threshold_crossed", e)
+	}
+	return &res, nil
+}
+
+func (m *MemoryLedger) Recharge(ctx context.Context, req model.RechargeRequest) error {
+	if req.Amount <= 0 {
+		return apperr.Validation("recharge amount must be positive")
+	}
+
+	entryID, err := newID()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fp := fingerprint(opRecharge, req.AccountID, req.ResourceType, req.Amount)
+	if done, err := m.operationDone(req.IdempotencyKey, fp); err != nil || done {
+		return err
+	}
+	acc, err := m.liveAccount(req.AccountID, req.ResourceType)
+	if err != nil {
+		return err
+	}
+	err = m.writeJournal(model.JournalEntry{
+		Type:           model.EntryRecharge,
+		IdempotencyKey: "recharge:" + entryID,
+		Legs:           legs(req.AccountID, model.SystemFunding, req.ResourceType, req.Amount),
+	})
+	if err != nil {
+		return err
+	}
+
+	acc.amount += req.Amount
+	acc.lastRecharge = req.Amount
+	m.armThresholds(memKey{req.AccountID, req.ResourceType})
+	m.claimOperation(req.IdempotencyKey, fp)
+	m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceRecharge, AccountID: req.AccountID, ResourceType: req.ResourceType,
+		Amount: req.Amount, Balance: acc.available(), IdempotencyKey: req.IdempotencyKey})
+	return nil
+}
+
+func (m *MemoryLedger) GetBalance(ctx context.Context, accountID, resourceType string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, err := m.cachedAccount(accountID, resourceType)
+	if err != nil {
+		return 0, err
+	}
+	return acc.available(), nil
+}
+
+func (m *MemoryLedger) CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64, idempotencyKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fp := fingerprint(opCreateAccount, accountID, resourceType, initialAmount)
+	if done, err := m.operationDone(idempotencyKey, fp); err != nil || done {
+		return err
+	}
+	// A deleted account is kept as a tombstone, so its ID can not be taken again.
+	key := memKey{accountID, resourceType}
+	if _, ok := m.accounts[key]; ok {
+		return ErrAccountExists
+	}
+	m.accounts[key] = &memAccount{amount: initialAmount, lastRecharge: max(initialAmount, 0)}
+	m.claimOperation(idempotencyKey, fp)
+	m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceAccountCreated, AccountID: accountID, ResourceType: resourceType,
+		Amount: initialAmount, Balance: initialAmount, IdempotencyKey: idempotencyKey})
+
+	if initialAmount == 0 {
+		return nil
+	}
+	return m.writeJournal(model.JournalEntry{
+		Type:           model.EntryOpeningBalance,
+		IdempotencyKey: fmt.Sprintf("opening:%s:%s", accountID, resourceType),
+		Legs:           legs(accountID, model.SystemFunding, resourceType, initialAmount),
+	})
+}
+
+func (m *MemoryLedger) DeleteAccount(ctx context.Context, accountID, resourceType, idempotencyKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fp := fingerprint(opDeleteAccount, accountID, resourceType)
+	if done, err := m.operationDone(idempotencyKey, fp); err != nil || done {
+		return err
+	}
+	acc, err := m.liveAccount(accountID, resourceType)
+	if err != nil {
+		return err
+	}
+	m.claimOperation(idempotencyKey, fp)
+
+	// The remaining balance is closed out to the system account, as LedgerRepo does.
+	closedAmount := acc.amount
+	acc.amount = 0
+	acc.deleted = true
+	m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceAccountDeleted, AccountID: accountID, ResourceType: resourceType,
+		Amount: closedAmount, IdempotencyKey: idempotencyKey})
+
+	if closedAmount == 0 {
+		return nil
+	}
+	return m.writeJournal(model.JournalEntry{
+		Type:           model.EntryAdjustment,
+		IdempotencyKey: fmt.Sprintf("close:%s:%s", accountID, resourceType),
+		Metadata:       map[string]string{"reason": "account_deleted"},
+		Legs:           legs(accountID, model.SystemClosed, resourceType, -closedAmount),
+	})
+}
+
+// SyncTransactionWithBalance records a spend made elsewhere. Spends made through this
+// ledger are already recorded, so their events are skipped like any duplicate.
+func (m *MemoryLedger) SyncTransactionWithBalance(ctx context.Context, event model.SpendEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.syncSpend(event)
+	return err
+}
+
+func (m *MemoryLedger) SyncTransactions(ctx context.Context, events []model.SpendEvent) (*model.BatchStats, error) {
+	started := time.Now()
+	stats := &model.BatchStats{Events: len(events)}
+	accounts := make(map[memKey]bool)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range events {
+		inserted, err := m.syncSpend(e)
+		if err != nil {
+			return nil, err
+		}
+		if !inserted {
+			stats.Duplicates++
+			continue
+		}
+		stats.Inserted++
+		accounts[memKey{e.AccountID, e.ResourceType}] = true
+	}
+
+	stats.Accounts = len(accounts)
+	stats.Duration = time.Since(started)
+	return stats, nil
+}
+
+// syncSpend records a spend event unless it is already recorded, and reports whether it was new.
+func (m *MemoryLedger) syncSpend(e model.SpendEvent) (bool, error) {
+	if _, ok := m.txByKey[e.IdempotencyKey]; ok {
+		return false, nil
+	}
+	if err := m.recordSpend(e); err != nil {
+		return false, err
+	}
+
+	// A lot may have been expired before this event arrived, so never go below zero.
+	for _, lot := range e.Lots {
+		if g, ok := m.grants[lot.GrantID]; ok {
+			g.Remaining = max(g.Remaining-lot.Amount, 0)
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryLedger) Authorize(ctx context.Context, req model.AuthorizeRequest) (*model.HoldResult, error) {
+	if req.Amount <= 0 {
+		return nil, apperr.Validation("hold amount must be positive")
+	}
+	if req.IdempotencyKey == "" {
+		return nil, apperr.Validation("idempotency key is required")
+	}
+
+	ttl := DefaultHoldTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+
+	holdID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second).UTC()
+
+	m.mu.Lock()
+	if m.processed(req.IdempotencyKey) {
+		m.mu.Unlock()
+		return nil, ErrAlreadyProcessed
+	}
+	acc, err := m.cachedAccount(req.AccountID, req.ResourceType)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if acc.available()-req.Amount < -acc.creditLimit {
+		m.mu.Unlock()
+		return nil, ErrInsufficient
+	}
+
+	acc.held += req.Amount
+	m.holds[holdID] = &memHold{
+		id:        holdID,
+		key:       memKey{req.AccountID, req.ResourceType},
+		amount:    req.Amount,
+		expiresAt: expiresAt,
+		status:    "pending",
+		lots:      m.consumeLots(memKey{req.AccountID, req.ResourceType}, req.Amount),
+	}
+	m.remember(req.IdempotencyKey)
+	change := model.BalanceEvent{Type: model.BalanceHold, AccountID: req.AccountID, ResourceType: req.ResourceType,
+		Amount: req.Amount, Balance: acc.available(), IdempotencyKey: req.IdempotencyKey}
+	m.addBalanceEvent(change)
+	crossed := m.crossThresholds(change, acc)
+	m.mu.Unlock()
+
+	for _, e := range crossed {
+		m.publish("balance.threshold_crossed", e)
+	}
+	return &model.HoldResult{
+		HoldID:     holdID,
+		Amount:     req.Amount,
+		NewBalance: change.Balance,
+		Status:     "AUTHORIZED",
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+func (m *MemoryLedger) Capture(ctx context.Context, req model.CaptureRequest) (*model.HoldResult, error) {
+	if req.Amount < 0 {
+		return nil, apperr.Validation("capture amount must not be negative")
+	}
+
+	newBalance, err := m.releaseHold(req.HoldID, "captured", req.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.HoldResult{
+		HoldID:     req.HoldID,
+		Amount:     req.Amount,
+		NewBalance: newBalance,
+		Status:     "CAPTURED",
+	}, nil
+}
+
+func (m *MemoryLedger) Void(ctx context.Context, holdID string) (*model.HoldResult, error) {
+	newBalance, err := m.releaseHold(holdID, "voided", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.HoldResult{
+		HoldID:     holdID,
+		NewBalance: newBalance,
+		Status:     "VOIDED",
+	}, nil
+}
+
+func (m *MemoryLedger) ExpireHolds(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	var due []string
+	for id, h := range m.holds {
+		if h.status == "pending" && h.expiresAt.Unix() <= before.Unix() {
+			due = append(due, id)
+		}
+	}
+	m.mu.Unlock()
+
+	expired := 0
+	for _, id := range due {
+		if _, err := m.releaseHold(id, "expired", 0); err != nil {
+			if errors.Is(err, ErrHoldNotFound) {
+				// Settled concurrently.
+				continue
+			}
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// releaseHold settles a pending hold with the given status, keeping captureAmount as a
+// spend keyed by the hold and giving the rest back, to its lots as release.lua does. It
+// returns the new balance.
+func (m *MemoryLedger) releaseHold(holdID, status string, captureAmount int64) (int64, error) {
+	m.mu.Lock()
+
+	h, ok := m.holds[holdID]
+	if !ok || h.status != "pending" {
+		m.mu.Unlock()
+		return 0, ErrHoldNotFound
+	}
+	if captureAmount > h.amount {
+		m.mu.Unlock()
+		return 0, ErrCaptureExceedsHold
+	}
+
+	acc := m.accounts[h.key]
+	acc.held -= h.amount
+	h.status = status
+
+	// The captured amount is charged to the hold's lots in order; the rest goes back to
+	// lots that have not expired.
+	var captured []model.LotUsage
+	toCapture := captureAmount
+	for _, lot := range h.lots {
+		take := min(lot.Amount, toCapture)
+		toCapture -= take
+		if take > 0 {
+			captured = append(captured, model.LotUsage{GrantID: lot.GrantID, Amount: take})
+		}
+		if g, ok := m.grants[lot.GrantID]; ok && g.status == "active" && (g.ExpiresAt == nil || g.ExpiresAt.After(time.Now())) {
+			g.Remaining += lot.Amount - take
+		}
+	}
+
+	var event *model.SpendEvent
+	if captureAmount > 0 {
+		event = &model.SpendEvent{
+			AccountID:      h.key.accountID,
+			ResourceType:   h.key.resourceType,
+			Amount:         captureAmount,
+			IdempotencyKey: "hold:" + holdID,
+			Lots:           captured,
+			CreatedAt:      time.Now(),
+		}
+		if err := m.recordSpend(*event); err != nil {
+			m.mu.Unlock()
+			return 0, err
+		}
+	}
+
+	// The balance of a deleted account is no longer cached; LedgerRepo reports 0 for it.
+	var newBalance int64
+	if !acc.deleted {
+		newBalance = acc.available()
+	}
+	feedEvent := model.BalanceEvent{AccountID: h.key.accountID, ResourceType: h.key.resourceType, Amount: h.amount, Balance: newBalance}
+	switch status {
+	case "captured":
+		feedEvent.Type, feedEvent.Amount, feedEvent.IdempotencyKey = model.BalanceCapture, captureAmount, "hold:"+holdID
+	case "voided":
+		feedEvent.Type = model.BalanceVoid
+	default:
+		feedEvent.Type = model.BalanceHoldExpired
+	}
+	m.addBalanceEvent(feedEvent)
+	m.mu.Unlock()
+
+	if event != nil {
+		m.publish("transactions.created", *event)
+	}
+	return newBalance, nil
+}
+
+func (m *MemoryLedger) Transfer(ctx context.Context, from, to, resourceType string, amount int64, idempotencyKey string) (*model.TransferResult, error) {
+	if from == to {
+		return nil, apperr.Validation("cannot transfer to the same account")
+	}
+	if amount <= 0 {
+		return nil, apperr.Validation("transfer amount must be positive")
+	}
+	if idempotencyKey == "" {
+		return nil, apperr.Validation("idempotency key is required")
+	}
+
+	m.mu.Lock()
+	if m.processed(idempotencyKey) {
+		m.mu.Unlock()
+		return nil, ErrAlreadyProcessed
+	}
+	fromAcc, err := m.cachedAccount(from, resourceType)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	toAcc, err := m.cachedAccount(to, resourceType)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if fromAcc.available()-amount < -fromAcc.creditLimit {
+		m.mu.Unlock()
+		return nil, ErrInsufficient
+	}
+
+	event := model.TransferEvent{
+		FromAccountID:  from,
+		ToAccountID:    to,
+		ResourceType:   resourceType,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+		Lots:           m.consumeLots(memKey{from, resourceType}, amount),
+		CreatedAt:      time.Now(),
+	}
+	err = m.recordTransfer(event)
+	result := &model.TransferResult{
+		FromBalance: fromAcc.available(),
+		ToBalance:   toAcc.available(),
+		Status:      "SUCCESS",
+	}
+	var crossed []model.ThresholdCrossedEvent
+	if err == nil {
+		m.remember(idempotencyKey)
+		debit := model.BalanceEvent{Type: model.BalanceTransferOut, AccountID: from, ResourceType: resourceType,
+			Amount: amount, Balance: result.FromBalance, IdempotencyKey: idempotencyKey}
+		m.addBalanceEvent(debit)
+		m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceTransferIn, AccountID: to, ResourceType: resourceType,
+			Amount: amount, Balance: result.ToBalance, IdempotencyKey: idempotencyKey})
+		crossed = m.crossThresholds(debit, fromAcc)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	m.publish("transfers.created", event)
+	for _, e := range crossed {
+		m.publish("balance.threshold_crossed", e)
+	}
+	return result, nil
+}
+
+// SyncTransfer records a transfer made elsewhere; transfers made through this ledger are skipped.
+func (m *MemoryLedger) SyncTransfer(ctx context.Context, event model.TransferEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.txByKey[event.IdempotencyKey+":debit"]; ok {
+		return nil
+	}
+	if err := m.recordTransfer(event); err != nil {
+		return err
+	}
+
+	// As for a spend, a lot may have been expired before this event arrived.
+	for _, lot := range event.Lots {
+		if g, ok := m.grants[lot.GrantID]; ok {
+			g.Remaining = max(g.Remaining-lot.Amount, 0)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryLedger) SetCreditLimit(ctx context.Context, accountID, resourceType string, limit int64) error {
+	if limit < 0 {
+		return apperr.Validation("credit limit must not be negative")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, err := m.liveAccount(accountID, resourceType)
+	if err != nil {
+		return err
+	}
+	acc.creditLimit = limit
+	return nil
+}
+
+func (m *MemoryLedger) GetCreditLimit(ctx context.Context, accountID, resourceType string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, err := m.liveAccount(accountID, resourceType)
+	if err != nil {
+		return 0, err
+	}
+	return acc.creditLimit, nil
+}
+
+func (m *MemoryLedger) GrantCredits(ctx context.Context, req model.GrantRequest) (*model.CreditGrant, error) {
+	if err := validateGrant(req); err != nil {
+		return nil, err
+	}
+
+	grantID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fp := grantFingerprint(req)
+	if done, err := m.operationDone(req.IdempotencyKey, fp); err != nil {
+		return nil, err
+	} else if done {
+		for _, g := range m.grants {
+			if g.idempotencyKey == req.IdempotencyKey {
+				grant := g.CreditGrant
+				grant.Remaining = grant.Amount
+				return &grant, nil
+			}
+		}
+		return nil, fmt.Errorf("grant %s not found", req.IdempotencyKey)
+	}
+	acc, err := m.liveAccount(req.AccountID, req.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	acc.amount += req.Amount
+	m.claimOperation(req.IdempotencyKey, fp)
+
+	grant := model.CreditGrant{
+		ID:           grantID,
+		AccountID:    req.AccountID,
+		ResourceType: req.ResourceType,
+		Amount:       req.Amount,
+		Remaining:    req.Amount,
+		Priority:     req.Priority,
+		ExpiresAt:    req.ExpiresAt,
+		CreatedAt:    time.Now(),
+	}
+	m.grants[grantID] = &memGrant{CreditGrant: grant, status: "active", idempotencyKey: req.IdempotencyKey}
+
+	err = m.writeJournal(model.JournalEntry{
+		Type:           model.EntryRecharge,
+		IdempotencyKey: "grant:" + grantID,
+		Reference:      grantID,
+		Metadata:       map[string]string{"source": "credit_grant"},
+		Legs:           legs(req.AccountID, model.SystemFunding, req.ResourceType, req.Amount),
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceGrant, AccountID: req.AccountID, ResourceType: req.ResourceType,
+		Amount: req.Amount, Balance: acc.available(), IdempotencyKey: req.IdempotencyKey})
+	return &grant, nil
+}
+
+func (m *MemoryLedger) GetBalanceBreakdown(ctx context.Context, accountID, resourceType string) (*model.BalanceBreakdown, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, err := m.cachedAccount(accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := &model.BalanceBreakdown{Balance: acc.available(), Lots: []model.CreditGrant{}}
+	var allocated int64
+	for _, g := range m.activeLots(memKey{accountID, resourceType}) {
+		allocated += g.Remaining
+		breakdown.Lots = append(breakdown.Lots, g.CreditGrant)
+	}
+	breakdown.Unallocated = breakdown.Balance - allocated
+	return breakdown, nil
+}
+
+func (m *MemoryLedger) ExpireGrants(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+
+	var due []*memGrant
+	for _, g := range m.grants {
+		if g.status == "active" && g.ExpiresAt != nil && !g.ExpiresAt.After(before) {
+			due = append(due, g)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ExpiresAt.Before(*due[j].ExpiresAt) })
+	if len(due) > 500 {
+		due = due[:500]
+	}
+
+	var events []model.CreditExpiredEvent
+	for _, g := range due {
+		acc := m.accounts[memKey{g.AccountID, g.ResourceType}]
+
+		// Never expire more than is left on the balance (a refill_to takes credits away
+		// without drawing from lots).
+		expired := min(g.Remaining, max(acc.available(), 0))
+		acc.amount -= expired
+		g.Remaining = 0
+		g.status = "expired"
+
+		if expired > 0 {
+			err := m.writeJournal(model.JournalEntry{
+				Type:           model.EntryAdjustment,
+				IdempotencyKey: "expire:" + g.ID,
+				Reference:      g.ID,
+				Metadata:       map[string]string{"reason": "credit_grant_expired"},
+				Legs:           legs(g.AccountID, model.SystemExpired, g.ResourceType, -expired),
+			})
+			if err != nil {
+				m.mu.Unlock()
+				return len(events), err
+			}
+		}
+
+		m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceGrantExpired, AccountID: g.AccountID, ResourceType: g.ResourceType,
+			Amount: expired, Balance: acc.available()})
+		events = append(events, model.CreditExpiredEvent{
+			GrantID:      g.ID,
+			AccountID:    g.AccountID,
+			ResourceType: g.ResourceType,
+			Amount:       expired,
+			ExpiredAt:    time.Now(),
+		})
+	}
+	m.mu.Unlock()
+
+	for _, e := range events {
+		m.publish("credits.expired", e)
+	}
+	return len(events), nil
+}
+
+func (m *MemoryLedger) Refund(ctx context.Context, originalIdempotencyKey string, amount int64, idempotencyKey string) (*model.RefundResult, error) {
+	if amount <= 0 {
+		return nil, apperr.Validation("refund amount must be positive")
+	}
+
+	refundID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.txByKey[originalIdempotencyKey]
+	if !ok {
+		return nil, ErrOriginalNotFound
+	}
+	original := m.transactions[i]
+	if original.ReversalOf != "" || original.Amount <= 0 || (original.Metadata["type"] != "" && original.Metadata["type"] != "spend") {
+		return nil, ErrOriginalNotFound
+	}
+
+	fp := fingerprint(opRefund, originalIdempotencyKey, amount)
+	done, err := m.operationDone(idempotencyKey, fp)
+	if err != nil {
+		return nil, err
+	}
+
+	var refunded int64
+	var replayed *model.Transaction
+	for _, t := range m.transactions {
+		if t.ReversalOf == original.ID {
+			refunded -= t.Amount
+			if done && t.Metadata["refund_key"] == idempotencyKey {
+				replayed = &t
+			}
+		}
+	}
+	acc := m.accounts[memKey{original.AccountID, original.ResourceType}]
+	if done {
+		if replayed == nil {
+			return nil, fmt.Errorf("refund %s not found", idempotencyKey)
+		}
+		if acc.deleted {
+			return nil, ErrAccountDeleted
+		}
+		return &model.RefundResult{
+			RefundID:       strings.TrimPrefix(replayed.IdempotencyKey, fmt.Sprintf("refund:%s:", originalIdempotencyKey)),
+			OriginalKey:    originalIdempotencyKey,
+			Amount:         -replayed.Amount,
+			RefundedTotal:  refunded,
+			OriginalAmount: original.Amount,
+			NewBalance:     acc.available(),
+			Status:         "REFUNDED",
+		}, nil
+	}
+	if refunded+amount > original.Amount {
+		return nil, fmt.Errorf("%w: %d of %d already refunded", ErrRefundExceeds, refunded, original.Amount)
+	}
+	if acc.deleted {
+		return nil, ErrAccountDeleted
+	}
+
+	metadata := map[string]string{"type": "refund"}
+	if idempotencyKey != "" {
+		metadata["refund_key"] = idempotencyKey
+	}
+	refundKey := fmt.Sprintf("refund:%s:%s", originalIdempotencyKey, refundID)
+	m.insertTransaction(model.Transaction{
+		AccountID:      original.AccountID,
+		ResourceType:   original.ResourceType,
+		Amount:         -amount,
+		IdempotencyKey: refundKey,
+		Metadata:       metadata,
+		ReversalOf:     original.ID,
+		CreatedAt:      time.Now(),
+	})
+	m.claimOperation(idempotencyKey, fp)
+	acc.amount += amount
+
+	err = m.writeJournal(model.JournalEntry{
+		Type:           model.EntryRefund,
+		IdempotencyKey: refundKey,
+		Reference:      "spend:" + originalIdempotencyKey,
+		Legs:           legs(original.AccountID, model.SystemRevenue, original.ResourceType, amount),
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceRefund, AccountID: original.AccountID, ResourceType: original.ResourceType,
+		Amount: amount, Balance: acc.available(), IdempotencyKey: idempotencyKey})
+
+	return &model.RefundResult{
+		RefundID:       refundID,
+		OriginalKey:    originalIdempotencyKey,
+		Amount:         amount,
+		RefundedTotal:  refunded + amount,
+		OriginalAmount: original.Amount,
+		NewBalance:     acc.available(),
+		Status:         "REFUNDED",
+	}, nil
+}
+
+func (m *MemoryLedger) CheckJournal(ctx context.Context) (*model.JournalReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := &model.JournalReport{
+		CheckedAt:         time.Now(),
+		UnbalancedEntries: []model.UnbalancedEntry{},
+		BalanceMismatches: []model.BalanceMismatch{},
+	}
+
+	totals := make(map[memKey]int64)
+	for _, entry := range m.journal {
+		var sum int64
+		for _, leg := range entry.Legs {
+			sum += leg.Amount
+			totals[memKey{leg.AccountID, leg.ResourceType}] += leg.Amount
+		}
+		if sum != 0 {
+			report.UnbalancedEntries = append(report.UnbalancedEntries, model.UnbalancedEntry{EntryID: entry.ID, Sum: sum})
+		}
+	}
+
+	for key, acc := range m.accounts {
+		if acc.amount != totals[key] {
+			report.BalanceMismatches = append(report.BalanceMismatches, model.BalanceMismatch{
+				AccountID:      key.accountID,
+				ResourceType:   key.resourceType,
+				Balance:        acc.amount,
+				JournalBalance: totals[key],
+			})
+		}
+	}
+
+	report.OK = len(report.UnbalancedEntries) == 0 && len(report.BalanceMismatches) == 0
+	return report, nil
+}
+
+func (m *MemoryLedger) ListTransactions(ctx context.Context, f model.TransactionFilter) (*model.TransactionPage, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	var cursorAt time.Time
+	var cursorID string
+	if f.Cursor != "" {
+		var err error
+		if cursorAt, cursorID, err = decodeCursor(f.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	var matched []model.Transaction
+	for _, t := range m.transactions {
+		if memMatches(t, f) && (f.Cursor == "" || memBefore(t, cursorAt, cursorID)) {
+			matched = append(matched, t)
+		}
+	}
+	m.mu.Unlock()
+
+	// Newest first, with the ID as tie-breaker, like the (created_at, id) ordering of LedgerRepo.
+	sort.Slice(matched, func(i, j int) bool {
+		return memBefore(matched[j], matched[i].CreatedAt, matched[i].ID)
+	})
+
+	page := &model.TransactionPage{Transactions: []model.Transaction{}}
+	if len(matched) > limit {
+		matched = matched[:limit]
+		last := matched[limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+	page.Transactions = append(page.Transactions, matched...)
+	return page, nil
+}
+
+// memMatches reports whether a transaction passes every filter except the cursor.
+func memMatches(t model.Transaction, f model.TransactionFilter) bool {
+	if t.AccountID != f.AccountID {
+		return false
+	}
+	if f.ResourceType != "" && t.ResourceType != f.ResourceType {
+		return false
+	}
+	if f.From != nil && t.CreatedAt.Before(*f.From) {
+		return false
+	}
+	if f.To != nil && !t.CreatedAt.Before(*f.To) {
+		return false
+	}
+	if f.MinAmount != nil && t.Amount < *f.MinAmount {
+		return false
+	}
+	if f.MaxAmount != nil && t.Amount > *f.MaxAmount {
+		return false
+	}
+	for k, v := range f.Metadata {
+		if t.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// memBefore reports whether t sorts before (createdAt, id), i.e. (t.CreatedAt, t.ID) < (createdAt, id).
+func memBefore(t model.Transaction, createdAt time.Time, id string) bool {
+	if !t.CreatedAt.Equal(createdAt) {
+		return t.CreatedAt.Before(createdAt)
+	}
+	return t.ID < id
+}
+
+func (m *MemoryLedger) GetBalanceAt(ctx context.Context, accountID, resourceType string, at time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := memKey{accountID, resourceType}
+	if _, ok := m.accounts[key]; !ok {
+		return 0, ErrNotFoundInDB
+	}
+
+	// Start from the latest snapshot taken at or before the time, then add the legs since.
+	var base int64
+	var since *time.Time
+	for _, s := range m.snapshots[key] {
+		if !s.at.After(at) && (since == nil || s.at.After(*since)) {
+			base, since = s.amount, &s.at
+		}
+	}
+	return base + m.legsBetween(key, since, at, true), nil
+}
+
+func (m *MemoryLedger) TakeSnapshots(ctx context.Context, at time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	taken := 0
+	for key := range m.accounts {
+		var base int64
+		var since *time.Time
+		existing := -1
+		for i, s := range m.snapshots[key] {
+			if s.at.Equal(at) {
+				existing = i
+			}
+			if s.at.Before(at) && (since == nil || s.at.After(*since)) {
+				base, since = s.amount, &s.at
+			}
+		}
+
+		amount := base + m.legsBetween(key, since, at, false)
+		switch {
+		case existing < 0:
+			m.snapshots[key] = append(m.snapshots[key], memSnapshot{at: at, amount: amount})
+		case m.snapshots[key][existing].amount != amount:
+			m.snapshots[key][existing].amount = amount
+		default:
+			continue
+		}
+		taken++
+	}
+	return taken, nil
+}
+
+// legsBetween sums an account's journal legs created at or after since (if set) and
+// before until, or at until as well when inclusive is set.
+func (m *MemoryLedger) legsBetween(key memKey, since *time.Time, until time.Time, inclusive bool) int64 {
+	var total int64
+	for _, entry := range m.journal {
+		if since != nil && entry.CreatedAt.Before(*since) {
+			continue
+		}
+		if entry.CreatedAt.After(until) || (!inclusive && entry.CreatedAt.Equal(until)) {
+			continue
+		}
+		for _, leg := range entry.Legs {
+			if leg.AccountID == key.accountID && leg.ResourceType == key.resourceType {
+				total += leg.Amount
+			}
+		}
+	}
+	return total
+}
+
+// Reconcile has nothing to compare: the ledger has a single store, so it never drifts.
+func (m *MemoryLedger) Reconcile(ctx context.Context, policy model.RepairPolicy) (*model.DriftReport, error) {
+	switch policy {
+	case "":
+		policy = model.RepairNone
+	case model.RepairNone, model.RepairTrustRedis, model.RepairTrustPostgres:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPolicy, policy)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := &model.DriftReport{
+		OK:        true,
+		Policy:    policy,
+		CheckedAt: time.Now(),
+		Accounts:  []model.AccountDrift{},
+	}
+	for _, acc := range m.accounts {
+		if !acc.deleted {
+			report.Scanned++
+		}
+	}
+	return report, nil
+}
+
+func (m *MemoryLedger) ParkDeadLetter(ctx context.Context, dl model.DeadLetter) error {
+	var event struct {
+		IdempotencyKey string `json:"idempotency_key"`
+	}
+	_ = json.Unmarshal([]byte(dl.Payload), &event)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if event.IdempotencyKey != "" {
+		for _, parked := range m.deadLetters {
+			if parked.Status == model.DeadLetterParked && parked.Topic == dl.Topic && parked.EventKey == event.IdempotencyKey {
+				parked.Error = dl.Error
+				parked.Attempts += dl.Attempts
+				parked.UpdatedAt = now
+				return nil
+			}
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	m.deadLetters = append(m.deadLetters, &model.DeadLetter{
+		ID:        id,
+		Topic:     dl.Topic,
+		EventKey:  event.IdempotencyKey,
+		Payload:   dl.Payload,
+		Error:     dl.Error,
+		Attempts:  dl.Attempts,
+		Status:    model.DeadLetterParked,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	return nil
+}
+
+func (m *MemoryLedger) ListDeadLetters(ctx context.Context, status string, limit int) ([]model.DeadLetter, error) {
+	if status == "" {
+		status = model.DeadLetterParked
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Dead letters are appended as they are parked, so walking backwards is newest first.
+	letters := []model.DeadLetter{}
+	for i := len(m.deadLetters) - 1; i >= 0 && len(letters) < limit; i-- {
+		if m.deadLetters[i].Status == status {
+			letters = append(letters, *m.deadLetters[i])
+		}
+	}
+	return letters, nil
+}
+
+func (m *MemoryLedger) GetDeadLetter(ctx context.Context, id string) (*model.DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, dl := range m.deadLetters {
+		if dl.ID == id {
+			found := *dl
+			return &found, nil
+		}
+	}
+	return nil, ErrDeadLetterNotFound
+}
+
+func (m *MemoryLedger) ReplayDeadLetter(ctx context.Context, id string) error {
+	if m.bus == nil {
+		return errors.New("replay dead letter: no message bus")
+	}
+
+	m.mu.Lock()
+	dl := m.parkedDeadLetter(id)
+	if dl == nil {
+		m.mu.Unlock()
+		return ErrDeadLetterNotFound
+	}
+	// Claimed before publishing so it is replayed at most once; put back if the publish fails.
+	dl.Status = model.DeadLetterReplaying
+	dl.UpdatedAt = time.Now()
+	topic, payload := dl.Topic, dl.Payload
+	m.mu.Unlock()
+
+	err := m.bus.Publish(topic, []byte(payload))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dl.UpdatedAt = time.Now()
+	if err != nil {
+		dl.Status = model.DeadLetterParked
+		return fmt.Errorf("replay dead letter: %w", err)
+	}
+	dl.Status = model.DeadLetterReplayed
+	return nil
+}
+
+func (m *MemoryLedger) DiscardDeadLetter(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dl := m.parkedDeadLetter(id)
+	if dl == nil {
+		return ErrDeadLetterNotFound
+	}
+	dl.Status = model.DeadLetterDiscarded
+	dl.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *MemoryLedger) parkedDeadLetter(id string) *model.DeadLetter {
+	for _, dl := range m.deadLetters {
+		if dl.ID == id && dl.Status == model.DeadLetterParked {
+			return dl
+		}
+	}
+	return nil
+}
+
+// processed reports whether an idempotency key was used within the last 24 hours.
+func (m *MemoryLedger) processed(key string) bool {
+	expiry, ok := m.idempotency[key]
+	if ok && time.Now().After(expiry) {
+		delete(m.idempotency, key)
+		delete(m.spendReplies, key)
+		return false
+	}
+	return ok
+}
+
+func (m *MemoryLedger) remember(key string) {
+	m.idempotency[key] = time.Now().Add(idempotencyTTL)
+}
+
+// operationDone is claimIdempotencyKey for the operations LedgerRepo keeps keys of in PostgreSQL.
+func (m *MemoryLedger) operationDone(key, fingerprint string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	stored, ok := m.opKeys[key]
+	if !ok {
+		return false, nil
+	}
+	if stored != fingerprint {
+		return false, ErrIdempotencyConflict
+	}
+	return true, nil
+}
+
+// claimOperation records the key of an operation that has been done.
+func (m *MemoryLedger) claimOperation(key, fingerprint string) {
+	if key != "" {
+		m.opKeys[key] = fingerprint
+	}
+}
+
+// cachedAccount returns an account the way the Lua scripts see it after a warm-up:
+// unknown accounts are not found and deleted ones are refused.
+func (m *MemoryLedger) cachedAccount(accountID, resourceType string) (*memAccount, error) {
+	acc, ok := m.accounts[memKey{accountID, resourceType}]
+	if !ok {
+		return nil, ErrNotFoundInDB
+	}
+	if acc.deleted {
+		return nil, ErrAccountDeleted
+	}
+	return acc, nil
+}
+
+// liveAccount returns an account the way PostgreSQL updates see it: deleted accounts are not found.
+func (m *MemoryLedger) liveAccount(accountID, resourceType string) (*memAccount, error) {
+	acc, ok := m.accounts[memKey{accountID, resourceType}]
+	if !ok || acc.deleted {
+		return nil, ErrNotFoundInDB
+	}
+	return acc, nil
+}
+
+// activeLots returns an account's lots with something left, in the order they are consumed.
+func (m *MemoryLedger) activeLots(key memKey) []*memGrant {
+	var lots []*memGrant
+	for _, g := range m.grants {
+		if g.status == "active" && g.Remaining > 0 && g.AccountID == key.accountID && g.ResourceType == key.resourceType {
+			lots = append(lots, g)
+		}
+	}
+	sort.Slice(lots, func(i, j int) bool {
+		si, sj := lotScore(lots[i].Priority, lots[i].ExpiresAt), lotScore(lots[j].Priority, lots[j].ExpiresAt)
+		if si != sj {
+			return si < sj
+		}
+		return lots[i].ID < lots[j].ID
+	})
+	return lots
+}
+
+// consumeLots takes amount from the account's lots in order; whatever they don't cover
+// comes from the non-expiring balance.
+func (m *MemoryLedger) consumeLots(key memKey, amount int64) []model.LotUsage {
+	var consumed []model.LotUsage
+	for _, g := range m.activeLots(key) {
+		if amount <= 0 {
+			break
+		}
+		take := min(g.Remaining, amount)
+		g.Remaining -= take
+		amount -= take
+		consumed = append(consumed, model.LotUsage{GrantID: g.ID, Amount: take})
+	}
+	return consumed
+}
+
+// recordSpend books a spend: its transaction, the balance change and the journal entry.
+func (m *MemoryLedger) recordSpend(e model.SpendEvent) error {
+	err := m.writeJournal(model.JournalEntry{
+		Type:           model.EntrySpend,
+		IdempotencyKey: "spend:" + e.IdempotencyKey,
+		Legs:           legs(e.AccountID, model.SystemRevenue, e.ResourceType, -e.Amount),
+		CreatedAt:      e.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	m.insertTransaction(model.Transaction{
+		AccountID:      e.AccountID,
+		ResourceType:   e.ResourceType,
+		Amount:         e.Amount,
+		IdempotencyKey: e.IdempotencyKey,
+		CreatedAt:      e.CreatedAt,
+	})
+	if acc, ok := m.accounts[memKey{e.AccountID, e.ResourceType}]; ok {
+		acc.amount -= e.Amount
+	}
+	return nil
+}
+
+// recordTransfer books both legs of a transfer, as SyncTransfer does.
+func (m *MemoryLedger) recordTransfer(e model.TransferEvent) error {
+	err := m.writeJournal(model.JournalEntry{
+		Type:           model.EntryTransfer,
+		IdempotencyKey: "transfer:" + e.IdempotencyKey,
+		Legs:           legs(e.ToAccountID, e.FromAccountID, e.ResourceType, e.Amount),
+		CreatedAt:      e.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	m.insertTransaction(model.Transaction{
+		AccountID:      e.FromAccountID,
+		ResourceType:   e.ResourceType,
+		Amount:         e.Amount,
+		IdempotencyKey: e.IdempotencyKey + ":debit",
+		Metadata:       map[string]string{"type": "transfer", "counterparty": e.ToAccountID},
+		CreatedAt:      e.CreatedAt,
+	})
+	m.insertTransaction(model.Transaction{
+		AccountID:      e.ToAccountID,
+		ResourceType:   e.ResourceType,
+		Amount:         -e.Amount,
+		IdempotencyKey: e.IdempotencyKey + ":credit",
+		Metadata:       map[string]string{"type": "transfer", "counterparty": e.FromAccountID},
+		CreatedAt:      e.CreatedAt,
+	})
+	if acc, ok := m.accounts[memKey{e.FromAccountID, e.ResourceType}]; ok {
+		acc.amount -= e.Amount
+	}
+	if acc, ok := m.accounts[memKey{e.ToAccountID, e.ResourceType}]; ok {
+		acc.amount += e.Amount
+	}
+	return nil
+}
+
+func (m *MemoryLedger) insertTransaction(t model.Transaction) {
+	t.ID, _ = newID()
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	m.txByKey[t.IdempotencyKey] = len(m.transactions)
+	m.transactions = append(m.transactions, t)
+}
+
+// writeJournal records a balanced entry, rejecting it like the PostgreSQL writeJournal does.
+func (m *MemoryLedger) writeJournal(entry model.JournalEntry) error {
+	var sum int64
+	for _, leg := range entry.Legs {
+		sum += leg.Amount
+	}
+	if sum != 0 || len(entry.Legs) < 2 {
+		return fmt.Errorf("%w: %s %s", ErrUnbalancedEntry, entry.Type, entry.IdempotencyKey)
+	}
+
+	entry.ID, _ = newID()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	m.journal = append(m.journal, entry)
+
+	// A leg booked after the snapshots that should include it brings them up to date.
+	for _, leg := range entry.Legs {
+		snapshots := m.snapshots[memKey{leg.AccountID, leg.ResourceType}]
+		for i := range snapshots {
+			if snapshots[i].at.After(entry.CreatedAt) {
+				snapshots[i].amount += leg.Amount
+			}
+		}
+	}
+	return nil
+}
+
+// WatchBalances follows the in-process feed. Offsets are built like those of LedgerRepo's
+// feed; one from before a restart resumes with the oldest event kept, as one older than
+// LedgerRepo's retention does.
+func (m *MemoryLedger) WatchBalances(ctx context.Context, accountIDs []string, offset string) (<-chan model.BalanceEvent, error) {
+	watched, err := watchedAccounts(accountIDs)
+	if err != nil {
+		return nil, err
+	}
+	if offset != "" && !streamOffset.MatchString(offset) {
+		return nil, apperr.Validation("invalid offset")
+	}
+
+	last := offset
+	if last == "" {
+		m.mu.Lock()
+		last = m.newestOffset()
+		m.mu.Unlock()
+	}
+
+	events := make(chan model.BalanceEvent, 64)
+	go func() {
+		defer close(events)
+		for {
+			m.mu.Lock()
+			var pending []model.BalanceEvent
+			from := sort.Search(len(m.feed), func(i int) bool { return olderOffset(last, m.feed[i].Offset) })
+			for _, e := range m.feed[from:] {
+				if watched.has(e.AccountID) {
+					pending = append(pending, e)
+				}
+			}
+			if from < len(m.feed) {
+				last = m.newestOffset()
+			}
+			signal := m.feedSignal
+			m.mu.Unlock()
+
+			for _, e := range pending {
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-signal:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// newestOffset returns the offset of the newest event of the feed, "0-0" when it is empty.
+// The caller must hold m.mu.
+func (m *MemoryLedger) newestOffset() string {
+	if len(m.feed) == 0 {
+		return "0-0"
+	}
+	return m.feed[len(m.feed)-1].Offset
+}
+
+// addBalanceEvent adds a balance change to the feed and wakes up the watchers.
+// The caller must hold m.mu.
+func (m *MemoryLedger) addBalanceEvent(e model.BalanceEvent) {
+	m.feedSeq++
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	// Offsets are "<ms>-<seq>" like Redis stream IDs, and like them never go back, even
+	// when the clock does.
+	if ms := e.At.UnixMilli(); ms > m.feedMs {
+		m.feedMs, m.feedMsSeq = ms, 0
+	} else {
+		m.feedMsSeq++
+	}
+	e.Offset = fmt.Sprintf("%d-%d", m.feedMs, m.feedMsSeq)
+	m.feed = append(m.feed, e)
+	// Trim in chunks, so that the feed is not copied on every event.
+	if len(m.feed) >= 2*memFeedRetention {
+		m.feed = append([]model.BalanceEvent(nil), m.feed[len(m.feed)-memFeedRetention:]...)
+	}
+	close(m.feedSignal)
+	m.feedSignal = make(chan struct{})
+}
+
+func (m *MemoryLedger) publish(topic string, event any) {
+	if m.bus == nil {
+		return
+	}
+	data, _ := json.Marshal(event)
+	if err := m.bus.Publish(topic, data); err != nil {
+		slog.Error("event publish failed", "error", err, "topic", topic)
+	}
+}
+
+func (m *MemoryLedger) CreateWebhook(ctx context.Context, req model.WebhookRequest) (*model.Webhook, error) {
+	w, err := newWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+	if w.ID, err = newID(); err != nil {
+		return nil, err
+	}
+	w.CreatedAt = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.webhooks = append(m.webhooks, &w)
+	created := w
+	return &created, nil
+}
+
+func (m *MemoryLedger) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhooks := []model.Webhook{}
+	for _, w := range m.webhooks {
+		listed := *w
+		listed.Secret = ""
+		webhooks = append(webhooks, listed)
+	}
+	return webhooks, nil
+}
+
+func (m *MemoryLedger) DeleteWebhook(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.IndexFunc(m.webhooks, func(w *model.Webhook) bool { return w.ID == id })
+	if i < 0 {
+		return ErrWebhookNotFound
+	}
+	m.webhooks = slices.Delete(m.webhooks, i, i+1)
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d *model.WebhookDelivery) bool { return d.WebhookID == id })
+	return nil
+}
+
+func (m *MemoryLedger) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.webhook(webhookID) == nil {
+		return nil, ErrWebhookNotFound
+	}
+	deliveries := []model.WebhookDelivery{}
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := m.deliveries[i]; d.WebhookID == webhookID {
+			listed := *d
+			listed.URL, listed.Secret = "", ""
+			if listed.Status != model.WebhookPending {
+				listed.NextAttemptAt = nil
+			}
+			deliveries = append(deliveries, listed)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryLedger) RedeliverWebhook(ctx context.Context, deliveryID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.delivery(deliveryID)
+	if d == nil {
+		return ErrDeliveryNotFound
+	}
+	now := time.Now()
+	d.Status, d.Attempts, d.NextAttemptAt = model.WebhookPending, 0, &now
+	return nil
+}
+
+// FanOutWebhookEvents fans out the feed events after the last one fanned out, waiting for
+// up to balanceEventBlock when there are none. The feed only lives in this process, so
+// there is no group to share it with and consumer is not used.
+func (m *MemoryLedger) FanOutWebhookEvents(ctx context.Context, consumer string) (int, error) {
+	m.mu.Lock()
+	if m.webhookSeq == m.feedSeq {
+		signal := m.feedSignal
+		m.mu.Unlock()
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(balanceEventBlock):
+			return 0, nil
+		}
+		m.mu.Lock()
+	}
+	defer m.mu.Unlock()
+
+	first := m.feedSeq - uint64(len(m.feed)) + 1
+	if m.webhookSeq+1 < first {
+		slog.Error("webhook fan-out fell behind the balance feed, events were not delivered",
+			"after", m.webhookSeq, "through", first-1)
+		m.webhookSeq = first - 1
+	}
+	events := m.feed[m.webhookSeq+1-first:]
+	events = events[:min(len(events), webhookFanOutBatch)]
+
+	now := time.Now()
+	for _, event := range events {
+		for _, w := range m.webhooks {
+			if !subscribed(*w, event) || w.CreatedAt.After(event.At) {
+				continue
+			}
+			id, err := newID()
+			if err != nil {
+				return 0, err
+			}
+			next := now
+			m.deliveries = append(m.deliveries, &model.WebhookDelivery{
+				ID:            id,
+				WebhookID:     w.ID,
+				Event:         event,
+				Status:        model.WebhookPending,
+				NextAttemptAt: &next,
+				CreatedAt:     now,
+			})
+		}
+		m.webhookSeq++
+	}
+	return len(events), nil
+}
+
+func (m *MemoryLedger) ClaimWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var claimed []model.WebhookDelivery
+	leased := now.Add(webhookLease)
+	for _, d := range m.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+		if d.Status != model.WebhookPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		w := m.webhook(d.WebhookID)
+		d.NextAttemptAt = &leased
+		c := *d
+		c.URL, c.Secret = w.URL, w.Secret
+		claimed = append(claimed, c)
+	}
+	return claimed, nil
+}
+
+func (m *MemoryLedger) RecordWebhookAttempt(ctx context.Context, attempt model.WebhookAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.delivery(attempt.DeliveryID)
+	if d == nil {
+		return ErrDeliveryNotFound
+	}
+	d.Attempts++
+	d.LastStatusCode, d.LastError = attempt.StatusCode, attempt.Error
+	d.Status, d.NextAttemptAt = attemptStatus(attempt)
+	if attempt.Delivered {
+		now := time.Now()
+		d.DeliveredAt = &now
+	}
+	return nil
+}
+
+func (m *MemoryLedger) webhook(id string) *model.Webhook {
+	for _, w := range m.webhooks {
+		if w.ID == id {
+			return w
+		}
+	}
+	return nil
+}
+
+func (m *MemoryLedger) delivery(id string) *model.WebhookDelivery {
+	for _, d := range m.deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func (m *MemoryLedger) CreateThreshold(ctx context.Context, req model.ThresholdRequest) (*model.BalanceThreshold, error) {
+	if err := validateThreshold(req); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.liveAccount(req.AccountID, req.ResourceType); err != nil {
+		return nil, err
+	}
+	t := &model.BalanceThreshold{
+		ID:           id,
+		AccountID:    req.AccountID,
+		ResourceType: req.ResourceType,
+		Kind:         req.Kind,
+		Value:        req.Value,
+		Armed:        true,
+		CreatedAt:    time.Now(),
+	}
+	m.thresholds = append(m.thresholds, t)
+	created := *t
+	return &created, nil
+}
+
+func (m *MemoryLedger) ListThresholds(ctx context.Context, accountID, resourceType string) ([]model.BalanceThreshold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	thresholds := []model.BalanceThreshold{}
+	for _, t := range m.thresholds {
+		if t.AccountID == accountID && t.ResourceType == resourceType {
+			thresholds = append(thresholds, *t)
+		}
+	}
+	return thresholds, nil
+}
+
+func (m *MemoryLedger) DeleteThreshold(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.IndexFunc(m.thresholds, func(t *model.BalanceThreshold) bool { return t.ID == id })
+	if i < 0 {
+		return ErrThresholdNotFound
+	}
+	m.thresholds = slices.Delete(m.thresholds, i, i+1)
+	return nil
+}
+
+// armThresholds arms an account's thresholds again. The caller must hold m.mu.
+func (m *MemoryLedger) armThresholds(key memKey) {
+	for _, t := range m.thresholds {
+		if t.AccountID == key.accountID && t.ResourceType == key.resourceType {
+			t.Armed = true
+		}
+	}
+}
+
+// crossThresholds disarms the thresholds a debit of acc crossed and returns their events.
+// The caller must hold m.mu.
+func (m *MemoryLedger) crossThresholds(change model.BalanceEvent, acc *memAccount) []model.ThresholdCrossedEvent {
+	var crossed []model.ThresholdCrossedEvent
+	for _, t := range m.thresholds {
+		if !t.Armed || t.AccountID != change.AccountID || t.ResourceType != change.ResourceType {
+			continue
+		}
+		e, ok := crossedThreshold(*t, acc.lastRecharge, change.Balance+change.Amount, change.Balance)
+		if !ok {
+			continue
+		}
+		t.Armed = false
+		e.IdempotencyKey = change.IdempotencyKey
+		m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceThresholdCrossed, AccountID: e.AccountID, ResourceType: e.ResourceType,
+			Amount: e.Level, Balance: e.Balance, IdempotencyKey: e.IdempotencyKey, At: e.CrossedAt})
+		crossed = append(crossed, e)
+	}
+	return crossed
+}
+
+func (m *MemoryLedger) CreateQuotaPolicy(ctx context.Context, req model.QuotaPolicyRequest) (*model.QuotaPolicy, error) {
+	p, err := newQuotaPolicy(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if p.ID, err = newID(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.liveAccount(req.AccountID, req.ResourceType); err != nil {
+		return nil, err
+	}
+	m.quotas = append(m.quotas, &p)
+	created := p
+	return &created, nil
+}
+
+func (m *MemoryLedger) ListQuotaPolicies(ctx context.Context, accountID, resourceType string) ([]model.QuotaPolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	policies := []model.QuotaPolicy{}
+	for _, p := range m.quotas {
+		if p.AccountID == accountID && p.ResourceType == resourceType {
+			policies = append(policies, *p)
+		}
+	}
+	return policies, nil
+}
+
+func (m *MemoryLedger) DeleteQuotaPolicy(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.IndexFunc(m.quotas, func(p *model.QuotaPolicy) bool { return p.ID == id })
+	if i < 0 {
+		return ErrQuotaPolicyNotFound
+	}
+	m.quotas = slices.Delete(m.quotas, i, i+1)
+	return nil
+}
+
+// ApplyDueRefills applies the due periods of every due policy and returns how many periods
+// it applied. As with LedgerRepo, a policy that fails is logged and skipped.
+func (m *MemoryLedger) ApplyDueRefills(ctx context.Context, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []*model.QuotaPolicy
+	for _, p := range m.quotas {
+		if !p.NextRefillAt.After(now) {
+			due = append(due, p)
+		}
+	}
+	slices.SortStableFunc(due, func(a, b *model.QuotaPolicy) int { return a.NextRefillAt.Compare(b.NextRefillAt) })
+
+	applied := 0
+	for _, p := range due[:min(len(due), refillBatchSize)] {
+		n, err := m.applyRefill(p, now)
+		if err != nil {
+			slog.Error("quota refill failed", "error", err, "policy_id", p.ID)
+			continue
+		}
+		applied += n
+	}
+	return applied, nil
+}
+
+// applyRefill applies the due periods of a policy and schedules the next one, like
+// LedgerRepo's. The journal is written first, so a policy that fails is not refilled.
+func (m *MemoryLedger) applyRefill(p *model.QuotaPolicy, now time.Time) (int, error) {
+	acc, err := m.liveAccount(p.AccountID, p.ResourceType)
+	if err != nil {
+		// Nothing left to refill.
+		m.quotas = slices.DeleteFunc(m.quotas, func(q *model.QuotaPolicy) bool { return q == p })
+		return 0, nil
+	}
+
+	starts, next := duePeriods(*p, now)
+	balance := acc.available()
+	var periods []refillPeriod
+	var total int64
+	for _, start := range starts {
+		change := refillChange(*p, balance)
+		balance += change
+		total += change
+		if change != 0 {
+			periods = append(periods, refillPeriod{key: periodKey(start), change: change, balance: balance})
+		}
+	}
+
+	for _, period := range periods {
+		if err := m.writeJournal(refillEntry(*p, period.key, period.change)); err != nil {
+			return 0, err
+		}
+	}
+	if len(periods) > 0 {
+		acc.amount += total
+		acc.lastRecharge = max(balance, 0)
+		m.armThresholds(memKey{p.AccountID, p.ResourceType})
+	}
+	for _, period := range periods {
+		m.addBalanceEvent(model.BalanceEvent{Type: model.BalanceRefill, AccountID: p.AccountID, ResourceType: p.ResourceType,
+			Amount: period.change, Balance: period.balance, IdempotencyKey: fmt.Sprintf("refill:%s:%s", p.ID, period.key)})
+	}
+
+	p.LastPeriod = periodKey(starts[len(starts)-1])
+	p.NextRefillAt = next
+	return len(starts), nil
+}
@@ -0,0 +1,878 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+)
+
+// recordingBus keeps every published message for inspection.
+type recordingBus struct {
+	topics   []string
+	payloads [][]byte
+}
+
+func (b *recordingBus) Publish(topic string, data []byte) error {
+	b.topics = append(b.topics, topic)
+	b.payloads = append(b.payloads, data)
+	return nil
+}
+
+// last returns the payload of the latest message published on topic.
+func (b *recordingBus) last(topic string) []byte {
+	for i := len(b.topics) - 1; i >= 0; i-- {
+		if b.topics[i] == topic {
+			return b.payloads[i]
+		}
+	}
+	return nil
+}
+
+func newTestLedger(t *testing.T, balance int64) (*MemoryLedger, *recordingBus) {
+	t.Helper()
+	bus := &recordingBus{}
+	ledger := NewMemoryLedger(bus)
+	if err := ledger.CreateAccount(context.Background(), "user123", "api_credits", balance, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return ledger, bus
+}
+
+func TestMemoryLedger_SpendInsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	ledger := NewMemoryLedger(nil)
+	if err := ledger.CreateAccount(ctx, "user123", "api_credits", 10, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 11, IdempotencyKey: "req-1"})
+	if !errors.Is(err, ErrInsufficient) {
+		t.Fatalf("expected ErrInsufficient, got %v", err)
+	}
+
+	// A rejected spend does not use up its idempotency key.
+	res, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, IdempotencyKey: "req-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.NewBalance != 0 {
+		t.Errorf("expected balance 0, got %d", res.NewBalance)
+	}
+}
+
+func TestMemoryLedger_RechargeNotFound(t *testing.T) {
+	ctx := context.Background()
+	ledger := NewMemoryLedger(nil)
+
+	err := ledger.Recharge(ctx, model.RechargeRequest{AccountID: "ghost", ResourceType: "api_credits", Amount: 10})
+	if !errors.Is(err, ErrNotFoundInDB) {
+		t.Fatalf("expected ErrNotFoundInDB, got %v", err)
+	}
+}
+
+func TestMemoryLedger_SpendIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	ledger, bus := newTestLedger(t, 100)
+
+	req := model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "req-1"}
+	res, err := ledger.Spend(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.NewBalance != 70 || res.Status != "SUCCESS" {
+		t.Errorf("expected SUCCESS with balance 70, got %s with %d", res.Status, res.NewBalance)
+	}
+
+	if _, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 20, IdempotencyKey: "req-2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A retry gets the original result back, not the current balance.
+	replay, err := ledger.Spend(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !replay.Replayed || replay.NewBalance != 70 || replay.Amount != 30 || !replay.ProcessedAt.Equal(res.ProcessedAt) {
+		t.Errorf("expected a replay of %+v, got %+v", res, replay)
+	}
+	if balance, _ := ledger.GetBalance(ctx, "user123", "api_credits"); balance != 50 {
+		t.Errorf("expected the retry to leave balance 50, got %d", balance)
+	}
+
+	// The same key with a different amount is not a retry.
+	reused := req
+	reused.Amount = 31
+	if _, err := ledger.Spend(ctx, reused); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("expected ErrIdempotencyConflict, got %v", err)
+	}
+	if len(bus.topics) != 2 {
+		t.Errorf("expected one transactions.created event per spend, got %v", bus.topics)
+	}
+
+	// The event of a spend made here is already recorded when it comes back from the bus.
+	if err := ledger.SyncTransactionWithBalance(ctx, model.SpendEvent{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "req-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if balance, _ := ledger.GetBalance(ctx, "user123", "api_credits"); balance != 50 {
+		t.Errorf("expected syncing the event again to leave balance 50, got %d", balance)
+	}
+}
+
+func TestMemoryLedger_KeyedOperationsRequireAKey(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+
+	if _, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10}); apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a spend without a key to fail validation, got %v", err)
+	}
+	if _, err := ledger.Authorize(ctx, model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10}); apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a hold without a key to fail validation, got %v", err)
+	}
+	if err := ledger.CreateAccount(ctx, "user456", "api_credits", 0, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ledger.Transfer(ctx, "user123", "user456", "api_credits", 10, ""); apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a transfer without a key to fail validation, got %v", err)
+	}
+	if balance, _ := ledger.GetBalance(ctx, "user123", "api_credits"); balance != 100 {
+		t.Errorf("expected balance 100, got %d", balance)
+	}
+}
+
+func TestMemoryLedger_SpendWithinCreditLimit(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 10)
+	if err := ledger.SetCreditLimit(ctx, "user123", "api_credits", 5); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 15, IdempotencyKey: "req-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.NewBalance != -5 || res.OverdraftUsed != 5 || res.CreditLimit != 5 {
+		t.Errorf("expected balance -5 with 5 of 5 overdraft used, got %+v", res)
+	}
+
+	_, err = ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 1, IdempotencyKey: "req-2"})
+	if !errors.Is(err, ErrInsufficient) {
+		t.Fatalf("expected ErrInsufficient past the credit limit, got %v", err)
+	}
+}
+
+func TestMemoryLedger_DeletedAccountIsTombstoned(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 50)
+
+	if err := ledger.DeleteAccount(ctx, "user123", "api_credits", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 1, IdempotencyKey: "req-1"})
+	if !errors.Is(err, ErrAccountDeleted) {
+		t.Errorf("expected ErrAccountDeleted on spend, got %v", err)
+	}
+	if err := ledger.CreateAccount(ctx, "user123", "api_credits", 10, ""); !errors.Is(err, ErrAccountExists) {
+		t.Errorf("expected ErrAccountExists on re-create, got %v", err)
+	}
+	if err := ledger.DeleteAccount(ctx, "user123", "api_credits", ""); !errors.Is(err, ErrNotFoundInDB) {
+		t.Errorf("expected ErrNotFoundInDB on second delete, got %v", err)
+	}
+
+	report, err := ledger.CheckJournal(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.OK {
+		t.Errorf("expected the journal to balance after closing the account, got %+v", report)
+	}
+}
+
+func TestMemoryLedger_SpendConsumesLotsInOrder(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 0)
+
+	soon := time.Now().Add(time.Hour)
+	later := time.Now().Add(2 * time.Hour)
+	late, err := ledger.GrantCredits(ctx, model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, ExpiresAt: &later})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	early, err := ledger.GrantCredits(ctx, model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, ExpiresAt: &soon})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 15, IdempotencyKey: "req-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	breakdown, err := ledger.GetBalanceBreakdown(ctx, "user123", "api_credits")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if breakdown.Balance != 5 || len(breakdown.Lots) != 1 || breakdown.Lots[0].ID != late.ID || breakdown.Lots[0].Remaining != 5 {
+		t.Errorf("expected the lot expiring first (%s) to be used up and 5 left of %s, got %+v", early.ID, late.ID, breakdown)
+	}
+}
+
+func TestMemoryLedger_TransferConsumesLots(t *testing.T) {
+	ctx := context.Background()
+	ledger, bus := newTestLedger(t, 5)
+	if err := ledger.CreateAccount(ctx, "user456", "api_credits", 0, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	grant, err := ledger.GrantCredits(ctx, model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, ExpiresAt: &expiry})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ledger.Transfer(ctx, "user123", "user456", "api_credits", 8, "tr-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	breakdown, err := ledger.GetBalanceBreakdown(ctx, "user123", "api_credits")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if breakdown.Balance != 7 || len(breakdown.Lots) != 1 || breakdown.Lots[0].Remaining != 2 || breakdown.Unallocated != 5 {
+		t.Errorf("expected 2 left of the lot and the 5 outside it untouched, got %+v", breakdown)
+	}
+	var event model.TransferEvent
+	if err := json.Unmarshal(bus.last("transfers.created"), &event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(event.Lots) != 1 || event.Lots[0] != (model.LotUsage{GrantID: grant.ID, Amount: 8}) {
+		t.Errorf("expected the transfer event to carry 8 from %s, got %+v", grant.ID, event)
+	}
+
+	// The destination gets plain credits, and the source only loses to expiry what is left of the lot.
+	if n, err := ledger.ExpireGrants(ctx, expiry); err != nil || n != 1 {
+		t.Fatalf("expected 1 lot expired, got %d (%v)", n, err)
+	}
+	if balance, _ := ledger.GetBalance(ctx, "user123", "api_credits"); balance != 5 {
+		t.Errorf("expected balance 5 after expiry, got %d", balance)
+	}
+	if balance, _ := ledger.GetBalance(ctx, "user456", "api_credits"); balance != 8 {
+		t.Errorf("expected the destination to keep 8, got %d", balance)
+	}
+}
+
+func TestMemoryLedger_HoldsConsumeLots(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 0)
+
+	expiry := time.Now().Add(time.Hour)
+	if _, err := ledger.GrantCredits(ctx, model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, ExpiresAt: &expiry}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	remaining := func() int64 {
+		breakdown, err := ledger.GetBalanceBreakdown(ctx, "user123", "api_credits")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var total int64
+		for _, lot := range breakdown.Lots {
+			total += lot.Remaining
+		}
+		return total
+	}
+
+	hold, err := ledger.Authorize(ctx, model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 6, IdempotencyKey: "auth-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := remaining(); got != 4 {
+		t.Errorf("expected 4 left of the lot while the hold is pending, got %d", got)
+	}
+
+	// What is not captured goes back to the lot.
+	if _, err := ledger.Capture(ctx, model.CaptureRequest{HoldID: hold.HoldID, Amount: 2}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := remaining(); got != 8 {
+		t.Errorf("expected 8 left of the lot after capturing 2, got %d", got)
+	}
+
+	hold, err = ledger.Authorize(ctx, model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 8, IdempotencyKey: "auth-2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ledger.Void(ctx, hold.HoldID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := remaining(); got != 8 {
+		t.Errorf("expected a void to give the lot back its 8, got %d", got)
+	}
+}
+
+func TestMemoryLedger_GrantPriorityIsBounded(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 0)
+
+	_, err := ledger.GrantCredits(ctx, model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, Priority: maxLotPriority + 1})
+	if apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a validation error, got %v", err)
+	}
+
+	// At the bounds, a second of expiry still orders lots of the same priority.
+	soon := time.Now().Add(time.Hour)
+	later := soon.Add(time.Second)
+	for _, priority := range []int{-maxLotPriority, maxLotPriority} {
+		if lotScore(priority, &soon) >= lotScore(priority, &later) {
+			t.Errorf("priority %d: expected the lot expiring first to score lower", priority)
+		}
+	}
+}
+
+func TestMemoryLedger_GrantIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 0)
+
+	req := model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 10, IdempotencyKey: "grant-1"}
+	first, err := ledger.GrantCredits(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	retry, err := ledger.GrantCredits(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if retry.ID != first.ID {
+		t.Errorf("expected the retry to return grant %s, got %s", first.ID, retry.ID)
+	}
+	if bal, _ := ledger.GetBalance(ctx, "user123", "api_credits"); bal != 10 {
+		t.Errorf("expected the grant to be credited once, got balance %d", bal)
+	}
+
+	req.Amount = 20
+	if _, err := ledger.GrantCredits(ctx, req); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Errorf("expected ErrIdempotencyConflict for a different amount, got %v", err)
+	}
+}
+
+func TestMemoryLedger_CaptureReleasesRemainder(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+
+	hold, err := ledger.Authorize(ctx, model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 40, IdempotencyKey: "auth-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hold.NewBalance != 60 {
+		t.Errorf("expected 60 spendable while held, got %d", hold.NewBalance)
+	}
+
+	res, err := ledger.Capture(ctx, model.CaptureRequest{HoldID: hold.HoldID, Amount: 25})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.NewBalance != 75 {
+		t.Errorf("expected 75 after capturing 25 of 40, got %d", res.NewBalance)
+	}
+	if _, err := ledger.Void(ctx, hold.HoldID); !errors.Is(err, ErrHoldNotFound) {
+		t.Errorf("expected ErrHoldNotFound for a settled hold, got %v", err)
+	}
+}
+
+func TestMemoryLedger_FailedAuthorizeKeepsItsKey(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 50)
+
+	req := model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 80, IdempotencyKey: "auth-1"}
+	if _, err := ledger.Authorize(ctx, req); !errors.Is(err, ErrInsufficient) {
+		t.Fatalf("expected ErrInsufficient, got %v", err)
+	}
+	if err := ledger.Recharge(ctx, model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 50}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The retry authorizes, since the failed attempt never reserved anything.
+	hold, err := ledger.Authorize(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hold.NewBalance != 20 {
+		t.Errorf("expected 20 left after the hold, got %d", hold.NewBalance)
+	}
+	if _, err := ledger.Authorize(ctx, req); !errors.Is(err, ErrAlreadyProcessed) {
+		t.Errorf("expected ErrAlreadyProcessed for a second retry, got %v", err)
+	}
+}
+
+func TestMemoryLedger_RefundIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+
+	if _, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 40, IdempotencyKey: "req-1"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first, err := ledger.Refund(ctx, "req-1", 10, "refund-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	retry, err := ledger.Refund(ctx, "req-1", 10, "refund-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if retry.RefundID != first.RefundID || retry.NewBalance != 70 || retry.RefundedTotal != 10 {
+		t.Errorf("expected the retry to return the first refund, got %+v and %+v", first, retry)
+	}
+	if _, err := ledger.Refund(ctx, "req-1", 20, "refund-1"); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Errorf("expected ErrIdempotencyConflict for a different amount, got %v", err)
+	}
+
+	// A refund of a deleted account changes nothing.
+	if err := ledger.DeleteAccount(ctx, "user123", "api_credits", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ledger.Refund(ctx, "req-1", 10, "refund-2"); !errors.Is(err, ErrAccountDeleted) {
+		t.Fatalf("expected ErrAccountDeleted, got %v", err)
+	}
+	report, err := ledger.CheckJournal(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.OK {
+		t.Errorf("expected the journal to agree with the balances, got %+v", report)
+	}
+}
+
+func TestMemoryLedger_RechargeIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 0)
+
+	req := model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 25, IdempotencyKey: "payment-1"}
+	for i := 0; i < 2; i++ {
+		if err := ledger.Recharge(ctx, req); err != nil {
+			t.Fatalf("attempt %d: unexpected error: %v", i+1, err)
+		}
+	}
+	if balance, _ := ledger.GetBalance(ctx, "user123", "api_credits"); balance != 25 {
+		t.Errorf("expected the retried recharge to be applied once, got balance %d", balance)
+	}
+
+	req.Amount = 30
+	if err := ledger.Recharge(ctx, req); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Errorf("expected ErrIdempotencyConflict, got %v", err)
+	}
+	if err := ledger.DeleteAccount(ctx, "user123", "api_credits", "payment-1"); !errors.Is(err, ErrIdempotencyConflict) {
+		t.Errorf("expected ErrIdempotencyConflict for a key of another operation, got %v", err)
+	}
+
+	// A retried delete succeeds instead of reporting the account as gone.
+	for i := 0; i < 2; i++ {
+		if err := ledger.DeleteAccount(ctx, "user123", "api_credits", "close-1"); err != nil {
+			t.Fatalf("attempt %d: unexpected error: %v", i+1, err)
+		}
+	}
+}
+
+func TestMemoryLedger_ThresholdsFireOncePerCrossing(t *testing.T) {
+	ctx := context.Background()
+	ledger, bus := newTestLedger(t, 100)
+
+	if _, err := ledger.CreateThreshold(ctx, model.ThresholdRequest{AccountID: "user123", ResourceType: "api_credits",
+		Kind: model.ThresholdPercent, Value: 0}); apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a validation error for a 0%% threshold, got %v", err)
+	}
+	for _, req := range []model.ThresholdRequest{
+		{AccountID: "user123", ResourceType: "api_credits", Kind: model.ThresholdAbsolute, Value: 50},
+		// 20% of the opening balance until the first recharge.
+		{AccountID: "user123", ResourceType: "api_credits", Kind: model.ThresholdPercent, Value: 20},
+	} {
+		if _, err := ledger.CreateThreshold(ctx, req); err != nil {
+			t.Fatalf("create threshold: %v", err)
+		}
+	}
+
+	crossings := func() int {
+		n := 0
+		for _, topic := range bus.topics {
+			if topic == "balance.threshold_crossed" {
+				n++
+			}
+		}
+		return n
+	}
+	spend := func(key string, amount int64, want int) {
+		t.Helper()
+		req := model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: amount, IdempotencyKey: key}
+		if _, err := ledger.Spend(ctx, req); err != nil {
+			t.Fatalf("spend %s: %v", key, err)
+		}
+		if got := crossings(); got != want {
+			t.Errorf("after spend %s: expected %d crossings, got %d", key, want, got)
+		}
+	}
+
+	spend("req-1", 40, 0) // 60
+	spend("req-2", 20, 1) // 40, below 50
+	spend("req-3", 10, 1) // 30, the absolute threshold is disarmed
+	spend("req-4", 15, 2) // 15, below 20% of 100
+	spend("req-4", 15, 2) // a replay crosses nothing
+
+	// The recharge arms both again, and the percent threshold is now 20% of 200.
+	if err := ledger.Recharge(ctx, model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 200}); err != nil {
+		t.Fatalf("recharge: %v", err)
+	}
+	spend("req-5", 170, 3) // 45, below 50
+	spend("req-6", 10, 4)  // 35, below 40
+
+	thresholds, err := ledger.ListThresholds(ctx, "user123", "api_credits")
+	if err != nil || len(thresholds) != 2 || thresholds[0].Armed || thresholds[1].Armed {
+		t.Errorf("expected both thresholds disarmed, got %+v (%v)", thresholds, err)
+	}
+	if err := ledger.DeleteThreshold(ctx, thresholds[0].ID); err != nil {
+		t.Fatalf("delete threshold: %v", err)
+	}
+	if err := ledger.DeleteThreshold(ctx, thresholds[0].ID); !errors.Is(err, ErrThresholdNotFound) {
+		t.Errorf("expected ErrThresholdNotFound, got %v", err)
+	}
+}
+
+func TestMemoryLedger_TransfersAndHoldsCrossThresholds(t *testing.T) {
+	ctx := context.Background()
+	ledger, bus := newTestLedger(t, 100)
+	_ = ledger.CreateAccount(ctx, "other", "api_credits", 0, "")
+
+	for _, value := range []int64{50, 20} {
+		req := model.ThresholdRequest{AccountID: "user123", ResourceType: "api_credits", Kind: model.ThresholdAbsolute, Value: value}
+		if _, err := ledger.CreateThreshold(ctx, req); err != nil {
+			t.Fatalf("create threshold: %v", err)
+		}
+	}
+	crossings := func() int {
+		n := 0
+		for _, topic := range bus.topics {
+			if topic == "balance.threshold_crossed" {
+				n++
+			}
+		}
+		return n
+	}
+
+	if _, err := ledger.Transfer(ctx, "user123", "other", "api_credits", 60, "tr-1"); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if got := crossings(); got != 1 {
+		t.Errorf("after the transfer: expected 1 crossing, got %d", got)
+	}
+	if _, err := ledger.Authorize(ctx, model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "hold-1"}); err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if got := crossings(); got != 2 {
+		t.Errorf("after the hold: expected 2 crossings, got %d", got)
+	}
+}
+func TestMemoryLedger_QuotaRefillsApplyEachPeriodOnce(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+	for _, id := range []string{"adder", "saver"} {
+		if err := ledger.CreateAccount(ctx, id, "api_credits", 100, ""); err != nil {
+			t.Fatalf("create account %s: %v", id, err)
+		}
+	}
+
+	policies := map[string]model.QuotaPolicyRequest{
+		"user123": {Mode: model.QuotaRefillTo, Amount: 100},
+		"adder":   {Mode: model.QuotaAdd, Amount: 50},
+		"saver":   {Mode: model.QuotaRollover, Amount: 50, Cap: 120},
+	}
+	for id, req := range policies {
+		req.AccountID, req.ResourceType, req.IntervalSeconds = id, "api_credits", 3600
+		if _, err := ledger.CreateQuotaPolicy(ctx, req); err != nil {
+			t.Fatalf("create quota policy for %s: %v", id, err)
+		}
+	}
+	if _, err := ledger.CreateQuotaPolicy(ctx, model.QuotaPolicyRequest{AccountID: "user123", ResourceType: "api_credits",
+		Mode: model.QuotaAdd, Amount: 50, Cron: "@monthly", IntervalSeconds: 60}); apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a validation error for two schedules, got %v", err)
+	}
+
+	if _, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "req-1"}); err != nil {
+		t.Fatalf("spend: %v", err)
+	}
+
+	apply := func(after time.Duration, want int, balances map[string]int64) {
+		t.Helper()
+		n, err := ledger.ApplyDueRefills(ctx, time.Now().Add(after))
+		if err != nil || n != want {
+			t.Fatalf("after %v: expected %d refills, got %d (%v)", after, want, n, err)
+		}
+		for id, want := range balances {
+			if got, _ := ledger.GetBalance(ctx, id, "api_credits"); got != want {
+				t.Errorf("after %v: expected %s to hold %d, got %d", after, id, want, got)
+			}
+		}
+	}
+
+	apply(0, 0, map[string]int64{"user123": 70, "adder": 100, "saver": 100})
+	apply(time.Hour+time.Second, 3, map[string]int64{"user123": 100, "adder": 150, "saver": 120})
+	// The period is not applied again.
+	apply(time.Hour+time.Second, 0, map[string]int64{"user123": 100, "adder": 150, "saver": 120})
+
+	// Three periods later, the policies catch up every missed period in one call; a refill_to
+	// also takes away what a recharge added above the quota.
+	if err := ledger.Recharge(ctx, model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 50}); err != nil {
+		t.Fatalf("recharge: %v", err)
+	}
+	apply(4*time.Hour+time.Second, 9, map[string]int64{"user123": 100, "adder": 300, "saver": 120})
+	apply(4*time.Hour+time.Second, 0, nil)
+
+	refills := 0
+	for _, e := range ledger.journal {
+		if e.Type == model.EntryRefill {
+			refills++
+		}
+	}
+	// user123: +30 and -50; adder: four periods; saver: +20 only.
+	if refills != 7 {
+		t.Errorf("expected 7 refill journal entries, got %d", refills)
+	}
+	if report, err := ledger.CheckJournal(ctx); err != nil || !report.OK {
+		t.Errorf("expected the journal to check out, got %+v (%v)", report, err)
+	}
+
+	listed, err := ledger.ListQuotaPolicies(ctx, "adder", "api_credits")
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("expected one policy, got %+v (%v)", listed, err)
+	}
+	if p := listed[0]; p.LastPeriod != periodKey(p.CreatedAt.Add(4*time.Hour)) || !p.NextRefillAt.Equal(p.CreatedAt.Add(5*time.Hour)) {
+		t.Errorf("expected the fourth period applied and the fifth next, got %+v", p)
+	}
+}
+
+func TestMemoryLedger_ShortQuotaIntervalsDoNotFallBehind(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 0)
+
+	policy, err := ledger.CreateQuotaPolicy(ctx, model.QuotaPolicyRequest{AccountID: "user123", ResourceType: "api_credits",
+		Mode: model.QuotaAdd, Amount: 1, IntervalSeconds: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Periods shorter than the sweep are all applied, up to maxCatchUpPeriods per call.
+	now := policy.CreatedAt.Add((maxCatchUpPeriods + 500) * time.Second)
+	for _, want := range []int{maxCatchUpPeriods, 500, 0} {
+		if n, err := ledger.ApplyDueRefills(ctx, now); err != nil || n != want {
+			t.Fatalf("expected %d refills, got %d (%v)", want, n, err)
+		}
+	}
+	if bal, _ := ledger.GetBalance(ctx, "user123", "api_credits"); bal != maxCatchUpPeriods+500 {
+		t.Errorf("expected every period credited, got balance %d", bal)
+	}
+}
+
+func TestMemoryLedger_WatchBalancesResumesFromOffset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ledger, _ := newTestLedger(t, 100)
+
+	events, err := ledger.WatchBalances(ctx, []string{"user123"}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Only changes made after the watch started, to the watched accounts, are pushed.
+	_ = ledger.CreateAccount(ctx, "other", "api_credits", 5, "")
+	_ = ledger.Recharge(ctx, model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 20})
+	_, _ = ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "req-1"})
+
+	recharge, spend := <-events, <-events
+	if recharge.Type != model.BalanceRecharge || recharge.Amount != 20 || recharge.Balance != 120 {
+		t.Errorf("unexpected recharge event %+v", recharge)
+	}
+	if spend.Type != model.BalanceSpend || spend.Amount != 30 || spend.Balance != 90 || spend.IdempotencyKey != "req-1" {
+		t.Errorf("unexpected spend event %+v", spend)
+	}
+
+	// A watcher that reconnects with the offset of the recharge gets the spend again.
+	resumed, err := ledger.WatchBalances(ctx, []string{"user123"}, recharge.Offset)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e := <-resumed; e.Offset != spend.Offset {
+		t.Errorf("expected to resume with the spend at offset %s, got %+v", spend.Offset, e)
+	}
+
+	// Offsets have the format of LedgerRepo's; one older than the feed resumes with its
+	// oldest event.
+	if !streamOffset.MatchString(spend.Offset) || !olderOffset(recharge.Offset, spend.Offset) {
+		t.Errorf("expected increasing <ms>-<seq> offsets, got %s then %s", recharge.Offset, spend.Offset)
+	}
+	old, err := ledger.WatchBalances(ctx, []string{"user123"}, "1700000000000-0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e := <-old; e.Type != model.BalanceAccountCreated {
+		t.Errorf("expected to resume with the oldest event, got %+v", e)
+	}
+	if _, err := ledger.WatchBalances(ctx, []string{"user123"}, "1"); apperr.CodeOf(err) != apperr.CodeValidationFailed {
+		t.Errorf("expected a validation error for a malformed offset, got %v", err)
+	}
+}
+
+func TestMemoryLedger_WebhookFanOut(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+
+	// The account was created before the webhook, so that event is not delivered to it.
+	time.Sleep(time.Millisecond)
+	hook, err := ledger.CreateWebhook(ctx, model.WebhookRequest{
+		URL:        "https://example.com/hooks",
+		EventTypes: []string{model.BalanceAccountCreated, model.BalanceRecharge},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = ledger.Recharge(ctx, model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 20})
+	_, _ = ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "req-1"})
+
+	if n, err := ledger.FanOutWebhookEvents(ctx, "test"); err != nil || n != 3 {
+		t.Fatalf("expected the three events fanned out, got %d, %v", n, err)
+	}
+	deliveries, _ := ledger.ListWebhookDeliveries(ctx, hook.ID, 0)
+	if len(deliveries) != 1 || deliveries[0].Event.Type != model.BalanceRecharge {
+		t.Fatalf("expected only the recharge delivered, got %+v", deliveries)
+	}
+
+	// Events are fanned out once.
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if n, _ := ledger.FanOutWebhookEvents(waitCtx, "test"); n != 0 {
+		t.Errorf("expected nothing left to fan out, got %d events", n)
+	}
+}
+
+func TestMemoryLedger_EveryBalanceChangeIsInTheFeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ledger, _ := newTestLedger(t, 100)
+	_ = ledger.CreateAccount(ctx, "other", "api_credits", 0, "")
+
+	events, err := ledger.WatchBalances(ctx, nil, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ledger.Transfer(ctx, "user123", "other", "api_credits", 10, "tr-1"); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	if _, err := ledger.Spend(ctx, model.SpendRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 20, IdempotencyKey: "req-1"}); err != nil {
+		t.Fatalf("spend: %v", err)
+	}
+	if _, err := ledger.Refund(ctx, "req-1", 5, "refund-1"); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	expiry := time.Now().Add(time.Hour)
+	if _, err := ledger.GrantCredits(ctx, model.GrantRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 30, ExpiresAt: &expiry}); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	hold, err := ledger.Authorize(ctx, model.AuthorizeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 40, IdempotencyKey: "auth-1"})
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if _, err := ledger.Capture(ctx, model.CaptureRequest{HoldID: hold.HoldID, Amount: 15}); err != nil {
+		t.Fatalf("capture: %v", err)
+	}
+	if _, err := ledger.ExpireGrants(ctx, expiry); err != nil {
+		t.Fatalf("expire grants: %v", err)
+	}
+
+	want := []struct {
+		typ       string
+		accountID string
+		amount    int64
+		balance   int64
+	}{
+		{model.BalanceTransferOut, "user123", 10, 90},
+		{model.BalanceTransferIn, "other", 10, 10},
+		{model.BalanceSpend, "user123", 20, 70},
+		{model.BalanceRefund, "user123", 5, 75},
+		{model.BalanceGrant, "user123", 30, 105},
+		{model.BalanceHold, "user123", 40, 65},
+		{model.BalanceCapture, "user123", 15, 90},
+		// The capture was charged to the lot, so only what is left of it expires.
+		{model.BalanceGrantExpired, "user123", 15, 75},
+	}
+	for _, w := range want {
+		e := <-events
+		if e.Type != w.typ || e.AccountID != w.accountID || e.Amount != w.amount || e.Balance != w.balance {
+			t.Errorf("expected a %s event of %d leaving %s at %d, got %+v", w.typ, w.amount, w.accountID, w.balance, e)
+		}
+	}
+}
+
+func TestMemoryLedger_LateLegsUpdateSnapshots(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+
+	at := time.Now().Add(time.Minute)
+	if n, err := ledger.TakeSnapshots(ctx, at); err != nil || n != 1 {
+		t.Fatalf("expected 1 snapshot, got %d (%v)", n, err)
+	}
+	before, err := ledger.GetBalanceAt(ctx, "user123", "api_credits", at)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A spend made before the snapshot but booked after it must still count towards it.
+	late := model.SpendEvent{AccountID: "user123", ResourceType: "api_credits", Amount: 30, IdempotencyKey: "late-1", CreatedAt: time.Now()}
+	if err := ledger.SyncTransactionWithBalance(ctx, late); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after, err := ledger.GetBalanceAt(ctx, "user123", "api_credits", at)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after != before-30 {
+		t.Errorf("expected balance %d at the snapshot, got %d", before-30, after)
+	}
+
+	// The snapshot is already exact, so retaking it changes nothing.
+	if n, err := ledger.TakeSnapshots(ctx, at); err != nil || n != 0 {
+		t.Errorf("expected no snapshot changes, got %d (%v)", n, err)
+	}
+}
+
+func TestMemoryLedger_BatchedLateLegsUpdateSnapshots(t *testing.T) {
+	ctx := context.Background()
+	ledger, _ := newTestLedger(t, 100)
+
+	at := time.Now().Add(time.Minute)
+	if n, err := ledger.TakeSnapshots(ctx, at); err != nil || n != 1 {
+		t.Fatalf("expected 1 snapshot, got %d (%v)", n, err)
+	}
+	before, err := ledger.GetBalanceAt(ctx, "user123", "api_credits", at)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Late spends synced as one batch, one of them delivered twice, must count once each.
+	late := []model.SpendEvent{
+		{AccountID: "user123", ResourceType: "api_credits", Amount: 10, IdempotencyKey: "late-1", CreatedAt: time.Now()},
+		{AccountID: "user123", ResourceType: "api_credits", Amount: 20, IdempotencyKey: "late-2", CreatedAt: time.Now()},
+		{AccountID: "user123", ResourceType: "api_credits", Amount: 20, IdempotencyKey: "late-2", CreatedAt: time.Now()},
+	}
+	if _, err := ledger.SyncTransactions(ctx, late); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	after, err := ledger.GetBalanceAt(ctx, "user123", "api_credits", at)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after != before-30 {
+		t.Errorf("expected balance %d at the snapshot, got %d", before-30, after)
+	}
+
+	if n, err := ledger.TakeSnapshots(ctx, at); err != nil || n != 0 {
+		t.Errorf("expected no snapshot changes, got %d (%v)", n, err)
+	}
+}
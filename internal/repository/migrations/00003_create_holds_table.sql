@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE holds (
+    id              VARCHAR(64)  PRIMARY KEY,
+    account_id      VARCHAR(255) NOT NULL,
+    resource_type   VARCHAR(50)  NOT NULL,
+    amount          BIGINT       NOT NULL,
+    captured_amount BIGINT       NOT NULL DEFAULT 0,
+    status          VARCHAR(20)  NOT NULL DEFAULT 'pending',
+    idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+    expires_at      TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_holds_account_resource ON holds (account_id, resource_type) WHERE status = 'pending';
+CREATE INDEX idx_holds_expires_at ON holds (expires_at) WHERE status = 'pending';
+
+-- +goose Down
+DROP TABLE holds;
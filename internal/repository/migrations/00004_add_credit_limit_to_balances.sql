@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE balances ADD COLUMN credit_limit BIGINT NOT NULL DEFAULT 0 CHECK (credit_limit >= 0);
+
+-- +goose Down
+ALTER TABLE balances DROP COLUMN credit_limit;
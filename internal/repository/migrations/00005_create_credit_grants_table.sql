@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE credit_grants (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id    VARCHAR(255) NOT NULL,
+    resource_type VARCHAR(50)  NOT NULL,
+    amount        BIGINT       NOT NULL,
+    remaining     BIGINT       NOT NULL,
+    priority      INTEGER      NOT NULL DEFAULT 0,
+    status        VARCHAR(20)  NOT NULL DEFAULT 'active',
+    expires_at    TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+    created_at    TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at    TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_grants_account_resource ON credit_grants (account_id, resource_type) WHERE status = 'active';
+CREATE INDEX idx_grants_expires_at ON credit_grants (expires_at) WHERE status = 'active';
+
+-- +goose Down
+DROP TABLE credit_grants;
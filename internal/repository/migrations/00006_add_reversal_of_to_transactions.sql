@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE transactions ADD COLUMN reversal_of UUID DEFAULT NULL REFERENCES transactions (id);
+CREATE INDEX idx_tx_reversal_of ON transactions (reversal_of) WHERE reversal_of IS NOT NULL;
+
+-- +goose Down
+DROP INDEX idx_tx_reversal_of;
+ALTER TABLE transactions DROP COLUMN reversal_of;
@@ -0,0 +1,42 @@
+-- +goose Up
+CREATE TABLE journal_entries (
+    id              UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    entry_type      VARCHAR(20)  NOT NULL CHECK (entry_type IN ('spend', 'recharge', 'opening_balance', 'adjustment', 'refund', 'transfer')),
+    idempotency_key VARCHAR(255) UNIQUE NOT NULL,
+    reference       VARCHAR(255) DEFAULT NULL,
+    metadata        JSONB DEFAULT '{}'::jsonb,
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE journal_legs (
+    id            BIGSERIAL PRIMARY KEY,
+    entry_id      UUID         NOT NULL REFERENCES journal_entries (id),
+    account_id    VARCHAR(255) NOT NULL,
+    resource_type VARCHAR(50)  NOT NULL,
+    amount        BIGINT       NOT NULL,
+    created_at    TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_legs_entry ON journal_legs (entry_id);
+CREATE INDEX idx_legs_account_resource ON journal_legs (account_id, resource_type, created_at);
+
+-- Existing balances become opening entries so every account can be rebuilt from the journal.
+INSERT INTO journal_entries (entry_type, idempotency_key, metadata, created_at)
+SELECT 'opening_balance', 'migration:opening:' || account_id || ':' || resource_type,
+       jsonb_build_object('account_id', account_id, 'resource_type', resource_type), NOW()
+FROM balances
+WHERE amount <> 0;
+
+INSERT INTO journal_legs (entry_id, account_id, resource_type, amount, created_at)
+SELECT e.id, b.account_id, b.resource_type, b.amount, e.created_at
+FROM journal_entries e
+JOIN balances b ON b.account_id = e.metadata->>'account_id' AND b.resource_type = e.metadata->>'resource_type'
+WHERE e.idempotency_key LIKE 'migration:opening:%'
+UNION ALL
+SELECT e.id, 'system:funding', b.resource_type, -b.amount, e.created_at
+FROM journal_entries e
+JOIN balances b ON b.account_id = e.metadata->>'account_id' AND b.resource_type = e.metadata->>'resource_type'
+WHERE e.idempotency_key LIKE 'migration:opening:%';
+
+-- +goose Down
+DROP TABLE journal_legs;
+DROP TABLE journal_entries;
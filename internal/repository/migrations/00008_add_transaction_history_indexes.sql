@@ -0,0 +1,7 @@
+-- +goose Up
+CREATE INDEX idx_tx_account_created ON transactions (account_id, created_at DESC, id DESC);
+CREATE INDEX idx_tx_metadata ON transactions USING GIN (metadata jsonb_path_ops);
+
+-- +goose Down
+DROP INDEX idx_tx_metadata;
+DROP INDEX idx_tx_account_created;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- A snapshot holds the sum of an account's journal legs created strictly before snapshot_at.
+CREATE TABLE balance_snapshots (
+    account_id    VARCHAR(255) NOT NULL,
+    resource_type VARCHAR(50)  NOT NULL,
+    snapshot_at   TIMESTAMP WITH TIME ZONE NOT NULL,
+    amount        BIGINT       NOT NULL,
+    created_at    TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (account_id, resource_type, snapshot_at)
+);
+
+-- +goose Down
+DROP TABLE balance_snapshots;
@@ -0,0 +1,19 @@
+-- +goose Up
+-- Events the worker could not persist. The payload is kept as text because it may not be valid JSON.
+CREATE TABLE dead_letters (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    topic       VARCHAR(255) NOT NULL,
+    event_key   VARCHAR(255) DEFAULT NULL,
+    payload     TEXT         NOT NULL,
+    error       TEXT         NOT NULL,
+    attempts    INTEGER      NOT NULL DEFAULT 0,
+    status      VARCHAR(20)  NOT NULL DEFAULT 'parked',
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- An event delivered again while it is parked updates the existing entry instead of adding one.
+CREATE UNIQUE INDEX idx_dead_letters_parked_event ON dead_letters (topic, event_key) WHERE status = 'parked';
+CREATE INDEX idx_dead_letters_status_created ON dead_letters (status, created_at DESC);
+
+-- +goose Down
+DROP TABLE dead_letters;
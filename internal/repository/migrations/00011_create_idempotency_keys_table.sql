@@ -0,0 +1,13 @@
+-- +goose Up
+-- Idempotency keys of the operations that change PostgreSQL directly (recharges, account creation and
+-- deletion). A key is claimed in the same transaction as its operation and kept for good, so a retry
+-- is recognised even after Redis has been flushed.
+CREATE TABLE idempotency_keys (
+    key         VARCHAR(255) PRIMARY KEY,
+    operation   VARCHAR(50)  NOT NULL,
+    fingerprint VARCHAR(64)  NOT NULL,
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE idempotency_keys;
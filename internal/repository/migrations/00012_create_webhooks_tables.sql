@@ -0,0 +1,40 @@
+-- +goose Up
+-- HTTPS endpoints that balance events are delivered to. Empty account_ids means every account.
+CREATE TABLE webhooks (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    url         TEXT         NOT NULL,
+    secret      VARCHAR(255) NOT NULL,
+    event_types TEXT[]       NOT NULL,
+    account_ids TEXT[]       NOT NULL DEFAULT '{}',
+    created_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One row per event and webhook: the delivery log. event_offset is the event's position in
+-- the balance event feed, so an event fanned out twice is only delivered once.
+CREATE TABLE webhook_deliveries (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    webhook_id       UUID         NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_offset     VARCHAR(64)  NOT NULL,
+    event            JSONB        NOT NULL,
+    status           VARCHAR(20)  NOT NULL DEFAULT 'pending',
+    attempts         INTEGER      NOT NULL DEFAULT 0,
+    last_status_code INTEGER      NOT NULL DEFAULT 0,
+    last_error       TEXT         NOT NULL DEFAULT '',
+    next_attempt_at  TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    delivered_at     TIMESTAMP WITH TIME ZONE DEFAULT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (webhook_id, event_offset)
+);
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, created_at DESC);
+
+-- The offset of the last feed event fanned out to the webhooks, so fan-out resumes after a restart.
+CREATE TABLE webhook_cursor (
+    id           BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    event_offset VARCHAR(64) NOT NULL
+);
+
+-- +goose Down
+DROP TABLE webhook_cursor;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
@@ -0,0 +1,19 @@
+-- +goose Up
+-- The amount of the latest recharge (or the opening balance), which percent thresholds are taken of.
+ALTER TABLE balances ADD COLUMN last_recharge BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE balance_thresholds (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id    VARCHAR(255) NOT NULL,
+    resource_type VARCHAR(50)  NOT NULL,
+    kind          VARCHAR(20)  NOT NULL,
+    value         BIGINT       NOT NULL,
+    armed         BOOLEAN      NOT NULL DEFAULT TRUE,
+    created_at    TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (account_id, resource_type) REFERENCES balances (account_id, resource_type)
+);
+CREATE INDEX idx_thresholds_account_resource ON balance_thresholds (account_id, resource_type);
+
+-- +goose Down
+DROP TABLE balance_thresholds;
+ALTER TABLE balances DROP COLUMN last_recharge;
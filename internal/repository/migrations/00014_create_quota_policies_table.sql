@@ -0,0 +1,29 @@
+-- +goose Up
+-- Periodic refills of an account. next_refill_at is the start of the next period to apply;
+-- the scheduler moves it on in the same transaction that applies a period.
+CREATE TABLE quota_policies (
+    id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id       VARCHAR(255) NOT NULL,
+    resource_type    VARCHAR(50)  NOT NULL,
+    mode             VARCHAR(20)  NOT NULL,
+    amount           BIGINT       NOT NULL,
+    cap              BIGINT       NOT NULL DEFAULT 0,
+    cron             VARCHAR(100) NOT NULL DEFAULT '',
+    interval_seconds BIGINT       NOT NULL DEFAULT 0,
+    next_refill_at   TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_period      VARCHAR(64)  NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (account_id, resource_type) REFERENCES balances (account_id, resource_type)
+);
+CREATE INDEX idx_quota_policies_next_refill ON quota_policies (next_refill_at);
+CREATE INDEX idx_quota_policies_account_resource ON quota_policies (account_id, resource_type);
+
+ALTER TABLE journal_entries DROP CONSTRAINT journal_entries_entry_type_check;
+ALTER TABLE journal_entries ADD CONSTRAINT journal_entries_entry_type_check
+    CHECK (entry_type IN ('spend', 'recharge', 'opening_balance', 'adjustment', 'refund', 'transfer', 'refill'));
+
+-- +goose Down
+ALTER TABLE journal_entries DROP CONSTRAINT journal_entries_entry_type_check;
+ALTER TABLE journal_entries ADD CONSTRAINT journal_entries_entry_type_check
+    CHECK (entry_type IN ('spend', 'recharge', 'opening_balance', 'adjustment', 'refund', 'transfer'));
+DROP TABLE quota_policies;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- The idempotency key a grant was made with, so a retry gets the same grant back.
+ALTER TABLE credit_grants ADD COLUMN idempotency_key VARCHAR(255) UNIQUE;
+
+-- +goose Down
+ALTER TABLE credit_grants DROP COLUMN idempotency_key;
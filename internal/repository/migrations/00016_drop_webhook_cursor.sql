@@ -0,0 +1,10 @@
+-- +goose Up
+-- Webhook fan-out reads the balance feed through a Redis consumer group, which keeps its
+-- own position in the feed.
+DROP TABLE webhook_cursor;
+
+-- +goose Down
+CREATE TABLE webhook_cursor (
+    id           BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    event_offset VARCHAR(64) NOT NULL
+);
@@ -0,0 +1,213 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"quantlo/internal/model"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// outboxStream holds every event whose balance change is already applied in Redis.
+// The Lua scripts append to it in the same step as the change, so an event can not be
+// lost between Redis and the bus; an entry is deleted once the worker has persisted it.
+const (
+	outboxStream = "outbox:events"
+	outboxGroup  = "relay"
+	outboxBatch  = 100
+
+	// outboxPublishAttempts bounds the immediate retries of a failed publish; after that
+	// the entry waits out the ack timeout and is relayed again.
+	outboxPublishAttempts = 3
+	outboxRetryBackoff    = 100 * time.Millisecond
+)
+
+// confirmOutbox removes a relayed event from the outbox once PostgreSQL has it.
+func (r *LedgerRepo) confirmOutbox(ctx context.Context, id string) {
+	if id == "" {
+		return
+	}
+	pipe := r.rdb.TxPipeline()
+	pipe.XAck(ctx, outboxStream, outboxGroup, id)
+	pipe.XDel(ctx, outboxStream, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("failed to confirm outbox entry", "outbox_id", id, "error", err)
+	}
+}
+
+// OutboxRelay forwards outbox entries to the message bus. An entry stays pending in the
+// relay's consumer group until the worker confirms it; entries not confirmed within the
+// ack timeout are relayed again, which the worker's idempotent sync makes harmless.
+type OutboxRelay struct {
+	rdb         *redis.Client
+	bus         MessageBus
+	consumer    string
+	ackTimeout  time.Duration
+	claimCursor string
+}
+
+func NewOutboxRelay(rdb *redis.Client, bus MessageBus, ackTimeout time.Duration) *OutboxRelay {
+	host, _ := os.Hostname()
+	return &OutboxRelay{
+		rdb:         rdb,
+		bus:         bus,
+		consumer:    fmt.Sprintf("%s-%d", host, os.Getpid()),
+		ackTimeout:  ackTimeout,
+		claimCursor: "0-0",
+	}
+}
+
+// Run relays outbox entries and blocks until ctx is cancelled.
+func (o *OutboxRelay) Run(ctx context.Context) error {
+	// Start from the beginning of the stream so entries written before the group existed are relayed too.
+	err := o.rdb.XGroupCreateMkStream(ctx, outboxStream, outboxGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("create outbox consumer group: %w", err)
+	}
+
+	slog.Info("Outbox relay is running", "consumer", o.consumer, "ack_timeout", o.ackTimeout)
+
+	for {
+		if ctx.Err() != nil {
+			slog.Info("Outbox relay received shutdown signal")
+			return nil
+		}
+		if err := o.relayOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("outbox relay: failed to read outbox", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (o *OutboxRelay) relayOnce(ctx context.Context) error {
+	// Entries relayed earlier but never confirmed, by this relay or one that went away.
+	claimed, next, err := o.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   outboxStream,
+		Group:    outboxGroup,
+		Consumer: o.consumer,
+		MinIdle:  o.ackTimeout,
+		Start:    o.claimCursor,
+		Count:    outboxBatch,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	o.claimCursor = next
+	o.relay(ctx, claimed)
+
+	streams, err := o.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    outboxGroup,
+		Consumer: o.consumer,
+		Streams:  []string{outboxStream, ">"},
+		Count:    outboxBatch,
+		Block:    time.Second,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		o.relay(ctx, stream.Messages)
+	}
+	return nil
+}
+
+func (o *OutboxRelay) relay(ctx context.Context, messages []redis.XMessage) {
+	for _, msg := range messages {
+		topic, data, err := outboxMessage(msg)
+		if err != nil {
+			// A malformed entry can never be delivered; drop it rather than relay it forever.
+			slog.Error("outbox relay: dropping malformed entry", "outbox_id", msg.ID, "error", err)
+			o.rdb.XAck(ctx, outboxStream, outboxGroup, msg.ID)
+			o.rdb.XDel(ctx, outboxStream, msg.ID)
+			continue
+		}
+
+		if err := o.publish(ctx, topic, data); err != nil {
+			slog.Error("outbox relay: publish failed, will retry", "outbox_id", msg.ID, "topic", topic, "error", err)
+		}
+	}
+}
+
+func (o *OutboxRelay) publish(ctx context.Context, topic string, data []byte) error {
+	backoff := outboxRetryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = o.bus.Publish(topic, data); err == nil || attempt == outboxPublishAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Start implements the infrastructure.Server interface.
+func (o *OutboxRelay) Start(ctx context.Context) error {
+	return o.Run(ctx)
+}
+
+// Stop implements the infrastructure.Server interface (no-op, shutdown is via ctx).
+func (o *OutboxRelay) Stop(ctx context.Context) error {
+	return nil
+}
+
+// outboxMessage turns an outbox entry into the bus message: the payload written by
+// the script, completed with the lots it consumed and the entry's ID for confirmation.
+func outboxMessage(msg redis.XMessage) (string, []byte, error) {
+	topic, _ := msg.Values["topic"].(string)
+	payload, _ := msg.Values["payload"].(string)
+	if topic == "" || payload == "" {
+		return "", nil, errors.New("outbox entry without topic or payload")
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return "", nil, fmt.Errorf("outbox payload: %w", err)
+	}
+
+	if raw, _ := msg.Values["lots"].(string); raw != "" {
+		lots, err := parseLots(raw)
+		if err != nil {
+			return "", nil, err
+		}
+		fields["lots"], _ = json.Marshal(lots)
+	}
+	fields["outbox_id"], _ = json.Marshal(msg.ID)
+
+	data, err := json.Marshal(fields)
+	return topic, data, err
+}
+
+// parseLots reads the "grant,amount,grant,amount" list spend.lua, transfer.lua and release.lua write.
+func parseLots(raw string) ([]model.LotUsage, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("outbox lots: odd number of fields in %q", raw)
+	}
+	lots := make([]model.LotUsage, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		amount, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("outbox lots: %w", err)
+		}
+		lots = append(lots, model.LotUsage{GrantID: parts[i], Amount: amount})
+	}
+	return lots, nil
+}
@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"encoding/json"
+	"testing"
+
+	"quantlo/internal/model"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestOutboxMessage_AddsLotsAndID(t *testing.T) {
+	msg := redis.XMessage{
+		ID: "1700000000000-0",
+		Values: map[string]interface{}{
+			"topic":   "transactions.created",
+			"payload": `{"account_id":"user123","resource_type":"api_tokens","amount":15,"idempotency_key":"req-1","created_at":"2026-01-01T00:00:00Z"}`,
+			"lots":    "grant-a,10,grant-b,5",
+		},
+	}
+
+	topic, data, err := outboxMessage(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if topic != "transactions.created" {
+		t.Errorf("expected topic transactions.created, got %s", topic)
+	}
+
+	var event model.SpendEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.OutboxID != msg.ID || event.Amount != 15 || len(event.Lots) != 2 {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if event.Lots[1] != (model.LotUsage{GrantID: "grant-b", Amount: 5}) {
+		t.Errorf("unexpected lot: %+v", event.Lots[1])
+	}
+}
+
+func TestOutboxMessage_Malformed(t *testing.T) {
+	for _, values := range []map[string]interface{}{
+		{"topic": "transactions.created"},
+		{"topic": "transactions.created", "payload": "not json"},
+		{"topic": "transactions.created", "payload": "{}", "lots": "grant-a"},
+	} {
+		if _, _, err := outboxMessage(redis.XMessage{ID: "1-0", Values: values}); err == nil {
+			t.Errorf("expected an error for %v", values)
+		}
+	}
+}
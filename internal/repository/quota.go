@@ -0,0 +1,327 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/cron"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrQuotaPolicyNotFound = apperr.New(apperr.CodeNotFound, "quota policy not found")
+
+// refillBatchSize is how many due policies one ApplyDueRefills call refills.
+const refillBatchSize = 100
+
+// maxCatchUpPeriods bounds how many missed periods of a policy one call applies, so a
+// short interval that fell far behind catches up over a few sweeps instead of one long
+// transaction.
+const maxCatchUpPeriods = 1000
+
+// validateQuotaPolicy checks a new quota policy.
+func validateQuotaPolicy(req model.QuotaPolicyRequest) error {
+	if req.AccountID == "" || req.ResourceType == "" {
+		return apperr.Validation("account_id and resource_type are required")
+	}
+	switch req.Mode {
+	case model.QuotaRefillTo, model.QuotaAdd:
+		if req.Cap != 0 {
+			return apperr.Validation("cap only applies to the rollover mode")
+		}
+	case model.QuotaRollover:
+		if req.Cap < req.Amount {
+			return apperr.Validation("cap must be at least the amount")
+		}
+	default:
+		return apperr.Validation(fmt.Sprintf("unknown quota mode %q", req.Mode))
+	}
+	if req.Amount <= 0 {
+		return apperr.Validation("quota amount must be positive")
+	}
+	if (req.Cron == "") == (req.IntervalSeconds == 0) {
+		return apperr.Validation("exactly one of cron and interval_seconds is required")
+	}
+	if req.IntervalSeconds < 0 {
+		return apperr.Validation("interval_seconds must be positive")
+	}
+	if req.Cron != "" {
+		if _, err := cron.Parse(req.Cron); err != nil {
+			return apperr.Validation(err.Error())
+		}
+	}
+	return nil
+}
+
+// newQuotaPolicy returns a validated policy created at now, with its first refill scheduled.
+func newQuotaPolicy(req model.QuotaPolicyRequest, now time.Time) (model.QuotaPolicy, error) {
+	if err := validateQuotaPolicy(req); err != nil {
+		return model.QuotaPolicy{}, err
+	}
+	p := model.QuotaPolicy{
+		AccountID:       req.AccountID,
+		ResourceType:    req.ResourceType,
+		Mode:            req.Mode,
+		Amount:          req.Amount,
+		Cap:             req.Cap,
+		Cron:            req.Cron,
+		IntervalSeconds: req.IntervalSeconds,
+		// PostgreSQL keeps microseconds, so interval periods are counted from what it stores.
+		CreatedAt: now.UTC().Truncate(time.Microsecond),
+	}
+	p.NextRefillAt = nextRefill(p, p.CreatedAt)
+	return p, nil
+}
+
+// nextRefill returns the start of the first period of a policy after t.
+func nextRefill(p model.QuotaPolicy, t time.Time) time.Time {
+	if p.Cron != "" {
+		// The expression was checked when the policy was created.
+		s, _ := cron.Parse(p.Cron)
+		return s.Next(t.UTC())
+	}
+	interval := time.Duration(p.IntervalSeconds) * time.Second
+	return p.CreatedAt.Add((t.Sub(p.CreatedAt)/interval + 1) * interval)
+}
+
+// refillChange is what a refill adds to balance; a refill_to of a balance above its amount
+// takes the difference away.
+func refillChange(p model.QuotaPolicy, balance int64) int64 {
+	switch p.Mode {
+	case model.QuotaRefillTo:
+		return p.Amount - balance
+	case model.QuotaRollover:
+		return max(0, min(p.Amount, p.Cap-balance))
+	default:
+		return p.Amount
+	}
+}
+
+// periodKey identifies a period of a policy by its start.
+func periodKey(start time.Time) string {
+	return start.UTC().Format(time.RFC3339)
+}
+
+// refillEntry is the journal entry of a refill. Its idempotency key is the policy's period
+// key, so a period is never booked twice. Credits taken away by a reset go to system:expired.
+func refillEntry(p model.QuotaPolicy, period string, change int64) model.JournalEntry {
+	counter := model.SystemFunding
+	if change < 0 {
+		counter = model.SystemExpired
+	}
+	return model.JournalEntry{
+		Type:           model.EntryRefill,
+		IdempotencyKey: fmt.Sprintf("refill:%s:%s", p.ID, period),
+		Reference:      p.ID,
+		Metadata:       map[string]string{"policy_id": p.ID, "period": period, "mode": p.Mode},
+		Legs:           legs(p.AccountID, counter, p.ResourceType, change),
+	}
+}
+
+func (r *LedgerRepo) CreateQuotaPolicy(ctx context.Context, req model.QuotaPolicyRequest) (*model.QuotaPolicy, error) {
+	p, err := newQuotaPolicy(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+        INSERT INTO quota_policies (account_id, resource_type, mode, amount, cap, cron, interval_seconds, next_refill_at, created_at)
+        SELECT account_id, resource_type, $3, $4, $5, $6, $7, $8, $9 FROM balances
+        WHERE account_id = $1 AND resource_type = $2 AND deleted_at IS NULL
+        RETURNING id`
+
+	err = r.db.QueryRow(ctx, query, p.AccountID, p.ResourceType, p.Mode, p.Amount, p.Cap, p.Cron, p.IntervalSeconds,
+		p.NextRefillAt, p.CreatedAt).Scan(&p.ID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFoundInDB
+		}
+		return nil, fmt.Errorf("db create quota policy: %w", err)
+	}
+	return &p, nil
+}
+
+const quotaPolicyColumns = `id, account_id, resource_type, mode, amount, cap, cron, interval_seconds, next_refill_at, last_period, created_at`
+
+func scanQuotaPolicy(row pgx.Row) (model.QuotaPolicy, error) {
+	var p model.QuotaPolicy
+	err := row.Scan(&p.ID, &p.AccountID, &p.ResourceType, &p.Mode, &p.Amount, &p.Cap, &p.Cron, &p.IntervalSeconds,
+		&p.NextRefillAt, &p.LastPeriod, &p.CreatedAt)
+	return p, err
+}
+
+// ListQuotaPolicies returns an account's quota policies, oldest first.
+func (r *LedgerRepo) ListQuotaPolicies(ctx context.Context, accountID, resourceType string) ([]model.QuotaPolicy, error) {
+	query := `SELECT ` + quotaPolicyColumns + ` FROM quota_policies WHERE account_id = $1 AND resource_type = $2 ORDER BY created_at`
+
+	rows, err := r.db.Query(ctx, query, accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []model.QuotaPolicy{}
+	for rows.Next() {
+		p, err := scanQuotaPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+func (r *LedgerRepo) DeleteQuotaPolicy(ctx context.Context, id string) error {
+	res, err := r.db.Exec(ctx, `DELETE FROM quota_policies WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("db delete quota policy: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrQuotaPolicyNotFound
+	}
+	return nil
+}
+
+// ApplyDueRefills applies the due periods of every policy whose next refill is at or before
+// now, and returns how many periods it applied. A policy that fails is logged and skipped,
+// so it does not hold up the policies behind it.
+func (r *LedgerRepo) ApplyDueRefills(ctx context.Context, now time.Time) (int, error) {
+	rows, err := r.db.Query(ctx, `SELECT id FROM quota_policies WHERE next_refill_at <= $1 ORDER BY next_refill_at LIMIT $2`,
+		now, refillBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, id := range ids {
+		n, err := r.applyRefill(ctx, id, now)
+		if err != nil {
+			slog.Error("quota refill failed", "error", err, "policy_id", id)
+			continue
+		}
+		applied += n
+	}
+	return applied, nil
+}
+
+// duePeriods returns the starts of the periods of a policy due at now, oldest first,
+// and the start of the period after them.
+func duePeriods(p model.QuotaPolicy, now time.Time) ([]time.Time, time.Time) {
+	var starts []time.Time
+	next := p.NextRefillAt
+	for !next.After(now) && len(starts) < maxCatchUpPeriods {
+		starts = append(starts, next)
+		next = nextRefill(p, next)
+	}
+	return starts, next
+}
+
+// refillPeriod is a period applied by a refill and the change it made.
+type refillPeriod struct {
+	key     string
+	change  int64
+	balance int64
+}
+
+// applyRefill applies the due periods of a policy and schedules the next one, in one
+// transaction, and returns how many periods it applied. The policy row is locked, so
+// concurrent schedulers skip it. A refill_to refills from the balance read when it is
+// applied, so a spend made meanwhile counts against the new period.
+func (r *LedgerRepo) applyRefill(ctx context.Context, id string, now time.Time) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	query := `SELECT ` + quotaPolicyColumns + ` FROM quota_policies WHERE id = $1 AND next_refill_at <= $2 FOR UPDATE SKIP LOCKED`
+	p, err := scanQuotaPolicy(tx.QueryRow(ctx, query, id, now))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	balance, err := r.GetBalance(ctx, p.AccountID, p.ResourceType)
+	if errors.Is(err, ErrAccountDeleted) || errors.Is(err, ErrNotFoundInDB) {
+		// Nothing left to refill.
+		if _, err := tx.Exec(ctx, `DELETE FROM quota_policies WHERE id = $1`, p.ID); err != nil {
+			return 0, err
+		}
+		return 0, tx.Commit(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	starts, next := duePeriods(p, now)
+	var periods []refillPeriod
+	var total int64
+	for _, start := range starts {
+		change := refillChange(p, balance)
+		balance += change
+		total += change
+		if change != 0 {
+			periods = append(periods, refillPeriod{key: periodKey(start), change: change, balance: balance})
+		}
+	}
+	lastPeriod := periodKey(starts[len(starts)-1])
+
+	if len(periods) > 0 {
+		// A refill starts a new period: percent thresholds are taken of the refilled balance
+		// and every threshold is armed again.
+		queryUpdate := `
+            UPDATE balances
+            SET amount = amount + $1, last_recharge = GREATEST($2, 0), updated_at = NOW()
+            WHERE account_id = $3 AND resource_type = $4 AND deleted_at IS NULL`
+		if _, err := tx.Exec(ctx, queryUpdate, total, balance, p.AccountID, p.ResourceType); err != nil {
+			return 0, fmt.Errorf("db refill: %w", err)
+		}
+		queryArm := `UPDATE balance_thresholds SET armed = TRUE WHERE account_id = $1 AND resource_type = $2 AND NOT armed`
+		if _, err := tx.Exec(ctx, queryArm, p.AccountID, p.ResourceType); err != nil {
+			return 0, fmt.Errorf("db arm thresholds: %w", err)
+		}
+		for _, period := range periods {
+			if err := writeJournal(ctx, tx, refillEntry(p, period.key, period.change)); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	querySchedule := `UPDATE quota_policies SET next_refill_at = $2, last_period = $3 WHERE id = $1`
+	if _, err := tx.Exec(ctx, querySchedule, p.ID, next, lastPeriod); err != nil {
+		return 0, fmt.Errorf("db schedule refill: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	if len(periods) == 0 {
+		return len(starts), nil
+	}
+
+	// As after a recharge, the cache is warmed back up from PostgreSQL.
+	if err := r.rdb.Del(ctx, fmt.Sprintf("balance:%s:%s", p.AccountID, p.ResourceType)).Err(); err != nil {
+		return len(starts), err
+	}
+	for _, period := range periods {
+		r.publishBalanceEvent(ctx, model.BalanceEvent{
+			Type:           model.BalanceRefill,
+			AccountID:      p.AccountID,
+			ResourceType:   p.ResourceType,
+			Amount:         period.change,
+			Balance:        period.balance,
+			IdempotencyKey: fmt.Sprintf("refill:%s:%s", p.ID, period.key),
+		})
+	}
+	return len(starts), nil
+}
@@ -0,0 +1,370 @@
+package repository
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed reconcile.lua
+var reconcileLuaScript string
+
+const (
+	// staleEventAge is how long an event may stay unsynced before it is presumed lost.
+	staleEventAge = 5 * time.Minute
+
+	// reconcileConfirmDelay separates the two measurements that must agree before an account
+	// is reported, so an event synced between the Redis and PostgreSQL reads is not taken for drift.
+	reconcileConfirmDelay = 500 * time.Millisecond
+
+	reconcileLockKey = "reconcile:lock"
+	reconcileLockTTL = 10 * time.Minute
+)
+
+var (
+	ErrUnknownPolicy    = apperr.New(apperr.CodeValidationFailed, "unknown repair policy")
+	ErrReconcileRunning = apperr.New(apperr.CodeConflict, "another reconciliation is already repairing balances")
+)
+
+// pendingKey is a sorted set of the balance changes made in Redis whose events have not
+// been synced to PostgreSQL yet, scored by when they were made (unix seconds). The Lua
+// scripts add to it together with the outbox entry; the worker removes from it.
+func pendingKey(accountID, resourceType string) string {
+	return fmt.Sprintf("pending:%s:%s", accountID, resourceType)
+}
+
+func pendingMember(idempotencyKey string, amount int64) string {
+	return fmt.Sprintf("%s|%d", idempotencyKey, amount)
+}
+
+func parsePendingMember(member string) (string, int64, bool) {
+	key, raw, ok := cutLast(member, "|")
+	if !ok {
+		return "", 0, false
+	}
+	amount, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return key, amount, true
+}
+
+// parseBalanceKey splits "balance:{account}:{resource}"; account IDs may contain colons themselves.
+func parseBalanceKey(key string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, "balance:")
+	if !ok {
+		return "", "", false
+	}
+	return cutLast(rest, ":")
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i <= 0 || i+len(sep) == len(s) {
+		return "", "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// untrackPending forgets an event once PostgreSQL has it.
+func (r *LedgerRepo) untrackPending(ctx context.Context, accountID, resourceType, idempotencyKey string, amount int64) {
+	member := pendingMember(idempotencyKey, amount)
+	if err := r.rdb.ZRem(ctx, pendingKey(accountID, resourceType), member).Err(); err != nil {
+		slog.Error("failed to untrack pending event", "idempotency_key", idempotencyKey, "error", err)
+	}
+}
+
+// pendingTotal returns the amount taken from the cached balance by events not yet synced.
+func (r *LedgerRepo) pendingTotal(ctx context.Context, accountID, resourceType string) (int64, error) {
+	members, err := r.rdb.ZRange(ctx, pendingKey(accountID, resourceType), 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, member := range members {
+		if _, amount, ok := parsePendingMember(member); ok {
+			total += amount
+		}
+	}
+	return total, nil
+}
+
+// driftCheck is one measurement of an account, with what a repair needs beyond the report.
+type driftCheck struct {
+	model.AccountDrift
+	freshPending int64
+	staleMembers []string
+}
+
+// Reconcile compares every cached balance with PostgreSQL, allowing for pending holds and
+// events not yet synced, and reports the accounts that drifted. Unless the policy is
+// RepairNone, each drifted account is corrected towards the store the policy trusts.
+func (r *LedgerRepo) Reconcile(ctx context.Context, policy model.RepairPolicy) (*model.DriftReport, error) {
+	switch policy {
+	case "":
+		policy = model.RepairNone
+	case model.RepairNone, model.RepairTrustRedis, model.RepairTrustPostgres:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPolicy, policy)
+	}
+
+	if policy != model.RepairNone {
+		locked, err := r.rdb.SetNX(ctx, reconcileLockKey, "1", reconcileLockTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			return nil, ErrReconcileRunning
+		}
+		defer r.rdb.Del(context.WithoutCancel(ctx), reconcileLockKey)
+	}
+
+	report := &model.DriftReport{
+		Policy:    policy,
+		CheckedAt: time.Now(),
+		Accounts:  []model.AccountDrift{},
+	}
+
+	iter := r.rdb.Scan(ctx, 0, "balance:*", 500).Iterator()
+	for iter.Next(ctx) {
+		accountID, resourceType, ok := parseBalanceKey(iter.Val())
+		if !ok {
+			continue
+		}
+		report.Scanned++
+
+		drift, err := r.confirmDrift(ctx, accountID, resourceType)
+		if err != nil {
+			return nil, fmt.Errorf("reconcile %s: %w", iter.Val(), err)
+		}
+		if drift == nil {
+			continue
+		}
+
+		if policy != model.RepairNone {
+			if drift.Repaired, err = r.repairDrift(ctx, policy, drift); err != nil {
+				return nil, fmt.Errorf("repair %s: %w", iter.Val(), err)
+			}
+			if drift.Repaired {
+				report.Repaired++
+			}
+		}
+		report.Accounts = append(report.Accounts, drift.AccountDrift)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	report.OK = len(report.Accounts) == 0
+	return report, nil
+}
+
+// confirmDrift measures an account twice and only reports what both measurements agree on.
+func (r *LedgerRepo) confirmDrift(ctx context.Context, accountID, resourceType string) (*driftCheck, error) {
+	first, err := r.measureDrift(ctx, accountID, resourceType)
+	if err != nil || first == nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(reconcileConfirmDelay):
+	}
+
+	second, err := r.measureDrift(ctx, accountID, resourceType)
+	if err != nil || second == nil {
+		return nil, err
+	}
+	if first.Drift != second.Drift || first.StaleEvents != second.StaleEvents {
+		return nil, nil
+	}
+	return second, nil
+}
+
+// measureDrift returns nil when the cached balance matches PostgreSQL.
+func (r *LedgerRepo) measureDrift(ctx context.Context, accountID, resourceType string) (*driftCheck, error) {
+	// The balance and its pending events are read in one MULTI so they describe the same moment.
+	pipe := r.rdb.TxPipeline()
+	balanceCmd := pipe.Get(ctx, fmt.Sprintf("balance:%s:%s", accountID, resourceType))
+	pendingCmd := pipe.ZRangeWithScores(ctx, pendingKey(accountID, resourceType), 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if errors.Is(err, redis.Nil) {
+			// Invalidated since the scan; it will be reloaded from PostgreSQL.
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	d := &driftCheck{AccountDrift: model.AccountDrift{AccountID: accountID, ResourceType: resourceType}}
+	var err error
+	if d.RedisBalance, err = balanceCmd.Int64(); err != nil {
+		return nil, err
+	}
+
+	staleBefore := float64(time.Now().Add(-staleEventAge).Unix())
+	for _, z := range pendingCmd.Val() {
+		member, _ := z.Member.(string)
+		_, amount, ok := parsePendingMember(member)
+		if !ok {
+			continue
+		}
+		d.PendingEvents += amount
+		if z.Score < staleBefore {
+			d.StaleEvents++
+			d.StaleAmount += amount
+			d.staleMembers = append(d.staleMembers, member)
+		} else {
+			d.freshPending += amount
+		}
+	}
+
+	query := `
+        SELECT b.amount, COALESCE((
+            SELECT SUM(h.amount) FROM holds h
+            WHERE h.account_id = b.account_id AND h.resource_type = b.resource_type AND h.status = 'pending'
+        ), 0)::BIGINT
+        FROM balances b
+        WHERE b.account_id = $1 AND b.resource_type = $2 AND b.deleted_at IS NULL`
+
+	err = r.db.QueryRow(ctx, query, accountID, resourceType).Scan(&d.PostgresBalance, &d.PendingHolds)
+	if errors.Is(err, pgx.ErrNoRows) {
+		d.MissingInPostgres = true
+		d.Drift = d.RedisBalance
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.Drift = d.RedisBalance - (d.PostgresBalance - d.PendingHolds - d.PendingEvents)
+	if d.Drift == 0 && d.StaleEvents == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// repairDrift corrects one account towards the trusted store. It returns false when the
+// account cannot be repaired or changed since it was measured; the next run picks it up again.
+func (r *LedgerRepo) repairDrift(ctx context.Context, policy model.RepairPolicy, d *driftCheck) (bool, error) {
+	switch {
+	case d.MissingInPostgres && policy == model.RepairTrustPostgres:
+		balanceKey := fmt.Sprintf("balance:%s:%s", d.AccountID, d.ResourceType)
+		if err := r.rdb.Del(ctx, balanceKey, pendingKey(d.AccountID, d.ResourceType)).Err(); err != nil {
+			return false, err
+		}
+		return true, nil
+	case d.MissingInPostgres:
+		// There is no PostgreSQL balance to bring in line with Redis.
+		return false, nil
+	case policy == model.RepairTrustPostgres:
+		return r.repairRedis(ctx, d)
+	default:
+		return r.repairPostgres(ctx, d)
+	}
+}
+
+// repairRedis moves the cached balance to what PostgreSQL implies. Stale events are presumed
+// lost, so their amounts are given back; should one arrive later the next run takes it back out.
+func (r *LedgerRepo) repairRedis(ctx context.Context, d *driftCheck) (bool, error) {
+	target := d.PostgresBalance - d.PendingHolds - d.freshPending
+
+	args := []interface{}{d.RedisBalance, target - d.RedisBalance}
+	for _, member := range d.staleMembers {
+		args = append(args, member)
+	}
+
+	balanceKey := fmt.Sprintf("balance:%s:%s", d.AccountID, d.ResourceType)
+	result, err := r.rdb.Eval(ctx, reconcileLuaScript,
+		[]string{balanceKey, pendingKey(d.AccountID, d.ResourceType)}, args...,
+	).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return result.([]interface{})[0].(int64) == 1, nil
+}
+
+// repairPostgres moves the stored balance to what Redis implies. Stale events are presumed
+// lost and recorded under their own idempotency keys, so the worker ignores a late delivery.
+func (r *LedgerRepo) repairPostgres(ctx context.Context, d *driftCheck) (bool, error) {
+	delta := d.RedisBalance + d.PendingHolds + d.freshPending - d.PostgresBalance
+
+	entryID, err := newID()
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Only correct the balance the drift was measured against.
+	queryUpdate := `
+        UPDATE balances
+        SET amount = amount + $1, updated_at = NOW()
+        WHERE account_id = $2 AND resource_type = $3 AND amount = $4`
+
+	res, err := tx.Exec(ctx, queryUpdate, delta, d.AccountID, d.ResourceType, d.PostgresBalance)
+	if err != nil {
+		return false, fmt.Errorf("db reconcile balance: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	metadata, _ := json.Marshal(map[string]string{"source": "reconcile"})
+	queryInsert := `
+        INSERT INTO transactions (account_id, resource_type, amount, idempotency_key, metadata, created_at)
+        VALUES ($1, $2, $3, $4, $5, NOW())
+        ON CONFLICT (idempotency_key) DO NOTHING`
+
+	for _, member := range d.staleMembers {
+		key, amount, _ := parsePendingMember(member)
+		if _, err := tx.Exec(ctx, queryInsert, d.AccountID, d.ResourceType, amount, key, metadata); err != nil {
+			return false, fmt.Errorf("db insert reconciled event: %w", err)
+		}
+	}
+
+	if delta != 0 {
+		err = writeJournal(ctx, tx, model.JournalEntry{
+			Type:           model.EntryAdjustment,
+			IdempotencyKey: "reconcile:" + entryID,
+			Metadata:       map[string]string{"reason": "reconcile", "policy": string(model.RepairTrustRedis)},
+			Legs:           legs(d.AccountID, model.SystemReconcile, d.ResourceType, delta),
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+
+	if len(d.staleMembers) > 0 {
+		members := make([]interface{}, len(d.staleMembers))
+		for i, member := range d.staleMembers {
+			members[i] = member
+		}
+		if err := r.rdb.ZRem(ctx, pendingKey(d.AccountID, d.ResourceType), members...).Err(); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,19 @@
+-- KEYS[1] = Balance key (e.g., "balance:user123:api_tokens")
+-- KEYS[2] = Pending events key (e.g., "pending:user123:api_tokens")
+-- ARGV[1] = Balance the reconciler observed
+-- ARGV[2] = Correction to apply
+-- ARGV[3..] = Stale pending events to drop
+
+-- 1. Only correct the balance the drift was measured against; a spend in between means measure again
+local current_balance = redis.call("GET", KEYS[1])
+if not current_balance or tonumber(current_balance) ~= tonumber(ARGV[1]) then
+    return {0, "BALANCE_CHANGED"}
+end
+
+-- 2. Apply the correction and forget the events it accounts for
+local new_balance = redis.call("INCRBY", KEYS[1], ARGV[2])
+for i = 3, #ARGV do
+    redis.call("ZREM", KEYS[2], ARGV[i])
+end
+
+return {1, new_balance}
@@ -0,0 +1,34 @@
+package repository
+
+import "testing"
+
+func TestParseBalanceKey(t *testing.T) {
+	tests := []struct {
+		key, account, resource string
+		ok                     bool
+	}{
+		{"balance:user123:api_tokens", "user123", "api_tokens", true},
+		{"balance:org:42:api_tokens", "org:42", "api_tokens", true},
+		{"balance:user123", "", "", false},
+		{"balance:user123:", "", "", false},
+		{"credit_limit:user123:api_tokens", "", "", false},
+	}
+	for _, tt := range tests {
+		account, resource, ok := parseBalanceKey(tt.key)
+		if account != tt.account || resource != tt.resource || ok != tt.ok {
+			t.Errorf("%q: expected (%q, %q, %t), got (%q, %q, %t)", tt.key, tt.account, tt.resource, tt.ok, account, resource, ok)
+		}
+	}
+}
+
+func TestPendingMember_RoundTrip(t *testing.T) {
+	for _, amount := range []int64{10, -25} {
+		key, got, ok := parsePendingMember(pendingMember("req|with-pipe:credit", amount))
+		if !ok || key != "req|with-pipe:credit" || got != amount {
+			t.Errorf("expected (req|with-pipe:credit, %d), got (%s, %d, %t)", amount, key, got, ok)
+		}
+	}
+	if _, _, ok := parsePendingMember("no-amount|"); ok {
+		t.Error("expected a member without an amount to be rejected")
+	}
+}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrOriginalNotFound = apperr.New(apperr.CodeNotFound, "original transaction not found")
+	ErrRefundExceeds    = apperr.New(apperr.CodeValidationFailed, "refund exceeds the original amount")
+)
+
+// Refund credits back part or all of a prior spend identified by its idempotency key.
+// The refund is recorded as a reversal entry linked to the original transaction,
+// and the total refunded can never exceed the original amount. A retry with the same
+// idempotencyKey gets the refund it made back instead of refunding again.
+func (r *LedgerRepo) Refund(ctx context.Context, originalIdempotencyKey string, amount int64, idempotencyKey string) (*model.RefundResult, error) {
+	if amount <= 0 {
+		return nil, apperr.Validation("refund amount must be positive")
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Lock the original row so concurrent refunds of the same spend are serialised.
+	var originalID, accountID, resourceType string
+	var originalAmount int64
+	queryOriginal := `
+        SELECT id, account_id, resource_type, amount
+        FROM transactions
+        WHERE idempotency_key = $1 AND reversal_of IS NULL AND amount > 0
+          AND COALESCE(metadata->>'type', 'spend') = 'spend'
+        FOR UPDATE`
+
+	err = tx.QueryRow(ctx, queryOriginal, originalIdempotencyKey).
+		Scan(&originalID, &accountID, &resourceType, &originalAmount)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrOriginalNotFound
+		}
+		return nil, err
+	}
+
+	done, err := claimIdempotencyKey(ctx, tx, idempotencyKey, opRefund,
+		fingerprint(opRefund, originalIdempotencyKey, amount))
+	if err != nil {
+		return nil, err
+	}
+
+	var refunded int64
+	queryRefunded := `SELECT COALESCE(SUM(-amount), 0)::BIGINT FROM transactions WHERE reversal_of = $1`
+	if err := tx.QueryRow(ctx, queryRefunded, originalID).Scan(&refunded); err != nil {
+		return nil, err
+	}
+	if done {
+		original := model.Transaction{ID: originalID, AccountID: accountID, ResourceType: resourceType,
+			Amount: originalAmount, IdempotencyKey: originalIdempotencyKey}
+		return r.replayedRefund(ctx, tx, original, idempotencyKey, refunded)
+	}
+	if refunded+amount > originalAmount {
+		return nil, fmt.Errorf("%w: %d of %d already refunded", ErrRefundExceeds, refunded, originalAmount)
+	}
+
+	refundID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{"type": "refund"}
+	if idempotencyKey != "" {
+		meta["refund_key"] = idempotencyKey
+	}
+	metadata, _ := json.Marshal(meta)
+
+	queryInsert := `
+        INSERT INTO transactions (account_id, resource_type, amount, idempotency_key, metadata, reversal_of, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW())`
+
+	refundKey := fmt.Sprintf("refund:%s:%s", originalIdempotencyKey, refundID)
+	_, err = tx.Exec(ctx, queryInsert,
+		accountID, resourceType, -amount, refundKey, metadata, originalID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("db insert refund: %w", err)
+	}
+
+	queryUpdate := `
+        UPDATE balances SET amount = amount + $1, updated_at = NOW()
+        WHERE account_id = $2 AND resource_type = $3 AND deleted_at IS NULL`
+	res, err := tx.Exec(ctx, queryUpdate, amount, accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, ErrAccountDeleted
+	}
+
+	err = writeJournal(ctx, tx, model.JournalEntry{
+		Type:           model.EntryRefund,
+		IdempotencyKey: refundKey,
+		Reference:      "spend:" + originalIdempotencyKey,
+		Legs:           legs(accountID, model.SystemRevenue, resourceType, amount),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	// As after a recharge, the cache is warmed back up from PostgreSQL.
+	if err := r.rdb.Del(ctx, fmt.Sprintf("balance:%s:%s", accountID, resourceType)).Err(); err != nil {
+		return nil, err
+	}
+	newBalance, err := r.GetBalance(ctx, accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	r.publishBalanceEvent(ctx, model.BalanceEvent{
+		Type:           model.BalanceRefund,
+		AccountID:      accountID,
+		ResourceType:   resourceType,
+		Amount:         amount,
+		Balance:        newBalance,
+		IdempotencyKey: idempotencyKey,
+	})
+
+	return &model.RefundResult{
+		RefundID:       refundID,
+		OriginalKey:    originalIdempotencyKey,
+		Amount:         amount,
+		RefundedTotal:  refunded + amount,
+		OriginalAmount: originalAmount,
+		NewBalance:     newBalance,
+		Status:         "REFUNDED",
+	}, nil
+}
+
+// replayedRefund returns the refund made earlier with an idempotency key.
+func (r *LedgerRepo) replayedRefund(ctx context.Context, tx pgx.Tx, original model.Transaction, idempotencyKey string, refunded int64) (*model.RefundResult, error) {
+	var refundKey string
+	var amount int64
+	query := `SELECT idempotency_key, -amount FROM transactions WHERE reversal_of = $1 AND metadata->>'refund_key' = $2`
+	if err := tx.QueryRow(ctx, query, original.ID, idempotencyKey).Scan(&refundKey, &amount); err != nil {
+		return nil, fmt.Errorf("db read refund %s: %w", idempotencyKey, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	newBalance, err := r.GetBalance(ctx, original.AccountID, original.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	return &model.RefundResult{
+		RefundID:       strings.TrimPrefix(refundKey, fmt.Sprintf("refund:%s:", original.IdempotencyKey)),
+		OriginalKey:    original.IdempotencyKey,
+		Amount:         amount,
+		RefundedTotal:  refunded,
+		OriginalAmount: original.Amount,
+		NewBalance:     newBalance,
+		Status:         "REFUNDED",
+	}, nil
+}
@@ -0,0 +1,73 @@
+-- Settles a hold: used by both Capture and Void.
+-- KEYS[1] = Hold key (e.g., "hold:9f86d081884c7d65")
+-- KEYS[2] = Balance key of the account that owns the hold
+-- KEYS[3] = Outbox stream (e.g., "outbox:events")
+-- KEYS[4] = Pending events of the account (e.g., "pending:user123:api_tokens")
+-- KEYS[5] = Credit lot order of the account (sorted set of grant IDs)
+-- KEYS[6] = Credit lot remaining amounts of the account (hash of grant ID -> remaining)
+-- ARGV[1] = Amount to capture (0 releases the whole hold)
+-- ARGV[2] = Spend event payload for the captured amount (JSON, unused when nothing is captured)
+-- ARGV[3] = Pending event member (e.g., "hold:9f86d081884c7d65|10")
+-- ARGV[4] = Current time (unix seconds)
+-- ARGV[5] = Lot score modulus: a lot's score modulo it is the lot's expiry (unix seconds)
+
+-- 1. The hold must still be pending
+local held = redis.call("HGET", KEYS[1], "amount")
+if not held then
+    return {-1, "HOLD_NOT_FOUND"}
+end
+
+held = tonumber(held)
+local capture_amount = tonumber(ARGV[1])
+
+-- 2. A hold can never be captured for more than was reserved
+if capture_amount > held then
+    return {-2, "CAPTURE_EXCEEDS_HOLD"}
+end
+
+-- 3. The captured amount is charged to the lots the hold consumed, in the order it consumed
+--    them. The rest goes back to its lots while they are cached and have not expired;
+--    otherwise it goes back to the balance only, like any credits outside a lot
+local captured_lots = {}
+local to_capture = capture_amount
+local lots_cached = redis.call("EXISTS", KEYS[6]) == 1
+local lots = {}
+for field in string.gmatch(redis.call("HGET", KEYS[1], "lots") or "", "[^,]+") do
+    table.insert(lots, field)
+end
+for i = 1, #lots, 3 do
+    local lot_id, taken, score = lots[i], tonumber(lots[i + 1]), lots[i + 2]
+    local take = math.min(taken, to_capture)
+    if take > 0 then
+        to_capture = to_capture - take
+        table.insert(captured_lots, lot_id)
+        table.insert(captured_lots, take)
+    end
+    if taken > take and lots_cached and tonumber(score) % tonumber(ARGV[5]) > tonumber(ARGV[4]) then
+        redis.call("HINCRBY", KEYS[6], lot_id, taken - take)
+        redis.call("ZADD", KEYS[5], score, lot_id)
+    end
+end
+
+-- 4. Queue the captured amount for PostgreSQL in the same step
+if capture_amount > 0 then
+    redis.call("XADD", KEYS[3], "*", "topic", "transactions.created", "payload", ARGV[2], "lots", table.concat(captured_lots, ","))
+    redis.call("ZADD", KEYS[4], ARGV[4], ARGV[3])
+end
+
+-- 5. Remove the hold and give back what was not captured. The hold is marked settled for
+--    a day, so the expiry sweep can tell a settled hold from one Redis lost
+redis.call("DEL", KEYS[1])
+redis.call("HSET", KEYS[1], "settled", "1")
+redis.call("EXPIRE", KEYS[1], 86400)
+
+local remainder = held - capture_amount
+if redis.call("EXISTS", KEYS[2]) == 0 then
+    -- Balance is not cached; it will be rebuilt from PostgreSQL on the next read.
+    return {2, 0, held}
+end
+
+local new_balance = redis.call("INCRBY", KEYS[2], remainder)
+
+-- Return 1 (success), the new balance and the originally held amount
+return {1, new_balance, held}
@@ -0,0 +1,30 @@
+-- Undoes an authorization PostgreSQL did not record.
+-- KEYS[1] = Hold key (e.g., "hold:9f86d081884c7d65")
+-- KEYS[2] = Balance key of the account that owns the hold
+-- KEYS[3] = Idempotency key of the authorization (e.g., "idem:req-uuid-456")
+-- KEYS[4] = Credit lot order of the account (sorted set of grant IDs)
+-- KEYS[5] = Credit lot remaining amounts of the account (hash of grant ID -> remaining)
+
+-- 1. Give the reservation back, unless the balance is no longer cached
+local held = redis.call("HGET", KEYS[1], "amount")
+if held and redis.call("EXISTS", KEYS[2]) == 1 then
+    redis.call("INCRBY", KEYS[2], held)
+end
+
+-- 2. Give the lots back what the hold took from them ("grant,amount,score,..."), unless
+--    they are no longer cached
+if redis.call("EXISTS", KEYS[5]) == 1 then
+    local lots = {}
+    for field in string.gmatch(redis.call("HGET", KEYS[1], "lots") or "", "[^,]+") do
+        table.insert(lots, field)
+    end
+    for i = 1, #lots, 3 do
+        redis.call("HINCRBY", KEYS[5], lots[i], lots[i + 1])
+        redis.call("ZADD", KEYS[4], lots[i + 2], lots[i])
+    end
+end
+
+-- 3. Forget the hold and the idempotency key, so a retry authorizes again
+redis.call("DEL", KEYS[1], KEYS[3])
+
+return 1
@@ -1,10 +1,35 @@
 -- KEYS[1] = Balance key (e.g., "balance:user123:api_tokens")
 -- KEYS[2] = Idempotency key (e.g., "idem:req-uuid-456")
+-- KEYS[3] = Credit limit key (e.g., "credit_limit:user123:api_tokens"), missing means no overdraft
+-- KEYS[4] = Credit lot order (sorted set of grant IDs, lowest score is consumed first)
+-- KEYS[5] = Credit lot remaining amounts (hash of grant ID -> remaining)
+-- KEYS[6] = Outbox stream (e.g., "outbox:events")
+-- KEYS[7] = Pending events of the account (e.g., "pending:user123:api_tokens")
+-- KEYS[8] = Balance event stream (e.g., "events:balances")
+-- KEYS[9] = Threshold definitions of the account (e.g., "thresholds:user123:api_tokens")
 -- ARGV[1] = Deduction amount (e.g., 10)
+-- ARGV[2] = Spend event payload (JSON, without the lots consumed)
+-- ARGV[3] = Pending event member (e.g., "req-uuid-456|10")
+-- ARGV[4] = Current time (unix seconds)
+-- ARGV[5] = Request fingerprint (hash of account, resource type and amount)
+-- ARGV[6] = Current time (unix milliseconds)
+-- ARGV[7] = Approximate length the balance event stream is capped at
+-- ARGV[8] = Account ID
+-- ARGV[9] = Resource type
+-- ARGV[10] = Idempotency key
 
--- 1. Check idempotency. If this request has already been processed, return status 0
+-- 1. Check idempotency. A request already processed gets its original outcome back with
+-- status 2, unless the key is now used for a different request (status -3). Keys stored
+-- without an outcome, by other scripts or older versions, still return status 0.
 if redis.call("EXISTS", KEYS[2]) == 1 then
-    return {0, "ALREADY_PROCESSED"}
+    if redis.call("TYPE", KEYS[2]).ok ~= "hash" then
+        return {0, "ALREADY_PROCESSED"}
+    end
+    local original = redis.call("HMGET", KEYS[2], "fingerprint", "new_balance", "credit_limit", "amount", "processed_at")
+    if original[1] ~= ARGV[5] then
+        return {-3, "IDEMPOTENCY_CONFLICT"}
+    end
+    return {2, original[2], original[3], original[4], original[5]}
 end
 
 -- 2. Get the current balance
@@ -15,17 +40,51 @@ end
 
 current_balance = tonumber(current_balance)
 local deduct_amount = tonumber(ARGV[1])
+local credit_limit = tonumber(redis.call("GET", KEYS[3]) or "0")
 
--- 3. Check if there are enough tokens on the balance
-if current_balance < deduct_amount then
+-- 3. Check if there are enough tokens on the balance, allowing it to go down to -credit_limit
+if current_balance - deduct_amount < -credit_limit then
     return {-2, "INSUFFICIENT_FUNDS"}
 end
 
 -- 4. Success! Deduct funds
 local new_balance = redis.call("DECRBY", KEYS[1], deduct_amount)
 
--- 5. Store the idempotency key for 24 hours (86400 seconds) to prevent duplicates
-redis.call("SET", KEYS[2], "1", "EX", 86400)
+-- 5. Consume credit lots in order; whatever they don't cover comes from the non-expiring balance
+local consumed = {}
+local to_consume = deduct_amount
+for _, lot_id in ipairs(redis.call("ZRANGE", KEYS[4], 0, -1)) do
+    if to_consume <= 0 then
+        break
+    end
+    local remaining = tonumber(redis.call("HGET", KEYS[5], lot_id) or "0")
+    local take = math.min(remaining, to_consume)
+    if take > 0 then
+        to_consume = to_consume - take
+        table.insert(consumed, lot_id)
+        table.insert(consumed, take)
+    end
+    if remaining - take <= 0 then
+        redis.call("HDEL", KEYS[5], lot_id)
+        redis.call("ZREM", KEYS[4], lot_id)
+    else
+        redis.call("HINCRBY", KEYS[5], lot_id, -take)
+    end
+end
+
+-- 6. Store the outcome under the idempotency key for 24 hours (86400 seconds), so a retry gets it back
+redis.call("HSET", KEYS[2], "fingerprint", ARGV[5], "new_balance", new_balance, "credit_limit", credit_limit,
+    "amount", deduct_amount, "processed_at", ARGV[6])
+redis.call("EXPIRE", KEYS[2], 86400)
+
+-- 7. Queue the event for PostgreSQL in the same step, with the lots as "grant,amount,grant,amount"
+redis.call("XADD", KEYS[6], "*", "topic", "transactions.created", "payload", ARGV[2], "lots", table.concat(consumed, ","))
+redis.call("ZADD", KEYS[7], ARGV[4], ARGV[3])
+
+-- 8. Tell the balance watchers
+redis.call("XADD", KEYS[8], "MAXLEN", "~", ARGV[7], "*", "type", "spend", "account_id", ARGV[8],
+    "resource_type", ARGV[9], "amount", deduct_amount, "balance", new_balance, "idempotency_key", ARGV[10], "at", ARGV[6])
 
--- Return 1 (success) and the new balance
-return {1, new_balance}
\ No newline at end of file
+-- Return 1 (success), the new balance, the credit limit it was checked against and whether
+-- the account has thresholds, so the caller only checks them when there are any
+return {1, new_balance, credit_limit, redis.call("EXISTS", KEYS[9])}
\ No newline at end of file
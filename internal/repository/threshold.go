@@ -0,0 +1,255 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrThresholdNotFound = apperr.New(apperr.CodeNotFound, "threshold not found")
+
+// thresholdKeys returns the Redis keys of an account's thresholds: a hash of threshold ID
+// to "kind:value", the set of the armed ones, and the amount of the last recharge.
+func thresholdKeys(accountID, resourceType string) (defsKey, armedKey, lastRechargeKey string) {
+	return fmt.Sprintf("thresholds:%s:%s", accountID, resourceType),
+		fmt.Sprintf("thresholds_armed:%s:%s", accountID, resourceType),
+		fmt.Sprintf("last_recharge:%s:%s", accountID, resourceType)
+}
+
+// validateThreshold checks a new threshold.
+func validateThreshold(req model.ThresholdRequest) error {
+	if req.AccountID == "" || req.ResourceType == "" {
+		return apperr.Validation("account_id and resource_type are required")
+	}
+	switch req.Kind {
+	case model.ThresholdAbsolute:
+		if req.Value < 0 {
+			return apperr.Validation("an absolute threshold must not be negative")
+		}
+	case model.ThresholdPercent:
+		if req.Value < 1 || req.Value > 100 {
+			return apperr.Validation("a percent threshold must be between 1 and 100")
+		}
+	default:
+		return apperr.Validation(fmt.Sprintf("unknown threshold kind %q", req.Kind))
+	}
+	return nil
+}
+
+// thresholdLevel is the balance a threshold stands for. A percent threshold has none
+// before the account is first funded.
+func thresholdLevel(kind string, value, lastRecharge int64) (int64, bool) {
+	if kind == model.ThresholdAbsolute {
+		return value, true
+	}
+	if lastRecharge <= 0 {
+		return 0, false
+	}
+	return lastRecharge * value / 100, true
+}
+
+// crossedThreshold returns the event of a debit that took the balance from above a
+// threshold's level to or below it, if it did.
+func crossedThreshold(t model.BalanceThreshold, lastRecharge, previous, balance int64) (model.ThresholdCrossedEvent, bool) {
+	level, ok := thresholdLevel(t.Kind, t.Value, lastRecharge)
+	if !ok || previous <= level || balance > level {
+		return model.ThresholdCrossedEvent{}, false
+	}
+	e := model.ThresholdCrossedEvent{
+		ThresholdID:     t.ID,
+		AccountID:       t.AccountID,
+		ResourceType:    t.ResourceType,
+		Kind:            t.Kind,
+		Value:           t.Value,
+		Level:           level,
+		PreviousBalance: previous,
+		Balance:         balance,
+		CrossedAt:       time.Now(),
+	}
+	if t.Kind == model.ThresholdPercent {
+		e.LastRecharge = lastRecharge
+	}
+	return e, true
+}
+
+// CreateThreshold adds an armed threshold to a live account.
+func (r *LedgerRepo) CreateThreshold(ctx context.Context, req model.ThresholdRequest) (*model.BalanceThreshold, error) {
+	if err := validateThreshold(req); err != nil {
+		return nil, err
+	}
+
+	query := `
+        INSERT INTO balance_thresholds (account_id, resource_type, kind, value)
+        SELECT account_id, resource_type, $3, $4 FROM balances
+        WHERE account_id = $1 AND resource_type = $2 AND deleted_at IS NULL
+        RETURNING id, armed, created_at`
+
+	t := model.BalanceThreshold{AccountID: req.AccountID, ResourceType: req.ResourceType, Kind: req.Kind, Value: req.Value}
+	err := r.db.QueryRow(ctx, query, req.AccountID, req.ResourceType, req.Kind, req.Value).Scan(&t.ID, &t.Armed, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFoundInDB
+		}
+		return nil, fmt.Errorf("db create threshold: %w", err)
+	}
+
+	if err := r.warmUpThresholds(ctx, req.AccountID, req.ResourceType); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListThresholds returns an account's thresholds, oldest first.
+func (r *LedgerRepo) ListThresholds(ctx context.Context, accountID, resourceType string) ([]model.BalanceThreshold, error) {
+	query := `
+        SELECT id, account_id, resource_type, kind, value, armed, created_at
+        FROM balance_thresholds
+        WHERE account_id = $1 AND resource_type = $2
+        ORDER BY created_at`
+
+	rows, err := r.db.Query(ctx, query, accountID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	thresholds := []model.BalanceThreshold{}
+	for rows.Next() {
+		var t model.BalanceThreshold
+		if err := rows.Scan(&t.ID, &t.AccountID, &t.ResourceType, &t.Kind, &t.Value, &t.Armed, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		thresholds = append(thresholds, t)
+	}
+	return thresholds, rows.Err()
+}
+
+func (r *LedgerRepo) DeleteThreshold(ctx context.Context, id string) error {
+	var accountID, resourceType string
+	query := `DELETE FROM balance_thresholds WHERE id = $1 RETURNING account_id, resource_type`
+
+	if err := r.db.QueryRow(ctx, query, id).Scan(&accountID, &resourceType); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrThresholdNotFound
+		}
+		return fmt.Errorf("db delete threshold: %w", err)
+	}
+	return r.warmUpThresholds(ctx, accountID, resourceType)
+}
+
+// warmUpThresholds loads an account's thresholds, whether they are armed and its last
+// recharge from PostgreSQL into Redis, replacing what was cached.
+func (r *LedgerRepo) warmUpThresholds(ctx context.Context, accountID, resourceType string) error {
+	var lastRecharge int64
+	err := r.db.QueryRow(ctx, `SELECT last_recharge FROM balances WHERE account_id = $1 AND resource_type = $2`,
+		accountID, resourceType).Scan(&lastRecharge)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFoundInDB
+		}
+		return err
+	}
+
+	rows, err := r.db.Query(ctx, `SELECT id, kind, value, armed FROM balance_thresholds WHERE account_id = $1 AND resource_type = $2`,
+		accountID, resourceType)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	defsKey, armedKey, lastRechargeKey := thresholdKeys(accountID, resourceType)
+	pipe := r.rdb.TxPipeline()
+	pipe.Del(ctx, defsKey, armedKey)
+	pipe.Set(ctx, lastRechargeKey, lastRecharge, 0)
+	for rows.Next() {
+		var id, kind string
+		var value int64
+		var armed bool
+		if err := rows.Scan(&id, &kind, &value, &armed); err != nil {
+			return err
+		}
+		pipe.HSet(ctx, defsKey, id, fmt.Sprintf("%s:%d", kind, value))
+		if armed {
+			pipe.SAdd(ctx, armedKey, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// checkThresholds runs right after a spend, a transfer out or a hold took the balance
+// down by change.Amount to change.Balance, when the script that did it found the account
+// has thresholds. A crossed threshold is disarmed with SREM, so of concurrent debits only
+// one reports it, and the next recharge arms it again. The debit is already made, so
+// failures are only logged.
+func (r *LedgerRepo) checkThresholds(ctx context.Context, change model.BalanceEvent) {
+	defsKey, armedKey, lastRechargeKey := thresholdKeys(change.AccountID, change.ResourceType)
+
+	pipe := r.rdb.Pipeline()
+	defsCmd := pipe.HGetAll(ctx, defsKey)
+	lastRechargeCmd := pipe.Get(ctx, lastRechargeKey)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		slog.Error("threshold check failed", "error", err, "account_id", change.AccountID)
+		return
+	}
+	if len(defsCmd.Val()) == 0 {
+		return
+	}
+	lastRecharge, _ := lastRechargeCmd.Int64()
+
+	for id, def := range defsCmd.Val() {
+		kind, value, _ := strings.Cut(def, ":")
+		t := model.BalanceThreshold{ID: id, AccountID: change.AccountID, ResourceType: change.ResourceType, Kind: kind}
+		t.Value, _ = strconv.ParseInt(value, 10, 64)
+
+		e, crossed := crossedThreshold(t, lastRecharge, change.Balance+change.Amount, change.Balance)
+		if !crossed {
+			continue
+		}
+		disarmed, err := r.rdb.SRem(ctx, armedKey, id).Result()
+		if err != nil {
+			slog.Error("threshold disarm failed", "error", err, "threshold_id", id)
+			continue
+		}
+		if disarmed == 0 {
+			continue
+		}
+		if _, err := r.db.Exec(ctx, `UPDATE balance_thresholds SET armed = FALSE WHERE id = $1`, id); err != nil {
+			slog.Error("threshold disarm failed", "error", err, "threshold_id", id)
+		}
+
+		e.IdempotencyKey = change.IdempotencyKey
+		r.publishThresholdCrossed(ctx, e)
+	}
+}
+
+func (r *LedgerRepo) publishThresholdCrossed(ctx context.Context, e model.ThresholdCrossedEvent) {
+	data, _ := json.Marshal(e)
+	if err := r.bus.Publish("balance.threshold_crossed", data); err != nil {
+		slog.Error("event publish failed", "error", err, "topic", "balance.threshold_crossed")
+	}
+
+	r.publishBalanceEvent(ctx, model.BalanceEvent{
+		Type:           model.BalanceThresholdCrossed,
+		AccountID:      e.AccountID,
+		ResourceType:   e.ResourceType,
+		Amount:         e.Level,
+		Balance:        e.Balance,
+		IdempotencyKey: e.IdempotencyKey,
+	})
+}
@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//go:embed transfer.lua
+var transferLuaScript string
+
+// errTransferCacheMiss carries which side of a transfer is missing from the cache.
+type errTransferCacheMiss struct {
+	accountID string
+}
+
+func (e *errTransferCacheMiss) Error() string {
+	return fmt.Sprintf("balance of %s not found in cache", e.accountID)
+}
+
+func (e *errTransferCacheMiss) Is(target error) bool {
+	return target == ErrCacheMiss
+}
+
+// Transfer moves amount from one account to another atomically in Redis. The debit
+// consumes the source's credit lots like a spend does.
+// Both legs are persisted to PostgreSQL in a single transaction by the worker.
+func (r *LedgerRepo) Transfer(ctx context.Context, from, to, resourceType string, amount int64, idempotencyKey string) (*model.TransferResult, error) {
+	if from == to {
+		return nil, apperr.Validation("cannot transfer to the same account")
+	}
+	if amount <= 0 {
+		return nil, apperr.Validation("transfer amount must be positive")
+	}
+	if idempotencyKey == "" {
+		return nil, apperr.Validation("idempotency key is required")
+	}
+
+	req := model.TransferRequest{
+		FromAccountID:  from,
+		ToAccountID:    to,
+		ResourceType:   resourceType,
+		Amount:         amount,
+		IdempotencyKey: idempotencyKey,
+	}
+
+	// At most two warm-ups are needed: one per side of the transfer.
+	for attempt := 0; ; attempt++ {
+		result, hasThresholds, err := r.executeTransfer(ctx, req)
+
+		var miss *errTransferCacheMiss
+		if !errors.As(err, &miss) || attempt == 2 {
+			if err == nil && hasThresholds {
+				r.checkThresholds(ctx, model.BalanceEvent{AccountID: from, ResourceType: resourceType,
+					Amount: amount, Balance: result.FromBalance, IdempotencyKey: idempotencyKey})
+			}
+			return result, err
+		}
+
+		slog.Info("cold start, warming up cache", "account_id", miss.accountID)
+		if err := r.warmUpCache(ctx, miss.accountID, resourceType); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *LedgerRepo) SyncTransfer(ctx context.Context, event model.TransferEvent) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// The debit leg carries a positive amount and the credit leg a negative one,
+	// matching the "amount spent" meaning of the transactions table.
+	var insertedKey string
+	queryInsert := `
+        INSERT INTO transactions (account_id, resource_type, amount, idempotency_key, metadata, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6), ($7, $2, $8, $9, $10, $6)
+        ON CONFLICT (idempotency_key) DO NOTHING
+        RETURNING idempotency_key`
+
+	debitMeta, _ := json.Marshal(map[string]string{"type": "transfer", "counterparty": event.ToAccountID})
+	creditMeta, _ := json.Marshal(map[string]string{"type": "transfer", "counterparty": event.FromAccountID})
+
+	err = tx.QueryRow(ctx, queryInsert,
+		event.FromAccountID, event.ResourceType, event.Amount, event.IdempotencyKey+":debit", debitMeta, event.CreatedAt,
+		event.ToAccountID, -event.Amount, event.IdempotencyKey+":credit", creditMeta,
+	).Scan(&insertedKey)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if insertedKey == "" {
+		r.untrackTransfer(ctx, event)
+		return nil
+	}
+
+	queryUpdate := `UPDATE balances SET amount = amount - $1, updated_at = NOW() WHERE account_id = $2 AND resource_type = $3`
+	if _, err = tx.Exec(ctx, queryUpdate, event.Amount, event.FromAccountID, event.ResourceType); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, queryUpdate, -event.Amount, event.ToAccountID, event.ResourceType); err != nil {
+		return err
+	}
+
+	err = writeJournal(ctx, tx, model.JournalEntry{
+		Type:           model.EntryTransfer,
+		IdempotencyKey: "transfer:" + event.IdempotencyKey,
+		Legs:           legs(event.ToAccountID, event.FromAccountID, event.ResourceType, event.Amount),
+		CreatedAt:      event.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	// As for a spend, a lot may have been expired before this event arrived.
+	queryLot := `UPDATE credit_grants SET remaining = GREATEST(remaining - $1, 0), updated_at = NOW() WHERE id = $2`
+	for _, lot := range event.Lots {
+		if _, err = tx.Exec(ctx, queryLot, lot.Amount, lot.GrantID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	r.untrackTransfer(ctx, event)
+	return nil
+}
+
+func (r *LedgerRepo) untrackTransfer(ctx context.Context, event model.TransferEvent) {
+	r.confirmOutbox(ctx, event.OutboxID)
+	r.untrackPending(ctx, event.FromAccountID, event.ResourceType, event.IdempotencyKey+":debit", event.Amount)
+	r.untrackPending(ctx, event.ToAccountID, event.ResourceType, event.IdempotencyKey+":credit", -event.Amount)
+}
+
+// executeTransfer runs transfer.lua and also reports whether the source has thresholds.
+func (r *LedgerRepo) executeTransfer(ctx context.Context, req model.TransferRequest) (*model.TransferResult, bool, error) {
+	fromKey := fmt.Sprintf("balance:%s:%s", req.FromAccountID, req.ResourceType)
+	toKey := fmt.Sprintf("balance:%s:%s", req.ToAccountID, req.ResourceType)
+	idemKey := fmt.Sprintf("idem:%s", req.IdempotencyKey)
+	limitKey := creditLimitKey(req.FromAccountID, req.ResourceType)
+
+	now := time.Now()
+	payload, err := json.Marshal(model.TransferEvent{
+		FromAccountID:  req.FromAccountID,
+		ToAccountID:    req.ToAccountID,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
+		CreatedAt:      now,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	defsKey, _, _ := thresholdKeys(req.FromAccountID, req.ResourceType)
+	lotOrderKey, lotRemainingKey := lotKeys(req.FromAccountID, req.ResourceType)
+	result, err := r.rdb.Eval(ctx, transferLuaScript,
+		[]string{fromKey, toKey, idemKey, limitKey, outboxStream,
+			pendingKey(req.FromAccountID, req.ResourceType), pendingKey(req.ToAccountID, req.ResourceType),
+			balanceEventStream, defsKey, lotOrderKey, lotRemainingKey},
+		req.Amount, payload,
+		pendingMember(req.IdempotencyKey+":debit", req.Amount),
+		pendingMember(req.IdempotencyKey+":credit", -req.Amount),
+		now.Unix(), now.UnixMilli(), balanceEventRetention,
+		req.FromAccountID, req.ToAccountID, req.ResourceType, req.IdempotencyKey,
+	).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	resArray := result.([]interface{})
+	status := resArray[0].(int64)
+
+	switch status {
+	case 1:
+		return &model.TransferResult{
+			FromBalance: resArray[1].(int64),
+			ToBalance:   resArray[2].(int64),
+			Status:      "SUCCESS",
+		}, resArray[3].(int64) == 1, nil
+	case 0:
+		return nil, false, ErrAlreadyProcessed
+	case -1:
+		if resArray[1].(int64) == 1 {
+			return nil, false, &errTransferCacheMiss{accountID: req.FromAccountID}
+		}
+		return nil, false, &errTransferCacheMiss{accountID: req.ToAccountID}
+	case -2:
+		return nil, false, ErrInsufficient
+	default:
+		return nil, false, fmt.Errorf("unknown lua status: %d", status)
+	}
+}
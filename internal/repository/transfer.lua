@@ -0,0 +1,89 @@
+-- KEYS[1] = Source balance key (e.g., "balance:user123:api_tokens")
+-- KEYS[2] = Destination balance key (e.g., "balance:user456:api_tokens")
+-- KEYS[3] = Idempotency key (e.g., "idem:req-uuid-456")
+-- KEYS[4] = Source credit limit key (e.g., "credit_limit:user123:api_tokens"), missing means no overdraft
+-- KEYS[5] = Outbox stream (e.g., "outbox:events")
+-- KEYS[6] = Pending events of the source (e.g., "pending:user123:api_tokens")
+-- KEYS[7] = Pending events of the destination (e.g., "pending:user456:api_tokens")
+-- KEYS[8] = Balance event stream (e.g., "events:balances")
+-- KEYS[9] = Threshold definitions of the source (e.g., "thresholds:user123:api_tokens")
+-- KEYS[10] = Credit lot order of the source (sorted set of grant IDs, lowest score is consumed first)
+-- KEYS[11] = Credit lot remaining amounts of the source (hash of grant ID -> remaining)
+-- ARGV[1] = Transfer amount (e.g., 10)
+-- ARGV[2] = Transfer event payload (JSON)
+-- ARGV[3] = Pending event member of the source (e.g., "req-uuid-456:debit|10")
+-- ARGV[4] = Pending event member of the destination (e.g., "req-uuid-456:credit|-10")
+-- ARGV[5] = Current time (unix seconds)
+-- ARGV[6] = Current time (unix milliseconds)
+-- ARGV[7] = Approximate length the balance event stream is capped at
+-- ARGV[8] = Source account ID
+-- ARGV[9] = Destination account ID
+-- ARGV[10] = Resource type
+-- ARGV[11] = Idempotency key
+
+-- 1. Check idempotency. If this request has already been processed, return status 0
+if redis.call("EXISTS", KEYS[3]) == 1 then
+    return {0, "ALREADY_PROCESSED"}
+end
+
+-- 2. Both balances must be cached; the second element tells the caller which one is missing
+local from_balance = redis.call("GET", KEYS[1])
+if not from_balance then
+    return {-1, 1}
+end
+if redis.call("EXISTS", KEYS[2]) == 0 then
+    return {-1, 2}
+end
+
+from_balance = tonumber(from_balance)
+local amount = tonumber(ARGV[1])
+local credit_limit = tonumber(redis.call("GET", KEYS[4]) or "0")
+
+-- 3. Check if the source has enough tokens, allowing it to go down to -credit_limit
+if from_balance - amount < -credit_limit then
+    return {-2, "INSUFFICIENT_FUNDS"}
+end
+
+-- 4. Success! Move funds in one step
+local new_from = redis.call("DECRBY", KEYS[1], amount)
+local new_to = redis.call("INCRBY", KEYS[2], amount)
+
+-- 5. Consume the source's credit lots in order, as a spend does; the destination gets
+--    plain credits
+local consumed = {}
+local to_consume = amount
+for _, lot_id in ipairs(redis.call("ZRANGE", KEYS[10], 0, -1)) do
+    if to_consume <= 0 then
+        break
+    end
+    local remaining = tonumber(redis.call("HGET", KEYS[11], lot_id) or "0")
+    local take = math.min(remaining, to_consume)
+    if take > 0 then
+        to_consume = to_consume - take
+        table.insert(consumed, lot_id)
+        table.insert(consumed, take)
+    end
+    if remaining - take <= 0 then
+        redis.call("HDEL", KEYS[11], lot_id)
+        redis.call("ZREM", KEYS[10], lot_id)
+    else
+        redis.call("HINCRBY", KEYS[11], lot_id, -take)
+    end
+end
+
+-- 6. Store the idempotency key for 24 hours (86400 seconds) to prevent duplicates
+redis.call("SET", KEYS[3], "1", "EX", 86400)
+
+-- 7. Queue the event for PostgreSQL in the same step, with the lots as "grant,amount,grant,amount"
+redis.call("XADD", KEYS[5], "*", "topic", "transfers.created", "payload", ARGV[2], "lots", table.concat(consumed, ","))
+redis.call("ZADD", KEYS[6], ARGV[5], ARGV[3])
+redis.call("ZADD", KEYS[7], ARGV[5], ARGV[4])
+
+-- 8. Tell the balance watchers about both sides
+redis.call("XADD", KEYS[8], "MAXLEN", "~", ARGV[7], "*", "type", "transfer_out", "account_id", ARGV[8],
+    "resource_type", ARGV[10], "amount", amount, "balance", new_from, "idempotency_key", ARGV[11], "at", ARGV[6])
+redis.call("XADD", KEYS[8], "MAXLEN", "~", ARGV[7], "*", "type", "transfer_in", "account_id", ARGV[9],
+    "resource_type", ARGV[10], "amount", amount, "balance", new_to, "idempotency_key", ARGV[11], "at", ARGV[6])
+
+-- Return 1 (success), both new balances and whether the source has thresholds
+return {1, new_from, new_to, redis.call("EXISTS", KEYS[9])}
@@ -0,0 +1,404 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrWebhookNotFound  = apperr.New(apperr.CodeNotFound, "webhook not found")
+	ErrDeliveryNotFound = apperr.New(apperr.CodeNotFound, "webhook delivery not found")
+)
+
+const (
+	// webhookLease is how long a claimed delivery, or a feed event read for fan-out, is left
+	// to its dispatcher; after that another dispatcher may claim it again, in case the first
+	// one stopped.
+	webhookLease = time.Minute
+	// webhookGroup is the consumer group of the balance feed that fans events out into
+	// webhook deliveries.
+	webhookGroup = "webhooks"
+	// webhookFanOutBatch is how many feed events are fanned out at once.
+	webhookFanOutBatch = 100
+)
+
+// newWebhook validates a registration and generates its secret when none is given.
+func newWebhook(req model.WebhookRequest) (model.Webhook, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return model.Webhook{}, apperr.Validation("url must be an absolute https URL")
+	}
+	if len(req.EventTypes) == 0 {
+		return model.Webhook{}, apperr.Validation("at least one event type is required")
+	}
+	for _, t := range req.EventTypes {
+		if !slices.Contains(model.WebhookEventTypes, t) {
+			return model.Webhook{}, apperr.Validation(fmt.Sprintf("unknown event type %q", t))
+		}
+	}
+	for _, id := range req.AccountIDs {
+		if id == "" {
+			return model.Webhook{}, apperr.Validation("account_id must not be empty")
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return model.Webhook{}, err
+		}
+		secret = "whsec_" + hex.EncodeToString(b)
+	}
+	return model.Webhook{
+		URL:        req.URL,
+		EventTypes: slices.Compact(slices.Sorted(slices.Values(req.EventTypes))),
+		AccountIDs: req.AccountIDs,
+		Secret:     secret,
+	}, nil
+}
+
+// subscribed reports whether a webhook gets an event.
+func subscribed(w model.Webhook, e model.BalanceEvent) bool {
+	return slices.Contains(w.EventTypes, e.Type) && (len(w.AccountIDs) == 0 || slices.Contains(w.AccountIDs, e.AccountID))
+}
+
+func (r *LedgerRepo) CreateWebhook(ctx context.Context, req model.WebhookRequest) (*model.Webhook, error) {
+	w, err := newWebhook(req)
+	if err != nil {
+		return nil, err
+	}
+	if w.AccountIDs == nil {
+		w.AccountIDs = []string{}
+	}
+
+	query := `
+        INSERT INTO webhooks (url, secret, event_types, account_ids)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at`
+
+	if err := r.db.QueryRow(ctx, query, w.URL, w.Secret, w.EventTypes, w.AccountIDs).Scan(&w.ID, &w.CreatedAt); err != nil {
+		return nil, fmt.Errorf("db create webhook: %w", err)
+	}
+	return &w, nil
+}
+
+// ListWebhooks returns the registered webhooks, oldest first, without their secrets.
+func (r *LedgerRepo) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	query := `SELECT id, url, event_types, account_ids, created_at FROM webhooks ORDER BY created_at`
+
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []model.Webhook{}
+	for rows.Next() {
+		var w model.Webhook
+		if err := rows.Scan(&w.ID, &w.URL, &w.EventTypes, &w.AccountIDs, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook together with its delivery log.
+func (r *LedgerRepo) DeleteWebhook(ctx context.Context, id string) error {
+	res, err := r.db.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("db delete webhook: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns a webhook's delivery log, newest first.
+func (r *LedgerRepo) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	var exists bool
+	if err := r.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1)`, webhookID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	query := `
+        SELECT id, webhook_id, event, status, attempts, last_status_code, last_error, next_attempt_at, delivered_at, created_at
+        FROM webhook_deliveries
+        WHERE webhook_id = $1
+        ORDER BY created_at DESC
+        LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		var d model.WebhookDelivery
+		var event []byte
+		if err := rows.Scan(&d.ID, &d.WebhookID, &event, &d.Status, &d.Attempts, &d.LastStatusCode, &d.LastError,
+			&d.NextAttemptAt, &d.DeliveredAt, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(event, &d.Event); err != nil {
+			return nil, fmt.Errorf("webhook delivery %s: %w", d.ID, err)
+		}
+		if d.Status != model.WebhookPending {
+			d.NextAttemptAt = nil
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhook sends a delivery again, whatever its status, with a fresh set of attempts.
+func (r *LedgerRepo) RedeliverWebhook(ctx context.Context, deliveryID string) error {
+	query := `
+        UPDATE webhook_deliveries
+        SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+        WHERE id = $1`
+
+	res, err := r.db.Exec(ctx, query, deliveryID)
+	if err != nil {
+		return fmt.Errorf("db redeliver webhook: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// FanOutWebhookEvents reads the next events of the balance feed as a member of the webhook
+// consumer group, waiting for up to balanceEventBlock when there are none, and adds a
+// delivery of each event for every webhook subscribed to it. Every event goes to one member
+// of the group, so any number of dispatchers can fan out side by side, and the group keeps
+// its own position in the feed. Events are acknowledged once their deliveries are
+// enqueued; the ones a dispatcher failed on, or stopped with, are claimed again by any
+// member after webhookLease. It returns how many events it took.
+func (r *LedgerRepo) FanOutWebhookEvents(ctx context.Context, consumer string) (int, error) {
+	msgs, err := r.readWebhookEvents(ctx, consumer)
+	if isNoGroup(err) {
+		// The group starts at the beginning of the feed, so webhooks are not missing the
+		// events added before the first dispatcher ran; deliveries are unique per event and
+		// webhook, and a webhook does not get events from before it was created.
+		err = r.rdb.XGroupCreateMkStream(ctx, balanceEventStream, webhookGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return 0, fmt.Errorf("create webhook consumer group: %w", err)
+		}
+		msgs, err = r.readWebhookEvents(ctx, consumer)
+	}
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+
+	if err := r.enqueueWebhookDeliveries(ctx, msgs); err != nil {
+		return 0, err
+	}
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	if err := r.rdb.XAck(ctx, balanceEventStream, webhookGroup, ids...).Err(); err != nil {
+		return 0, fmt.Errorf("ack webhook events: %w", err)
+	}
+	return len(msgs), nil
+}
+
+// readWebhookEvents returns the events left behind by a member for longer than
+// webhookLease, or else the next new events of the feed.
+func (r *LedgerRepo) readWebhookEvents(ctx context.Context, consumer string) ([]redis.XMessage, error) {
+	stale, _, err := r.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   balanceEventStream,
+		Group:    webhookGroup,
+		Consumer: consumer,
+		MinIdle:  webhookLease,
+		Start:    "0-0",
+		Count:    webhookFanOutBatch,
+	}).Result()
+	if err != nil || len(stale) > 0 {
+		return stale, err
+	}
+
+	r.logWebhookGap(ctx)
+	streams, err := r.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    webhookGroup,
+		Consumer: consumer,
+		Streams:  []string{balanceEventStream, ">"},
+		Count:    webhookFanOutBatch,
+		Block:    balanceEventBlock,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return streams[0].Messages, nil
+}
+
+// logWebhookGap logs when the feed was trimmed past events the webhook group had not read
+// yet. Those events are lost to the webhooks: the next read goes on from the oldest event
+// still kept.
+func (r *LedgerRepo) logWebhookGap(ctx context.Context) {
+	groups, err := r.rdb.XInfoGroups(ctx, balanceEventStream).Result()
+	if err != nil {
+		return
+	}
+	i := slices.IndexFunc(groups, func(g redis.XInfoGroup) bool { return g.Name == webhookGroup })
+	if i < 0 {
+		return
+	}
+	stream, err := r.rdb.XInfoStream(ctx, balanceEventStream).Result()
+	if err != nil {
+		return
+	}
+	// The feed is trimmed from its oldest end, so the newest deleted event tells how far
+	// it was trimmed.
+	if olderOffset(groups[i].LastDeliveredID, stream.MaxDeletedEntryID) {
+		slog.Error("webhook fan-out fell behind the balance feed, events were not delivered",
+			"after", groups[i].LastDeliveredID, "through", stream.MaxDeletedEntryID)
+	}
+}
+
+// enqueueWebhookDeliveries adds a delivery of every event for every webhook subscribed to
+// it, in one statement. An event fanned out twice is not delivered twice, and nothing is
+// written for events no webhook subscribes to.
+func (r *LedgerRepo) enqueueWebhookDeliveries(ctx context.Context, msgs []redis.XMessage) error {
+	var (
+		offsets, payloads, types, accounts []string
+		ats                                []time.Time
+	)
+	for _, msg := range msgs {
+		event, err := balanceEvent(msg)
+		if err != nil {
+			slog.Error("webhook fan-out: skipping malformed event", "offset", msg.ID, "error", err)
+			continue
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, event.Offset)
+		payloads = append(payloads, string(payload))
+		types = append(types, event.Type)
+		accounts = append(accounts, event.AccountID)
+		ats = append(ats, event.At)
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	query := `
+        INSERT INTO webhook_deliveries (webhook_id, event_offset, event)
+        SELECT w.id, e.event_offset, e.event::jsonb
+        FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::timestamptz[])
+            AS e (event_offset, event, event_type, account_id, at)
+        JOIN webhooks w ON e.event_type = ANY (w.event_types)
+            AND (cardinality(w.account_ids) = 0 OR e.account_id = ANY (w.account_ids))
+            AND w.created_at <= e.at
+        ON CONFLICT (webhook_id, event_offset) DO NOTHING`
+
+	if _, err := r.db.Exec(ctx, query, offsets, payloads, types, accounts, ats); err != nil {
+		return fmt.Errorf("db enqueue webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+// isNoGroup reports whether a stream command failed because the consumer group does not
+// exist yet.
+func isNoGroup(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOGROUP")
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due, leasing them
+// to the caller so that concurrent dispatchers send each one once.
+func (r *LedgerRepo) ClaimWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	query := `
+        UPDATE webhook_deliveries d
+        SET next_attempt_at = $2
+        FROM webhooks w
+        WHERE d.webhook_id = w.id AND d.id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= $1
+            ORDER BY next_attempt_at
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED)
+        RETURNING d.id, d.webhook_id, d.event, d.status, d.attempts, d.created_at, w.url, w.secret`
+
+	rows, err := r.db.Query(ctx, query, now, now.Add(webhookLease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []model.WebhookDelivery
+	for rows.Next() {
+		var d model.WebhookDelivery
+		var event []byte
+		if err := rows.Scan(&d.ID, &d.WebhookID, &event, &d.Status, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(event, &d.Event); err != nil {
+			return nil, fmt.Errorf("webhook delivery %s: %w", d.ID, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt logs the outcome of sending a delivery and schedules its retry.
+func (r *LedgerRepo) RecordWebhookAttempt(ctx context.Context, attempt model.WebhookAttempt) error {
+	status, retryAt := attemptStatus(attempt)
+	query := `
+        UPDATE webhook_deliveries
+        SET attempts = attempts + 1, last_status_code = $2, last_error = $3, status = $4, next_attempt_at = $5,
+            delivered_at = CASE WHEN $4 = 'delivered' THEN NOW() ELSE delivered_at END
+        WHERE id = $1`
+
+	res, err := r.db.Exec(ctx, query, attempt.DeliveryID, attempt.StatusCode, attempt.Error, status, retryAt)
+	if err != nil {
+		return fmt.Errorf("db record webhook attempt: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// attemptStatus is the delivery status after an attempt, with when to retry if it is pending.
+func attemptStatus(attempt model.WebhookAttempt) (string, *time.Time) {
+	switch {
+	case attempt.Delivered:
+		return model.WebhookDelivered, nil
+	case attempt.RetryAt.IsZero():
+		return model.WebhookFailed, nil
+	default:
+		return model.WebhookPending, &attempt.RetryAt
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"time"
 
 	"quantlo/internal/model"
 )
@@ -12,7 +13,80 @@ type LedgerService interface {
 	Spend(ctx context.Context, req model.SpendRequest) (*model.SpendResult, error)
 	Recharge(ctx context.Context, req model.RechargeRequest) error
 	GetBalance(ctx context.Context, accountID, resourceType string) (int64, error)
-	CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64) error
-	DeleteAccount(ctx context.Context, accountID, resourceType string) error
+	// CreateAccount and DeleteAccount take an optional idempotency key, like Recharge.
+	CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64, idempotencyKey string) error
+	DeleteAccount(ctx context.Context, accountID, resourceType, idempotencyKey string) error
+	// WatchBalances streams the balance events of the given accounts (all of them when none
+	// are given), starting after the event at offset, or with the next one when offset is
+	// empty. The channel is closed when ctx ends, the feed fails or the watcher falls too far
+	// behind; the watcher then resumes from the last offset it got.
+	WatchBalances(ctx context.Context, accountIDs []string, offset string) (<-chan model.BalanceEvent, error)
 	SyncTransactionWithBalance(ctx context.Context, event model.SpendEvent) error
+	// SyncTransactions persists many spend events in one PostgreSQL transaction.
+	SyncTransactions(ctx context.Context, events []model.SpendEvent) (*model.BatchStats, error)
+
+	// Two-phase holds: reserve funds first, then capture the actual amount or release them.
+	Authorize(ctx context.Context, req model.AuthorizeRequest) (*model.HoldResult, error)
+	Capture(ctx context.Context, req model.CaptureRequest) (*model.HoldResult, error)
+	Void(ctx context.Context, holdID string) (*model.HoldResult, error)
+	ExpireHolds(ctx context.Context, before time.Time) (int, error)
+
+	Transfer(ctx context.Context, from, to, resourceType string, amount int64, idempotencyKey string) (*model.TransferResult, error)
+	SyncTransfer(ctx context.Context, event model.TransferEvent) error
+
+	// Credit limits let an account's balance go negative down to -limit.
+	SetCreditLimit(ctx context.Context, accountID, resourceType string, limit int64) error
+	GetCreditLimit(ctx context.Context, accountID, resourceType string) (int64, error)
+
+	// Credit grants are lots of credits consumed by priority, then by soonest expiry.
+	GrantCredits(ctx context.Context, req model.GrantRequest) (*model.CreditGrant, error)
+	GetBalanceBreakdown(ctx context.Context, accountID, resourceType string) (*model.BalanceBreakdown, error)
+	ExpireGrants(ctx context.Context, before time.Time) (int, error)
+
+	Refund(ctx context.Context, originalIdempotencyKey string, amount int64, idempotencyKey string) (*model.RefundResult, error)
+
+	// CheckJournal verifies that every journal entry balances and every account matches its legs.
+	CheckJournal(ctx context.Context) (*model.JournalReport, error)
+
+	ListTransactions(ctx context.Context, filter model.TransactionFilter) (*model.TransactionPage, error)
+
+	// Point-in-time balances are rebuilt from the journal on top of daily snapshots.
+	GetBalanceAt(ctx context.Context, accountID, resourceType string, at time.Time) (int64, error)
+	TakeSnapshots(ctx context.Context, at time.Time) (int, error)
+
+	// Reconcile reports cached balances that drifted from PostgreSQL and repairs them per policy.
+	Reconcile(ctx context.Context, policy model.RepairPolicy) (*model.DriftReport, error)
+
+	// Thresholds alert on low balances: a spend that crosses one publishes
+	// balance.threshold_crossed once, until a recharge arms it again.
+	CreateThreshold(ctx context.Context, req model.ThresholdRequest) (*model.BalanceThreshold, error)
+	ListThresholds(ctx context.Context, accountID, resourceType string) ([]model.BalanceThreshold, error)
+	DeleteThreshold(ctx context.Context, id string) error
+
+	// Quota policies refill an account on a schedule. ApplyDueRefills applies each due
+	// period once, books it in the journal and schedules the next one.
+	CreateQuotaPolicy(ctx context.Context, req model.QuotaPolicyRequest) (*model.QuotaPolicy, error)
+	ListQuotaPolicies(ctx context.Context, accountID, resourceType string) ([]model.QuotaPolicy, error)
+	DeleteQuotaPolicy(ctx context.Context, id string) error
+	ApplyDueRefills(ctx context.Context, now time.Time) (int, error)
+
+	// Webhooks deliver balance events to registered HTTPS endpoints, with a delivery log
+	// per webhook. Dispatchers fan the feed out into deliveries, each taking its share of
+	// the events under its consumer name, then claim the due deliveries and record the
+	// outcome of every attempt.
+	CreateWebhook(ctx context.Context, req model.WebhookRequest) (*model.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]model.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, deliveryID string) error
+	FanOutWebhookEvents(ctx context.Context, consumer string) (int, error)
+	ClaimWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]model.WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, attempt model.WebhookAttempt) error
+
+	// Dead letters are events the worker gave up on; they can be replayed or discarded.
+	ParkDeadLetter(ctx context.Context, dl model.DeadLetter) error
+	ListDeadLetters(ctx context.Context, status string, limit int) ([]model.DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id string) (*model.DeadLetter, error)
+	ReplayDeadLetter(ctx context.Context, id string) error
+	DiscardDeadLetter(ctx context.Context, id string) error
 }
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"quantlo/internal/model"
+)
+
+// ErrMalformedEvent marks an event that can never be synced because it does not decode.
+var ErrMalformedEvent = errors.New("malformed event")
+
+// maxSyncBackoff caps the delay between two sync attempts.
+const maxSyncBackoff = 5 * time.Second
+
+// SyncEvent decodes an event by topic and hands it to the matching sync method.
+func SyncEvent(ctx context.Context, svc LedgerService, topic string, payload []byte) error {
+	if topic == "transfers.created" {
+		var event model.TransferEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedEvent, err)
+		}
+		return svc.SyncTransfer(ctx, event)
+	}
+
+	var event model.SpendEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedEvent, err)
+	}
+	return svc.SyncTransactionWithBalance(ctx, event)
+}
+
+// EventSyncer persists events received from the bus. A failed sync is retried with
+// exponential backoff; an event that still fails, or does not decode, is parked as a
+// dead letter with its error instead of being dropped.
+type EventSyncer struct {
+	svc         LedgerService
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewEventSyncer(svc LedgerService, maxAttempts int, backoff time.Duration) *EventSyncer {
+	return &EventSyncer{
+		svc:         svc,
+		maxAttempts: max(maxAttempts, 1),
+		backoff:     backoff,
+	}
+}
+
+// Sync returns nil once the event is persisted or parked. An error means it is neither,
+// and the caller should leave the event for redelivery.
+func (s *EventSyncer) Sync(ctx context.Context, topic string, payload []byte) error {
+	attempts, err := s.retry(ctx, topic, payload)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the event was not given a fair number of attempts.
+		return err
+	}
+
+	slog.Error("sync failed, parking event as dead letter", "topic", topic, "attempts", attempts, "error", err)
+	return s.svc.ParkDeadLetter(ctx, model.DeadLetter{
+		Topic:    topic,
+		Payload:  string(payload),
+		Error:    err.Error(),
+		Attempts: attempts,
+	})
+}
+
+func (s *EventSyncer) retry(ctx context.Context, topic string, payload []byte) (int, error) {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := SyncEvent(ctx, s.svc, topic, payload)
+		if err == nil || errors.Is(err, ErrMalformedEvent) || attempt >= s.maxAttempts {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxSyncBackoff)
+	}
+}
+
+// Event is a message received from the bus, not yet decoded.
+type Event struct {
+	Topic   string
+	Payload []byte
+}
+
+// SyncBatch persists events in the order given. Consecutive spend events are written with
+// one SyncTransactions call; transfers, malformed events and every event of a batch that
+// failed go through Sync one by one, so they still get retries and dead-letter parking.
+func (s *EventSyncer) SyncBatch(ctx context.Context, events []Event) error {
+	var errs []error
+	var spends []model.SpendEvent
+	var pending []Event
+
+	flush := func() {
+		if len(spends) == 0 {
+			return
+		}
+		stats, err := s.svc.SyncTransactions(ctx, spends)
+		if err != nil {
+			slog.Warn("batch sync failed, syncing events one by one", "events", len(spends), "error", err)
+			for _, e := range pending {
+				errs = append(errs, s.Sync(ctx, e.Topic, e.Payload))
+			}
+		} else {
+			slog.Info("batch synced",
+				"events", stats.Events,
+				"inserted", stats.Inserted,
+				"duplicates", stats.Duplicates,
+				"accounts", stats.Accounts,
+				"duration", stats.Duration,
+			)
+		}
+		spends, pending = spends[:0], pending[:0]
+	}
+
+	for _, e := range events {
+		var event model.SpendEvent
+		if e.Topic != "transfers.created" && json.Unmarshal(e.Payload, &event) == nil {
+			spends = append(spends, event)
+			pending = append(pending, e)
+			continue
+		}
+		// Everything queued before this event must land first to keep per-account order.
+		flush()
+		errs = append(errs, s.Sync(ctx, e.Topic, e.Payload))
+	}
+	flush()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"quantlo/internal/apperr"
+	"quantlo/internal/proto"
+
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchItems caps how many accounts one batch call may carry.
+const maxBatchItems = 100
+
+func (s *Server) GetBalance(ctx context.Context, req *proto.GetBalanceRequest) (*proto.GetBalanceResponse, error) {
+	if err := requireAccount(req.AccountId, req.ResourceType); err != nil {
+		return nil, err
+	}
+	bal, err := s.svc.GetBalance(ctx, req.AccountId, req.ResourceType)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.GetBalanceResponse{AccountId: req.AccountId, ResourceType: req.ResourceType, Balance: bal}, nil
+}
+
+func (s *Server) CreateAccount(ctx context.Context, req *proto.CreateAccountRequest) (*proto.CreateAccountResponse, error) {
+	if err := requireAccount(req.AccountId, req.ResourceType); err != nil {
+		return nil, err
+	}
+	if err := s.svc.CreateAccount(ctx, req.AccountId, req.ResourceType, req.InitialAmount, req.IdempotencyKey); err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.CreateAccountResponse{Status: "created"}, nil
+}
+
+func (s *Server) DeleteAccount(ctx context.Context, req *proto.DeleteAccountRequest) (*proto.DeleteAccountResponse, error) {
+	if err := requireAccount(req.AccountId, req.ResourceType); err != nil {
+		return nil, err
+	}
+	if err := s.svc.DeleteAccount(ctx, req.AccountId, req.ResourceType, req.IdempotencyKey); err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.DeleteAccountResponse{Status: "deleted"}, nil
+}
+
+// BatchGetBalance reads the balances one by one; a failed item does not fail the call.
+func (s *Server) BatchGetBalance(ctx context.Context, req *proto.BatchGetBalanceRequest) (*proto.BatchGetBalanceResponse, error) {
+	if err := checkBatchSize(len(req.Accounts)); err != nil {
+		return nil, err
+	}
+	out := &proto.BatchGetBalanceResponse{Results: make([]*proto.BatchGetBalanceResult, 0, len(req.Accounts))}
+	for _, item := range req.Accounts {
+		res, err := s.GetBalance(ctx, item)
+		result := &proto.BatchGetBalanceResult{AccountId: item.AccountId, ResourceType: item.ResourceType, Status: itemStatus(err)}
+		if err == nil {
+			result.Balance = res.Balance
+		}
+		out.Results = append(out.Results, result)
+	}
+	return out, nil
+}
+
+// BatchCreateAccount creates the accounts one by one; a failed item does not fail the call.
+func (s *Server) BatchCreateAccount(ctx context.Context, req *proto.BatchCreateAccountRequest) (*proto.BatchAccountResponse, error) {
+	if err := checkBatchSize(len(req.Accounts)); err != nil {
+		return nil, err
+	}
+	out := &proto.BatchAccountResponse{Results: make([]*proto.BatchAccountResult, 0, len(req.Accounts))}
+	for _, item := range req.Accounts {
+		_, err := s.CreateAccount(ctx, item)
+		out.Results = append(out.Results, &proto.BatchAccountResult{AccountId: item.AccountId, ResourceType: item.ResourceType, Status: itemStatus(err)})
+	}
+	return out, nil
+}
+
+// BatchDeleteAccount deletes the accounts one by one; a failed item does not fail the call.
+func (s *Server) BatchDeleteAccount(ctx context.Context, req *proto.BatchDeleteAccountRequest) (*proto.BatchAccountResponse, error) {
+	if err := checkBatchSize(len(req.Accounts)); err != nil {
+		return nil, err
+	}
+	out := &proto.BatchAccountResponse{Results: make([]*proto.BatchAccountResult, 0, len(req.Accounts))}
+	for _, item := range req.Accounts {
+		_, err := s.DeleteAccount(ctx, item)
+		out.Results = append(out.Results, &proto.BatchAccountResult{AccountId: item.AccountId, ResourceType: item.ResourceType, Status: itemStatus(err)})
+	}
+	return out, nil
+}
+
+func requireAccount(accountID, resourceType string) error {
+	if accountID == "" || resourceType == "" {
+		return statusError(apperr.Validation("account_id and resource_type are required"))
+	}
+	return nil
+}
+
+func checkBatchSize(n int) error {
+	if n == 0 {
+		return statusError(apperr.Validation("batch has no accounts"))
+	}
+	if n > maxBatchItems {
+		return statusError(apperr.Validation(fmt.Sprintf("batch has %d accounts, at most %d are allowed", n, maxBatchItems)))
+	}
+	return nil
+}
+
+// itemStatus reports the outcome of one batch item, nil meaning OK.
+func itemStatus(err error) *proto.ItemStatus {
+	st := status.Convert(err)
+	return &proto.ItemStatus{Code: int32(st.Code()), Message: st.Message(), ErrorCode: string(errorCode(err))}
+}
@@ -1,66 +1,407 @@
 package grpc
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"math/rand/v2"
+	"os"
 	"quantlo/internal/proto"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+var (
+	// ErrBusFull is returned by Publish when the buffer stayed full for the whole PublishTimeout.
+	// The event is not queued; the outbox relay publishes it again later.
+	ErrBusFull = errors.New("grpc bus: buffer is full")
+	// ErrBusClosed is returned by Publish once the bus is closed.
+	ErrBusClosed = errors.New("grpc bus: closed")
+)
+
+// BusOptions tunes the GrpcBus. Zero values take the defaults below.
+type BusOptions struct {
+	// BufferSize is how many events may be queued for delivery (default 1024).
+	BufferSize int
+	// PublishTimeout is how long Publish waits for room in a full buffer before failing
+	// with ErrBusFull (default 1s).
+	PublishTimeout time.Duration
+	// BatchSize is how many queued events are streamed in one PublishBatch call (default 100).
+	BatchSize int
+	// MaxAttempts is how many times a batch is sent before its events are spilled (default 5).
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry (default 100ms). It doubles on every
+	// retry up to MaxBackoff (default 5s), and each delay is jittered by up to half.
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// CallTimeout bounds one PublishBatch call (default 10s).
+	CallTimeout time.Duration
+	// FlushTimeout is how long Close keeps delivering the queued events (default 10s).
+	FlushTimeout time.Duration
+	// SpillPath is an optional file that undeliverable events are appended to. They are
+	// delivered from it the next time a bus is started with the same path. Without it,
+	// undeliverable events are logged and dropped.
+	SpillPath string
+}
+
+func (o BusOptions) withDefaults() BusOptions {
+	if o.BufferSize <= 0 {
+		o.BufferSize = 1024
+	}
+	if o.PublishTimeout <= 0 {
+		o.PublishTimeout = time.Second
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 100
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = 100 * time.Millisecond
+	}
+	if o.MaxBackoff < o.RetryBackoff {
+		o.MaxBackoff = max(5*time.Second, o.RetryBackoff)
+	}
+	if o.CallTimeout <= 0 {
+		o.CallTimeout = 10 * time.Second
+	}
+	if o.FlushTimeout <= 0 {
+		o.FlushTimeout = 10 * time.Second
+	}
+	return o
+}
+
 // GrpcBus publishes events to a remote EventService over gRPC.
 // Used when BusProvider == "grpc" in config.
+//
+// Publish only queues the event; a background worker streams the queue to the remote
+// service in PublishBatch calls, resending with backoff whatever was not accepted.
+// When the queue is full, Publish blocks for up to PublishTimeout and then fails, so
+// the caller sees the backpressure instead of losing the event.
 type GrpcBus struct {
-	conn   *grpc.ClientConn
 	client proto.EventServiceClient
+	opts   BusOptions
 	events chan *proto.EventRequest
-}
 
-// NewGrpcBusFromAddr dials the remote EventService and returns a GrpcBus and a cleanup function.
-func NewGrpcBusFromAddr(addr string, bufferSize int) (*GrpcBus, func(), error) {
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, nil, err
-	}
-	client := proto.NewEventServiceClient(conn)
-	events := make(chan *proto.EventRequest, bufferSize)
+	// mu guards closed, so that no Publish sends on events after Close has closed it.
+	mu     sync.RWMutex
+	closed bool
+	// spillMu serializes the spill file writes of the worker and the replay.
+	spillMu sync.Mutex
 
+	// ctx ends the worker's and the replay's calls and retries once the flush deadline has passed.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// NewGrpcBus starts a bus that delivers to client. Events spilled by an earlier bus with
+// the same SpillPath are delivered in the background, alongside the new ones, so a large
+// spill file does not hold up live events.
+func NewGrpcBus(client proto.EventServiceClient, opts BusOptions) *GrpcBus {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
 	bus := &GrpcBus{
-		conn:   conn,
 		client: client,
-		events: events,
+		opts:   opts,
+		events: make(chan *proto.EventRequest, opts.BufferSize),
+		ctx:    ctx,
+		cancel: cancel,
 	}
-
+	bus.running.Add(2)
 	go bus.worker()
+	go bus.replaySpill()
+	return bus
+}
+
+// NewGrpcBusFromAddr dials the remote EventService and returns a GrpcBus and a cleanup function
+// that flushes the bus and closes the connection.
+func NewGrpcBusFromAddr(addr string, opts BusOptions) (*GrpcBus, func(), error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	bus := NewGrpcBus(proto.NewEventServiceClient(conn), opts)
 
 	cleanup := func() {
-		close(events)
+		bus.Close()
 		_ = conn.Close()
 	}
 	return bus, cleanup, nil
 }
 
+// Publish queues an event for delivery to the remote EventService. It fails with
+// ErrBusFull when the buffer stays full for PublishTimeout, and with ErrBusClosed
+// once the bus is closed.
+func (b *GrpcBus) Publish(topic string, data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+	req := &proto.EventRequest{Topic: topic, Payload: data}
+	select {
+	case b.events <- req:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(b.opts.PublishTimeout)
+	defer timer.Stop()
+	select {
+	case b.events <- req:
+		return nil
+	case <-timer.C:
+		slog.Warn("grpc bus: buffer full, rejecting event", "topic", topic)
+		return ErrBusFull
+	}
+}
+
+// Close stops accepting events and delivers the ones still queued, along with what is
+// left of the spill replay. Whatever is left when FlushTimeout passes is spilled. Close
+// returns once both are done.
+func (b *GrpcBus) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.events)
+	b.mu.Unlock()
+
+	deadline := time.AfterFunc(b.opts.FlushTimeout, b.cancel)
+	b.running.Wait()
+	deadline.Stop()
+	b.cancel()
+}
+
 func (b *GrpcBus) worker() {
+	defer b.running.Done()
+
+	batch := make([]*proto.EventRequest, 0, b.opts.BatchSize)
 	for req := range b.events {
-		// Use a fresh context for each publish since it's background
-		_, err := b.client.Publish(context.Background(), req)
-		if err != nil {
-			slog.Error("grpc bus: async publish failed", "topic", req.Topic, "error", err)
+		batch = append(batch[:0], req)
+	fill:
+		for len(batch) < b.opts.BatchSize {
+			select {
+			case req, ok := <-b.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, req)
+			default:
+				break fill
+			}
 		}
+		b.deliver(batch)
 	}
 }
 
-// Publish sends an event to the remote EventService asynchronously.
-func (b *GrpcBus) Publish(topic string, data []byte) error {
-	select {
-	case b.events <- &proto.EventRequest{
-		Topic:   topic,
-		Payload: data,
-	}:
-		return nil
-	default:
-		slog.Warn("grpc bus: buffer full, dropping event", "topic", topic)
+// deliver sends a batch, resending the events that were not accepted with jittered
+// exponential backoff. Attempts start over whenever the remote service makes progress.
+// Events still undelivered after MaxAttempts, or once the flush deadline has passed,
+// are spilled.
+func (b *GrpcBus) deliver(batch []*proto.EventRequest) {
+	backoff := b.opts.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		accepted, err := b.send(batch)
+		batch = batch[accepted:]
+		if len(batch) == 0 {
+			return
+		}
+		if err == nil {
+			err = errors.New("event not synced by the remote service")
+		}
+		if accepted > 0 {
+			attempt, backoff = 1, b.opts.RetryBackoff
+		}
+		if attempt >= b.opts.MaxAttempts || b.ctx.Err() != nil {
+			slog.Error("grpc bus: giving up on events", "count", len(batch), "attempts", attempt, "error", err)
+			b.spill(batch)
+			return
+		}
+
+		slog.Warn("grpc bus: publish failed, retrying", "pending", len(batch), "attempt", attempt, "error", err)
+		select {
+		case <-b.ctx.Done():
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = min(backoff*2, b.opts.MaxBackoff)
+	}
+}
+
+// send streams a batch in one PublishBatch call and returns how many events, from the
+// start of the batch, the remote service synced.
+func (b *GrpcBus) send(batch []*proto.EventRequest) (int, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, b.opts.CallTimeout)
+	defer cancel()
+
+	stream, err := b.client.PublishBatch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, req := range batch {
+		// A failed Send means the server has ended the call; its status or response,
+		// which says how far it got, comes from CloseAndRecv.
+		if err := stream.Send(req); err != nil {
+			break
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, err
+	}
+	return min(int(res.Accepted), len(batch)), nil
+}
+
+// jitter returns a delay between half of d and d, so that retrying buses spread out.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// spilledEvent is one line of the spill file.
+type spilledEvent struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+// spill appends undeliverable events to the spill file, or drops them when there is none.
+func (b *GrpcBus) spill(batch []*proto.EventRequest) {
+	if b.opts.SpillPath == "" {
+		for _, req := range batch {
+			slog.Error("grpc bus: dropping undelivered event", "topic", req.Topic)
+		}
+		return
+	}
+	b.spillMu.Lock()
+	err := appendSpill(b.opts.SpillPath, batch)
+	b.spillMu.Unlock()
+	if err != nil {
+		slog.Error("grpc bus: failed to spill events, dropping them", "count", len(batch), "path", b.opts.SpillPath, "error", err)
+		return
+	}
+	slog.Warn("grpc bus: spilled undelivered events", "count", len(batch), "path", b.opts.SpillPath)
+}
+
+func appendSpill(path string, batch []*proto.EventRequest) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, req := range batch {
+		if err := enc.Encode(spilledEvent{Topic: req.Topic, Payload: req.Payload}); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaySpill delivers the events spilled by an earlier run. The spill file is first moved
+// into a replay file, so that events spilled again while replaying go to a fresh spill file;
+// the replay file is removed once every event in it has been delivered or spilled again.
+// A replay file left by a run that stopped while replaying is picked up as well. It runs
+// next to the worker; once the flush deadline has passed, the events not yet replayed are
+// spilled again.
+func (b *GrpcBus) replaySpill() {
+	defer b.running.Done()
+
+	if b.opts.SpillPath == "" {
+		return
+	}
+	replayPath := b.opts.SpillPath + ".replay"
+	b.spillMu.Lock()
+	err := moveSpill(b.opts.SpillPath, replayPath)
+	b.spillMu.Unlock()
+	if err != nil {
+		slog.Error("grpc bus: failed to read the spill file", "path", b.opts.SpillPath, "error", err)
+		return
+	}
+
+	events, err := readSpill(replayPath)
+	if err != nil {
+		slog.Error("grpc bus: failed to read the spill file", "path", replayPath, "error", err)
+		return
+	}
+	if len(events) == 0 {
+		_ = os.Remove(replayPath)
+		return
+	}
+	slog.Info("grpc bus: replaying spilled events", "count", len(events))
+	for start := 0; start < len(events); start += b.opts.BatchSize {
+		if b.ctx.Err() != nil {
+			b.spill(events[start:])
+			break
+		}
+		b.deliver(events[start:min(start+b.opts.BatchSize, len(events))])
+	}
+	if err := os.Remove(replayPath); err != nil {
+		slog.Error("grpc bus: failed to remove the replayed spill file", "path", replayPath, "error", err)
+	}
+}
+
+// moveSpill appends the spill file to the replay file and removes it.
+func moveSpill(spillPath, replayPath string) error {
+	data, err := os.ReadFile(spillPath)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(replayPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(spillPath)
+}
+
+func readSpill(path string) ([]*proto.EventRequest, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*proto.EventRequest
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var ev spilledEvent
+		if err := dec.Decode(&ev); err != nil {
+			// A line cut short by a crash ends the file; keep what was read before it.
+			slog.Error("grpc bus: skipping the rest of a damaged spill file", "path", path, "error", err)
+			break
+		}
+		events = append(events, &proto.EventRequest{Topic: ev.Topic, Payload: ev.Payload})
+	}
+	return events, nil
 }
@@ -0,0 +1,208 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"quantlo/internal/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// eventServer is an EventService that records the events it syncs.
+type eventServer struct {
+	proto.UnimplementedEventServiceServer
+
+	mu sync.Mutex
+	// unavailable fails that many calls outright; rejects stops that many calls after their first event.
+	unavailable int
+	rejects     int
+	// release, when set, holds every call until it is closed; stall holds only the calls
+	// that start with a spilled event.
+	release chan struct{}
+	stall   chan struct{}
+	synced  []string
+}
+
+func (s *eventServer) PublishBatch(stream proto.EventService_PublishBatchServer) error {
+	if s.release != nil {
+		<-s.release
+	}
+	first, err := stream.Recv()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if s.stall != nil && first != nil && strings.HasPrefix(string(first.Payload), "spilled-") {
+		<-s.stall
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unavailable > 0 {
+		s.unavailable--
+		return status.Error(codes.Unavailable, "worker is down")
+	}
+	var accepted int32
+	for req := first; req != nil; req, err = stream.Recv() {
+		if accepted == 1 && s.rejects > 0 {
+			s.rejects--
+			break
+		}
+		s.synced = append(s.synced, string(req.Payload))
+		accepted++
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return stream.SendAndClose(&proto.PublishBatchResponse{Accepted: accepted})
+}
+
+func (s *eventServer) events() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.synced...)
+}
+
+// dialTestServer serves the registered services in memory and returns a connection to them.
+func dialTestServer(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	register(gs)
+	go func() { _ = gs.Serve(lis) }()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func newTestBus(t *testing.T, srv *eventServer, opts BusOptions) *GrpcBus {
+	t.Helper()
+	conn := dialTestServer(t, func(gs *grpc.Server) { proto.RegisterEventServiceServer(gs, srv) })
+	opts.RetryBackoff = time.Millisecond
+	return NewGrpcBus(proto.NewEventServiceClient(conn), opts)
+}
+
+func publishAll(t *testing.T, bus *GrpcBus, n int) []string {
+	t.Helper()
+	var want []string
+	for i := 0; i < n; i++ {
+		payload := fmt.Sprintf("event-%d", i)
+		if err := bus.Publish("transactions.created", []byte(payload)); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+		want = append(want, payload)
+	}
+	return want
+}
+
+func assertEvents(t *testing.T, got, want []string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+}
+
+func TestGrpcBus_RetriesAndFlushesOnClose(t *testing.T) {
+	srv := &eventServer{unavailable: 2, rejects: 2}
+	bus := newTestBus(t, srv, BusOptions{BatchSize: 3, MaxAttempts: 5})
+
+	want := publishAll(t, bus, 10)
+	bus.Close()
+
+	// Every event arrives exactly once and in order, despite failed and partly accepted calls.
+	assertEvents(t, srv.events(), want)
+	if err := bus.Publish("transactions.created", []byte("late")); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("expected ErrBusClosed after Close, got %v", err)
+	}
+}
+
+func TestGrpcBus_SpillsAndReplaysUndeliveredEvents(t *testing.T) {
+	spill := filepath.Join(t.TempDir(), "grpc-bus.spill")
+
+	down := &eventServer{unavailable: 1000}
+	bus := newTestBus(t, down, BusOptions{MaxAttempts: 2, SpillPath: spill})
+	want := publishAll(t, bus, 3)
+	bus.Close()
+
+	if len(down.events()) != 0 {
+		t.Fatalf("expected nothing delivered while the remote is down, got %v", down.events())
+	}
+	if _, err := os.Stat(spill); err != nil {
+		t.Fatalf("expected the events to be spilled: %v", err)
+	}
+
+	up := &eventServer{}
+	bus = newTestBus(t, up, BusOptions{SpillPath: spill})
+	bus.Close()
+
+	assertEvents(t, up.events(), want)
+	for _, path := range []string{spill, spill + ".replay"} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s to be removed after the replay, got %v", path, err)
+		}
+	}
+}
+
+func TestGrpcBus_ReplaysSpillAlongsideNewEvents(t *testing.T) {
+	spill := filepath.Join(t.TempDir(), "grpc-bus.spill")
+	spilled := []*proto.EventRequest{{Topic: "transactions.created", Payload: []byte("spilled-0")}}
+	if err := appendSpill(spill, spilled); err != nil {
+		t.Fatalf("write spill: %v", err)
+	}
+
+	// The replay is stuck on the remote, but new events still get through.
+	srv := &eventServer{stall: make(chan struct{})}
+	bus := newTestBus(t, srv, BusOptions{SpillPath: spill})
+	want := publishAll(t, bus, 3)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.events()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assertEvents(t, srv.events(), want)
+
+	close(srv.stall)
+	bus.Close()
+	assertEvents(t, srv.events(), append(want, "spilled-0"))
+}
+
+func TestGrpcBus_RejectsEventsWhenFull(t *testing.T) {
+	srv := &eventServer{release: make(chan struct{})}
+	bus := newTestBus(t, srv, BusOptions{BufferSize: 1, BatchSize: 1, PublishTimeout: 10 * time.Millisecond})
+
+	// The worker holds one event in a blocked call and the buffer holds one more.
+	var want []string
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		payload := fmt.Sprintf("event-%d", i)
+		if err = bus.Publish("transactions.created", []byte(payload)); err == nil {
+			want = append(want, payload)
+		}
+	}
+	if !errors.Is(err, ErrBusFull) {
+		t.Fatalf("expected ErrBusFull, got %v", err)
+	}
+
+	close(srv.release)
+	bus.Close()
+	assertEvents(t, srv.events(), want)
+}
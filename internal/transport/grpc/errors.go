@@ -0,0 +1,65 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"quantlo/internal/apperr"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the ErrorInfo domain of the ledger's error codes.
+const errorDomain = "quantlo"
+
+// statusError maps a service error to a gRPC status error. The domain error code is
+// attached as an ErrorInfo detail whose reason is the code, e.g. ACCOUNT_NOT_FOUND.
+// Internal errors are logged and reported without their text.
+func statusError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	code := apperr.CodeOf(err)
+	if code == apperr.CodeInternal {
+		slog.Error("grpc: request failed", "error", err)
+	}
+	st := status.New(grpcCode(code), apperr.Message(err))
+	if detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{Reason: string(code), Domain: errorDomain}); detailErr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// grpcCode maps a domain error code to a gRPC status code.
+func grpcCode(code apperr.Code) codes.Code {
+	switch code {
+	case apperr.CodeAccountNotFound, apperr.CodeNotFound:
+		return codes.NotFound
+	case apperr.CodeAccountExists, apperr.CodeDuplicateRequest:
+		return codes.AlreadyExists
+	case apperr.CodeAccountDeleted, apperr.CodeInsufficientFunds:
+		return codes.FailedPrecondition
+	case apperr.CodeValidationFailed, apperr.CodeIdempotencyConflict:
+		return codes.InvalidArgument
+	case apperr.CodeConflict:
+		return codes.Aborted
+	default:
+		return codes.Internal
+	}
+}
+
+// errorCode returns the domain error code carried by a status error from statusError.
+func errorCode(err error) apperr.Code {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain {
+			return apperr.Code(info.Reason)
+		}
+	}
+	return ""
+}
@@ -2,11 +2,14 @@ package grpc
 
 import (
 	"context"
-	"encoding/json"
+	"io"
+	"log/slog"
 	"net"
 	"quantlo/internal/model"
 	"quantlo/internal/proto"
 	"quantlo/internal/service"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
 )
@@ -14,13 +17,17 @@ import (
 type Server struct {
 	proto.UnimplementedLedgerServiceServer
 	proto.UnimplementedEventServiceServer
-	svc  service.LedgerService
-	srv  *grpc.Server
-	addr string
+	svc    service.LedgerService
+	syncer *service.EventSyncer
+	srv    *grpc.Server
+	addr   string
+	// stopping is closed when the server stops, to end the streams GracefulStop would wait for.
+	stopping chan struct{}
+	stopOnce sync.Once
 }
 
-func NewServer(addr string, svc service.LedgerService) *Server {
-	s := &Server{svc: svc, addr: addr, srv: grpc.NewServer()}
+func NewServer(addr string, svc service.LedgerService, syncer *service.EventSyncer) *Server {
+	s := &Server{svc: svc, syncer: syncer, addr: addr, srv: grpc.NewServer(), stopping: make(chan struct{})}
 	proto.RegisterLedgerServiceServer(s.srv, s)
 	proto.RegisterEventServiceServer(s.srv, s)
 	return s
@@ -35,6 +42,7 @@ func (s *Server) Start(ctx context.Context) error {
 }
 
 func (s *Server) Stop(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopping) })
 	s.srv.GracefulStop()
 	return nil
 }
@@ -47,36 +55,183 @@ func (s *Server) Spend(ctx context.Context, req *proto.SpendRequest) (*proto.Spe
 		IdempotencyKey: req.IdempotencyKey,
 	})
 	if err != nil {
-		return &proto.SpendResponse{Success: false, ErrorMessage: err.Error()}, nil
+		return nil, statusError(err)
 	}
 	return &proto.SpendResponse{
-		Success:    true,
-		NewBalance: res.NewBalance,
-		Status:     res.Status,
+		Success:       true,
+		NewBalance:    res.NewBalance,
+		Status:        res.Status,
+		CreditLimit:   res.CreditLimit,
+		OverdraftUsed: res.OverdraftUsed,
+		Amount:        res.Amount,
+		ProcessedAt:   res.ProcessedAt.UnixMilli(),
+		Replayed:      res.Replayed,
 	}, nil
 }
 
 func (s *Server) Recharge(ctx context.Context, req *proto.RechargeRequest) (*proto.RechargeResponse, error) {
 	err := s.svc.Recharge(ctx, model.RechargeRequest{
-		AccountID:    req.AccountId,
-		ResourceType: req.ResourceType,
-		Amount:       req.Amount,
+		AccountID:      req.AccountId,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
 	})
 	if err != nil {
-		return &proto.RechargeResponse{Success: false, ErrorMessage: err.Error()}, nil
+		return nil, statusError(err)
 	}
 	return &proto.RechargeResponse{Success: true, Status: "SUCCESS"}, nil
 }
 
-func (s *Server) Publish(ctx context.Context, req *proto.EventRequest) (*proto.EventResponse, error) {
-	var event model.SpendEvent
-	if err := json.Unmarshal(req.Payload, &event); err != nil {
-		return &proto.EventResponse{Success: false}, err
+func (s *Server) Authorize(ctx context.Context, req *proto.AuthorizeRequest) (*proto.HoldResponse, error) {
+	res, err := s.svc.Authorize(ctx, model.AuthorizeRequest{
+		AccountID:      req.AccountId,
+		ResourceType:   req.ResourceType,
+		Amount:         req.Amount,
+		IdempotencyKey: req.IdempotencyKey,
+		TTLSeconds:     req.TtlSeconds,
+	})
+	if err != nil {
+		return nil, statusError(err)
 	}
+	return holdResponse(res), nil
+}
 
-	if err := s.svc.SyncTransactionWithBalance(ctx, event); err != nil {
-		return &proto.EventResponse{Success: false}, err
+func (s *Server) Capture(ctx context.Context, req *proto.CaptureRequest) (*proto.HoldResponse, error) {
+	res, err := s.svc.Capture(ctx, model.CaptureRequest{
+		HoldID: req.HoldId,
+		Amount: req.Amount,
+	})
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return holdResponse(res), nil
+}
+
+func (s *Server) Void(ctx context.Context, req *proto.VoidRequest) (*proto.HoldResponse, error) {
+	res, err := s.svc.Void(ctx, req.HoldId)
+	if err != nil {
+		return nil, statusError(err)
 	}
+	return holdResponse(res), nil
+}
+
+func (s *Server) Transfer(ctx context.Context, req *proto.TransferRequest) (*proto.TransferResponse, error) {
+	res, err := s.svc.Transfer(ctx, req.FromAccountId, req.ToAccountId, req.ResourceType, req.Amount, req.IdempotencyKey)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.TransferResponse{
+		Success:     true,
+		FromBalance: res.FromBalance,
+		ToBalance:   res.ToBalance,
+		Status:      res.Status,
+	}, nil
+}
 
+func (s *Server) Refund(ctx context.Context, req *proto.RefundRequest) (*proto.RefundResponse, error) {
+	res, err := s.svc.Refund(ctx, req.IdempotencyKey, req.Amount, req.RefundIdempotencyKey)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.RefundResponse{
+		Success:        true,
+		RefundId:       res.RefundID,
+		Amount:         res.Amount,
+		RefundedTotal:  res.RefundedTotal,
+		OriginalAmount: res.OriginalAmount,
+		NewBalance:     res.NewBalance,
+		Status:         res.Status,
+	}, nil
+}
+
+func (s *Server) ListTransactions(ctx context.Context, req *proto.ListTransactionsRequest) (*proto.ListTransactionsResponse, error) {
+	filter := model.TransactionFilter{
+		AccountID:    req.AccountId,
+		ResourceType: req.ResourceType,
+		MinAmount:    req.MinAmount,
+		MaxAmount:    req.MaxAmount,
+		Metadata:     req.Metadata,
+		Cursor:       req.Cursor,
+		Limit:        int(req.Limit),
+	}
+	if req.From > 0 {
+		from := time.Unix(req.From, 0)
+		filter.From = &from
+	}
+	if req.To > 0 {
+		to := time.Unix(req.To, 0)
+		filter.To = &to
+	}
+
+	page, err := s.svc.ListTransactions(ctx, filter)
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	out := &proto.ListTransactionsResponse{Success: true, NextCursor: page.NextCursor}
+	for _, t := range page.Transactions {
+		out.Transactions = append(out.Transactions, &proto.Transaction{
+			Id:             t.ID,
+			AccountId:      t.AccountID,
+			ResourceType:   t.ResourceType,
+			Amount:         t.Amount,
+			IdempotencyKey: t.IdempotencyKey,
+			Metadata:       t.Metadata,
+			ReversalOf:     t.ReversalOf,
+			CreatedAt:      t.CreatedAt.UnixMilli(),
+		})
+	}
+	return out, nil
+}
+
+func (s *Server) GetBalanceAt(ctx context.Context, req *proto.GetBalanceAtRequest) (*proto.BalanceResponse, error) {
+	bal, err := s.svc.GetBalanceAt(ctx, req.AccountId, req.ResourceType, time.Unix(req.At, 0))
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &proto.BalanceResponse{Success: true, Balance: bal}, nil
+}
+
+func holdResponse(res *model.HoldResult) *proto.HoldResponse {
+	out := &proto.HoldResponse{
+		Success:    true,
+		HoldId:     res.HoldID,
+		Amount:     res.Amount,
+		NewBalance: res.NewBalance,
+		Status:     res.Status,
+	}
+	if !res.ExpiresAt.IsZero() {
+		out.ExpiresAt = res.ExpiresAt.Unix()
+	}
+	return out
+}
+
+// Publish syncs an event from the GrpcBus. Failed events are retried and then parked
+// as dead letters, so an error is only returned when the event could not even be parked.
+func (s *Server) Publish(ctx context.Context, req *proto.EventRequest) (*proto.EventResponse, error) {
+	if err := s.syncer.Sync(ctx, req.Topic, req.Payload); err != nil {
+		return &proto.EventResponse{Success: false}, err
+	}
 	return &proto.EventResponse{Success: true}, nil
 }
+
+// PublishBatch syncs a stream of events from the GrpcBus in order. It stops at the first
+// event it can not sync and reports how many were synced, so the bus resends only the rest.
+func (s *Server) PublishBatch(stream proto.EventService_PublishBatchServer) error {
+	var accepted int32
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.syncer.Sync(stream.Context(), req.Topic, req.Payload); err != nil {
+			slog.Error("grpc: batch sync failed", "topic", req.Topic, "accepted", accepted, "error", err)
+			break
+		}
+		accepted++
+	}
+	return stream.SendAndClose(&proto.PublishBatchResponse{Accepted: accepted})
+}
@@ -3,15 +3,27 @@ package grpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"quantlo/internal/apperr"
 	"quantlo/internal/model"
 	"quantlo/internal/proto"
+	"quantlo/internal/repository"
+	"quantlo/internal/service"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type mockService struct {
-	syncCalled bool
-	syncErr    error
+	syncCalled     bool
+	syncErr        error
+	transferCalled bool
+	parked         []model.DeadLetter
 }
 
 func (m *mockService) Spend(ctx context.Context, req model.SpendRequest) (*model.SpendResult, error) {
@@ -21,20 +33,149 @@ func (m *mockService) Recharge(ctx context.Context, req model.RechargeRequest) e
 func (m *mockService) GetBalance(ctx context.Context, accountID, resourceType string) (int64, error) {
 	return 0, nil
 }
-func (m *mockService) CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64) error {
+func (m *mockService) CreateAccount(ctx context.Context, accountID, resourceType string, initialAmount int64, idempotencyKey string) error {
 	return nil
 }
-func (m *mockService) DeleteAccount(ctx context.Context, accountID, resourceType string) error {
+func (m *mockService) DeleteAccount(ctx context.Context, accountID, resourceType, idempotencyKey string) error {
 	return nil
 }
+func (m *mockService) WatchBalances(ctx context.Context, accountIDs []string, offset string) (<-chan model.BalanceEvent, error) {
+	return nil, nil
+}
 func (m *mockService) SyncTransactionWithBalance(ctx context.Context, event model.SpendEvent) error {
 	m.syncCalled = true
 	return m.syncErr
 }
+func (m *mockService) SyncTransactions(ctx context.Context, events []model.SpendEvent) (*model.BatchStats, error) {
+	return nil, nil
+}
+
+func (m *mockService) Authorize(ctx context.Context, req model.AuthorizeRequest) (*model.HoldResult, error) {
+	return nil, nil
+}
+func (m *mockService) Capture(ctx context.Context, req model.CaptureRequest) (*model.HoldResult, error) {
+	return nil, nil
+}
+func (m *mockService) Void(ctx context.Context, holdID string) (*model.HoldResult, error) {
+	return nil, nil
+}
+func (m *mockService) ExpireHolds(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *mockService) Transfer(ctx context.Context, from, to, resourceType string, amount int64, idempotencyKey string) (*model.TransferResult, error) {
+	return nil, nil
+}
+func (m *mockService) SyncTransfer(ctx context.Context, event model.TransferEvent) error {
+	m.transferCalled = true
+	return nil
+}
+
+func (m *mockService) SetCreditLimit(ctx context.Context, accountID, resourceType string, limit int64) error {
+	return nil
+}
+func (m *mockService) GetCreditLimit(ctx context.Context, accountID, resourceType string) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockService) GrantCredits(ctx context.Context, req model.GrantRequest) (*model.CreditGrant, error) {
+	return nil, nil
+}
+func (m *mockService) GetBalanceBreakdown(ctx context.Context, accountID, resourceType string) (*model.BalanceBreakdown, error) {
+	return nil, nil
+}
+func (m *mockService) ExpireGrants(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *mockService) Refund(ctx context.Context, originalIdempotencyKey string, amount int64, idempotencyKey string) (*model.RefundResult, error) {
+	return nil, nil
+}
+
+func (m *mockService) CheckJournal(ctx context.Context) (*model.JournalReport, error) {
+	return nil, nil
+}
+
+func (m *mockService) ListTransactions(ctx context.Context, filter model.TransactionFilter) (*model.TransactionPage, error) {
+	return nil, nil
+}
+
+func (m *mockService) GetBalanceAt(ctx context.Context, accountID, resourceType string, at time.Time) (int64, error) {
+	return 0, nil
+}
+func (m *mockService) TakeSnapshots(ctx context.Context, at time.Time) (int, error) {
+	return 0, nil
+}
+
+func (m *mockService) Reconcile(ctx context.Context, policy model.RepairPolicy) (*model.DriftReport, error) {
+	return nil, nil
+}
+
+func (m *mockService) ParkDeadLetter(ctx context.Context, dl model.DeadLetter) error {
+	m.parked = append(m.parked, dl)
+	return nil
+}
+func (m *mockService) ListDeadLetters(ctx context.Context, status string, limit int) ([]model.DeadLetter, error) {
+	return nil, nil
+}
+func (m *mockService) GetDeadLetter(ctx context.Context, id string) (*model.DeadLetter, error) {
+	return nil, nil
+}
+func (m *mockService) ReplayDeadLetter(ctx context.Context, id string) error {
+	return nil
+}
+func (m *mockService) DiscardDeadLetter(ctx context.Context, id string) error {
+	return nil
+}
+func (m *mockService) CreateThreshold(ctx context.Context, req model.ThresholdRequest) (*model.BalanceThreshold, error) {
+	return nil, nil
+}
+func (m *mockService) ListThresholds(ctx context.Context, accountID, resourceType string) ([]model.BalanceThreshold, error) {
+	return nil, nil
+}
+func (m *mockService) DeleteThreshold(ctx context.Context, id string) error {
+	return nil
+}
+func (m *mockService) CreateQuotaPolicy(ctx context.Context, req model.QuotaPolicyRequest) (*model.QuotaPolicy, error) {
+	return nil, nil
+}
+func (m *mockService) ListQuotaPolicies(ctx context.Context, accountID, resourceType string) ([]model.QuotaPolicy, error) {
+	return nil, nil
+}
+func (m *mockService) DeleteQuotaPolicy(ctx context.Context, id string) error {
+	return nil
+}
+func (m *mockService) ApplyDueRefills(ctx context.Context, now time.Time) (int, error) {
+	return 0, nil
+}
+func (m *mockService) CreateWebhook(ctx context.Context, req model.WebhookRequest) (*model.Webhook, error) {
+	return nil, nil
+}
+func (m *mockService) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	return nil, nil
+}
+func (m *mockService) DeleteWebhook(ctx context.Context, id string) error {
+	return nil
+}
+func (m *mockService) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	return nil, nil
+}
+func (m *mockService) RedeliverWebhook(ctx context.Context, deliveryID string) error {
+	return nil
+}
+func (m *mockService) FanOutWebhookEvents(ctx context.Context, consumer string) (int, error) {
+	return 0, nil
+}
+func (m *mockService) ClaimWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	return nil, nil
+}
+func (m *mockService) RecordWebhookAttempt(ctx context.Context, attempt model.WebhookAttempt) error {
+	return nil
+}
 
 func TestServer_Publish(t *testing.T) {
 	svc := &mockService{}
-	server := &Server{svc: svc}
+	server := &Server{svc: svc, syncer: service.NewEventSyncer(svc, 1, 0)}
 
 	event := model.SpendEvent{AccountID: "user123", Amount: 100}
 	payload, _ := json.Marshal(event)
@@ -57,3 +198,199 @@ func TestServer_Publish(t *testing.T) {
 		t.Error("expected SyncTransactionWithBalance to be called")
 	}
 }
+
+func TestServer_PublishTransfer(t *testing.T) {
+	svc := &mockService{}
+	server := &Server{svc: svc, syncer: service.NewEventSyncer(svc, 1, 0)}
+
+	event := model.TransferEvent{FromAccountID: "user123", ToAccountID: "user456", Amount: 50}
+	payload, _ := json.Marshal(event)
+
+	res, err := server.Publish(context.Background(), &proto.EventRequest{
+		Topic:   "transfers.created",
+		Payload: payload,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !res.Success {
+		t.Error("expected success")
+	}
+
+	if !svc.transferCalled || svc.syncCalled {
+		t.Error("expected only SyncTransfer to be called")
+	}
+}
+
+func TestServer_PublishParksFailedEvent(t *testing.T) {
+	svc := &mockService{syncErr: errors.New("db down")}
+	server := &Server{svc: svc, syncer: service.NewEventSyncer(svc, 3, time.Millisecond)}
+
+	payload, _ := json.Marshal(model.SpendEvent{AccountID: "user123", Amount: 100, IdempotencyKey: "req-1"})
+	res, err := server.Publish(context.Background(), &proto.EventRequest{
+		Topic:   "transactions.created",
+		Payload: payload,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.Success {
+		t.Error("expected success once the event is parked")
+	}
+
+	if len(svc.parked) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(svc.parked))
+	}
+	if dl := svc.parked[0]; dl.Attempts != 3 || dl.Error != "db down" {
+		t.Errorf("unexpected dead letter: %+v", dl)
+	}
+}
+
+func TestServer_PublishParksMalformedEvent(t *testing.T) {
+	svc := &mockService{}
+	server := &Server{svc: svc, syncer: service.NewEventSyncer(svc, 3, time.Millisecond)}
+
+	res, err := server.Publish(context.Background(), &proto.EventRequest{
+		Topic:   "transactions.created",
+		Payload: []byte("not json"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !res.Success {
+		t.Error("expected success once the event is parked")
+	}
+
+	if svc.syncCalled || len(svc.parked) != 1 || svc.parked[0].Attempts != 1 {
+		t.Errorf("expected the event to be parked without syncing, got %+v", svc.parked)
+	}
+}
+
+func TestServer_AccountStatusCodes(t *testing.T) {
+	ctx := context.Background()
+	server := &Server{svc: repository.NewMemoryLedger(nil)}
+
+	if _, err := server.CreateAccount(ctx, &proto.CreateAccountRequest{AccountId: "user123", ResourceType: "api_credits", InitialAmount: 50}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res, err := server.GetBalance(ctx, &proto.GetBalanceRequest{AccountId: "user123", ResourceType: "api_credits"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Balance != 50 {
+		t.Errorf("expected balance 50, got %d", res.Balance)
+	}
+
+	_, err = server.CreateAccount(ctx, &proto.CreateAccountRequest{AccountId: "user123", ResourceType: "api_credits"})
+	if code := status.Code(err); code != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", code)
+	}
+	_, err = server.GetBalance(ctx, &proto.GetBalanceRequest{AccountId: "ghost", ResourceType: "api_credits"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", code)
+	}
+	_, err = server.GetBalance(ctx, &proto.GetBalanceRequest{AccountId: "user123"})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", code)
+	}
+
+	if _, err := server.DeleteAccount(ctx, &proto.DeleteAccountRequest{AccountId: "user123", ResourceType: "api_credits"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = server.GetBalance(ctx, &proto.GetBalanceRequest{AccountId: "user123", ResourceType: "api_credits"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a deleted account, got %v", code)
+	}
+}
+
+func TestServer_BatchCreateAccountReportsEachItem(t *testing.T) {
+	ctx := context.Background()
+	server := &Server{svc: repository.NewMemoryLedger(nil)}
+
+	res, err := server.BatchCreateAccount(ctx, &proto.BatchCreateAccountRequest{Accounts: []*proto.CreateAccountRequest{
+		{AccountId: "user123", ResourceType: "api_credits", InitialAmount: 10},
+		{AccountId: "user123", ResourceType: "api_credits", InitialAmount: 20},
+		{AccountId: "", ResourceType: "api_credits"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []codes.Code{codes.OK, codes.AlreadyExists, codes.InvalidArgument}
+	if len(res.Results) != len(want) {
+		t.Fatalf("expected %d results, got %d", len(want), len(res.Results))
+	}
+	for i, code := range want {
+		if got := codes.Code(res.Results[i].Status.Code); got != code {
+			t.Errorf("item %d: expected %v, got %v", i, code, got)
+		}
+	}
+
+	balances, err := server.BatchGetBalance(ctx, &proto.BatchGetBalanceRequest{Accounts: []*proto.GetBalanceRequest{
+		{AccountId: "user123", ResourceType: "api_credits"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if balances.Results[0].Balance != 10 {
+		t.Errorf("expected the first create to win with balance 10, got %d", balances.Results[0].Balance)
+	}
+
+	_, err = server.BatchDeleteAccount(ctx, &proto.BatchDeleteAccountRequest{})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an empty batch, got %v", code)
+	}
+}
+
+func TestServer_SpendErrorCarriesCode(t *testing.T) {
+	ctx := context.Background()
+	server := &Server{svc: repository.NewMemoryLedger(nil)}
+	if _, err := server.CreateAccount(ctx, &proto.CreateAccountRequest{AccountId: "user123", ResourceType: "api_credits", InitialAmount: 5}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err := server.Spend(ctx, &proto.SpendRequest{AccountId: "user123", ResourceType: "api_credits", Amount: 10, IdempotencyKey: "req-1"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", code)
+	}
+	if code := errorCode(err); code != apperr.CodeInsufficientFunds {
+		t.Errorf("expected an %s error detail, got %q", apperr.CodeInsufficientFunds, code)
+	}
+}
+
+func TestServer_WatchBalancesStreamsEvents(t *testing.T) {
+	ledger := repository.NewMemoryLedger(nil)
+	server := &Server{svc: ledger, stopping: make(chan struct{})}
+
+	conn := dialTestServer(t, func(gs *grpc.Server) { proto.RegisterLedgerServiceServer(gs, server) })
+	client := proto.NewLedgerServiceClient(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.WatchBalances(ctx, &proto.WatchBalancesRequest{AccountIds: []string{"user123"}, Offset: "0-0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ledger.CreateAccount(ctx, "user123", "api_credits", 10, "open-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if event.Type != "account_created" || event.Balance != 10 || event.IdempotencyKey != "open-1" || !strings.HasSuffix(event.Offset, "-0") {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	// Stopping the server ends the stream so that GracefulStop does not wait for it.
+	close(server.stopping)
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable once the server stops, got %v", err)
+	}
+
+	bad, _ := client.WatchBalances(ctx, &proto.WatchBalancesRequest{AccountIds: []string{"user123"}, Offset: "x"})
+	if _, err := bad.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a bad offset, got %v", err)
+	}
+}
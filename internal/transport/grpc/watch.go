@@ -0,0 +1,61 @@
+package grpc
+
+import (
+	"context"
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+	"quantlo/internal/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WatchBalances streams the balance events of the requested accounts until the client
+// goes away or the server stops. When the feed fails the stream ends with Unavailable;
+// the client reconnects with the offset of the last event it got and misses nothing.
+func (s *Server) WatchBalances(req *proto.WatchBalancesRequest, stream proto.LedgerService_WatchBalancesServer) error {
+	if len(req.AccountIds) == 0 {
+		return statusError(apperr.Validation("at least one account_id is required"))
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	events, err := s.svc.WatchBalances(ctx, req.AccountIds, req.Offset)
+	if err != nil {
+		return statusError(err)
+	}
+	for e := range events {
+		if err := stream.Send(balanceEventMessage(e)); err != nil {
+			return err
+		}
+	}
+	if err := stream.Context().Err(); err != nil {
+		return statusError(err)
+	}
+	select {
+	case <-s.stopping:
+		return status.Error(codes.Unavailable, "server is shutting down, resume from the last offset")
+	default:
+		return status.Error(codes.Unavailable, "balance feed interrupted, resume from the last offset")
+	}
+}
+
+func balanceEventMessage(e model.BalanceEvent) *proto.BalanceEvent {
+	return &proto.BalanceEvent{
+		Offset:         e.Offset,
+		Type:           e.Type,
+		AccountId:      e.AccountID,
+		ResourceType:   e.ResourceType,
+		Amount:         e.Amount,
+		Balance:        e.Balance,
+		IdempotencyKey: e.IdempotencyKey,
+		At:             e.At.UnixMilli(),
+	}
+}
@@ -2,11 +2,29 @@ package http
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"quantlo/internal/apperr"
 	"quantlo/internal/model"
 	"quantlo/internal/service"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// HeaderIdempotentReplay marks a response that replays the result of an earlier request
+// with the same idempotency key instead of processing it again.
+const HeaderIdempotentReplay = "X-Idempotent-Replay"
+
+// sseKeepAlive is how often an idle event stream gets a comment, so proxies keep it open.
+const sseKeepAlive = 15 * time.Second
+
+// HeaderIdempotencyKey carries the idempotency key of a mutating request. It may be used
+// instead of the idempotency_key body field, which is how DELETE /accounts can carry one.
+const HeaderIdempotencyKey = "Idempotency-Key"
+
 type Handler struct {
 	svc service.LedgerService
 }
@@ -19,9 +37,37 @@ func (h *Handler) Register(mux *http.ServeMux) {
 	mux.HandleFunc("GET /health", h.Health)
 	mux.HandleFunc("POST /accounts", h.CreateAccount)
 	mux.HandleFunc("DELETE /accounts", h.DeleteAccount)
+	mux.HandleFunc("GET /accounts/{id}/transactions", h.ListTransactions)
+	mux.HandleFunc("GET /accounts/{id}/events", h.WatchBalances)
 	mux.HandleFunc("GET /balance", h.GetBalance)
 	mux.HandleFunc("POST /recharge", h.Recharge)
 	mux.HandleFunc("POST /spend", h.Spend)
+	mux.HandleFunc("POST /transfers", h.Transfer)
+	mux.HandleFunc("POST /grants", h.GrantCredits)
+	mux.HandleFunc("POST /refunds", h.Refund)
+	mux.HandleFunc("POST /holds", h.Authorize)
+	mux.HandleFunc("POST /holds/{id}/capture", h.Capture)
+	mux.HandleFunc("POST /holds/{id}/void", h.Void)
+	mux.HandleFunc("POST /thresholds", h.CreateThreshold)
+	mux.HandleFunc("GET /thresholds", h.ListThresholds)
+	mux.HandleFunc("DELETE /thresholds/{id}", h.DeleteThreshold)
+	mux.HandleFunc("POST /quotas", h.CreateQuotaPolicy)
+	mux.HandleFunc("GET /quotas", h.ListQuotaPolicies)
+	mux.HandleFunc("DELETE /quotas/{id}", h.DeleteQuotaPolicy)
+	mux.HandleFunc("POST /webhooks", h.CreateWebhook)
+	mux.HandleFunc("GET /webhooks", h.ListWebhooks)
+	mux.HandleFunc("DELETE /webhooks/{id}", h.DeleteWebhook)
+	mux.HandleFunc("GET /webhooks/{id}/deliveries", h.ListWebhookDeliveries)
+	mux.HandleFunc("POST /webhooks/deliveries/{id}/redeliver", h.RedeliverWebhook)
+	mux.HandleFunc("GET /admin/credit-limit", h.GetCreditLimit)
+	mux.HandleFunc("PUT /admin/credit-limit", h.SetCreditLimit)
+	mux.HandleFunc("GET /admin/journal/check", h.CheckJournal)
+	mux.HandleFunc("GET /admin/reconcile", h.Reconcile)
+	mux.HandleFunc("POST /admin/reconcile", h.Reconcile)
+	mux.HandleFunc("GET /admin/dead-letters", h.ListDeadLetters)
+	mux.HandleFunc("GET /admin/dead-letters/{id}", h.GetDeadLetter)
+	mux.HandleFunc("POST /admin/dead-letters/{id}/replay", h.ReplayDeadLetter)
+	mux.HandleFunc("POST /admin/dead-letters/{id}/discard", h.DiscardDeadLetter)
 }
 
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
@@ -31,16 +77,22 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) CreateAccount(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		ID     string `json:"account_id"`
-		Type   string `json:"resource_type"`
-		Amount int64  `json:"initial_amount"`
+		ID             string `json:"account_id"`
+		Type           string `json:"resource_type"`
+		Amount         int64  `json:"initial_amount"`
+		IdempotencyKey string `json:"idempotency_key"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid_json")
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	key, err := idempotencyKey(r, req.IdempotencyKey)
+	if err != nil {
+		h.respondError(w, err)
 		return
 	}
-	if err := h.svc.CreateAccount(r.Context(), req.ID, req.Type, req.Amount); err != nil {
-		h.respondError(w, http.StatusConflict, err.Error())
+	if err := h.svc.CreateAccount(r.Context(), req.ID, req.Type, req.Amount, key); err != nil {
+		h.respondError(w, err)
 		return
 	}
 	h.respondJSON(w, http.StatusCreated, map[string]string{"status": "created"})
@@ -49,25 +101,38 @@ func (h *Handler) CreateAccount(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) Spend(w http.ResponseWriter, r *http.Request) {
 	var req model.SpendRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid_json")
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	var err error
+	if req.IdempotencyKey, err = idempotencyKey(r, req.IdempotencyKey); err != nil {
+		h.respondError(w, err)
 		return
 	}
 	res, err := h.svc.Spend(r.Context(), req)
 	if err != nil {
-		h.respondError(w, http.StatusUnprocessableEntity, err.Error())
+		h.respondError(w, err)
 		return
 	}
+	if res.Replayed {
+		w.Header().Set(HeaderIdempotentReplay, "true")
+	}
 	h.respondJSON(w, http.StatusOK, res)
 }
 
 func (h *Handler) Recharge(w http.ResponseWriter, r *http.Request) {
 	var req model.RechargeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondError(w, http.StatusBadRequest, "invalid_json")
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	var err error
+	if req.IdempotencyKey, err = idempotencyKey(r, req.IdempotencyKey); err != nil {
+		h.respondError(w, err)
 		return
 	}
-	if err := h.svc.Recharge(r.Context(), req); err != nil {
-		h.respondError(w, http.StatusInternalServerError, err.Error())
+	if err = h.svc.Recharge(r.Context(), req); err != nil {
+		h.respondError(w, err)
 		return
 	}
 	h.respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
@@ -77,12 +142,35 @@ func (h *Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	accID := r.URL.Query().Get("account_id")
 	resType := r.URL.Query().Get("resource_type")
 	if accID == "" || resType == "" {
-		h.respondError(w, http.StatusBadRequest, "missing_params")
+		h.respondError(w, apperr.Validation("missing_params"))
+		return
+	}
+	if atParam := r.URL.Query().Get("at"); atParam != "" {
+		at, err := time.Parse(time.RFC3339, atParam)
+		if err != nil {
+			h.respondError(w, apperr.Validation("invalid_at"))
+			return
+		}
+		bal, err := h.svc.GetBalanceAt(r.Context(), accID, resType, at)
+		if err != nil {
+			h.respondError(w, err)
+			return
+		}
+		h.respondJSON(w, http.StatusOK, map[string]interface{}{"balance": bal, "at": at})
+		return
+	}
+	if r.URL.Query().Get("breakdown") == "true" {
+		breakdown, err := h.svc.GetBalanceBreakdown(r.Context(), accID, resType)
+		if err != nil {
+			h.respondError(w, err)
+			return
+		}
+		h.respondJSON(w, http.StatusOK, breakdown)
 		return
 	}
 	bal, err := h.svc.GetBalance(r.Context(), accID, resType)
 	if err != nil {
-		h.respondError(w, http.StatusNotFound, err.Error())
+		h.respondError(w, err)
 		return
 	}
 	h.respondJSON(w, http.StatusOK, map[string]interface{}{"balance": bal})
@@ -92,16 +180,487 @@ func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 	accID := r.URL.Query().Get("account_id")
 	resType := r.URL.Query().Get("resource_type")
 	if accID == "" || resType == "" {
-		h.respondError(w, http.StatusBadRequest, "missing_params")
+		h.respondError(w, apperr.Validation("missing_params"))
 		return
 	}
-	if err := h.svc.DeleteAccount(r.Context(), accID, resType); err != nil {
-		h.respondError(w, http.StatusNotFound, err.Error())
+	if err := h.svc.DeleteAccount(r.Context(), accID, resType, r.Header.Get(HeaderIdempotencyKey)); err != nil {
+		h.respondError(w, err)
 		return
 	}
 	h.respondJSON(w, http.StatusNoContent, nil)
 }
 
+func (h *Handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	var req model.TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	var err error
+	if req.IdempotencyKey, err = idempotencyKey(r, req.IdempotencyKey); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	res, err := h.svc.Transfer(r.Context(), req.FromAccountID, req.ToAccountID, req.ResourceType, req.Amount, req.IdempotencyKey)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) GrantCredits(w http.ResponseWriter, r *http.Request) {
+	var req model.GrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	var err error
+	if req.IdempotencyKey, err = idempotencyKey(r, req.IdempotencyKey); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	grant, err := h.svc.GrantCredits(r.Context(), req)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusCreated, grant)
+}
+
+func (h *Handler) Refund(w http.ResponseWriter, r *http.Request) {
+	var req model.RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	// idempotency_key names the spend to refund; the header is the key of the refund itself.
+	var err error
+	if req.RefundIdempotencyKey, err = idempotencyKey(r, req.RefundIdempotencyKey); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	res, err := h.svc.Refund(r.Context(), req.IdempotencyKey, req.Amount, req.RefundIdempotencyKey)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) Authorize(w http.ResponseWriter, r *http.Request) {
+	var req model.AuthorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	var err error
+	if req.IdempotencyKey, err = idempotencyKey(r, req.IdempotencyKey); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	res, err := h.svc.Authorize(r.Context(), req)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusCreated, res)
+}
+
+func (h *Handler) Capture(w http.ResponseWriter, r *http.Request) {
+	var req model.CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	req.HoldID = r.PathValue("id")
+	res, err := h.svc.Capture(r.Context(), req)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) Void(w http.ResponseWriter, r *http.Request) {
+	res, err := h.svc.Void(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, res)
+}
+
+func (h *Handler) GetCreditLimit(w http.ResponseWriter, r *http.Request) {
+	accID := r.URL.Query().Get("account_id")
+	resType := r.URL.Query().Get("resource_type")
+	if accID == "" || resType == "" {
+		h.respondError(w, apperr.Validation("missing_params"))
+		return
+	}
+	limit, err := h.svc.GetCreditLimit(r.Context(), accID, resType)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]interface{}{"credit_limit": limit})
+}
+
+func (h *Handler) SetCreditLimit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID    string `json:"account_id"`
+		Type  string `json:"resource_type"`
+		Limit int64  `json:"credit_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	if err := h.svc.SetCreditLimit(r.Context(), req.ID, req.Type, req.Limit); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+}
+
+func (h *Handler) CheckJournal(w http.ResponseWriter, r *http.Request) {
+	report, err := h.svc.CheckJournal(r.Context())
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusConflict
+	}
+	h.respondJSON(w, status, report)
+}
+
+// Reconcile reports drift between Redis and PostgreSQL. GET only reports;
+// POST repairs according to the policy query parameter.
+func (h *Handler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	policy := model.RepairNone
+	if r.Method == http.MethodPost {
+		policy = model.RepairPolicy(r.URL.Query().Get("policy"))
+	}
+	report, err := h.svc.Reconcile(r.Context(), policy)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !report.OK && report.Repaired < len(report.Accounts) {
+		status = http.StatusConflict
+	}
+	h.respondJSON(w, status, report)
+}
+
+// ListDeadLetters supports status (parked, replaying, replayed or discarded; parked by default) and limit query parameters.
+func (h *Handler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var limit int
+	if n, err := parseIntParam(q.Get("limit")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_limit"))
+		return
+	} else if n != nil {
+		limit = int(*n)
+	}
+	letters, err := h.svc.ListDeadLetters(r.Context(), q.Get("status"), limit)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, letters)
+}
+
+func (h *Handler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	dl, err := h.svc.GetDeadLetter(r.Context(), r.PathValue("id"))
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, dl)
+}
+
+func (h *Handler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.ReplayDeadLetter(r.Context(), r.PathValue("id")); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusAccepted, map[string]string{"status": "replayed"})
+}
+
+func (h *Handler) DiscardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DiscardDeadLetter(r.Context(), r.PathValue("id")); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "discarded"})
+}
+
+func (h *Handler) CreateThreshold(w http.ResponseWriter, r *http.Request) {
+	var req model.ThresholdRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	threshold, err := h.svc.CreateThreshold(r.Context(), req)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusCreated, threshold)
+}
+
+func (h *Handler) ListThresholds(w http.ResponseWriter, r *http.Request) {
+	accID := r.URL.Query().Get("account_id")
+	resType := r.URL.Query().Get("resource_type")
+	if accID == "" || resType == "" {
+		h.respondError(w, apperr.Validation("missing_params"))
+		return
+	}
+	thresholds, err := h.svc.ListThresholds(r.Context(), accID, resType)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, thresholds)
+}
+
+func (h *Handler) DeleteThreshold(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DeleteThreshold(r.Context(), r.PathValue("id")); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *Handler) CreateQuotaPolicy(w http.ResponseWriter, r *http.Request) {
+	var req model.QuotaPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	policy, err := h.svc.CreateQuotaPolicy(r.Context(), req)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusCreated, policy)
+}
+
+func (h *Handler) ListQuotaPolicies(w http.ResponseWriter, r *http.Request) {
+	accID := r.URL.Query().Get("account_id")
+	resType := r.URL.Query().Get("resource_type")
+	if accID == "" || resType == "" {
+		h.respondError(w, apperr.Validation("missing_params"))
+		return
+	}
+	policies, err := h.svc.ListQuotaPolicies(r.Context(), accID, resType)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, policies)
+}
+
+func (h *Handler) DeleteQuotaPolicy(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DeleteQuotaPolicy(r.Context(), r.PathValue("id")); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// CreateWebhook registers a webhook; the response is the only one that carries its secret.
+func (h *Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req model.WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.respondError(w, apperr.Validation("invalid_json"))
+		return
+	}
+	webhook, err := h.svc.CreateWebhook(r.Context(), req)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusCreated, webhook)
+}
+
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.svc.ListWebhooks(r.Context())
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, webhooks)
+}
+
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.DeleteWebhook(r.Context(), r.PathValue("id")); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// ListWebhookDeliveries returns the webhook's delivery log, newest first, up to ?limit=.
+func (h *Handler) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	var limit int
+	if n, err := parseIntParam(r.URL.Query().Get("limit")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_limit"))
+		return
+	} else if n != nil {
+		limit = int(*n)
+	}
+	deliveries, err := h.svc.ListWebhookDeliveries(r.Context(), r.PathValue("id"), limit)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, deliveries)
+}
+
+// RedeliverWebhook queues a delivery to be sent again, whether it succeeded or was given up.
+func (h *Handler) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := h.svc.RedeliverWebhook(r.Context(), r.PathValue("id")); err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusAccepted, map[string]string{"status": model.WebhookPending})
+}
+
+// ListTransactions supports resource_type, from/to (RFC 3339), min_amount/max_amount,
+// metadata.<key>=<value>, cursor and limit query parameters. A parameter that does not
+// parse is a validation error; others carry the status of their code.
+func (h *Handler) ListTransactions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := model.TransactionFilter{
+		AccountID:    r.PathValue("id"),
+		ResourceType: q.Get("resource_type"),
+		Cursor:       q.Get("cursor"),
+	}
+
+	var err error
+	if filter.From, err = parseTimeParam(q.Get("from")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_from"))
+		return
+	}
+	if filter.To, err = parseTimeParam(q.Get("to")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_to"))
+		return
+	}
+	if filter.MinAmount, err = parseIntParam(q.Get("min_amount")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_min_amount"))
+		return
+	}
+	if filter.MaxAmount, err = parseIntParam(q.Get("max_amount")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_max_amount"))
+		return
+	}
+	if limit, err := parseIntParam(q.Get("limit")); err != nil {
+		h.respondError(w, apperr.Validation("invalid_limit"))
+		return
+	} else if limit != nil {
+		filter.Limit = int(*limit)
+	}
+	for key, values := range q {
+		if name, ok := strings.CutPrefix(key, "metadata."); ok && name != "" {
+			if filter.Metadata == nil {
+				filter.Metadata = map[string]string{}
+			}
+			filter.Metadata[name] = values[0]
+		}
+	}
+
+	page, err := h.svc.ListTransactions(r.Context(), filter)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+	h.respondJSON(w, http.StatusOK, page)
+}
+
+// WatchBalances streams the account's balance events as Server-Sent Events. Each event
+// carries its offset as the SSE id, so a reconnecting EventSource resumes through the
+// Last-Event-ID header; other clients can pass ?offset= instead.
+func (h *Handler) WatchBalances(w http.ResponseWriter, r *http.Request) {
+	offset := r.URL.Query().Get("offset")
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		offset = lastID
+	}
+	events, err := h.svc.WatchBalances(r.Context(), []string{r.PathValue("id")}, offset)
+	if err != nil {
+		h.respondError(w, err)
+		return
+	}
+
+	// The stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.Offset, e.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// idempotencyKey returns the request's idempotency key from the Idempotency-Key header or
+// the idempotency_key body field. When both are set they must agree.
+func idempotencyKey(r *http.Request, bodyKey string) (string, error) {
+	headerKey := r.Header.Get(HeaderIdempotencyKey)
+	if headerKey != "" && bodyKey != "" && headerKey != bodyKey {
+		return "", apperr.Validation("Idempotency-Key header and idempotency_key differ")
+	}
+	if headerKey != "" {
+		return headerKey, nil
+	}
+	return bodyKey, nil
+}
+
+func parseTimeParam(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func parseIntParam(v string) (*int64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
 func (h *Handler) respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -110,6 +669,11 @@ func (h *Handler) respondJSON(w http.ResponseWriter, status int, data interface{
 	}
 }
 
-func (h *Handler) respondError(w http.ResponseWriter, status int, message string) {
-	h.respondJSON(w, status, map[string]string{"error": message})
+// respondError writes the machine-readable error body with the HTTP status of its code.
+// Internal errors are logged, as their body does not carry the error.
+func (h *Handler) respondError(w http.ResponseWriter, err error) {
+	if apperr.CodeOf(err) == apperr.CodeInternal {
+		slog.Error("http: request failed", "error", err)
+	}
+	h.respondJSON(w, apperr.HTTPStatus(err), apperr.BodyOf(err))
 }
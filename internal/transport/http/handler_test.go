@@ -0,0 +1,134 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+	"quantlo/internal/repository"
+)
+
+func TestHandler_ErrorResponses(t *testing.T) {
+	mux := http.NewServeMux()
+	NewHandler(repository.NewMemoryLedger(nil)).Register(mux)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	if rec := do("POST", "/accounts", `{"account_id":"user123","resource_type":"api_credits","initial_amount":10}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+
+	spend := `{"account_id":"user123","resource_type":"api_credits","amount":1,"idempotency_key":"req-ok"}`
+	if rec := do("POST", "/spend", spend); rec.Code != http.StatusOK || rec.Header().Get(HeaderIdempotentReplay) != "" {
+		t.Fatalf("expected a fresh 200, got %d with replay header %q", rec.Code, rec.Header().Get(HeaderIdempotentReplay))
+	}
+	if rec := do("POST", "/spend", spend); rec.Code != http.StatusOK || rec.Header().Get(HeaderIdempotentReplay) != "true" {
+		t.Errorf("expected a replayed 200, got %d with replay header %q", rec.Code, rec.Header().Get(HeaderIdempotentReplay))
+	}
+
+	recharge := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/recharge", strings.NewReader(`{"account_id":"user123","resource_type":"api_credits","amount":5}`))
+		req.Header.Set(HeaderIdempotencyKey, key)
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	if first, retry := recharge("payment-1"), recharge("payment-1"); first.Code != http.StatusOK || retry.Code != http.StatusOK {
+		t.Fatalf("expected both recharges to succeed, got %d and %d", first.Code, retry.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/recharge", strings.NewReader(`{"account_id":"user123","resource_type":"api_credits","amount":5,"idempotency_key":"payment-2"}`))
+	req.Header.Set(HeaderIdempotencyKey, "payment-3")
+	if mux.ServeHTTP(rec, req); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for mismatched idempotency keys, got %d", rec.Code)
+	}
+
+	tests := []struct {
+		name, method, target, body string
+		status                     int
+		code                       apperr.Code
+	}{
+		{"duplicate account", "POST", "/accounts", `{"account_id":"user123","resource_type":"api_credits"}`, http.StatusConflict, apperr.CodeAccountExists},
+		{"unknown account", "GET", "/balance?account_id=ghost&resource_type=api_credits", "", http.StatusNotFound, apperr.CodeAccountNotFound},
+		{"recharge unknown account", "POST", "/recharge", `{"account_id":"ghost","resource_type":"api_credits","amount":5}`, http.StatusNotFound, apperr.CodeAccountNotFound},
+		{"insufficient funds", "POST", "/spend", `{"account_id":"user123","resource_type":"api_credits","amount":15,"idempotency_key":"req-1"}`, http.StatusUnprocessableEntity, apperr.CodeInsufficientFunds},
+		{"reused idempotency key", "POST", "/spend", `{"account_id":"user123","resource_type":"api_credits","amount":2,"idempotency_key":"req-ok"}`, http.StatusUnprocessableEntity, apperr.CodeIdempotencyConflict},
+		{"non-positive spend", "POST", "/spend", `{"account_id":"user123","resource_type":"api_credits","amount":0,"idempotency_key":"req-2"}`, http.StatusBadRequest, apperr.CodeValidationFailed},
+		{"bad json", "POST", "/spend", `{`, http.StatusBadRequest, apperr.CodeValidationFailed},
+		{"plain http webhook", "POST", "/webhooks", `{"url":"http://example.com/hook","event_types":["spend"]}`, http.StatusBadRequest, apperr.CodeValidationFailed},
+		{"unknown webhook event", "POST", "/webhooks", `{"url":"https://example.com/hook","event_types":["payout"]}`, http.StatusBadRequest, apperr.CodeValidationFailed},
+		{"unknown webhook", "GET", "/webhooks/ghost/deliveries", "", http.StatusNotFound, apperr.CodeNotFound},
+		{"bad quota schedule", "POST", "/quotas", `{"account_id":"user123","resource_type":"api_credits","mode":"refill_to","amount":100,"cron":"0 0 32 * *"}`, http.StatusBadRequest, apperr.CodeValidationFailed},
+		{"quota for unknown account", "POST", "/quotas", `{"account_id":"ghost","resource_type":"api_credits","mode":"add","amount":100,"interval_seconds":3600}`, http.StatusNotFound, apperr.CodeAccountNotFound},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.target, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, rec.Code)
+		}
+		var body apperr.Body
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: invalid error body: %v", tt.name, err)
+		}
+		if body.Code != tt.code || body.Error == "" {
+			t.Errorf("%s: expected code %s with a message, got %+v", tt.name, tt.code, body)
+		}
+	}
+}
+
+func TestHandler_WatchBalancesStreamsEvents(t *testing.T) {
+	ledger := repository.NewMemoryLedger(nil)
+	mux := http.NewServeMux()
+	NewHandler(ledger).Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/accounts/user123/events", nil)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); res.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", res.StatusCode, ct)
+	}
+
+	if err := ledger.CreateAccount(ctx, "user123", "api_credits", 10, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := bufio.NewScanner(res.Body)
+	var got []string
+	for len(got) < 3 && lines.Scan() {
+		got = append(got, lines.Text())
+	}
+	if len(got) != 3 || got[1] != "event: account_created" || !strings.HasPrefix(got[2], "data: ") {
+		t.Fatalf("unexpected event %q", got)
+	}
+	var event model.BalanceEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(got[2], "data: ")), &event); err != nil || event.Balance != 10 {
+		t.Errorf("unexpected event data %s: %v", got[2], err)
+	}
+	if got[0] != "id: "+event.Offset {
+		t.Errorf("expected the event's offset as its ID, got %q", got[0])
+	}
+
+	// A bad offset is refused before the stream starts.
+	rec := httptest.NewRecorder()
+	bad := httptest.NewRequest("GET", "/accounts/user123/events", nil)
+	bad.Header.Set("Last-Event-ID", "not-an-offset")
+	if mux.ServeHTTP(rec, bad); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad Last-Event-ID, got %d", rec.Code)
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"quantlo/internal/service"
 	"time"
@@ -16,15 +17,20 @@ func NewServer(addr string, svc service.LedgerService) *Server {
 	h := NewHandler(svc)
 	h.Register(mux)
 
-	return &Server{
-		srv: &http.Server{
-			Addr:         addr,
-			Handler:      mux,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
-			IdleTimeout:  120 * time.Second,
-		},
+	// Requests share a context that is cancelled on shutdown, so open event streams end
+	// instead of holding Shutdown up.
+	base, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return base },
 	}
+	srv.RegisterOnShutdown(cancel)
+
+	return &Server{srv: srv}
 }
 
 func (s *Server) Start(ctx context.Context) error {
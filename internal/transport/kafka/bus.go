@@ -0,0 +1,90 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// Topics are the Kafka topics the worker consumes.
+var Topics = []string{"transactions.created", "transfers.created"}
+
+// publishTimeout bounds how long a publish waits for the brokers to acknowledge it.
+const publishTimeout = 5 * time.Second
+
+// Writer is the part of *kafkago.Writer the bus uses, so tests can replace the brokers.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+// Reader is the part of *kafkago.Reader the worker uses, so tests can replace the brokers.
+type Reader interface {
+	FetchMessage(ctx context.Context) (kafkago.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+// NewWriter returns a writer that hashes message keys onto partitions and waits for all
+// in-sync replicas, so a published event is durable and lands on its account's partition.
+func NewWriter(brokers []string) *kafkago.Writer {
+	return &kafkago.Writer{
+		Addr:                   kafkago.TCP(brokers...),
+		Balancer:               &kafkago.Hash{},
+		RequiredAcks:           kafkago.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// NewReader returns a consumer-group reader for the event topics. Offsets are only
+// committed explicitly, once an event is persisted.
+func NewReader(brokers []string, groupID string) *kafkago.Reader {
+	return kafkago.NewReader(kafkago.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     groupID,
+		GroupTopics: Topics,
+		StartOffset: kafkago.FirstOffset,
+	})
+}
+
+// Bus publishes events to Kafka, keyed by account so that all events of one account go
+// to the same partition and are consumed in the order they were published.
+type Bus struct {
+	w Writer
+}
+
+func NewBus(w Writer) *Bus {
+	return &Bus{w: w}
+}
+
+func (b *Bus) Publish(topic string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	return b.w.WriteMessages(ctx, kafkago.Message{
+		Topic: topic,
+		Key:   messageKey(data),
+		Value: data,
+	})
+}
+
+// messageKey is the account the event belongs to. A transfer is keyed by the account it
+// debits, since that side is the one that could be overdrawn.
+func messageKey(data []byte) []byte {
+	var event struct {
+		AccountID     string `json:"account_id"`
+		FromAccountID string `json:"from_account_id"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil
+	}
+	if event.AccountID != "" {
+		return []byte(event.AccountID)
+	}
+	if event.FromAccountID != "" {
+		return []byte(event.FromAccountID)
+	}
+	return nil
+}
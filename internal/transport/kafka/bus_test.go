@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+type fakeWriter struct {
+	msgs []kafkago.Message
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+func TestBus_PublishKeysByAccount(t *testing.T) {
+	w := &fakeWriter{}
+	bus := NewBus(w)
+
+	events := []struct {
+		topic string
+		data  string
+		key   string
+	}{
+		{"transactions.created", `{"account_id":"user123","idempotency_key":"req-1","amount":10}`, "user123"},
+		{"transfers.created", `{"from_account_id":"user123","to_account_id":"user456","amount":5}`, "user123"},
+		{"transactions.created", `not json`, ""},
+	}
+	for _, e := range events {
+		if err := bus.Publish(e.topic, []byte(e.data)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(w.msgs) != len(events) {
+		t.Fatalf("expected %d messages, got %d", len(events), len(w.msgs))
+	}
+	for i, e := range events {
+		msg := w.msgs[i]
+		if msg.Topic != e.topic || string(msg.Key) != e.key || string(msg.Value) != e.data {
+			t.Errorf("message %d: expected %s/%q, got %s/%q", i, e.topic, e.key, msg.Topic, msg.Key)
+		}
+	}
+}
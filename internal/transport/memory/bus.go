@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrBusClosed = errors.New("memory bus is closed")
+
+// Message is an event delivered to a subscriber.
+type Message struct {
+	Topic string
+	Data  []byte
+}
+
+// Bus is an in-process message bus. Every subscriber of a topic gets its own copy of each
+// message published to it, in publish order. A subscriber whose buffer is full holds up
+// publishers until it catches up, so no message is dropped.
+type Bus struct {
+	mu        sync.RWMutex
+	subs      map[string][]*Subscription
+	buffer    int
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewBus(buffer int) *Bus {
+	return &Bus{
+		subs:   make(map[string][]*Subscription),
+		buffer: buffer,
+		done:   make(chan struct{}),
+	}
+}
+
+// Subscription receives the messages of one topic until it is unsubscribed or the bus closes.
+type Subscription struct {
+	bus   *Bus
+	topic string
+	ch    chan Message
+	// done is closed first when the subscription ends, to release a publisher waiting on it.
+	done     chan struct{}
+	doneOnce sync.Once
+	once     sync.Once
+}
+
+// C returns the channel messages are delivered on; it is closed when the subscription ends.
+func (s *Subscription) C() <-chan Message {
+	return s.ch
+}
+
+// Unsubscribe stops delivery and closes the subscription's channel.
+func (s *Subscription) Unsubscribe() {
+	s.doneOnce.Do(func() { close(s.done) })
+
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	subs := s.bus.subs[s.topic]
+	for i, sub := range subs {
+		if sub == s {
+			s.bus.subs[s.topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	s.close()
+}
+
+func (s *Subscription) close() {
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Subscribe starts receiving the messages published to topic from now on.
+func (b *Bus) Subscribe(topic string) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	sub := &Subscription{bus: b, topic: topic, ch: make(chan Message, b.buffer), done: make(chan struct{})}
+	b.subs[topic] = append(b.subs[topic], sub)
+	return sub, nil
+}
+
+// Publish implements repository.MessageBus. A topic nobody subscribes to drops the message.
+func (b *Bus) Publish(topic string, data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	// Subscribers may keep the data, so each gets a copy the publisher can not change.
+	for _, sub := range b.subs[topic] {
+		select {
+		case sub.ch <- Message{Topic: topic, Data: append([]byte(nil), data...)}:
+		case <-sub.done:
+		case <-b.done:
+			return ErrBusClosed
+		}
+	}
+	return nil
+}
+
+// Close ends every subscription; publishing afterwards fails with ErrBusClosed.
+func (b *Bus) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for topic, subs := range b.subs {
+		for _, sub := range subs {
+			sub.close()
+		}
+		delete(b.subs, topic)
+	}
+}
@@ -0,0 +1,45 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBus_FansOutByTopic(t *testing.T) {
+	bus := NewBus(4)
+	first, _ := bus.Subscribe("transactions.created")
+	second, _ := bus.Subscribe("transactions.created")
+	other, _ := bus.Subscribe("transfers.created")
+
+	if err := bus.Publish("transactions.created", []byte(`{"amount":10}`)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, sub := range []*Subscription{first, second} {
+		msg := <-sub.C()
+		if msg.Topic != "transactions.created" || string(msg.Data) != `{"amount":10}` {
+			t.Errorf("unexpected message %s %s", msg.Topic, msg.Data)
+		}
+	}
+	if len(other.C()) != 0 {
+		t.Error("expected no message on another topic")
+	}
+}
+
+func TestBus_UnsubscribeAndClose(t *testing.T) {
+	bus := NewBus(1)
+	sub, _ := bus.Subscribe("transactions.created")
+	sub.Unsubscribe()
+
+	if _, ok := <-sub.C(); ok {
+		t.Error("expected the channel to be closed after unsubscribing")
+	}
+	if err := bus.Publish("transactions.created", []byte("x")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bus.Close()
+	if err := bus.Publish("transactions.created", []byte("x")); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("expected ErrBusClosed, got %v", err)
+	}
+}
@@ -12,4 +12,4 @@ func NewBus(nc *nats.Conn) *Bus {
 
 func (b *Bus) Publish(topic string, data []byte) error {
 	return b.nc.Publish(topic, data)
-}
\ No newline at end of file
+}
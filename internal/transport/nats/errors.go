@@ -0,0 +1,25 @@
+package nats
+
+import (
+	"encoding/json"
+	"log/slog"
+	"quantlo/internal/apperr"
+	"strconv"
+
+	"github.com/nats-io/nats.go/micro"
+)
+
+// replyError answers a command sent as a request with the machine-readable error body.
+// As with any nats.go/micro service error, Nats-Service-Error-Code is numeric: the HTTP
+// status of the error. Nats-Service-Error is the description, the domain error code
+// followed by the message. Commands published without a reply subject get no answer.
+func replyError(req micro.Request, err error) {
+	if req.Reply() == "" {
+		return
+	}
+	body := apperr.BodyOf(err)
+	data, _ := json.Marshal(body)
+	if err := req.Error(strconv.Itoa(apperr.HTTPStatus(err)), string(body.Code)+": "+body.Error, data); err != nil {
+		slog.Error("nats: failed to reply with error", "subject", req.Subject(), "error", err)
+	}
+}
@@ -4,70 +4,293 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
+	"quantlo/internal/apperr"
 	"quantlo/internal/model"
 	"quantlo/internal/service"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
 )
 
-// Handler subscribes to NATS command topics and delegates to the ledger service.
+// ServiceName and ServiceVersion identify the command handler to NATS service discovery
+// ($SRV.PING, $SRV.INFO and $SRV.STATS), e.g. `nats micro info quantlo-ledger`.
+const (
+	ServiceName    = "quantlo-ledger"
+	ServiceVersion = "1.0.0"
+
+	// HeaderIdempotentReplay marks a reply that replays the result of an earlier request
+	// with the same idempotency key instead of processing it again.
+	HeaderIdempotentReplay = "X-Idempotent-Replay"
+
+	// HeaderIdempotencyKey may carry a command's idempotency key instead of its idempotency_key field.
+	HeaderIdempotencyKey = "Idempotency-Key"
+)
+
+// Handler serves the commands.* subjects as a nats.go/micro service and delegates to the
+// ledger service. A command sent as a request gets its result, or a structured error,
+// as the reply; a command published without a reply subject is executed silently.
 type Handler struct {
-	svc  service.LedgerService
-	nc   *nats.Conn
-	subs []*nats.Subscription
+	svc service.LedgerService
+	nc  *nats.Conn
+	srv micro.Service
 }
 
 func NewHandler(svc service.LedgerService, nc *nats.Conn) *Handler {
 	return &Handler{svc: svc, nc: nc}
 }
 
-// Start subscribes to command topics and blocks until ctx is cancelled (graceful shutdown).
+// accountCommand is the body of the balance, create_account and delete_account commands.
+type accountCommand struct {
+	AccountID      string `json:"account_id"`
+	ResourceType   string `json:"resource_type"`
+	InitialAmount  int64  `json:"initial_amount"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// Start registers the command endpoints and blocks until ctx is cancelled (graceful shutdown).
 func (h *Handler) Start(ctx context.Context) error {
-	s1, err := h.nc.QueueSubscribe("commands.spend", "ledger_group", func(m *nats.Msg) {
-		var req model.SpendRequest
-		if err := json.Unmarshal(m.Data, &req); err != nil {
-			slog.Error("nats: failed to unmarshal spend command", "error", err)
-			return
-		}
-		if _, err := h.svc.Spend(ctx, req); err != nil {
-			slog.Error("nats: spend failed", "error", err, "account_id", req.AccountID)
-		}
+	srv, err := micro.AddService(h.nc, micro.Config{
+		Name:        ServiceName,
+		Version:     ServiceVersion,
+		Description: "Quantlo ledger commands",
+		// Keep the queue group of the earlier plain subscriptions so mixed deployments share work.
+		QueueGroup: "ledger_group",
 	})
 	if err != nil {
 		return err
 	}
-	h.subs = append(h.subs, s1)
+	h.srv = srv
 
-	s2, err := h.nc.QueueSubscribe("commands.recharge", "ledger_group", func(m *nats.Msg) {
-		var req model.RechargeRequest
-		if err := json.Unmarshal(m.Data, &req); err != nil {
-			slog.Error("nats: failed to unmarshal recharge command", "error", err)
-			return
-		}
-		if err := h.svc.Recharge(ctx, req); err != nil {
-			slog.Error("nats: recharge failed", "error", err, "account_id", req.AccountID)
+	commands := srv.AddGroup("commands")
+	endpoints := map[string]func(context.Context, micro.Request){
+		"spend":          h.spend,
+		"recharge":       h.recharge,
+		"authorize":      h.authorize,
+		"capture":        h.capture,
+		"void":           h.void,
+		"transfer":       h.transfer,
+		"refund":         h.refund,
+		"balance":        h.balance,
+		"create_account": h.createAccount,
+		"delete_account": h.deleteAccount,
+	}
+	for name, handle := range endpoints {
+		if err := commands.AddEndpoint(name, micro.ContextHandler(ctx, handle)); err != nil {
+			_ = srv.Stop()
+			return err
 		}
-	})
-	if err != nil {
-		return err
 	}
-	h.subs = append(h.subs, s2)
 
-	slog.Info("NATS command handler is running")
+	slog.Info("NATS command handler is running", "service", ServiceName)
 
 	// Block until context is cancelled.
 	<-ctx.Done()
 	slog.Info("NATS command handler shutting down, draining subscriptions...")
 
-	for _, s := range h.subs {
-		_ = s.Drain()
-	}
-	return nil
+	return srv.Stop()
 }
 
 func (h *Handler) Stop(ctx context.Context) error {
-	for _, s := range h.subs {
-		_ = s.Unsubscribe()
+	if h.srv == nil {
+		return nil
+	}
+	return h.srv.Stop()
+}
+
+func (h *Handler) spend(ctx context.Context, req micro.Request) {
+	var cmd model.SpendRequest
+	if !decode(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.IdempotencyKey) {
+		return
+	}
+	res, err := h.svc.Spend(ctx, cmd)
+	var opts []micro.RespondOpt
+	if err != nil {
+		slog.Error("nats: spend failed", "error", err, "account_id", cmd.AccountID)
+	} else if res.Replayed {
+		opts = append(opts, micro.WithHeaders(micro.Headers{HeaderIdempotentReplay: []string{"true"}}))
+	}
+	respond(req, res, err, opts...)
+}
+
+func (h *Handler) recharge(ctx context.Context, req micro.Request) {
+	var cmd model.RechargeRequest
+	if !decode(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.IdempotencyKey) {
+		return
+	}
+	err := h.svc.Recharge(ctx, cmd)
+	if err != nil {
+		slog.Error("nats: recharge failed", "error", err, "account_id", cmd.AccountID)
+	}
+	respond(req, map[string]string{"status": "SUCCESS"}, err)
+}
+
+func (h *Handler) authorize(ctx context.Context, req micro.Request) {
+	var cmd model.AuthorizeRequest
+	if !decode(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.IdempotencyKey) {
+		return
+	}
+	res, err := h.svc.Authorize(ctx, cmd)
+	if err != nil {
+		slog.Error("nats: authorize failed", "error", err, "account_id", cmd.AccountID)
+	}
+	respond(req, res, err)
+}
+
+func (h *Handler) capture(ctx context.Context, req micro.Request) {
+	var cmd model.CaptureRequest
+	if !decode(req, &cmd) {
+		return
+	}
+	res, err := h.svc.Capture(ctx, cmd)
+	if err != nil {
+		slog.Error("nats: capture failed", "error", err, "hold_id", cmd.HoldID)
+	}
+	respond(req, res, err)
+}
+
+func (h *Handler) void(ctx context.Context, req micro.Request) {
+	var cmd struct {
+		HoldID string `json:"hold_id"`
+	}
+	if !decode(req, &cmd) {
+		return
+	}
+	res, err := h.svc.Void(ctx, cmd.HoldID)
+	if err != nil {
+		slog.Error("nats: void failed", "error", err, "hold_id", cmd.HoldID)
+	}
+	respond(req, res, err)
+}
+
+func (h *Handler) transfer(ctx context.Context, req micro.Request) {
+	var cmd model.TransferRequest
+	if !decode(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.IdempotencyKey) {
+		return
+	}
+	res, err := h.svc.Transfer(ctx, cmd.FromAccountID, cmd.ToAccountID, cmd.ResourceType, cmd.Amount, cmd.IdempotencyKey)
+	if err != nil {
+		slog.Error("nats: transfer failed", "error", err, "from", cmd.FromAccountID, "to", cmd.ToAccountID)
+	}
+	respond(req, res, err)
+}
+
+func (h *Handler) refund(ctx context.Context, req micro.Request) {
+	var cmd model.RefundRequest
+	if !decode(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.RefundIdempotencyKey) {
+		return
+	}
+	res, err := h.svc.Refund(ctx, cmd.IdempotencyKey, cmd.Amount, cmd.RefundIdempotencyKey)
+	if err != nil {
+		slog.Error("nats: refund failed", "error", err, "key", cmd.IdempotencyKey)
+	}
+	respond(req, res, err)
+}
+
+func (h *Handler) balance(ctx context.Context, req micro.Request) {
+	var cmd accountCommand
+	if !decodeAccount(req, &cmd) {
+		return
+	}
+	bal, err := h.svc.GetBalance(ctx, cmd.AccountID, cmd.ResourceType)
+	respond(req, map[string]interface{}{
+		"account_id":    cmd.AccountID,
+		"resource_type": cmd.ResourceType,
+		"balance":       bal,
+	}, err)
+}
+
+func (h *Handler) createAccount(ctx context.Context, req micro.Request) {
+	var cmd accountCommand
+	if !decodeAccount(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.IdempotencyKey) {
+		return
+	}
+	err := h.svc.CreateAccount(ctx, cmd.AccountID, cmd.ResourceType, cmd.InitialAmount, cmd.IdempotencyKey)
+	if err != nil {
+		slog.Error("nats: create account failed", "error", err, "account_id", cmd.AccountID)
+	}
+	respond(req, map[string]string{"status": "created"}, err)
+}
+
+func (h *Handler) deleteAccount(ctx context.Context, req micro.Request) {
+	var cmd accountCommand
+	if !decodeAccount(req, &cmd) {
+		return
+	}
+	if !idempotencyKey(req, &cmd.IdempotencyKey) {
+		return
+	}
+	err := h.svc.DeleteAccount(ctx, cmd.AccountID, cmd.ResourceType, cmd.IdempotencyKey)
+	if err != nil {
+		slog.Error("nats: delete account failed", "error", err, "account_id", cmd.AccountID)
+	}
+	respond(req, map[string]string{"status": "deleted"}, err)
+}
+
+// decode unmarshals a command body, answering with a validation error when it does not decode.
+func decode(req micro.Request, v interface{}) bool {
+	if err := json.Unmarshal(req.Data(), v); err != nil {
+		slog.Error("nats: failed to unmarshal command", "subject", req.Subject(), "error", err)
+		replyError(req, apperr.Validation("invalid_json"))
+		return false
+	}
+	return true
+}
+
+// decodeAccount decodes an account command, which must name both the account and the resource type.
+func decodeAccount(req micro.Request, cmd *accountCommand) bool {
+	if !decode(req, cmd) {
+		return false
+	}
+	if cmd.AccountID == "" || cmd.ResourceType == "" {
+		replyError(req, apperr.Validation("account_id and resource_type are required"))
+		return false
+	}
+	return true
+}
+
+// idempotencyKey fills in the command's idempotency key from the Idempotency-Key header when
+// the body has none. As over HTTP, a header and body that disagree are answered with a
+// validation error.
+func idempotencyKey(req micro.Request, bodyKey *string) bool {
+	headerKey := nats.Header(req.Headers()).Get(HeaderIdempotencyKey)
+	if headerKey != "" && *bodyKey != "" && headerKey != *bodyKey {
+		replyError(req, apperr.Validation("Idempotency-Key header and idempotency_key differ"))
+		return false
+	}
+	if headerKey != "" {
+		*bodyKey = headerKey
+	}
+	return true
+}
+
+// respond replies with the JSON result, or with the error when err is set.
+func respond(req micro.Request, result interface{}, err error, opts ...micro.RespondOpt) {
+	if err != nil {
+		replyError(req, err)
+		return
+	}
+	if req.Reply() == "" {
+		return
+	}
+	if err := req.RespondJSON(result, opts...); err != nil {
+		slog.Error("nats: failed to reply", "subject", req.Subject(), "error", err)
 	}
-	return nil
 }
@@ -0,0 +1,119 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"quantlo/internal/apperr"
+	"quantlo/internal/model"
+	"quantlo/internal/repository"
+
+	"github.com/nats-io/nats.go/micro"
+)
+
+// fakeRequest records the reply a handler sends.
+type fakeRequest struct {
+	data        []byte
+	headers     micro.Headers
+	reply       string
+	response    []byte
+	errorCode   string
+	description string
+}
+
+func (r *fakeRequest) Respond(data []byte, _ ...micro.RespondOpt) error {
+	r.response = data
+	return nil
+}
+func (r *fakeRequest) RespondJSON(v any, _ ...micro.RespondOpt) error {
+	r.response, _ = json.Marshal(v)
+	return nil
+}
+func (r *fakeRequest) Error(code, description string, data []byte, _ ...micro.RespondOpt) error {
+	r.errorCode, r.description, r.response = code, description, data
+	return nil
+}
+func (r *fakeRequest) Data() []byte           { return r.data }
+func (r *fakeRequest) Headers() micro.Headers { return r.headers }
+func (r *fakeRequest) Subject() string        { return "commands.test" }
+func (r *fakeRequest) Reply() string          { return r.reply }
+
+func request(body string) *fakeRequest {
+	return &fakeRequest{data: []byte(body), reply: "_INBOX.test"}
+}
+
+func TestHandler_RepliesWithResult(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(repository.NewMemoryLedger(nil), nil)
+
+	create := request(`{"account_id":"user123","resource_type":"api_credits","initial_amount":100}`)
+	h.createAccount(ctx, create)
+	if create.errorCode != "" {
+		t.Fatalf("unexpected error reply: %s", create.response)
+	}
+
+	spend := request(`{"account_id":"user123","resource_type":"api_credits","amount":30,"idempotency_key":"req-1"}`)
+	h.spend(ctx, spend)
+	var res model.SpendResult
+	if err := json.Unmarshal(spend.response, &res); err != nil {
+		t.Fatalf("invalid reply: %v", err)
+	}
+	if res.NewBalance != 70 {
+		t.Errorf("expected new balance 70, got %d", res.NewBalance)
+	}
+
+	balance := request(`{"account_id":"user123","resource_type":"api_credits"}`)
+	h.balance(ctx, balance)
+	var bal struct {
+		Balance int64 `json:"balance"`
+	}
+	if err := json.Unmarshal(balance.response, &bal); err != nil || bal.Balance != 70 {
+		t.Errorf("expected balance 70, got %s", balance.response)
+	}
+}
+
+func TestHandler_RepliesWithError(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(repository.NewMemoryLedger(nil), nil)
+
+	tests := []struct {
+		name   string
+		handle func(context.Context, micro.Request)
+		body   string
+		status string
+		code   apperr.Code
+	}{
+		{"unknown account", h.spend, `{"account_id":"ghost","resource_type":"api_credits","amount":1,"idempotency_key":"req-1"}`, "404", apperr.CodeAccountNotFound},
+		{"bad json", h.recharge, `{`, "400", apperr.CodeValidationFailed},
+		{"missing account", h.deleteAccount, `{"resource_type":"api_credits"}`, "400", apperr.CodeValidationFailed},
+	}
+	for _, tt := range tests {
+		req := request(tt.body)
+		tt.handle(ctx, req)
+		if req.errorCode != tt.status || !strings.HasPrefix(req.description, string(tt.code)+": ") {
+			t.Errorf("%s: expected error code %s with %s in the description, got %q %q", tt.name, tt.status, tt.code, req.errorCode, req.description)
+		}
+		var body apperr.Body
+		if err := json.Unmarshal(req.response, &body); err != nil || body.Code != tt.code {
+			t.Errorf("%s: expected an error body with %s, got %s", tt.name, tt.code, req.response)
+		}
+	}
+
+	// An Idempotency-Key header that disagrees with the body is refused, as over HTTP.
+	req := request(`{"account_id":"user123","resource_type":"api_credits","amount":1,"idempotency_key":"req-1"}`)
+	req.headers = micro.Headers{HeaderIdempotencyKey: []string{"req-2"}}
+	h.recharge(ctx, req)
+	if req.errorCode != "400" || !strings.HasPrefix(req.description, string(apperr.CodeValidationFailed)) {
+		t.Errorf("expected error code 400 with %s for differing keys, got %q %q", apperr.CodeValidationFailed, req.errorCode, req.description)
+	}
+
+	// Without a reply subject the command runs but nothing is sent back.
+	req = request(`{"account_id":"ghost","resource_type":"api_credits","amount":1}`)
+	req.reply = ""
+	h.recharge(ctx, req)
+	if req.response != nil || req.errorCode != "" {
+		t.Errorf("expected no reply, got %s", req.response)
+	}
+}
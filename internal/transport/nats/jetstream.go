@@ -0,0 +1,73 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// StreamName is the JetStream stream that stores every event the worker persists.
+const StreamName = "LEDGER"
+
+// StreamSubjects are the topics captured by the stream; other topics stay on core NATS.
+var StreamSubjects = []string{"transactions.created", "transfers.created"}
+
+// publishTimeout bounds how long a publish waits for the stream to acknowledge it.
+const publishTimeout = 5 * time.Second
+
+// duplicateWindow is how long JetStream remembers a Nats-Msg-Id to drop a republished event.
+const duplicateWindow = 10 * time.Minute
+
+// EnsureStream creates the ledger stream, or updates it to the current configuration.
+func EnsureStream(ctx context.Context, js jetstream.JetStream) (jetstream.Stream, error) {
+	return js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       StreamName,
+		Subjects:   StreamSubjects,
+		Storage:    jetstream.FileStorage,
+		Duplicates: duplicateWindow,
+	})
+}
+
+// JetStreamBus publishes events to the ledger stream and waits for the stream to store them.
+// The idempotency key of the event becomes its Nats-Msg-Id, so an event published twice
+// within the duplicate window is stored once.
+type JetStreamBus struct {
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+func NewJetStreamBus(nc *nats.Conn, js jetstream.JetStream) *JetStreamBus {
+	return &JetStreamBus{nc: nc, js: js}
+}
+
+func (b *JetStreamBus) Publish(topic string, data []byte) error {
+	if !slices.Contains(StreamSubjects, topic) {
+		return b.nc.Publish(topic, data)
+	}
+
+	var opts []jetstream.PublishOpt
+	if id := msgID(topic, data); id != "" {
+		opts = append(opts, jetstream.WithMsgID(id))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	_, err := b.js.Publish(ctx, topic, data, opts...)
+	return err
+}
+
+// msgID derives the deduplication ID from the event's idempotency key.
+func msgID(topic string, data []byte) string {
+	var event struct {
+		IdempotencyKey string `json:"idempotency_key"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil || event.IdempotencyKey == "" {
+		return ""
+	}
+	return topic + ":" + event.IdempotencyKey
+}
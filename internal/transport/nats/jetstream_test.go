@@ -0,0 +1,16 @@
+package nats
+
+import "testing"
+
+func TestMsgID(t *testing.T) {
+	data := []byte(`{"account_id":"user123","idempotency_key":"req-1","amount":10}`)
+	if got := msgID("transactions.created", data); got != "transactions.created:req-1" {
+		t.Errorf("expected transactions.created:req-1, got %q", got)
+	}
+
+	for _, data := range []string{`{"account_id":"user123"}`, `not json`} {
+		if got := msgID("transactions.created", []byte(data)); got != "" {
+			t.Errorf("%s: expected no message ID, got %q", data, got)
+		}
+	}
+}
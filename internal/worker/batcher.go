@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"quantlo/internal/service"
+)
+
+// batchFlushTimeout bounds the flush of the last batch on shutdown, when ctx is already done.
+const batchFlushTimeout = 5 * time.Second
+
+// batcher collects events and syncs them in batches of up to size events, or whatever
+// arrived within wait of the first one. A single goroutine flushes, in arrival order,
+// so events of one account are persisted in the order they were received.
+type batcher struct {
+	syncer *service.EventSyncer
+	size   int
+	wait   time.Duration
+	events chan service.Event
+}
+
+func newBatcher(syncer *service.EventSyncer, size int, wait time.Duration) *batcher {
+	return &batcher{
+		syncer: syncer,
+		size:   size,
+		wait:   wait,
+		events: make(chan service.Event, size),
+	}
+}
+
+// add queues an event, blocking while the batcher is behind. An event dropped on shutdown
+// is not lost: its outbox entry is never confirmed, so the relay sends it again.
+func (b *batcher) add(ctx context.Context, e service.Event) {
+	select {
+	case b.events <- e:
+	case <-ctx.Done():
+	}
+}
+
+// run flushes batches until ctx is cancelled, then flushes what is left.
+func (b *batcher) run(ctx context.Context) {
+	batch := make([]service.Event, 0, b.size)
+	timer := time.NewTimer(b.wait)
+	timer.Stop()
+
+	flush := func(ctx context.Context) {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.syncer.SyncBatch(ctx, batch); err != nil {
+			slog.Error("worker: failed to sync batch with postgres", "events", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case e := <-b.events:
+			if len(batch) == 0 {
+				timer.Reset(b.wait)
+			}
+			batch = append(batch, e)
+			if len(batch) >= b.size {
+				flush(ctx)
+			}
+		case <-timer.C:
+			flush(ctx)
+		case <-ctx.Done():
+			for len(b.events) > 0 {
+				batch = append(batch, <-b.events)
+			}
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), batchFlushTimeout)
+			flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"quantlo/internal/service"
+	"time"
+)
+
+// GrantExpirer periodically removes credit lots whose expiry has passed
+// from the account balance.
+type GrantExpirer struct {
+	periodicJob
+	svc service.LedgerService
+}
+
+func NewGrantExpirer(svc service.LedgerService, interval time.Duration) *GrantExpirer {
+	e := &GrantExpirer{svc: svc}
+	e.periodicJob = periodicJob{name: "Grant expirer", interval: interval, tick: e.sweep}
+	return e
+}
+
+// sweep expires the credit grants expired by now.
+func (e *GrantExpirer) sweep(ctx context.Context, now time.Time) error {
+	n, err := e.svc.ExpireGrants(ctx, now)
+	if err != nil {
+		return fmt.Errorf("sweep expired grants: %w", err)
+	}
+	if n > 0 {
+		slog.Info("grant expirer: expired credit grants", "count", n)
+	}
+	return nil
+}
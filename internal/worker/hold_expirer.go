@@ -0,0 +1,34 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"quantlo/internal/service"
+	"time"
+)
+
+// HoldExpirer periodically releases holds whose TTL has passed,
+// returning the reserved funds to the account balance.
+type HoldExpirer struct {
+	periodicJob
+	svc service.LedgerService
+}
+
+func NewHoldExpirer(svc service.LedgerService, interval time.Duration) *HoldExpirer {
+	e := &HoldExpirer{svc: svc}
+	e.periodicJob = periodicJob{name: "Hold expirer", interval: interval, tick: e.sweep}
+	return e
+}
+
+// sweep releases the holds expired by now.
+func (e *HoldExpirer) sweep(ctx context.Context, now time.Time) error {
+	n, err := e.svc.ExpireHolds(ctx, now)
+	if err != nil {
+		return fmt.Errorf("sweep expired holds: %w", err)
+	}
+	if n > 0 {
+		slog.Info("hold expirer: released expired holds", "count", n)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"quantlo/internal/model"
+	"quantlo/internal/service"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// jetStreamAckWait is how long a delivered event may stay unacknowledged before it is redelivered.
+const jetStreamAckWait = 30 * time.Second
+
+// maxRedeliveryDelay caps the backoff between deliveries of a failing event.
+const maxRedeliveryDelay = time.Minute
+
+// JetStreamWorker syncs events from the ledger stream through durable pull consumers.
+// An event is acknowledged only after PostgreSQL has committed it, so a worker that is
+// down or crashes mid-event leaves it in the stream to be delivered again.
+//
+// Failed events are redelivered with exponential backoff; one that fails on its last
+// delivery, or does not decode, is parked as a dead letter.
+type JetStreamWorker struct {
+	svc        service.LedgerService
+	stream     jetstream.Stream
+	maxDeliver int
+	backoff    time.Duration
+}
+
+func NewJetStreamWorker(svc service.LedgerService, stream jetstream.Stream, maxDeliver int, backoff time.Duration) *JetStreamWorker {
+	return &JetStreamWorker{
+		svc:        svc,
+		stream:     stream,
+		maxDeliver: maxDeliver,
+		backoff:    backoff,
+	}
+}
+
+// Run consumes the event subjects and blocks until ctx is cancelled.
+func (w *JetStreamWorker) Run(ctx context.Context) error {
+	consumers := []struct {
+		durable string
+		subject string
+	}{
+		{"ledger-transactions", "transactions.created"},
+		{"ledger-transfers", "transfers.created"},
+	}
+
+	var running []jetstream.ConsumeContext
+	defer func() {
+		for _, cc := range running {
+			cc.Drain()
+		}
+	}()
+
+	for _, c := range consumers {
+		cons, err := w.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       c.durable,
+			FilterSubject: c.subject,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       jetStreamAckWait,
+			MaxDeliver:    w.maxDeliver,
+		})
+		if err != nil {
+			return fmt.Errorf("worker: failed to create consumer %s: %w", c.durable, err)
+		}
+
+		cc, err := cons.Consume(func(msg jetstream.Msg) {
+			w.handle(ctx, msg)
+		})
+		if err != nil {
+			return fmt.Errorf("worker: failed to consume %s: %w", c.subject, err)
+		}
+		running = append(running, cc)
+	}
+
+	slog.Info("JetStream worker is running", "stream", w.stream.CachedInfo().Config.Name, "max_deliver", w.maxDeliver)
+
+	<-ctx.Done()
+	slog.Info("JetStream worker received shutdown signal, draining consumers...")
+	return nil
+}
+
+func (w *JetStreamWorker) handle(ctx context.Context, msg jetstream.Msg) {
+	err := service.SyncEvent(ctx, w.svc, msg.Subject(), msg.Data())
+	if err == nil {
+		if err := msg.Ack(); err != nil {
+			slog.Error("worker: failed to ack event", "subject", msg.Subject(), "error", err)
+		}
+		return
+	}
+
+	delivered := 1
+	if md, mdErr := msg.Metadata(); mdErr == nil {
+		delivered = int(md.NumDelivered)
+	}
+
+	// Redelivering an event that does not decode will never succeed, and after the last
+	// delivery JetStream stops trying: either way the event is parked instead.
+	if errors.Is(err, service.ErrMalformedEvent) || delivered >= w.maxDeliver {
+		if ctx.Err() != nil {
+			_ = msg.Nak()
+			return
+		}
+		slog.Error("worker: parking event as dead letter", "subject", msg.Subject(), "deliveries", delivered, "error", err)
+		parkErr := w.svc.ParkDeadLetter(ctx, model.DeadLetter{
+			Topic:    msg.Subject(),
+			Payload:  string(msg.Data()),
+			Error:    err.Error(),
+			Attempts: delivered,
+		})
+		if parkErr != nil {
+			slog.Error("worker: failed to park event", "subject", msg.Subject(), "error", parkErr)
+			_ = msg.Nak()
+			return
+		}
+		_ = msg.Term()
+		return
+	}
+
+	slog.Error("worker: failed to sync event, will redeliver", "subject", msg.Subject(), "deliveries", delivered, "error", err)
+	_ = msg.NakWithDelay(min(w.backoff<<min(delivered-1, 16), maxRedeliveryDelay))
+}
+
+// Start implements the infrastructure.Server interface.
+func (w *JetStreamWorker) Start(ctx context.Context) error {
+	return w.Run(ctx)
+}
+
+// Stop implements the infrastructure.Server interface (no-op, shutdown is via ctx).
+func (w *JetStreamWorker) Stop(ctx context.Context) error {
+	return nil
+}
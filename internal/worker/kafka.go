@@ -0,0 +1,102 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"quantlo/internal/service"
+	"time"
+
+	transportKafka "quantlo/internal/transport/kafka"
+)
+
+const (
+	// kafkaRetryDelay is how long the kafka worker waits before trying an event it could
+	// neither persist nor park again.
+	kafkaRetryDelay = time.Second
+	// kafkaFetchBackoff is how long the kafka worker waits after a failed fetch, doubled on
+	// each failure in a row up to maxKafkaFetchBackoff.
+	kafkaFetchBackoff    = 100 * time.Millisecond
+	maxKafkaFetchBackoff = 30 * time.Second
+)
+
+// eventSyncer persists or parks one event; it is satisfied by *service.EventSyncer.
+type eventSyncer interface {
+	Sync(ctx context.Context, topic string, payload []byte) error
+}
+
+// KafkaWorker syncs events from the Kafka event topics as a member of a consumer group.
+// Each partition is consumed in order and its offset is committed only after the event is
+// persisted (or parked as a dead letter), so a worker that crashes mid-event leaves it to
+// be consumed again by whichever member takes over the partition.
+type KafkaWorker struct {
+	syncer eventSyncer
+	reader transportKafka.Reader
+}
+
+func NewKafkaWorker(syncer *service.EventSyncer, reader transportKafka.Reader) *KafkaWorker {
+	return &KafkaWorker{
+		syncer: syncer,
+		reader: reader,
+	}
+}
+
+// Run consumes the event topics and blocks until ctx is cancelled.
+func (w *KafkaWorker) Run(ctx context.Context) error {
+	slog.Info("Kafka worker is running")
+
+	backoff := kafkaFetchBackoff
+	for {
+		msg, err := w.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("Kafka worker received shutdown signal")
+				return nil
+			}
+			// The brokers may be unreachable for a while; syncing resumes once they are back.
+			slog.Error("worker: failed to fetch from kafka, will retry", "error", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxKafkaFetchBackoff)
+			continue
+		}
+		backoff = kafkaFetchBackoff
+
+		// Committing a later offset would skip this event, so it is retried until it is
+		// persisted or parked, holding back the rest of its partition.
+		for {
+			err := w.syncer.Sync(ctx, msg.Topic, msg.Value)
+			if err == nil {
+				break
+			}
+			slog.Error("worker: failed to sync event with postgres", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "error", err)
+			select {
+			case <-ctx.Done():
+				// The offset stays uncommitted, so the event is consumed again after a restart.
+				return nil
+			case <-time.After(kafkaRetryDelay):
+			}
+		}
+
+		if err := w.reader.CommitMessages(ctx, msg); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			// Not fatal: the event is persisted, and syncing it again after a rebalance is a no-op.
+			slog.Error("worker: failed to commit kafka offset", "topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset, "error", err)
+		}
+	}
+}
+
+// Start implements the infrastructure.Server interface.
+func (w *KafkaWorker) Start(ctx context.Context) error {
+	return w.Run(ctx)
+}
+
+// Stop implements the infrastructure.Server interface, leaving the consumer group.
+func (w *KafkaWorker) Stop(ctx context.Context) error {
+	return w.reader.Close()
+}
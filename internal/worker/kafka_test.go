@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// fakeReader is an in-process stand-in for one partition of a consumer group.
+type fakeReader struct {
+	msgs      []kafkago.Message
+	next      int
+	committed []int64
+	cancel    context.CancelFunc
+	// fetchErrs is how many fetches fail before messages are returned.
+	fetchErrs int
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafkago.Message, error) {
+	if r.fetchErrs > 0 {
+		r.fetchErrs--
+		return kafkago.Message{}, errors.New("broker unreachable")
+	}
+	if r.next == len(r.msgs) {
+		r.cancel()
+		<-ctx.Done()
+		return kafkago.Message{}, ctx.Err()
+	}
+	msg := r.msgs[r.next]
+	r.next++
+	return msg, nil
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	for _, m := range msgs {
+		r.committed = append(r.committed, m.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error { return nil }
+
+type fakeSyncer struct {
+	synced []string
+	fail   map[string]bool
+}
+
+func (s *fakeSyncer) Sync(ctx context.Context, topic string, payload []byte) error {
+	if s.fail[string(payload)] {
+		return errors.New("postgres unavailable")
+	}
+	s.synced = append(s.synced, string(payload))
+	return nil
+}
+
+func TestKafkaWorker_CommitsAfterSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &fakeReader{
+		msgs: []kafkago.Message{
+			{Topic: "transactions.created", Offset: 0, Value: []byte("a")},
+			{Topic: "transfers.created", Offset: 1, Value: []byte("b")},
+		},
+		cancel: cancel,
+	}
+	syncer := &fakeSyncer{}
+	w := &KafkaWorker{syncer: syncer, reader: reader}
+
+	if err := w.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(syncer.synced) != 2 || syncer.synced[0] != "a" || syncer.synced[1] != "b" {
+		t.Errorf("expected events synced in order, got %v", syncer.synced)
+	}
+	if len(reader.committed) != 2 || reader.committed[0] != 0 || reader.committed[1] != 1 {
+		t.Errorf("expected offsets 0 and 1 committed, got %v", reader.committed)
+	}
+}
+
+func TestKafkaWorker_DoesNotCommitUnsyncedEvent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader := &fakeReader{
+		msgs:   []kafkago.Message{{Topic: "transactions.created", Offset: 0, Value: []byte("a")}},
+		cancel: cancel,
+	}
+	w := &KafkaWorker{syncer: &fakeSyncer{fail: map[string]bool{"a": true}}, reader: reader}
+
+	if err := w.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reader.committed) != 0 {
+		t.Errorf("expected no commit for an unsynced event, got %v", reader.committed)
+	}
+}
+
+func TestKafkaWorker_RetriesFailedFetches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &fakeReader{
+		msgs:      []kafkago.Message{{Topic: "transactions.created", Offset: 0, Value: []byte("a")}},
+		cancel:    cancel,
+		fetchErrs: 2,
+	}
+	syncer := &fakeSyncer{}
+	w := &KafkaWorker{syncer: syncer, reader: reader}
+
+	if err := w.Run(ctx); err != nil {
+		t.Fatalf("expected the worker to keep running through fetch errors, got %v", err)
+	}
+	if len(syncer.synced) != 1 || len(reader.committed) != 1 {
+		t.Errorf("expected the event synced once the fetches succeed, got %v", syncer.synced)
+	}
+}
@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// periodicJob runs tick every interval until ctx is cancelled. The sweeps and jobs of
+// this package embed it and supply the tick; a failed tick is logged and the job tries
+// again at the next one.
+type periodicJob struct {
+	name     string
+	interval time.Duration
+	tick     func(ctx context.Context, now time.Time) error
+	// attrs are logged next to the interval when the job starts.
+	attrs []any
+}
+
+// Run calls tick every interval and blocks until ctx is cancelled.
+func (j *periodicJob) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	slog.Info(j.name+" is running", append([]any{"interval", j.interval}, j.attrs...)...)
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info(j.name + " received shutdown signal")
+			return nil
+		case now := <-ticker.C:
+			if err := j.tick(ctx, now); err != nil {
+				slog.Error(j.name+" failed", "error", err)
+			}
+		}
+	}
+}
+
+// Start implements the infrastructure.Server interface.
+func (j *periodicJob) Start(ctx context.Context) error {
+	return j.Run(ctx)
+}
+
+// Stop implements the infrastructure.Server interface (no-op, shutdown is via ctx).
+func (j *periodicJob) Stop(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPeriodicJob_KeepsTickingAfterFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticks := make(chan struct{}, 3)
+	job := &periodicJob{name: "Test job", interval: time.Millisecond, tick: func(ctx context.Context, now time.Time) error {
+		select {
+		case ticks <- struct{}{}:
+		default:
+			cancel()
+		}
+		return errors.New("tick failed")
+	}}
+
+	done := make(chan error, 1)
+	go func() { done <- job.Start(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not stop after ctx was cancelled")
+	}
+	if len(ticks) != 3 {
+		t.Errorf("expected the job to tick again after a failure, got %d ticks", len(ticks))
+	}
+}
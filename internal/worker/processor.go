@@ -2,68 +2,80 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
-	"quantlo/internal/model"
 	"quantlo/internal/service"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
-// TransactionWorker listens on the "transactions.created" NATS topic
-// and syncs spend events to the PostgreSQL transactions table.
+// TransactionWorker listens on the "transactions.created" and "transfers.created" NATS topics
+// and syncs spend and transfer events to the PostgreSQL transactions table. Events that keep
+// failing are parked as dead letters by the syncer. With a batch size above one, events
+// are written to PostgreSQL in batches instead of one transaction each.
 type TransactionWorker struct {
-	svc      service.LedgerService
-	natsConn *nats.Conn
+	syncer    *service.EventSyncer
+	natsConn  *nats.Conn
+	batchSize int
+	batchWait time.Duration
 }
 
-func NewTransactionWorker(svc service.LedgerService, nc *nats.Conn) *TransactionWorker {
+func NewTransactionWorker(syncer *service.EventSyncer, nc *nats.Conn, batchSize int, batchWait time.Duration) *TransactionWorker {
 	return &TransactionWorker{
-		svc:      svc,
-		natsConn: nc,
+		syncer:    syncer,
+		natsConn:  nc,
+		batchSize: batchSize,
+		batchWait: batchWait,
 	}
 }
 
-// Run subscribes to "transactions.created" and blocks until ctx is cancelled.
+// Run subscribes to the event topics and blocks until ctx is cancelled.
 func (w *TransactionWorker) Run(ctx context.Context) error {
-	// QueueSubscribe ensures that messages are processed in parallel,
-	// but each message will be received by only one worker in the group.
-	sub, err := w.natsConn.QueueSubscribe("transactions.created", "worker_group", func(m *nats.Msg) {
-		var event model.SpendEvent
-		if err := json.Unmarshal(m.Data, &event); err != nil {
-			slog.Error("worker: failed to unmarshal nats message", "error", err)
-			return
-		}
+	var batch *batcher
+	if w.batchSize > 1 {
+		batch = newBatcher(w.syncer, w.batchSize, w.batchWait)
+		go batch.run(ctx)
+	}
 
-		// Handle the transaction: idempotency check + balance update in Postgres.
-		if err := w.svc.SyncTransactionWithBalance(ctx, event); err != nil {
-			slog.Error("worker: failed to sync transaction with postgres",
-				"account_id", event.AccountID,
-				"key", event.IdempotencyKey,
-				"error", err,
-			)
-			return
+	var subs []*nats.Subscription
+	for _, topic := range []string{"transactions.created", "transfers.created"} {
+		// QueueSubscribe ensures that messages are processed in parallel,
+		// but each message will be received by only one worker in the group.
+		sub, err := w.natsConn.QueueSubscribe(topic, "worker_group", func(m *nats.Msg) {
+			if batch != nil {
+				batch.add(ctx, service.Event{Topic: m.Subject, Payload: m.Data})
+				return
+			}
+			// Handle the event: idempotency check + balance update in Postgres, with retries.
+			if err := w.syncer.Sync(ctx, m.Subject, m.Data); err != nil {
+				slog.Error("worker: failed to sync event with postgres", "topic", m.Subject, "error", err)
+				return
+			}
+			slog.Info("worker: event synced successfully", "topic", m.Subject)
+		})
+		if err != nil {
+			for _, s := range subs {
+				_ = s.Unsubscribe()
+			}
+			return fmt.Errorf("worker: failed to subscribe to NATS: %w", err)
 		}
-
-		slog.Info("worker: transaction synced successfully",
-			"account_id", event.AccountID,
-			"key", event.IdempotencyKey,
-		)
-	})
-
-	if err != nil {
-		return fmt.Errorf("worker: failed to subscribe to NATS: %w", err)
+		subs = append(subs, sub)
 	}
 
-	slog.Info("Transaction worker is running")
+	slog.Info("Transaction worker is running", "batch_size", w.batchSize, "batch_wait", w.batchWait)
 
 	// Wait for shutdown signal.
 	<-ctx.Done()
 
-	slog.Info("Worker received shutdown signal, draining subscription...")
-	// Close subscription gracefully, waiting for current processing to complete.
-	return sub.Drain()
+	slog.Info("Worker received shutdown signal, draining subscriptions...")
+	// Close subscriptions gracefully, waiting for current processing to complete.
+	for _, sub := range subs {
+		if err := sub.Drain(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Start implements the infrastructure.Server interface.
@@ -0,0 +1,34 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"quantlo/internal/service"
+	"time"
+)
+
+// QuotaScheduler periodically applies the due periods of the quota policies,
+// refilling the accounts they are attached to.
+type QuotaScheduler struct {
+	periodicJob
+	svc service.LedgerService
+}
+
+func NewQuotaScheduler(svc service.LedgerService, interval time.Duration) *QuotaScheduler {
+	s := &QuotaScheduler{svc: svc}
+	s.periodicJob = periodicJob{name: "Quota scheduler", interval: interval, tick: s.refill}
+	return s
+}
+
+// refill applies the refills due by now.
+func (s *QuotaScheduler) refill(ctx context.Context, now time.Time) error {
+	n, err := s.svc.ApplyDueRefills(ctx, now)
+	if err != nil {
+		return fmt.Errorf("apply due refills: %w", err)
+	}
+	if n > 0 {
+		slog.Info("quota scheduler: applied refills", "count", n)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"quantlo/internal/model"
+	"quantlo/internal/service"
+	"time"
+)
+
+// Reconciler periodically compares the cached balances in Redis with PostgreSQL
+// and repairs drift according to its policy.
+type Reconciler struct {
+	periodicJob
+	svc    service.LedgerService
+	policy model.RepairPolicy
+}
+
+func NewReconciler(svc service.LedgerService, interval time.Duration, policy model.RepairPolicy) *Reconciler {
+	r := &Reconciler{svc: svc, policy: policy}
+	r.periodicJob = periodicJob{name: "Reconciler", interval: interval, tick: r.reconcile, attrs: []any{"policy", policy}}
+	return r
+}
+
+// reconcile runs one reconciliation and logs every drifted account.
+func (r *Reconciler) reconcile(ctx context.Context, _ time.Time) error {
+	report, err := r.svc.Reconcile(ctx, r.policy)
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+	for _, d := range report.Accounts {
+		slog.Warn("reconciler: balance drift",
+			"account_id", d.AccountID,
+			"resource_type", d.ResourceType,
+			"drift", d.Drift,
+			"stale_events", d.StaleEvents,
+			"repaired", d.Repaired,
+		)
+	}
+	if !report.OK {
+		slog.Info("reconciler: done", "scanned", report.Scanned, "drifted", len(report.Accounts), "repaired", report.Repaired)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"quantlo/internal/service"
+	"time"
+)
+
+// snapshotGrace delays a day's snapshot so spend events still in flight on the bus
+// have reached the journal before the day is closed.
+const snapshotGrace = time.Hour
+
+// SnapshotJob writes a balance snapshot for every account at each UTC midnight,
+// keeping point-in-time balance queries from scanning the whole journal.
+type SnapshotJob struct {
+	periodicJob
+	svc service.LedgerService
+}
+
+func NewSnapshotJob(svc service.LedgerService, interval time.Duration) *SnapshotJob {
+	j := &SnapshotJob{svc: svc}
+	j.periodicJob = periodicJob{name: "Snapshot job", interval: interval, tick: j.snapshot}
+	return j
+}
+
+// snapshot takes, or brings up to date, the snapshots of the latest day that can be closed.
+func (j *SnapshotJob) snapshot(ctx context.Context, now time.Time) error {
+	day := now.Add(-snapshotGrace).UTC().Truncate(24 * time.Hour)
+	n, err := j.svc.TakeSnapshots(ctx, day)
+	if err != nil {
+		return fmt.Errorf("take snapshots of %s: %w", day.Format(time.DateOnly), err)
+	}
+	if n > 0 {
+		slog.Info("snapshot job: balances snapshotted", "day", day, "count", n)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"quantlo/internal/model"
+	"quantlo/internal/service"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderWebhookSignature signs a delivery: "t=<unix seconds>,v1=<hex HMAC-SHA256>", where the
+	// HMAC of "<t>.<body>" is keyed with the webhook's secret (see WebhookSignature).
+	HeaderWebhookSignature = "X-Quantlo-Signature"
+	// HeaderWebhookDelivery identifies a delivery; a redelivered event keeps its ID, so
+	// receivers can use it to ignore duplicates.
+	HeaderWebhookDelivery = "X-Quantlo-Delivery"
+	HeaderWebhookEvent    = "X-Quantlo-Event"
+
+	// webhookBatchSize is how many due deliveries are claimed and sent at once.
+	webhookBatchSize = 50
+	// maxWebhookBackoff caps the delay between two attempts of a delivery.
+	maxWebhookBackoff = time.Hour
+)
+
+// WebhookSignature returns the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with secret,
+// the v1 value of the X-Quantlo-Signature header. Receivers recompute it to verify a delivery.
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload is the body of a delivery.
+type webhookPayload struct {
+	ID        string             `json:"id"`
+	Type      string             `json:"type"`
+	CreatedAt time.Time          `json:"created_at"`
+	Data      model.BalanceEvent `json:"data"`
+}
+
+// WebhookDispatcher delivers balance events to the registered webhooks. It takes its share
+// of the balance event feed, shared with the other dispatchers, and turns every event into
+// a delivery per subscribed webhook; every interval it then sends the due deliveries as
+// signed POSTs.
+// A delivery that does not get a 2xx answer is retried with exponential backoff, and
+// given up after maxAttempts.
+type WebhookDispatcher struct {
+	svc         service.LedgerService
+	consumer    string
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewWebhookDispatcher(svc service.LedgerService, client *http.Client, interval time.Duration, maxAttempts int, backoff time.Duration) *WebhookDispatcher {
+	host, _ := os.Hostname()
+	return &WebhookDispatcher{
+		svc:         svc,
+		consumer:    fmt.Sprintf("%s-%d", host, os.Getpid()),
+		client:      client,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+}
+
+// Run fans out the feed and sends due deliveries until ctx is cancelled.
+func (d *WebhookDispatcher) Run(ctx context.Context) error {
+	slog.Info("Webhook dispatcher is running", "interval", d.interval, "max_attempts", d.maxAttempts)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.fanOut(ctx)
+	}()
+	defer wg.Wait()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Webhook dispatcher received shutdown signal")
+			return nil
+		case now := <-ticker.C:
+			d.deliverDue(ctx, now)
+		}
+	}
+}
+
+// fanOut enqueues the deliveries of the feed events until ctx is cancelled.
+func (d *WebhookDispatcher) fanOut(ctx context.Context) {
+	for ctx.Err() == nil {
+		if _, err := d.svc.FanOutWebhookEvents(ctx, d.consumer); err != nil && ctx.Err() == nil {
+			slog.Error("webhook dispatcher: failed to fan out the balance feed, will retry", "error", err)
+			sleep(ctx, d.interval)
+		}
+	}
+}
+
+// deliverDue sends the deliveries that are due, concurrently.
+func (d *WebhookDispatcher) deliverDue(ctx context.Context, now time.Time) {
+	deliveries, err := d.svc.ClaimWebhookDeliveries(ctx, now, webhookBatchSize)
+	if err != nil {
+		slog.Error("webhook dispatcher: failed to claim deliveries", "error", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt := d.send(ctx, delivery)
+			if err := d.svc.RecordWebhookAttempt(ctx, attempt); err != nil {
+				slog.Error("webhook dispatcher: failed to record attempt", "delivery_id", delivery.ID, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// send POSTs a delivery and returns the outcome, with when to retry if it failed.
+func (d *WebhookDispatcher) send(ctx context.Context, delivery model.WebhookDelivery) model.WebhookAttempt {
+	attempt := model.WebhookAttempt{DeliveryID: delivery.ID}
+
+	body, err := json.Marshal(webhookPayload{
+		ID:        delivery.ID,
+		Type:      delivery.Event.Type,
+		CreatedAt: delivery.CreatedAt,
+		Data:      delivery.Event,
+	})
+	if err == nil {
+		attempt.StatusCode, err = d.post(ctx, delivery, body)
+	}
+	if err == nil {
+		attempt.Delivered = true
+		return attempt
+	}
+
+	attempt.Error = err.Error()
+	if n := delivery.Attempts + 1; n < d.maxAttempts {
+		backoff := d.backoff
+		for i := 1; i < n && backoff < maxWebhookBackoff; i++ {
+			backoff *= 2
+		}
+		attempt.RetryAt = time.Now().Add(min(backoff, maxWebhookBackoff))
+	}
+	slog.Warn("webhook dispatcher: delivery failed", "delivery_id", delivery.ID, "webhook_id", delivery.WebhookID,
+		"attempt", delivery.Attempts+1, "error", err, "given_up", attempt.RetryAt.IsZero())
+	return attempt
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, delivery model.WebhookDelivery, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Quantlo-Webhooks/1.0")
+	req.Header.Set(HeaderWebhookDelivery, delivery.ID)
+	req.Header.Set(HeaderWebhookEvent, delivery.Event.Type)
+	req.Header.Set(HeaderWebhookSignature, fmt.Sprintf("t=%d,v1=%s", timestamp, WebhookSignature(delivery.Secret, timestamp, body)))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Start implements the infrastructure.Server interface.
+func (d *WebhookDispatcher) Start(ctx context.Context) error {
+	return d.Run(ctx)
+}
+
+// Stop implements the infrastructure.Server interface (no-op, shutdown is via ctx).
+func (d *WebhookDispatcher) Stop(ctx context.Context) error {
+	return nil
+}
+
+// sleep waits for d or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
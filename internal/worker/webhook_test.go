@@ -0,0 +1,195 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"quantlo/internal/model"
+	"quantlo/internal/repository"
+)
+
+// receivedWebhook is one request seen by a webhook receiver.
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver answers the first failures requests with a 500 and the others with a 204.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	received []receivedWebhook
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received = append(r.received, receivedWebhook{header: req.Header.Clone(), body: body})
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *webhookReceiver) requests() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook(nil), r.received...)
+}
+
+// waitForDelivery polls a webhook's delivery log until its newest delivery has the status.
+func waitForDelivery(t *testing.T, ledger *repository.MemoryLedger, webhookID, status string) model.WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, err := ledger.ListWebhookDeliveries(context.Background(), webhookID, 0)
+		if err != nil {
+			t.Fatalf("list deliveries: %v", err)
+		}
+		if len(deliveries) > 0 && deliveries[0].Status == status {
+			return deliveries[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a %s delivery, got %+v", status, deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDispatcher_RetriesSignsAndRedelivers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := &webhookReceiver{failures: 1}
+	srv := httptest.NewTLSServer(receiver)
+	defer srv.Close()
+
+	ledger := repository.NewMemoryLedger(nil)
+	hook, err := ledger.CreateWebhook(ctx, model.WebhookRequest{
+		URL:        srv.URL,
+		EventTypes: []string{model.BalanceRecharge},
+		AccountIDs: []string{"user123"},
+	})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	dispatcher := NewWebhookDispatcher(ledger, srv.Client(), 5*time.Millisecond, 3, time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = dispatcher.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, id := range []string{"user123", "other"} {
+		if err := ledger.CreateAccount(ctx, id, "api_credits", 10, ""); err != nil {
+			t.Fatalf("create account %s: %v", id, err)
+		}
+	}
+	if err := ledger.Recharge(ctx, model.RechargeRequest{AccountID: "other", ResourceType: "api_credits", Amount: 1}); err != nil {
+		t.Fatalf("recharge other: %v", err)
+	}
+	if err := ledger.Recharge(ctx, model.RechargeRequest{AccountID: "user123", ResourceType: "api_credits", Amount: 5}); err != nil {
+		t.Fatalf("recharge: %v", err)
+	}
+
+	// The first attempt gets a 500 and the retry goes through.
+	delivery := waitForDelivery(t, ledger, hook.ID, model.WebhookDelivered)
+	if delivery.Attempts != 2 || delivery.LastStatusCode != http.StatusNoContent || delivery.DeliveredAt == nil {
+		t.Errorf("expected a delivery made on the second attempt, got %+v", delivery)
+	}
+	requests := receiver.requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	// Only the subscribed account's recharge is delivered, signed with the webhook's secret.
+	req := requests[1]
+	var payload struct {
+		ID   string             `json:"id"`
+		Type string             `json:"type"`
+		Data model.BalanceEvent `json:"data"`
+	}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if payload.ID != delivery.ID || payload.Type != model.BalanceRecharge || payload.Data.AccountID != "user123" || payload.Data.Balance != 15 {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+	if got := req.header.Get(HeaderWebhookDelivery); got != delivery.ID {
+		t.Errorf("expected delivery header %s, got %s", delivery.ID, got)
+	}
+	var timestamp int64
+	var signature string
+	if _, err := fmt.Sscanf(req.header.Get(HeaderWebhookSignature), "t=%d,v1=%s", &timestamp, &signature); err != nil {
+		t.Fatalf("parse signature header %q: %v", req.header.Get(HeaderWebhookSignature), err)
+	}
+	if want := WebhookSignature(hook.Secret, timestamp, req.body); signature != want {
+		t.Errorf("expected signature %s, got %s", want, signature)
+	}
+
+	// A redelivery sends the same delivery again.
+	if err := ledger.RedeliverWebhook(ctx, delivery.ID); err != nil {
+		t.Fatalf("redeliver: %v", err)
+	}
+	redelivered := waitForDelivery(t, ledger, hook.ID, model.WebhookDelivered)
+	if redelivered.Attempts != 1 {
+		t.Errorf("expected the redelivery to succeed at once, got %+v", redelivered)
+	}
+	requests = receiver.requests()
+	if len(requests) != 3 || requests[2].header.Get(HeaderWebhookDelivery) != delivery.ID {
+		t.Errorf("expected the delivery to be sent again, got %d requests", len(requests))
+	}
+}
+
+func TestWebhookDispatcher_GivesUpAfterMaxAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := &webhookReceiver{failures: 100}
+	srv := httptest.NewTLSServer(receiver)
+	defer srv.Close()
+
+	ledger := repository.NewMemoryLedger(nil)
+	hook, err := ledger.CreateWebhook(ctx, model.WebhookRequest{URL: srv.URL, EventTypes: []string{model.BalanceAccountCreated}})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+
+	dispatcher := NewWebhookDispatcher(ledger, srv.Client(), 5*time.Millisecond, 3, time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = dispatcher.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if err := ledger.CreateAccount(ctx, "user123", "api_credits", 10, ""); err != nil {
+		t.Fatalf("create account: %v", err)
+	}
+
+	delivery := waitForDelivery(t, ledger, hook.ID, model.WebhookFailed)
+	if delivery.Attempts != 3 || delivery.LastStatusCode != http.StatusInternalServerError || delivery.NextAttemptAt != nil {
+		t.Errorf("expected the delivery to be given up after 3 attempts, got %+v", delivery)
+	}
+	if n := len(receiver.requests()); n != 3 {
+		t.Errorf("expected 3 requests, got %d", n)
+	}
+}